@@ -2,28 +2,47 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/conallob/o11y-analysis-tools/internal/changes"
+	"github.com/conallob/o11y-analysis-tools/internal/parallel"
 	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/internal/walk"
 )
 
 func main() {
+	var defaults promql.DefaultMatchers
+	flag.Var(&defaults, "default", "label=value matcher to inject with --fix into selectors missing the label (repeatable)")
+
+	var include, exclude walk.Patterns
+	flag.Var(&include, "include", "glob of files to check, matched against paths relative to each argument (repeatable)")
+	flag.Var(&exclude, "exclude", "glob of files or directories to skip, e.g. 'vendor/**' (repeatable)")
+
 	var (
 		requiredLabels      = flag.String("labels", "job", "comma-separated list of required labels (default: job)")
 		requiredAlertLabels = flag.String("alert-labels", "", "comma-separated list of required alert annotation labels (e.g., severity,grafana_url,runbook)")
 		checkAlerts         = flag.Bool("check-alerts", false, "enable alert-specific label validation")
+		policyFile          = flag.String("policy", "", "path to a label value policy file (allowed values/patterns per label and annotation)")
+		checkAnnotations    = flag.Bool("check-annotations", false, "enable alert annotation validation (required annotations, template syntax, $labels references)")
+		requiredAnnotations = flag.String("annotations", "summary,description", "comma-separated list of required alert annotations")
+		tenantLabel         = flag.String("tenant-label", "", "label that isolates tenants; every selector must pin it to the same value and binary operations must match on it")
+		fix                 = flag.Bool("fix", false, "inject the --default matchers into selectors missing them, rewriting files in place")
+		noGitignore         = flag.Bool("no-gitignore", false, "also check files ignored by .gitignore")
+		jobs                = flag.Int("jobs", parallel.DefaultJobs(), "number of files to check in parallel")
+		changedSince        = flag.String("changed-since", "", "only report findings in rules changed since this git ref, e.g. origin/main")
 	)
 
 	// Define flags for future functionality
 	_ = flag.Bool("verbose", false, "verbose output")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: label-check [options] <file|directory>...\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: label-check [options] <file|directory|->...\n\n")
 		fmt.Fprintf(os.Stderr, "Enforce label standards in PromQL expressions and alerts.\n")
 		fmt.Fprintf(os.Stderr, "Ensures required labels are present to prevent collisions in multi-tenant platforms.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
@@ -31,6 +50,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  label-check --labels=job,namespace ./alerts\n")
 		fmt.Fprintf(os.Stderr, "  label-check --check-alerts --alert-labels=severity,grafana_url,runbook ./alerts\n")
+		fmt.Fprintf(os.Stderr, "  label-check --policy=label-policy.yml ./alerts\n")
+		fmt.Fprintf(os.Stderr, "  label-check --check-annotations --annotations=summary,description,runbook_url ./alerts\n")
+		fmt.Fprintf(os.Stderr, "  label-check --fix --default job=myservice ./alerts\n")
+		fmt.Fprintf(os.Stderr, "  label-check --fix --default job=myservice - < alerts.yml > fixed.yml\n")
+		fmt.Fprintf(os.Stderr, "  label-check --tenant-label=tenant ./alerts\n")
+		fmt.Fprintf(os.Stderr, "  label-check --labels=job ./dashboards\n")
+		fmt.Fprintf(os.Stderr, "  label-check --changed-since=origin/main ./alerts\n")
 		fmt.Fprintf(os.Stderr, "  echo 'rate(metric[5m])' | label-check --labels=job -\n")
 	}
 
@@ -41,6 +67,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *fix && len(defaults) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --fix requires at least one --default label=value\n")
+		os.Exit(1)
+	}
+
 	// Parse required labels
 	labels := strings.Split(*requiredLabels, ",")
 	for i := range labels {
@@ -55,134 +86,453 @@ func main() {
 		}
 	}
 
+	var annotations []string
+	if *checkAnnotations && *requiredAnnotations != "" {
+		annotations = strings.Split(*requiredAnnotations, ",")
+		for i := range annotations {
+			annotations[i] = strings.TrimSpace(annotations[i])
+		}
+	}
+
+	var policy *promql.LabelPolicy
+	if *policyFile != "" {
+		var err error
+		policy, err = promql.LoadPolicy(*policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	c := checker{
+		labels:           labels,
+		alertLabels:      alertLabels,
+		annotations:      annotations,
+		policy:           policy,
+		tenantLabel:      *tenantLabel,
+		checkAlerts:      *checkAlerts,
+		checkAnnotations: *checkAnnotations,
+		fix:              *fix,
+		defaults:         defaults,
+	}
+
 	exitCode := 0
-	totalExpressions := 0
-	violationCount := 0
-	totalAlerts := 0
-	alertViolationCount := 0
 
+	walkOpts := walk.Options{
+		// YAML rule files and JSON files such as Grafana dashboards
+		Extensions:  []string{".yaml", ".yml", ".json"},
+		Include:     include,
+		Exclude:     exclude,
+		NoGitignore: *noGitignore,
+	}
+
+	// Collect files first so they can be processed concurrently and reported in path order
+	var files []string
 	for _, path := range flag.Args() {
 		// Handle stdin input
 		if path == "-" {
-			content, err := io.ReadAll(os.Stdin)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
-				exitCode = 1
-				continue
-			}
-
-			violations := promql.CheckRequiredLabels(string(content), labels)
-			totalExpressions += len(violations)
+			files = append(files, path)
+			continue
+		}
 
-			for _, v := range violations {
-				if len(v.MissingLabels) > 0 {
-					violationCount++
-					fmt.Printf("Expression: %s\n", truncate(v.Expression, 60))
-					fmt.Printf("  Missing required labels: %s\n", strings.Join(v.MissingLabels, ", "))
-					exitCode = 1
-				}
-			}
+		found, err := walk.Files(path, walkOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+			exitCode = 1
 			continue
 		}
+		files = append(files, found...)
+	}
 
-		err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	// Only files changed since the ref are checked, and only findings in changed rules reported
+	if *changedSince != "" {
+		paths := slices.DeleteFunc(slices.Clone(flag.Args()), func(p string) bool { return p == "-" })
+		changed, err := changes.Since(*changedSince, paths...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --changed-since: %v\n", err)
+			os.Exit(1)
+		}
+		c.changed = changed
+		files = slices.DeleteFunc(files, func(f string) bool {
+			return f != "-" && !changed.Changed(f)
+		})
+	}
 
-			if info.IsDir() {
-				return nil
-			}
+	var total counts
+	for _, r := range parallel.Map(files, *jobs, c.process) {
+		_, _ = os.Stdout.Write(r.stdout.Bytes())
+		_, _ = os.Stderr.Write(r.stderr.Bytes())
+		if r.failed {
+			exitCode = 1
+		}
+		total.add(r.counts)
+	}
 
-			// Process YAML files
-			if !strings.HasSuffix(filePath, ".yaml") && !strings.HasSuffix(filePath, ".yml") {
-				return nil
-			}
+	if total.fixed > 0 {
+		fmt.Printf("Injected missing matchers into %d selectors\n", total.fixed)
+	}
+
+	if total.violations > 0 {
+		fmt.Printf("Found %d expressions with missing required labels\n", total.violations)
+		fmt.Printf("Required labels: %s\n", strings.Join(labels, ", "))
+	} else if total.expressions > 0 {
+		fmt.Printf("All %d expressions have required labels\n", total.expressions)
+	}
+
+	if *checkAlerts && total.alertViolations > 0 {
+		fmt.Printf("Found %d alerts with missing required labels\n", total.alertViolations)
+		fmt.Printf("Required alert labels: %s\n", strings.Join(alertLabels, ", "))
+	} else if *checkAlerts && total.alerts > 0 {
+		fmt.Printf("All %d alerts have required labels\n", total.alerts)
+	}
+
+	if total.isolationViolations > 0 {
+		fmt.Printf("Found %d tenant isolation violations\n", total.isolationViolations)
+	}
+
+	if total.annotationViolations > 0 {
+		fmt.Printf("Found %d alert annotation violations\n", total.annotationViolations)
+	}
+
+	if total.policyViolations > 0 {
+		fmt.Printf("Found %d label policy violations\n", total.policyViolations)
+	}
+
+	os.Exit(exitCode)
+}
+
+// checker holds the checks to run on every file
+type checker struct {
+	labels           []string
+	alertLabels      []string
+	annotations      []string
+	policy           *promql.LabelPolicy
+	tenantLabel      string
+	checkAlerts      bool
+	checkAnnotations bool
+	fix              bool
+	defaults         promql.DefaultMatchers
+	// changed, if set, limits findings to rules changed since --changed-since
+	changed *changes.Set
+}
+
+// counts tallies what was checked and the violations found
+type counts struct {
+	expressions          int
+	violations           int
+	alerts               int
+	alertViolations      int
+	policyViolations     int
+	annotationViolations int
+	isolationViolations  int
+	fixed                int
+}
+
+// add accumulates the counts of another file
+func (t *counts) add(o counts) {
+	t.expressions += o.expressions
+	t.violations += o.violations
+	t.alerts += o.alerts
+	t.alertViolations += o.alertViolations
+	t.policyViolations += o.policyViolations
+	t.annotationViolations += o.annotationViolations
+	t.isolationViolations += o.isolationViolations
+	t.fixed += o.fixed
+}
+
+// result is the outcome of checking one file. Output is buffered so that files checked
+// concurrently are reported in order.
+type result struct {
+	counts
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	failed bool
+}
+
+// process checks one file, or stdin for the path -
+func (c checker) process(filePath string) *result {
+	if filePath == "-" {
+		return c.processStdin()
+	}
+
+	r := &result{}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error reading %s: %v\n", filePath, err)
+		r.failed = true
+		return r
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error reading %s: %v\n", filePath, err)
+		r.failed = true
+		return r
+	}
+
+	// Skip files without PromQL, e.g. CI config, Helm values or package manifests
+	ext := promql.FindExtractor(content)
+	if ext == nil {
+		return r
+	}
+
+	var only func(line int) bool
+	if c.changed != nil {
+		only = c.changed.Filter(filePath, content)
+	}
 
-			content, err := os.ReadFile(filePath)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", filePath, err)
-				exitCode = 1
-				return nil
+	if c.fix && ext.Name() == promql.FormatRules {
+		fixed, changed := promql.FixRequiredLabelsIn(string(content), c.defaults, only)
+		if changed > 0 {
+			if err := os.WriteFile(filePath, []byte(fixed), info.Mode()); err != nil {
+				fmt.Fprintf(&r.stderr, "Error writing %s: %v\n", filePath, err)
+				r.failed = true
+				return r
 			}
+			fmt.Fprintf(&r.stdout, "Fixed %d selectors in %s\n", changed, filePath)
+			r.fixed += changed
+			content = []byte(fixed)
+		}
+	}
 
-			violations := promql.CheckRequiredLabels(string(content), labels)
-			totalExpressions += len(violations)
+	c.check(r, filePath, content, ext, only)
+	return r
+}
 
-			hasViolation := false
-			for _, v := range violations {
-				if len(v.MissingLabels) > 0 {
+// check runs the enabled checks on the content of a file, or of stdin, in a format ext
+// recognizes, reporting findings at lines only accepts
+func (c checker) check(r *result, filePath string, content []byte, ext promql.Extractor, only func(line int) bool) {
+	// Dashboards, SLO specs and Prometheus configs only carry queries, so the rule
+	// checks below don't apply to them
+	if ext.Name() != promql.FormatRules {
+		exprs, err := ext.Extract(content)
+		if err != nil {
+			fmt.Fprintf(&r.stderr, "Error parsing %s %s: %v\n", ext.Name(), filePath, err)
+			r.failed = true
+			return
+		}
+		violations := keep(promql.CheckExpressionLabels(exprs, c.labels), only, labelViolationLine)
+		r.expressions += len(violations)
+		if n := printLabelViolations(&r.stdout, filePath, violations); n > 0 {
+			r.violations += n
+			r.failed = true
+		}
+		return
+	}
+
+	violations := keep(promql.CheckRequiredLabels(string(content), c.labels), only, labelViolationLine)
+	r.expressions += len(violations)
+
+	hasViolation := false
+	if n := printLabelViolations(&r.stdout, filePath, violations); n > 0 {
+		r.violations += n
+		hasViolation = true
+		r.failed = true
+	}
+
+	// Check alert-specific labels if enabled
+	if c.checkAlerts && len(c.alertLabels) > 0 {
+		alertViolations := keep(promql.CheckAlertLabels(string(content), c.alertLabels), only,
+			func(v promql.AlertViolation) int { return v.Line })
+		r.alerts += len(alertViolations)
+
+		hasAlertViolation := false
+		for _, v := range alertViolations {
+			if len(v.MissingLabels) > 0 {
+				if !hasAlertViolation {
 					if !hasViolation {
-						fmt.Printf("%s:\n", filePath)
-						hasViolation = true
-						exitCode = 1
-					}
-					violationCount++
-					fmt.Printf("  Expression: %s\n", truncate(v.Expression, 60))
-					fmt.Printf("    Missing required labels: %s\n", strings.Join(v.MissingLabels, ", "))
-					if v.Line > 0 {
-						fmt.Printf("    Line: %d\n", v.Line)
+						fmt.Fprintf(&r.stdout, "%s:\n", filePath)
 					}
+					hasAlertViolation = true
+					r.failed = true
+				}
+				r.alertViolations++
+				fmt.Fprintf(&r.stdout, "  Alert: %s\n", v.AlertName)
+				fmt.Fprintf(&r.stdout, "    Missing required alert labels: %s\n", strings.Join(v.MissingLabels, ", "))
+				if v.Line > 0 {
+					fmt.Fprintf(&r.stdout, "    Line: %d\n", v.Line)
 				}
 			}
+		}
 
-			if hasViolation {
-				fmt.Println()
+		if hasAlertViolation {
+			fmt.Fprintln(&r.stdout)
+		}
+		hasViolation = hasViolation || hasAlertViolation
+	}
+
+	// Check alert annotations and their templates if enabled
+	if c.checkAnnotations {
+		annotationViolations := keep(promql.CheckAnnotations(string(content), c.annotations), only,
+			func(v promql.AnnotationViolation) int { return v.Line })
+		for i, v := range annotationViolations {
+			if i == 0 {
+				if !hasViolation {
+					fmt.Fprintf(&r.stdout, "%s:\n", filePath)
+				}
+				r.failed = true
 			}
+			r.annotationViolations++
+			fmt.Fprintf(&r.stdout, "  Alert: %s\n", v.AlertName)
+			fmt.Fprintf(&r.stdout, "    %s\n", v.Message)
+			if v.Line > 0 {
+				fmt.Fprintf(&r.stdout, "    Line: %d\n", v.Line)
+			}
+		}
 
-			// Check alert-specific labels if enabled
-			if *checkAlerts && len(alertLabels) > 0 {
-				alertViolations := promql.CheckAlertLabels(string(content), alertLabels)
-				totalAlerts += len(alertViolations)
-
-				hasAlertViolation := false
-				for _, v := range alertViolations {
-					if len(v.MissingLabels) > 0 {
-						if !hasAlertViolation {
-							if !hasViolation {
-								fmt.Printf("%s:\n", filePath)
-							}
-							hasAlertViolation = true
-							exitCode = 1
-						}
-						alertViolationCount++
-						fmt.Printf("  Alert: %s\n", v.AlertName)
-						fmt.Printf("    Missing required alert labels: %s\n", strings.Join(v.MissingLabels, ", "))
-						if v.Line > 0 {
-							fmt.Printf("    Line: %d\n", v.Line)
-						}
-					}
+		if len(annotationViolations) > 0 {
+			fmt.Fprintln(&r.stdout)
+		}
+		hasViolation = hasViolation || len(annotationViolations) > 0
+	}
+
+	// Check that expressions cannot mix series from different tenants
+	if c.tenantLabel != "" {
+		isolationViolations := keep(promql.CheckTenantIsolation(string(content), c.tenantLabel), only,
+			func(v promql.IsolationViolation) int { return v.Line })
+		for i, v := range isolationViolations {
+			if i == 0 {
+				if !hasViolation {
+					fmt.Fprintf(&r.stdout, "%s:\n", filePath)
 				}
+				r.failed = true
+			}
+			r.isolationViolations++
+			fmt.Fprintf(&r.stdout, "  Expression: %s\n", truncate(v.Expression, 60))
+			fmt.Fprintf(&r.stdout, "    Isolation violation: %s\n", v.Message)
+			fmt.Fprintf(&r.stdout, "    Operand: %s\n", truncate(v.Operand, 60))
+			if v.Line > 0 {
+				fmt.Fprintf(&r.stdout, "    Line: %d\n", v.Line)
+			}
+		}
+
+		if len(isolationViolations) > 0 {
+			fmt.Fprintln(&r.stdout)
+		}
+		hasViolation = hasViolation || len(isolationViolations) > 0
+	}
 
-				if hasAlertViolation {
-					fmt.Println()
+	// Check label and annotation values against the policy
+	if c.policy != nil {
+		policyViolations := keep(promql.CheckLabelPolicy(string(content), c.policy), only,
+			func(v promql.PolicyViolation) int { return v.Line })
+		for i, v := range policyViolations {
+			if i == 0 {
+				if !hasViolation {
+					fmt.Fprintf(&r.stdout, "%s:\n", filePath)
 				}
+				r.failed = true
 			}
+			r.policyViolations++
+			if v.RuleName != "" {
+				fmt.Fprintf(&r.stdout, "  Rule: %s\n", v.RuleName)
+			} else {
+				fmt.Fprintf(&r.stdout, "  Expression: %s\n", truncate(v.Expression, 60))
+			}
+			fmt.Fprintf(&r.stdout, "    Policy violation: %s\n", v.Message)
+			if v.Line > 0 {
+				fmt.Fprintf(&r.stdout, "    Line: %d\n", v.Line)
+			}
+		}
 
-			return nil
-		})
+		if len(policyViolations) > 0 {
+			fmt.Fprintln(&r.stdout)
+		}
+	}
+}
 
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
-			exitCode = 1
+// processStdin checks rules or another supported format read from stdin, or a bare
+// expression
+func (c checker) processStdin() *result {
+	r := &result{}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error reading stdin: %v\n", err)
+		r.failed = true
+		return r
+	}
+
+	// In fix mode, stdin is rewritten to stdout. Only rule files can be fixed; echoing other
+	// input back unchanged would look like a successful fix.
+	if c.fix {
+		if ext := promql.FindExtractor(content); ext == nil || ext.Name() != promql.FormatRules {
+			fmt.Fprintf(&r.stderr, "Error: --fix only rewrites rule files, and stdin is not one\n")
+			r.failed = true
+			return r
 		}
+		fixed, _ := promql.FixRequiredLabels(string(content), c.defaults)
+		fmt.Fprint(&r.stdout, fixed)
+		return r
 	}
 
-	if violationCount > 0 {
-		fmt.Printf("Found %d expressions with missing required labels\n", violationCount)
-		fmt.Printf("Required labels: %s\n", strings.Join(labels, ", "))
-	} else if totalExpressions > 0 {
-		fmt.Printf("All %d expressions have required labels\n", totalExpressions)
+	if ext := promql.FindExtractor(content); ext != nil {
+		c.check(r, "<stdin>", content, ext, nil)
+		return r
 	}
 
-	if *checkAlerts && alertViolationCount > 0 {
-		fmt.Printf("Found %d alerts with missing required labels\n", alertViolationCount)
-		fmt.Printf("Required alert labels: %s\n", strings.Join(alertLabels, ", "))
-	} else if *checkAlerts && totalAlerts > 0 {
-		fmt.Printf("All %d alerts have required labels\n", totalAlerts)
+	// A bare expression, e.g. from echo 'rate(metric[5m])' | label-check -, has no rule to
+	// check alert labels, annotations, tenant isolation or policies on
+	if c.checkAlerts || c.checkAnnotations || c.tenantLabel != "" || c.policy != nil {
+		fmt.Fprintf(&r.stderr, "Error: stdin is not a rule file, so --check-alerts, --check-annotations, --tenant-label and --policy cannot be checked\n")
+		r.failed = true
+		return r
 	}
+	expr := promql.Expression{Value: strings.TrimSpace(string(content)), Line: 1}
+	violations := promql.CheckExpressionLabels([]promql.Expression{expr}, c.labels)
+	r.expressions += len(violations)
+	if n := printLabelViolations(&r.stdout, "<stdin>", violations); n > 0 {
+		r.violations += n
+		r.failed = true
+	}
+	return r
+}
 
-	os.Exit(exitCode)
+// keep returns the findings at lines only accepts, or all of them if only is nil. Findings
+// without a line cannot be placed in a rule and are kept.
+func keep[T any](findings []T, only func(line int) bool, line func(T) int) []T {
+	if only == nil {
+		return findings
+	}
+	var kept []T
+	for _, f := range findings {
+		if l := line(f); l == 0 || only(l) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+func labelViolationLine(v promql.LabelViolation) int { return v.Line }
+
+// printLabelViolations prints the expressions in a file that are missing required labels,
+// returning how many there were
+func printLabelViolations(w io.Writer, filePath string, violations []promql.LabelViolation) int {
+	count := 0
+	for _, v := range violations {
+		if len(v.MissingLabels) == 0 && len(v.MissingOutputLabels) == 0 {
+			continue
+		}
+		if count == 0 {
+			fmt.Fprintf(w, "%s:\n", filePath)
+		}
+		count++
+		fmt.Fprintf(w, "  Expression: %s\n", truncate(v.Expression, 60))
+		if len(v.MissingLabels) > 0 {
+			fmt.Fprintf(w, "    Missing required labels: %s\n", strings.Join(v.MissingLabels, ", "))
+		}
+		if len(v.MissingOutputLabels) > 0 {
+			fmt.Fprintf(w, "    Required labels dropped from result: %s\n", strings.Join(v.MissingOutputLabels, ", "))
+		}
+		if v.Line > 0 {
+			fmt.Fprintf(w, "    Line: %d\n", v.Line)
+		}
+	}
+
+	if count > 0 {
+		fmt.Fprintln(w)
+	}
+	return count
 }
 
 func truncate(s string, maxLen int) string {
@@ -1,115 +1,233 @@
-// Package main provides the promql-fmt command for formatting PromQL expressions in YAML files.
+// Package main provides the promql-fmt command for formatting PromQL expressions in rule files
+// and Grafana dashboards, and linting them in other files that embed PromQL.
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/conallob/o11y-analysis-tools/internal/changes"
+	"github.com/conallob/o11y-analysis-tools/internal/parallel"
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/internal/walk"
 	"github.com/conallob/o11y-analysis-tools/pkg/formatting"
 )
 
 func main() {
+	var include, exclude walk.Patterns
+	flag.Var(&include, "include", "glob of files to process, matched against paths relative to each argument (repeatable)")
+	flag.Var(&exclude, "exclude", "glob of files or directories to skip, e.g. 'vendor/**' (repeatable)")
+
 	var (
 		fix              = flag.Bool("fix", false, "automatically fix formatting issues")
 		fmtFlag          = flag.Bool("fmt", false, "automatically fix formatting issues (alias for --fix)")
 		check            = flag.Bool("check", true, "check formatting without fixing (default)")
 		verbose          = flag.Bool("verbose", false, "verbose output")
 		disableLineCheck = flag.Bool("disable-line-length", false, "disable line length checks for long metric names")
-		prometheusURL    = flag.String("prometheus-url", "", "Prometheus server URL for timeseries continuity checks (optional)")
+		prometheusURL    = flag.String("prometheus-url", "", "Prometheus server URL for timeseries continuity checks, job scrape intervals and metric metadata (optional)")
+		scrapeInterval   = flag.Duration("scrape-interval", 0, "scrape interval range windows are checked against for jobs not found at --prometheus-url; unset, only the evaluation interval is checked for them")
+		indentWidth      = flag.Int("indent", 2, "number of spaces per nesting level in multiline expressions")
+		maxLineWidth     = flag.Int("max-line-width", 80, "line width above which expressions are split across lines")
+		aggClause        = flag.String("aggregation-clause", "preserve", "position of by/without clauses: prefix, postfix or preserve")
+		sortMatchers     = flag.Bool("sort-matchers", false, "sort label matchers by label name")
+		diff             = flag.Bool("diff", false, "print a unified diff of the changes --fix would make; exits 1 if any file would change")
+		exprFlag         = flag.String("expr", "", "format a single raw PromQL expression (use - to read it from stdin) and print it")
+		noGitignore      = flag.Bool("no-gitignore", false, "also process files ignored by .gitignore")
+		jobs             = flag.Int("jobs", parallel.DefaultJobs(), "number of files to process in parallel")
+		changedSince     = flag.String("changed-since", "", "only report findings in rules changed since this git ref, e.g. origin/main")
+		metadataFile     = flag.String("metadata-file", "", "JSON file of metric metadata, as saved from /api/v1/metadata, for checking metric types offline")
+		absenceAlerts    = flag.Bool("absence-alerts", false, "report alerts whose selectors no absent() alert covers; --fix appends the missing absence alerts")
+		seriesBudget     = flag.Int("series-budget", 0, "report rules whose selectors match more series than this at --prometheus-url (0 disables)")
+		groupBudget      = flag.Int("group-series-budget", 0, "report rule groups whose rules match more series than this at --prometheus-url (0 disables)")
+		costReport       = flag.Bool("cost-report", false, "print the estimated series and samples each rule and group touches per evaluation at --prometheus-url")
+		ruleSet          = flag.Bool("rule-set", false, "also check all rule files as one rule set: duplicate groups, recording rules and alerts, and rules reading series recorded later or less often (check mode only)")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: promql-fmt [options] <file|directory>...\n\n")
-		fmt.Fprintf(os.Stderr, "Static analysis tool for PromQL expression formatting.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: promql-fmt [options] <file|directory|->...\n")
+		fmt.Fprintf(os.Stderr, "       promql-fmt [options] --expr <expression|->\n\n")
+		fmt.Fprintf(os.Stderr, "Static analysis tool for PromQL expression formatting.\n")
+		fmt.Fprintf(os.Stderr, "Use - as the path to read YAML or dashboard JSON from stdin and write the formatted result to stdout.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && *exprFlag == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// --fix and --fmt are aliases
-	shouldFix := *fix || *fmtFlag
-	shouldCheck := *check && !shouldFix
-
-	exitCode := 0
-	totalFiles := 0
-	filesWithIssues := 0
+	style := formatting.FormatStyle{
+		IndentWidth:  *indentWidth,
+		MaxLineWidth: *maxLineWidth,
+	}
+	aggStyle, err := formatting.ParseAggregationStyle(*aggClause)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --aggregation-clause: %v\n", err)
+		os.Exit(1)
+	}
+	style.AggregationStyle = aggStyle
+	if *sortMatchers {
+		style.MatcherOrder = formatting.MatcherOrderSorted
+	}
 
-	for _, path := range flag.Args() {
-		err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	// Rule set issues cannot be fixed, so they are only reported in check mode
+	if *ruleSet && (*fix || *fmtFlag || *diff) {
+		fmt.Fprintln(os.Stderr, "Error: --rule-set reports issues --fix cannot fix, so it cannot be combined with --fix, --fmt or --diff")
+		os.Exit(1)
+	}
 
-			// Skip directories
-			if info.IsDir() {
-				return nil
-			}
+	if (*seriesBudget > 0 || *groupBudget > 0 || *costReport) && *prometheusURL == "" {
+		fmt.Fprintln(os.Stderr, "Error: --series-budget, --group-series-budget and --cost-report require --prometheus-url")
+		os.Exit(1)
+	}
 
-			// Process YAML files (Prometheus rules/alerts)
-			if !strings.HasSuffix(filePath, ".yaml") && !strings.HasSuffix(filePath, ".yml") {
-				return nil
-			}
+	opts := formatting.CheckOptions{
+		DisableLineLength: *disableLineCheck,
+		PrometheusURL:     *prometheusURL,
+		ScrapeInterval:    *scrapeInterval,
+		AbsenceAlerts:     *absenceAlerts,
+		SeriesBudget:      *seriesBudget,
+		GroupSeriesBudget: *groupBudget,
+		Verbose:           *verbose,
+		Style:             style,
+		// Files share one cache so each remote lookup is made once per run
+		Cache: formatting.NewLookupCache(),
+	}
 
-			totalFiles++
+	if *metadataFile != "" {
+		metadata, err := formatting.LoadMetadata(*metadataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading metadata: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Metadata = metadata
+	}
 
-			content, err := os.ReadFile(filePath)
+	// Format a single raw expression
+	if *exprFlag != "" {
+		expression := *exprFlag
+		if expression == "-" {
+			input, err := io.ReadAll(os.Stdin)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", filePath, err)
-				exitCode = 1
-				return nil
+				fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+				os.Exit(1)
 			}
+			expression = string(input)
+		}
+		formatted, err := formatting.FormatExpr(strings.TrimSpace(expression), style)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(formatted)
+		os.Exit(0)
+	}
 
-			opts := formatting.CheckOptions{
-				DisableLineLength: *disableLineCheck,
-				PrometheusURL:     *prometheusURL,
-				Verbose:           *verbose,
-			}
-			issues, formatted := formatting.CheckAndFormatPromQL(string(content), opts)
-
-			if len(issues) > 0 {
-				filesWithIssues++
-				if shouldCheck {
-					fmt.Printf("%s:\n", filePath)
-					for _, issue := range issues {
-						fmt.Printf("  - %s\n", issue)
-					}
-					exitCode = 1
-				}
-			}
+	// --fix and --fmt are aliases
+	shouldFix := *fix || *fmtFlag
+	// Absence alerts are only generated when the formatted content is written or diffed
+	opts.FixAbsenceAlerts = *absenceAlerts && (shouldFix || *diff)
+	cfg := config{
+		opts:     opts,
+		fix:      shouldFix,
+		check:    *check && !shouldFix && !*diff,
+		diff:     *diff,
+		colorize: *diff && useColor(),
+		verbose:  *verbose,
+		cost:     *costReport,
+	}
 
-			if shouldFix && formatted != string(content) {
-				if *verbose {
-					fmt.Printf("Fixing %s\n", filePath)
-				}
-				if err := os.WriteFile(filePath, []byte(formatted), info.Mode()); err != nil {
-					fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", filePath, err)
-					exitCode = 1
-				}
-			}
+	exitCode := 0
 
-			return nil
-		})
+	walkOpts := walk.Options{
+		// YAML rule files and JSON files such as Grafana dashboards
+		Extensions:  []string{".yaml", ".yml", ".json"},
+		Include:     include,
+		Exclude:     exclude,
+		NoGitignore: *noGitignore,
+	}
+
+	// Collect files first so they can be processed concurrently and reported in path order
+	var files []string
+	for _, path := range flag.Args() {
+		if path == "-" {
+			files = append(files, path)
+			continue
+		}
 
+		found, err := walk.Files(path, walkOpts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
 			exitCode = 1
+			continue
 		}
+		files = append(files, found...)
 	}
 
-	if shouldCheck {
+	// The rule set check also reads files --changed-since skips, as changed rules may
+	// conflict with or depend on them
+	allFiles := slices.Clone(files)
+
+	// Only files changed since the ref are checked, and only findings in changed rules reported
+	if *changedSince != "" {
+		paths := slices.DeleteFunc(slices.Clone(flag.Args()), func(p string) bool { return p == "-" })
+		changed, err := changes.Since(*changedSince, paths...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --changed-since: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.changed = changed
+		files = slices.DeleteFunc(files, func(f string) bool {
+			return f != "-" && !changed.Changed(f)
+		})
+	}
+
+	results := parallel.Map(files, *jobs, cfg.process)
+
+	totalFiles := 0
+	filesWithIssues := 0
+	filesWithDiff := 0
+	for _, r := range results {
+		_, _ = os.Stdout.Write(r.stdout.Bytes())
+		_, _ = os.Stderr.Write(r.stderr.Bytes())
+		if r.failed {
+			exitCode = 1
+		}
+		if r.skipped {
+			continue
+		}
+		totalFiles++
+		if r.hasIssues {
+			filesWithIssues++
+		}
+		if r.hasDiff {
+			filesWithDiff++
+		}
+	}
+
+	ruleSetIssues := *ruleSet && cfg.checkRuleSet(allFiles)
+	if ruleSetIssues {
+		exitCode = 1
+	}
+
+	if *diff && filesWithDiff > 0 {
+		fmt.Fprintf(os.Stderr, "%d/%d files would be reformatted\n", filesWithDiff, totalFiles)
+	}
+
+	if cfg.check {
 		if filesWithIssues > 0 {
 			fmt.Printf("\nFound formatting issues in %d/%d files\n", filesWithIssues, totalFiles)
 			fmt.Printf("Run with --fix to automatically format\n")
-		} else if totalFiles > 0 {
+		} else if totalFiles > 0 && !ruleSetIssues {
 			fmt.Printf("All %d files are properly formatted\n", totalFiles)
 		}
 	} else if shouldFix {
@@ -120,3 +238,244 @@ func main() {
 
 	os.Exit(exitCode)
 }
+
+// config holds the settings shared by every file
+type config struct {
+	opts     formatting.CheckOptions
+	fix      bool
+	check    bool
+	diff     bool
+	colorize bool
+	verbose  bool
+	// cost prints the estimated evaluation cost of each rule file
+	cost bool
+	// changed, if set, limits findings to rules changed since --changed-since
+	changed *changes.Set
+}
+
+// result is the outcome of processing one file. Output is buffered so that files processed
+// concurrently are reported in order.
+type result struct {
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	skipped   bool
+	hasIssues bool
+	hasDiff   bool
+	failed    bool
+}
+
+// process checks, formats or diffs one file, or stdin for the path -
+func (c config) process(filePath string) *result {
+	r := &result{}
+
+	// Filter mode: format YAML or dashboard JSON from stdin to stdout, reporting issues on stderr
+	if filePath == "-" {
+		r.skipped = true
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(&r.stderr, "Error reading stdin: %v\n", err)
+			r.failed = true
+			return r
+		}
+
+		// The formatted content is always written to stdout
+		opts := c.opts
+		opts.FixAbsenceAlerts = opts.AbsenceAlerts
+		issues, formatted := formatting.CheckAndFormat(content, opts)
+		if c.verbose {
+			for _, issue := range issues {
+				fmt.Fprintf(&r.stderr, "<stdin>: %s\n", issue)
+			}
+		}
+
+		if c.diff {
+			if formatted != string(content) {
+				r.failed = true
+				d := formatting.UnifiedDiff("a/<stdin>", "b/<stdin>", string(content), formatted)
+				if c.colorize {
+					d = colorizeDiff(d)
+				}
+				r.stdout.WriteString(d)
+			}
+		} else {
+			r.stdout.WriteString(formatted)
+		}
+		return r
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error reading %s: %v\n", filePath, err)
+		r.failed = true
+		return r
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error reading %s: %v\n", filePath, err)
+		r.failed = true
+		return r
+	}
+
+	// Skip files without PromQL, e.g. CI config, Helm values or package manifests. Fragments
+	// of rule files, such as a single rule, are checked for their expr keys.
+	if fragments, _ := promql.ExtractRuleFragments(content); promql.FindExtractor(content) == nil && len(fragments) == 0 {
+		if c.verbose {
+			fmt.Fprintf(&r.stdout, "Skipping %s: no rule groups or other PromQL found\n", filePath)
+		}
+		r.skipped = true
+		return r
+	}
+
+	opts := c.opts
+	if c.changed != nil {
+		opts.Only = c.changed.Filter(filePath, content)
+	}
+	issues, formatted := formatting.CheckAndFormat(content, opts)
+
+	if len(issues) > 0 {
+		r.hasIssues = true
+		if c.check {
+			fmt.Fprintf(&r.stdout, "%s:\n", filePath)
+			for _, issue := range issues {
+				fmt.Fprintf(&r.stdout, "  - %s\n", issue)
+			}
+			r.failed = true
+		}
+	}
+
+	if c.cost {
+		c.reportCost(r, filePath, content)
+	}
+
+	if c.diff && formatted != string(content) {
+		r.hasDiff = true
+		r.failed = true
+		name := strings.TrimPrefix(filepath.ToSlash(filePath), "/")
+		d := formatting.UnifiedDiff("a/"+name, "b/"+name, string(content), formatted)
+		if c.colorize {
+			d = colorizeDiff(d)
+		}
+		r.stdout.WriteString(d)
+	}
+
+	if c.fix && formatted != string(content) {
+		if c.verbose {
+			fmt.Fprintf(&r.stdout, "Fixing %s\n", filePath)
+		}
+		if err := os.WriteFile(filePath, []byte(formatted), info.Mode()); err != nil {
+			fmt.Fprintf(&r.stderr, "Error writing %s: %v\n", filePath, err)
+			r.failed = true
+		}
+	}
+
+	return r
+}
+
+// checkRuleSet checks the rule files among paths as one rule set and prints the issues of
+// each file, reporting whether there were any
+func (c config) checkRuleSet(paths []string) bool {
+	var files []formatting.RuleFile
+	for _, path := range paths {
+		if path == "-" {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+			continue
+		}
+		files = append(files, formatting.RuleFile{Path: path, Content: content})
+	}
+
+	found := false
+	issues := formatting.CheckRuleSet(files)
+	for _, f := range files {
+		fileIssues := issues[f.Path]
+		if c.changed != nil {
+			only := c.changed.Filter(f.Path, f.Content)
+			fileIssues = slices.DeleteFunc(fileIssues, func(i formatting.Issue) bool {
+				return !c.changed.Changed(f.Path) || (i.Line > 0 && !only(i.Line))
+			})
+		}
+		if len(fileIssues) == 0 {
+			continue
+		}
+		if !found {
+			fmt.Printf("\nRule set issues:\n")
+			found = true
+		}
+		fmt.Printf("%s:\n", f.Path)
+		for _, issue := range fileIssues {
+			fmt.Printf("  - line %d: %s\n", issue.Line, issue)
+		}
+	}
+	return found
+}
+
+// reportCost prints the estimated series and samples each rule and group of a rule file
+// touches per evaluation
+func (c config) reportCost(r *result, filePath string, content []byte) {
+	groups, err := formatting.EstimateRuleCosts(string(content), c.opts)
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "Error estimating costs of %s: %v\n", filePath, err)
+		r.failed = true
+		return
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	fmt.Fprintf(&r.stdout, "%s: estimated cost per evaluation\n", filePath)
+	for _, group := range groups {
+		fmt.Fprintf(&r.stdout, "  group %s (line %d): ~%d series, ~%d samples\n", group.Name, group.Line, group.Series, group.Samples)
+		for _, rule := range group.Rules {
+			fmt.Fprintf(&r.stdout, "    %s (line %d): ~%d series, ~%d samples\n", rule.Name, rule.Line, rule.Series, rule.Samples)
+		}
+	}
+}
+
+// useColor reports whether stdout is a terminal and colour has not been disabled via NO_COLOR
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorizeDiff adds ANSI colours to a unified diff
+func colorizeDiff(diff string) string {
+	const (
+		bold  = "\033[1m"
+		red   = "\033[31m"
+		green = "\033[32m"
+		cyan  = "\033[36m"
+		reset = "\033[0m"
+	)
+
+	lines := strings.SplitAfter(diff, "\n")
+	for i, line := range lines {
+		text := strings.TrimSuffix(line, "\n")
+		if text == "" {
+			continue
+		}
+		color := ""
+		switch {
+		case strings.HasPrefix(text, "--- "), strings.HasPrefix(text, "+++ "):
+			color = bold
+		case strings.HasPrefix(text, "@@"):
+			color = cyan
+		case strings.HasPrefix(text, "-"):
+			color = red
+		case strings.HasPrefix(text, "+"):
+			color = green
+		}
+		if color != "" {
+			lines[i] = color + text + reset + line[len(text):]
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,124 @@
+// Package main provides the promql-lsp command, a language server for files holding PromQL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/lsp"
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/pkg/formatting"
+)
+
+func main() {
+	var defaults promql.DefaultMatchers
+	flag.Var(&defaults, "default", "label=value matcher the missing label quick fix adds to selectors (repeatable)")
+
+	var (
+		requiredLabels   = flag.String("labels", "job", "comma-separated list of labels every selector must match on; empty disables the check")
+		alertLabels      = flag.String("alert-labels", "", "comma-separated list of labels every alert must set")
+		annotations      = flag.String("annotations", "", "comma-separated list of annotations every alert must set; also validates annotation templates")
+		tenantLabel      = flag.String("tenant-label", "", "label that isolates tenants; every selector must pin it and binary operations must match on it")
+		metadataFile     = flag.String("metadata-file", "", "JSON file of metric metadata, as saved from /api/v1/metadata, for checking metric types offline")
+		policyFile       = flag.String("policy", "", "path to a label value policy file")
+		prometheusURL    = flag.String("prometheus-url", "", "Prometheus server URL for timeseries continuity checks, job scrape intervals and metric metadata (optional)")
+		scrapeInterval   = flag.Duration("scrape-interval", 0, "scrape interval range windows are checked against for jobs not found at --prometheus-url; unset, only the evaluation interval is checked for them")
+		disableLineCheck = flag.Bool("disable-line-length", false, "disable line length checks for long metric names")
+		indentWidth      = flag.Int("indent", 2, "number of spaces per nesting level in multiline expressions")
+		maxLineWidth     = flag.Int("max-line-width", 80, "line width above which expressions are split across lines")
+		aggClause        = flag.String("aggregation-clause", "preserve", "position of by/without clauses: prefix, postfix or preserve")
+		sortMatchers     = flag.Bool("sort-matchers", false, "sort label matchers by label name")
+		logFile          = flag.String("log", "", "file to log protocol errors to")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: promql-lsp [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Language server for Prometheus rule files, Grafana dashboards and other files holding PromQL.\n")
+		fmt.Fprintf(os.Stderr, "Speaks the Language Server Protocol over stdin and stdout.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  promql-lsp --labels=job,namespace --default job=myservice\n")
+		fmt.Fprintf(os.Stderr, "  promql-lsp --annotations=summary,description --max-line-width=100\n")
+	}
+
+	flag.Parse()
+
+	style := formatting.FormatStyle{
+		IndentWidth:  *indentWidth,
+		MaxLineWidth: *maxLineWidth,
+	}
+	aggStyle, err := formatting.ParseAggregationStyle(*aggClause)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --aggregation-clause: %v\n", err)
+		os.Exit(1)
+	}
+	style.AggregationStyle = aggStyle
+	if *sortMatchers {
+		style.MatcherOrder = formatting.MatcherOrderSorted
+	}
+
+	config := lsp.Config{
+		Check: formatting.CheckOptions{
+			DisableLineLength: *disableLineCheck,
+			PrometheusURL:     *prometheusURL,
+			ScrapeInterval:    *scrapeInterval,
+			Style:             style,
+			// Documents are re-checked on every change, so remote lookups are cached
+			Cache: formatting.NewLookupCache(),
+		},
+		Labels:      splitList(*requiredLabels),
+		Defaults:    defaults,
+		AlertLabels: splitList(*alertLabels),
+		Annotations: splitList(*annotations),
+		TenantLabel: *tenantLabel,
+	}
+
+	if *metadataFile != "" {
+		metadata, err := formatting.LoadMetadata(*metadataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading metadata: %v\n", err)
+			os.Exit(1)
+		}
+		config.Check.Metadata = metadata
+	}
+
+	if *policyFile != "" {
+		policy, err := promql.LoadPolicy(*policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+			os.Exit(1)
+		}
+		config.Policy = policy
+	}
+
+	var logger *log.Logger
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening log: %v\n", err)
+			os.Exit(1)
+		}
+		// The log stays open until the process exits
+		logger = log.New(f, "promql-lsp: ", log.LstdFlags)
+	}
+
+	if err := lsp.NewServer(config, logger).Run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// splitList splits a comma-separated flag, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,216 @@
+// Package main provides the rule-graph command for analyzing the dependencies between rules.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/internal/rulegraph"
+	"github.com/conallob/o11y-analysis-tools/internal/walk"
+)
+
+func main() {
+	var include, exclude walk.Patterns
+	flag.Var(&include, "include", "glob of files to process, matched against paths relative to each argument (repeatable)")
+	flag.Var(&exclude, "exclude", "glob of files or directories to skip, e.g. 'vendor/**' (repeatable)")
+
+	var (
+		format      = flag.String("format", "text", "output format: text, dot or json")
+		output      = flag.String("output", "", "file to write the report or graph to (default: stdout)")
+		maxDepth    = flag.Int("max-depth", 0, "fail when a chain of recording rules feeding a rule is deeper than this (0 disables)")
+		noGitignore = flag.Bool("no-gitignore", false, "also process files ignored by .gitignore")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rule-graph [options] <file-or-directory>...\n\n")
+		fmt.Fprintf(os.Stderr, "Build the dependency graph of recording and alerting rules across rule files, linking\n")
+		fmt.Fprintf(os.Stderr, "each recording rule to the rules reading the series it records. Reports dependency\n")
+		fmt.Fprintf(os.Stderr, "cycles, dependencies between groups, recording rules no rule reads and the depth of\n")
+		fmt.Fprintf(os.Stderr, "recording rule chains, or exports the graph as DOT or JSON.\n\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 when the rules contain a cycle or a chain deeper than --max-depth.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  rule-graph ./rules/\n")
+		fmt.Fprintf(os.Stderr, "  rule-graph --max-depth=3 ./rules/\n")
+		fmt.Fprintf(os.Stderr, "  rule-graph --format=dot ./rules/ | dot -Tsvg -o rules.svg\n")
+		fmt.Fprintf(os.Stderr, "  rule-graph --format=json --output=rules.json ./rules/\n")
+	}
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no files or directories specified\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *format != "text" && *format != "dot" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be text, dot or json\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	walkOpts := walk.Options{
+		Extensions:  []string{".yaml", ".yml"},
+		Include:     include,
+		Exclude:     exclude,
+		NoGitignore: *noGitignore,
+	}
+
+	exitCode := 0
+	var groups []promql.RuleGroup
+	for _, path := range flag.Args() {
+		files, err := walk.Files(path, walkOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+			exitCode = 1
+			continue
+		}
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", file, err)
+				exitCode = 1
+				continue
+			}
+			groups = append(groups, promql.LoadRuleGroups(file, content)...)
+		}
+	}
+
+	graph := rulegraph.Build(groups)
+
+	var out bytes.Buffer
+	switch *format {
+	case "dot":
+		_ = graph.WriteDOT(&out)
+	case "json":
+		_ = graph.WriteJSON(&out)
+	default:
+		_ = writeReport(&out, graph, *maxDepth)
+	}
+
+	if *output != "" {
+		if err := os.WriteFile(*output, out.Bytes(), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *output, err)
+			exitCode = 1
+		}
+	} else {
+		_, _ = os.Stdout.Write(out.Bytes())
+	}
+
+	if len(graph.Cycles()) > 0 {
+		exitCode = 1
+	}
+	if *maxDepth > 0 && len(tooDeep(graph, *maxDepth)) > 0 {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// tooDeep returns the IDs of rules fed by a chain of recording rules deeper than maxDepth
+// that do not themselves feed a rule reported for the same reason, so each chain is reported
+// once by its deepest rule
+func tooDeep(graph *rulegraph.Graph, maxDepth int) []int {
+	deep := make(map[int]bool)
+	for _, n := range graph.Nodes {
+		if n.Depth > maxDepth {
+			deep[n.ID] = true
+		}
+	}
+	for _, e := range graph.Edges {
+		if deep[e.To] {
+			delete(deep, e.From)
+		}
+	}
+	var ids []int
+	for _, n := range graph.Nodes {
+		if deep[n.ID] {
+			ids = append(ids, n.ID)
+		}
+	}
+	return ids
+}
+
+// writeReport writes the text report of a rule graph
+func writeReport(w io.Writer, graph *rulegraph.Graph, maxDepth int) error {
+	var b strings.Builder
+
+	records := 0
+	for _, n := range graph.Nodes {
+		if n.Kind == rulegraph.KindRecord {
+			records++
+		}
+	}
+	fmt.Fprintf(&b, "Rule graph: %d rules (%d recording, %d alerting), %d dependencies\n",
+		len(graph.Nodes), records, len(graph.Nodes)-records, len(graph.Edges))
+
+	cycles := graph.Cycles()
+	if len(cycles) > 0 {
+		fmt.Fprintf(&b, "\n✗ Dependency cycles (%d):\n", len(cycles))
+		for _, cycle := range cycles {
+			names := graph.Names(cycle)
+			names = append(names, names[0])
+			fmt.Fprintf(&b, "  - %s\n", strings.Join(names, " -> "))
+			for _, id := range cycle {
+				n := graph.Nodes[id]
+				fmt.Fprintf(&b, "      %s at %s\n", n.Name, n.Location())
+			}
+		}
+		b.WriteString("    Each evaluation reads the previous evaluation's values, so the series never settle\n")
+	}
+
+	crossGroup := graph.CrossGroup()
+	if len(crossGroup) > 0 {
+		fmt.Fprintf(&b, "\nCross-group dependencies (%d):\n", len(crossGroup))
+		for _, e := range crossGroup {
+			from, to := graph.Nodes[e.From], graph.Nodes[e.To]
+			fmt.Fprintf(&b, "  - %s (group '%s', %s) reads %s (group '%s', %s)\n",
+				to.Name, to.Group, to.Location(), from.Name, from.Group, from.Location())
+		}
+		b.WriteString("    Groups are evaluated independently, so these rules may read values up to one interval old\n")
+	}
+
+	unused := graph.Unused()
+	if len(unused) > 0 {
+		fmt.Fprintf(&b, "\nRecording rules not read by any rule (%d):\n", len(unused))
+		for _, id := range unused {
+			n := graph.Nodes[id]
+			fmt.Fprintf(&b, "  - %s at %s\n", n.Name, n.Location())
+		}
+		b.WriteString("    They may still be queried by dashboards or other clients\n")
+	}
+
+	deepest := -1
+	for _, n := range graph.Nodes {
+		if deepest < 0 || n.Depth > graph.Nodes[deepest].Depth {
+			deepest = n.ID
+		}
+	}
+	if deepest >= 0 && graph.Nodes[deepest].Depth > 0 {
+		fmt.Fprintf(&b, "\nLongest chain (depth %d): %s\n",
+			graph.Nodes[deepest].Depth, strings.Join(graph.Names(graph.Chain(deepest)), " -> "))
+	}
+	if maxDepth > 0 {
+		if deep := tooDeep(graph, maxDepth); len(deep) > 0 {
+			fmt.Fprintf(&b, "\n✗ Chains deeper than %d (%d):\n", maxDepth, len(deep))
+			for _, id := range deep {
+				n := graph.Nodes[id]
+				fmt.Fprintf(&b, "  - %s at %s (depth %d): %s\n",
+					n.Name, n.Location(), n.Depth, strings.Join(graph.Names(graph.Chain(id)), " -> "))
+			}
+			b.WriteString("    Each step can add up to one evaluation interval of delay; record from raw series directly\n")
+		}
+	}
+
+	if len(cycles) == 0 && len(crossGroup) == 0 && len(unused) == 0 {
+		b.WriteString("\n✓ No cycles, cross-group dependencies or unused recording rules\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
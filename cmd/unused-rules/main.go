@@ -0,0 +1,206 @@
+// Package main provides the unused-rules command for finding recording rules whose series nothing reads.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/internal/rulegraph"
+	"github.com/conallob/o11y-analysis-tools/internal/walk"
+)
+
+func main() {
+	var include, exclude walk.Patterns
+	flag.Var(&include, "include", "glob of files to process, matched against paths relative to each argument (repeatable)")
+	flag.Var(&exclude, "exclude", "glob of files or directories to skip, e.g. 'vendor/**' (repeatable)")
+
+	var (
+		prometheusURL = flag.String("prometheus-url", "", "Prometheus server URL whose query log is checked for recent queries of recorded series (optional)")
+		queryLog      = flag.String("query-log", "", "path of the Prometheus query log, if not readable at the path --prometheus-url reports, e.g. when mounted elsewhere")
+		since         = flag.String("since", "30d", "how far back queries in the query log count as recent usage")
+		noGitignore   = flag.Bool("no-gitignore", false, "also process files ignored by .gitignore")
+		verbose       = flag.Bool("verbose", false, "also list recording rules only read by dashboards or queries, and where they are read")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: unused-rules [options] <file-or-directory>...\n\n")
+		fmt.Fprintf(os.Stderr, "Report recording rules whose series are not read by any alert, any other recording rule\n")
+		fmt.Fprintf(os.Stderr, "that is itself read, or any Grafana dashboard query. Files are rule files, Grafana dashboard\n")
+		fmt.Fprintf(os.Stderr, "JSON exports and other files holding PromQL, such as Sloth and Pyrra SLO specs.\n\n")
+		fmt.Fprintf(os.Stderr, "With --prometheus-url or --query-log, series queried recently according to Prometheus'\n")
+		fmt.Fprintf(os.Stderr, "query log (global.query_log_file) are also treated as read.\n\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 when unused recording rules are found.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  unused-rules ./rules/ ./dashboards/\n")
+		fmt.Fprintf(os.Stderr, "  unused-rules --prometheus-url=http://prometheus:9090 --since=7d ./rules/ ./dashboards/\n")
+		fmt.Fprintf(os.Stderr, "  unused-rules --query-log=/mnt/prometheus/query.log ./rules/\n")
+	}
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no files or directories specified\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	window, err := promql.ParseDuration(*since)
+	if err != nil || window <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --since duration %q\n", *since)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	walkOpts := walk.Options{
+		// YAML rule files and SLO specs, and JSON dashboards
+		Extensions:  []string{".yaml", ".yml", ".json"},
+		Include:     include,
+		Exclude:     exclude,
+		NoGitignore: *noGitignore,
+	}
+
+	exitCode := 0
+	var groups []promql.RuleGroup
+	var refs []rulegraph.Reference
+	ruleFiles, otherFiles := 0, 0
+	for _, path := range flag.Args() {
+		files, err := walk.Files(path, walkOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+			exitCode = 1
+			continue
+		}
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", file, err)
+				exitCode = 1
+				continue
+			}
+			if fileGroups := promql.LoadRuleGroups(file, content); len(fileGroups) > 0 {
+				groups = append(groups, fileGroups...)
+				ruleFiles++
+				continue
+			}
+			// Dashboards and other files holding PromQL read series from outside the rule set
+			if promql.FindExtractor(content) == nil {
+				continue
+			}
+			_, exprs, err := promql.ExtractExpressions(content)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", file, err)
+				exitCode = 1
+				continue
+			}
+			refs = append(refs, rulegraph.ExpressionReferences(file, exprs)...)
+			otherFiles++
+		}
+	}
+
+	// The query log is read wherever Prometheus writes it unless its path is given
+	logPath := *queryLog
+	if logPath == "" && *prometheusURL != "" {
+		logPath, err = rulegraph.QueryLogFile(*prometheusURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error finding the query log of %s: %v\n", *prometheusURL, err)
+			os.Exit(1)
+		}
+	}
+	var logSince time.Time
+	if logPath != "" {
+		f, err := os.Open(logPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading query log: %v (use --query-log if it is mounted elsewhere)\n", err)
+			os.Exit(1)
+		}
+		logRefs, oldest, err := rulegraph.QueryLogReferences(f, time.Now().Add(-window))
+		_ = f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading query log %s: %v\n", logPath, err)
+			os.Exit(1)
+		}
+		refs = append(refs, logRefs...)
+		logSince = oldest
+	}
+
+	graph := rulegraph.Build(groups)
+
+	// Dashboards and queries may read recorded series by a __name__ regex
+	used := make(map[string]bool)
+	readers := make(map[string][]string)
+	for _, ref := range graph.Resolve(refs) {
+		used[ref.Metric] = true
+		source := ref.Source
+		if !ref.Time.IsZero() {
+			source += ", last " + ref.Time.Format(time.RFC3339)
+		}
+		readers[ref.Metric] = append(readers[ref.Metric], source)
+	}
+
+	records := 0
+	for _, n := range graph.Nodes {
+		if n.Kind == rulegraph.KindRecord {
+			records++
+		}
+	}
+
+	fmt.Printf("Checked %d recording rules and %d alerts (%d rule files, %d dashboards and other files",
+		records, len(graph.Nodes)-records, ruleFiles, otherFiles)
+	if logPath != "" {
+		fmt.Printf(", queries of the last %s", *since)
+	}
+	fmt.Println(")")
+	// A query log rotated or enabled recently cannot tell what was queried before it starts
+	if logPath != "" && (logSince.IsZero() || logSince.After(time.Now().Add(-window).Add(24*time.Hour))) {
+		if logSince.IsZero() {
+			fmt.Printf("Warning: the query log at %s has no queries from the last %s\n", logPath, *since)
+		} else {
+			fmt.Printf("Warning: the query log at %s only covers queries since %s\n", logPath, logSince.Format(time.RFC3339))
+		}
+	}
+
+	// Recording rules no rule reads at all, as opposed to those only read by other unused
+	// recording rules
+	direct := make(map[int]bool)
+	for _, id := range graph.Unused() {
+		direct[id] = true
+	}
+
+	unused := graph.Unreferenced(used)
+	if len(unused) > 0 {
+		fmt.Printf("\n✗ Unused recording rules (%d):\n", len(unused))
+		for _, id := range unused {
+			n := graph.Nodes[id]
+			fmt.Printf("  - %s at %s", n.Name, n.Location())
+			if !direct[id] {
+				fmt.Printf(" (only read by unused recording rules)")
+			}
+			fmt.Println()
+		}
+		fmt.Println("    Nothing reads their series; remove them to save evaluation time and storage")
+		exitCode = 1
+	} else {
+		fmt.Println("\n✓ Every recording rule is read")
+	}
+
+	if *verbose {
+		var external []string
+		for _, id := range graph.Unused() {
+			n := graph.Nodes[id]
+			if used[n.Name] {
+				external = append(external, fmt.Sprintf("  - %s at %s, read by:\n      %s",
+					n.Name, n.Location(), strings.Join(readers[n.Name], "\n      ")))
+			}
+		}
+		if len(external) > 0 {
+			fmt.Printf("\nRecording rules only read by dashboards or queries (%d):\n%s\n", len(external), strings.Join(external, "\n"))
+		}
+	}
+
+	os.Exit(exitCode)
+}
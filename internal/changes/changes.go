@@ -0,0 +1,188 @@
+// Package changes finds the files and lines changed since a git revision, so checks can be
+// limited to what a pull request touches.
+package changes
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// LineRange is an inclusive range of 1-based lines
+type LineRange struct {
+	Start int
+	End   int
+}
+
+// Set records the lines changed in each file, keyed by absolute path
+type Set struct {
+	files map[string][]LineRange
+}
+
+// wholeFile marks every line of a file as changed
+var wholeFile = []LineRange{{Start: 1, End: int(^uint(0) >> 1)}}
+
+// hunkHeaderRegex matches the new-file side of a unified diff hunk header
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// Since returns the changes in the working trees of the repositories containing paths
+// relative to ref. Changes are taken from the merge base of ref and HEAD, so commits made on
+// ref since the branch point are not counted. Untracked files count as wholly changed.
+func Since(ref string, paths ...string) (*Set, error) {
+	s := &Set{files: make(map[string][]LineRange)}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		dir := p
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			dir = filepath.Dir(p)
+		}
+
+		root, err := git(dir, "rev-parse", "--show-toplevel")
+		if err != nil {
+			return nil, err
+		}
+		root = strings.TrimSpace(root)
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+
+		if err := s.load(root, ref); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load adds the changes in the repository at root
+func (s *Set) load(root, ref string) error {
+	base, err := git(root, "merge-base", ref, "HEAD")
+	if err != nil {
+		// Without a common ancestor, compare against ref itself
+		base = ref
+	}
+	base = strings.TrimSpace(base)
+
+	diff, err := git(root, "-c", "core.quotePath=false", "diff", "--no-color", "--no-ext-diff", "--unified=0", base, "--")
+	if err != nil {
+		return err
+	}
+	for file, ranges := range parseDiff(diff) {
+		s.files[filepath.Join(root, filepath.FromSlash(file))] = ranges
+	}
+
+	untracked, err := git(root, "-c", "core.quotePath=false", "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	for _, file := range strings.Split(strings.TrimSpace(untracked), "\n") {
+		if file != "" {
+			s.files[filepath.Join(root, filepath.FromSlash(file))] = wholeFile
+		}
+	}
+	return nil
+}
+
+// Changed reports whether a file has any changes
+func (s *Set) Changed(path string) bool {
+	return len(s.ranges(path)) > 0
+}
+
+// Overlaps reports whether any line from start to end, inclusive, of a file changed
+func (s *Set) Overlaps(path string, start, end int) bool {
+	for _, r := range s.ranges(path) {
+		if r.Start <= end && start <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns a function reporting whether a finding at a line of a file falls in a changed
+// rule. A finding inside a rule counts as changed when any line of the rule changed, so
+// editing a rule's labels re-checks its expression; elsewhere only the line itself counts.
+func (s *Set) Filter(path string, content []byte) func(line int) bool {
+	spans := promql.RuleSpans(content)
+	return func(line int) bool {
+		for _, span := range spans {
+			if span.Start <= line && line <= span.End {
+				return s.Overlaps(path, span.Start, span.End)
+			}
+		}
+		return s.Overlaps(path, line, line)
+	}
+}
+
+func (s *Set) ranges(path string) []LineRange {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	if ranges, ok := s.files[abs]; ok {
+		return ranges
+	}
+	// git reports the repository root with symlinks resolved
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return s.files[resolved]
+	}
+	return nil
+}
+
+// parseDiff returns the changed line ranges of each file in a unified diff, by the file's
+// path in the new revision. Deleted files are omitted. A hunk that only removes lines marks
+// the lines on either side of the removal.
+func parseDiff(diff string) map[string][]LineRange {
+	files := make(map[string][]LineRange)
+
+	var current string
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			current = ""
+			if name := strings.TrimPrefix(line, "+++ "); strings.HasPrefix(name, "b/") {
+				current = strings.TrimSuffix(name[2:], "\t")
+			}
+		case strings.HasPrefix(line, "@@ ") && current != "":
+			m := hunkHeaderRegex.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			r := LineRange{Start: start, End: start + count - 1}
+			if count == 0 {
+				// start is the line before the removal
+				r = LineRange{Start: max(start, 1), End: start + 1}
+			}
+			files[current] = append(files[current], r)
+		}
+	}
+	return files
+}
+
+// git runs a git command in dir and returns its output
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,160 @@
+package changes
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	diff := `diff --git a/rules/alerts.yml b/rules/alerts.yml
+index 1111111..2222222 100644
+--- a/rules/alerts.yml
++++ b/rules/alerts.yml
+@@ -4 +4 @@ groups:
+-        expr: up == 0
++        expr: up{job="api"} == 0
+@@ -10,0 +11,3 @@ groups:
++      - alert: New
++        expr: vector(1)
++        for: 5m
+@@ -20,2 +23,0 @@ groups:
+-        labels:
+-          severity: page
+diff --git a/removed.yml b/removed.yml
+deleted file mode 100644
+--- a/removed.yml
++++ /dev/null
+@@ -1,3 +0,0 @@
+-groups: []
+diff --git a/added.yml b/added.yml
+new file mode 100644
+--- /dev/null
++++ b/added.yml
+@@ -0,0 +1,2 @@
++groups:
++  - name: a
+`
+
+	expected := map[string][]LineRange{
+		"rules/alerts.yml": {{4, 4}, {11, 13}, {23, 24}},
+		"added.yml":        {{1, 2}},
+	}
+
+	if got := parseDiff(diff); !reflect.DeepEqual(got, expected) {
+		t.Errorf("parseDiff() = %v, want %v", got, expected)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	abs, err := filepath.Abs("rules.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Set{files: map[string][]LineRange{abs: {{4, 4}, {11, 13}}}}
+
+	tests := []struct {
+		start, end int
+		expected   bool
+	}{
+		{1, 3, false},
+		{3, 5, true},
+		{5, 10, false},
+		{13, 20, true},
+		{14, 20, false},
+	}
+
+	for _, tt := range tests {
+		if got := s.Overlaps("rules.yml", tt.start, tt.end); got != tt.expected {
+			t.Errorf("Overlaps(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.expected)
+		}
+	}
+	if s.Changed("other.yml") {
+		t.Error("Changed(other.yml) = true, want false")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	content := []byte(`groups:
+  - name: example
+    rules:
+      - alert: Unchanged
+        expr: up == 0
+        for: 5m
+      - alert: Relabelled
+        expr: up == 0
+        labels:
+          severity: page
+`)
+	abs, err := filepath.Abs("rules.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the severity label of the second alert changed
+	s := &Set{files: map[string][]LineRange{abs: {{10, 10}}}}
+
+	only := s.Filter("rules.yml", content)
+	for line, expected := range map[int]bool{5: false, 8: true, 1: false} {
+		if got := only(line); got != expected {
+			t.Errorf("Filter()(%d) = %v, want %v", line, got, expected)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q", "-b", "main")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+	write("a.yml", "one\ntwo\nthree\n")
+	write("b.yml", "unchanged\n")
+	run("add", ".")
+	run("commit", "-q", "-m", "initial")
+
+	run("checkout", "-q", "-b", "feature")
+	write("a.yml", "one\n2\nthree\n")
+	run("commit", "-q", "-am", "change")
+	write("c.yml", "untracked\n")
+
+	s, err := Since("main", dir)
+	if err != nil {
+		t.Fatalf("Since() error: %v", err)
+	}
+
+	a := filepath.Join(dir, "a.yml")
+	if !s.Overlaps(a, 2, 2) || s.Overlaps(a, 1, 1) || s.Overlaps(a, 3, 3) {
+		t.Errorf("a.yml changes = %v, want line 2 only", s.ranges(a))
+	}
+	if s.Changed(filepath.Join(dir, "b.yml")) {
+		t.Error("b.yml reported as changed")
+	}
+	if !s.Overlaps(filepath.Join(dir, "c.yml"), 1, 1) {
+		t.Error("untracked c.yml not reported as changed")
+	}
+
+	if _, err := Since("no-such-ref", dir); err == nil {
+		t.Error("Since() with an unknown ref succeeded")
+	}
+}
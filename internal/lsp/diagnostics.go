@@ -0,0 +1,142 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/pkg/formatting"
+)
+
+// Diagnostic sources, named after the command line tool that reports the same issue
+const (
+	sourceFormat = "promql-fmt"
+	sourceLabels = "label-check"
+	sourceSyntax = "promql"
+)
+
+// errorLineRegex extracts the line from a YAML syntax error
+var errorLineRegex = regexp.MustCompile(`line (\d+):`)
+
+// diagnose returns the diagnostics for a document. Files in no format the extractors
+// recognize get no diagnostics, except YAML files that fail to parse.
+func (s *Server) diagnose(uri string, doc *document) []Diagnostic {
+	content := []byte(doc.text)
+
+	ext := promql.FindExtractor(content)
+	if ext == nil {
+		if isYAML(uri) {
+			var node yaml.Node
+			if err := yaml.Unmarshal(content, &node); err != nil {
+				return []Diagnostic{syntaxDiagnostic(doc, err)}
+			}
+		}
+		return []Diagnostic{}
+	}
+
+	diagnostics := []Diagnostic{}
+	add := func(line int, severity int, source, message string) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    doc.lineRange(line),
+			Severity: severity,
+			Source:   source,
+			Message:  message,
+		})
+	}
+
+	exprs, err := ext.Extract(content)
+	if err != nil {
+		return []Diagnostic{syntaxDiagnostic(doc, err)}
+	}
+	for _, e := range exprs {
+		if _, _, err := promql.ParseTemplatedExpr(e.Value); err != nil {
+			add(e.Line, severityError, sourceSyntax, fmt.Sprintf("Invalid PromQL: %v", err))
+		}
+	}
+
+	issues, _ := formatting.Check(content, s.config.Check)
+	for _, issue := range issues {
+		severity := severityWarning
+		if strings.HasPrefix(issue.Message, "Error:") {
+			severity = severityError
+		}
+		add(issue.Line, severity, sourceFormat, issue.Message)
+	}
+
+	s.labelDiagnostics(ext, exprs, doc.text, add)
+	return diagnostics
+}
+
+// labelDiagnostics reports the label-check violations the server is configured to check
+func (s *Server) labelDiagnostics(ext promql.Extractor, exprs []promql.Expression, content string,
+	add func(line, severity int, source, message string)) {
+	c := s.config
+
+	var violations []promql.LabelViolation
+	if len(c.Labels) > 0 {
+		if ext.Name() == promql.FormatRules {
+			violations = promql.CheckRequiredLabels(content, c.Labels)
+		} else {
+			violations = promql.CheckExpressionLabels(exprs, c.Labels)
+		}
+	}
+	for _, v := range violations {
+		if len(v.MissingLabels) > 0 {
+			add(v.Line, severityWarning, sourceLabels, "Missing required labels: "+strings.Join(v.MissingLabels, ", "))
+		}
+		if len(v.MissingOutputLabels) > 0 {
+			add(v.Line, severityWarning, sourceLabels, "Required labels dropped from result: "+strings.Join(v.MissingOutputLabels, ", "))
+		}
+	}
+
+	// The remaining checks apply to rule files only
+	if ext.Name() != promql.FormatRules {
+		return
+	}
+
+	if len(c.AlertLabels) > 0 {
+		for _, v := range promql.CheckAlertLabels(content, c.AlertLabels) {
+			if len(v.MissingLabels) > 0 {
+				add(v.Line, severityWarning, sourceLabels,
+					fmt.Sprintf("Alert %s is missing required alert labels: %s", v.AlertName, strings.Join(v.MissingLabels, ", ")))
+			}
+		}
+	}
+	if len(c.Annotations) > 0 {
+		for _, v := range promql.CheckAnnotations(content, c.Annotations) {
+			add(v.Line, severityWarning, sourceLabels, v.Message)
+		}
+	}
+	if c.TenantLabel != "" {
+		for _, v := range promql.CheckTenantIsolation(content, c.TenantLabel) {
+			add(v.Line, severityWarning, sourceLabels, "Isolation violation: "+v.Message)
+		}
+	}
+	if c.Policy != nil {
+		for _, v := range promql.CheckLabelPolicy(content, c.Policy) {
+			add(v.Line, severityWarning, sourceLabels, "Policy violation: "+v.Message)
+		}
+	}
+}
+
+// syntaxDiagnostic reports a YAML or JSON syntax error, at the line it names if any
+func syntaxDiagnostic(doc *document, err error) Diagnostic {
+	line := 0
+	if m := errorLineRegex.FindStringSubmatch(err.Error()); m != nil {
+		line, _ = strconv.Atoi(m[1])
+	}
+	return Diagnostic{
+		Range:    doc.lineRange(line),
+		Severity: severityError,
+		Source:   sourceSyntax,
+		Message:  err.Error(),
+	}
+}
+
+func isYAML(uri string) bool {
+	return strings.HasSuffix(uri, ".yml") || strings.HasSuffix(uri, ".yaml")
+}
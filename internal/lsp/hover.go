@@ -0,0 +1,162 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// identifierRegex matches metric, label and function names
+var identifierRegex = regexp.MustCompile(`[a-zA-Z_:][a-zA-Z0-9_:]*`)
+
+// metricTypeSuffixes infers what a metric is from the naming conventions of its suffix
+var metricTypeSuffixes = []struct {
+	suffix      string
+	description string
+}{
+	{"_total", "counter (by its `_total` suffix): use `rate()` or `increase()` rather than the raw value"},
+	{"_bucket", "histogram buckets (by its `_bucket` suffix): use `histogram_quantile()` over `rate()`"},
+	{"_count", "histogram or summary observation count (by its `_count` suffix): a counter"},
+	{"_sum", "histogram or summary sum of observations (by its `_sum` suffix): a counter"},
+	{"_created", "counter creation timestamp (by its `_created` suffix)"},
+	{"_info", "info metric (by its `_info` suffix): join its labels with `group_left`"},
+}
+
+// metricUse records where a metric is recorded and read in a document
+type metricUse struct {
+	// recordedAt holds the expressions of recording rules producing the metric
+	recordedAt []promql.Expression
+	// usedAt holds the expressions selecting the metric
+	usedAt []promql.Expression
+}
+
+// hover describes the metric or function name under the cursor
+func hover(doc *document, pos Position) *Hover {
+	text := doc.line(pos.Line)
+	offset := byteOffset(text, pos.Character)
+
+	var word string
+	var start, end int
+	for _, loc := range identifierRegex.FindAllStringIndex(text, -1) {
+		if loc[0] <= offset && offset <= loc[1] {
+			word, start, end = text[loc[0]:loc[1]], loc[0], loc[1]
+			break
+		}
+	}
+	if word == "" {
+		return nil
+	}
+
+	var value string
+	if fn, ok := promql.Functions[word]; ok && isCall(text, end) {
+		value = functionHover(fn)
+	} else if use := metricUses(doc)[word]; use != nil {
+		value = metricHover(word, use)
+	} else {
+		return nil
+	}
+
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: value},
+		Range: &Range{
+			Start: Position{Line: pos.Line, Character: utf16Len(text[:start])},
+			End:   Position{Line: pos.Line, Character: utf16Len(text[:end])},
+		},
+	}
+}
+
+// isCall reports whether the text after a name opens an argument list
+func isCall(text string, end int) bool {
+	return strings.HasPrefix(strings.TrimLeft(text[end:], " \t"), "(")
+}
+
+// metricUses indexes the metrics recorded and selected by the expressions in a document
+func metricUses(doc *document) map[string]*metricUse {
+	uses := make(map[string]*metricUse)
+	get := func(name string) *metricUse {
+		if uses[name] == nil {
+			uses[name] = &metricUse{}
+		}
+		return uses[name]
+	}
+
+	_, exprs, err := promql.ExtractExpressions([]byte(doc.text))
+	if err != nil {
+		return uses
+	}
+	for _, e := range exprs {
+		if name, ok := strings.CutPrefix(e.Location, "recording rule "); ok {
+			get(name).recordedAt = append(get(name).recordedAt, e)
+		}
+
+		parsed, _, err := promql.ParseTemplatedExpr(e.Value)
+		if err != nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, vs := range promql.VectorSelectors(parsed) {
+			if vs.Name != "" && !seen[vs.Name] {
+				seen[vs.Name] = true
+				get(vs.Name).usedAt = append(get(vs.Name).usedAt, e)
+			}
+		}
+	}
+	return uses
+}
+
+// metricHover describes a metric: its inferred type, the rules recording it and where it
+// is used
+func metricHover(name string, use *metricUse) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**%s**", name)
+
+	for _, t := range metricTypeSuffixes {
+		if strings.HasSuffix(name, t.suffix) {
+			fmt.Fprintf(&sb, "\n\n%s", t.description)
+			break
+		}
+	}
+
+	for _, r := range use.recordedAt {
+		fmt.Fprintf(&sb, "\n\nRecorded by the rule on line %d:\n\n```promql\n%s\n```", r.Line, r.Value)
+	}
+
+	if len(use.usedAt) > 0 {
+		lines := make([]string, len(use.usedAt))
+		for i, u := range use.usedAt {
+			lines[i] = fmt.Sprint(u.Line)
+		}
+		fmt.Fprintf(&sb, "\n\nUsed by %d %s in this file, on %s %s", len(use.usedAt),
+			plural(len(use.usedAt), "expression", "expressions"), plural(len(lines), "line", "lines"), strings.Join(lines, ", "))
+	}
+	return sb.String()
+}
+
+// functionHover shows a function's signature
+func functionHover(fn promql.Function) string {
+	args := make([]string, len(fn.ArgTypes))
+	for i, t := range fn.ArgTypes {
+		args[i] = string(t)
+	}
+	// The last argument of a variadic function is optional, and may repeat
+	if last := len(args) - 1; last >= 0 {
+		switch {
+		case fn.Variadic < 0:
+			args[last] += "..."
+		case fn.Variadic == 1:
+			args[last] = "[" + args[last] + "]"
+		case fn.Variadic > 1:
+			args[last] = "[" + args[last] + "...]"
+		}
+	}
+	return fmt.Sprintf("```promql\n%s(%s) %s\n```", fn.Name, strings.Join(args, ", "), fn.ReturnType)
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,298 @@
+// Package lsp implements a Language Server Protocol server over stdio that reports the
+// promql-fmt and label-check findings for rule files, dashboards and the other formats the
+// promql extractors recognize, and offers formatting, quick fixes and hover information.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+	"github.com/conallob/o11y-analysis-tools/pkg/formatting"
+)
+
+// Config selects the checks the server runs
+type Config struct {
+	// Check configures the promql-fmt checks and formatting
+	Check formatting.CheckOptions
+	// Labels lists the labels every selector must match on
+	Labels []string
+	// Defaults are the matchers the missing label quick fix adds; labels without a default
+	// get no quick fix
+	Defaults []*promql.LabelMatcher
+	// AlertLabels lists the labels every alert must set
+	AlertLabels []string
+	// Annotations lists the annotations every alert must set
+	Annotations []string
+	// TenantLabel, if set, enables the tenant isolation check
+	TenantLabel string
+	// Policy, if set, restricts label and annotation values
+	Policy *promql.LabelPolicy
+}
+
+// Server is a language server for files holding PromQL
+type Server struct {
+	config Config
+	// logger reports protocol errors; it discards them by default
+	logger *log.Logger
+
+	out       io.Writer
+	documents map[string]*document
+	shutdown  bool
+}
+
+// NewServer returns a server running the checks in config. Protocol errors are written to
+// logger if it is not nil.
+func NewServer(config Config, logger *log.Logger) *Server {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &Server{config: config, logger: logger, documents: make(map[string]*document)}
+}
+
+// Run serves requests read from in, writing responses and notifications to out, until the
+// client sends exit or closes in. It returns an error if the client exits without first
+// requesting shutdown, so that the process exit code reflects it as LSP specifies.
+func (s *Server) Run(in io.Reader, out io.Writer) error {
+	s.out = out
+	r := bufio.NewReader(in)
+	for {
+		msg, err := readMessage(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var rpcErr *responseError
+		if errors.As(err, &rpcErr) {
+			// The body was not JSON: the framing is intact, so carry on
+			s.logger.Printf("invalid message: %v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches a request or notification, replying to requests
+func (s *Server) handle(msg *message) error {
+	result, err := s.dispatch(msg)
+	if msg.ID == nil {
+		// Notifications get no reply, so errors can only be logged
+		if err != nil {
+			s.logger.Printf("%s: %v", msg.Method, err)
+		}
+		return nil
+	}
+
+	resp := response{JSONRPC: "2.0", ID: msg.ID, Result: result}
+	if err != nil {
+		resp.Result = nil
+		var rpcErr *responseError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &responseError{Code: codeInvalidRequest, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+	}
+	return writeMessage(s.out, resp)
+}
+
+func (s *Server) dispatch(msg *message) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				// Full document sync
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    1,
+					"save":      map[string]any{"includeText": true},
+				},
+				"documentFormattingProvider": true,
+				"codeActionProvider":         map[string]any{"codeActionKinds": []string{"quickfix"}},
+				"hoverProvider":              true,
+			},
+			"serverInfo": map[string]any{"name": "promql-lsp"},
+		}, nil
+	case "initialized", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didSave":
+		var params didSaveParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if params.Text == nil {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, *params.Text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.publish(params.TextDocument.URI, []Diagnostic{})
+
+	case "textDocument/formatting":
+		var params documentFormattingParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return s.format(doc, nil), nil
+	case "textDocument/codeAction":
+		var params codeActionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return s.codeActions(params.TextDocument.URI, doc, params), nil
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return hover(doc, params.Position), nil
+	}
+
+	if strings.HasPrefix(msg.Method, "$/") {
+		// Optional protocol notifications and requests may be ignored
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not supported: " + msg.Method}
+}
+
+// update stores a document's new text and publishes its diagnostics
+func (s *Server) update(uri, text string) error {
+	doc := newDocument(text)
+	s.documents[uri] = doc
+	return s.publish(uri, s.diagnose(uri, doc))
+}
+
+func (s *Server) publish(uri string, diagnostics []Diagnostic) error {
+	return writeMessage(s.out, notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  publishDiagnosticsParams{URI: uri, Diagnostics: diagnostics},
+	})
+}
+
+func (s *Server) document(uri string) (*document, error) {
+	doc, ok := s.documents[uri]
+	if !ok {
+		return nil, &responseError{Code: codeInvalidParams, Message: "document not open: " + uri}
+	}
+	return doc, nil
+}
+
+// format returns the edits promql-fmt --fix would make, limited to expressions whose key
+// is on a line only accepts if only is set. Files in no recognized format are left alone.
+func (s *Server) format(doc *document, only func(line int) bool) []TextEdit {
+	if promql.FindExtractor([]byte(doc.text)) == nil {
+		return []TextEdit{}
+	}
+	opts := s.config.Check
+	opts.Only = only
+	_, formatted := formatting.Check([]byte(doc.text), opts)
+	edits := lineEdit(doc.text, formatted)
+	if edits == nil {
+		// An empty array rather than null, which some clients treat as an error
+		return []TextEdit{}
+	}
+	return edits
+}
+
+// codeActions offers quick fixes for the expressions in a range: reformatting them, and
+// adding the default matchers for missing required labels
+func (s *Server) codeActions(uri string, doc *document, params codeActionParams) []CodeAction {
+	// Expressions are identified by the 1-based line of their key
+	first, last := params.Range.Start.Line+1, params.Range.End.Line+1
+	inRange := func(line int) bool { return first <= line && line <= last }
+
+	related := func(source string) []Diagnostic {
+		var diagnostics []Diagnostic
+		for _, d := range params.Context.Diagnostics {
+			if d.Source == source {
+				diagnostics = append(diagnostics, d)
+			}
+		}
+		return diagnostics
+	}
+
+	actions := []CodeAction{}
+	if edits := s.format(doc, inRange); len(edits) > 0 {
+		actions = append(actions, CodeAction{
+			Title:       "Reformat PromQL expression",
+			Kind:        "quickfix",
+			Diagnostics: related(sourceFormat),
+			Edit:        &WorkspaceEdit{Changes: map[string][]TextEdit{uri: edits}},
+		})
+	}
+
+	if len(s.config.Defaults) > 0 {
+		fixed, changed := promql.FixRequiredLabelsIn(doc.text, s.config.Defaults, inRange)
+		if changed > 0 {
+			matchers := make([]string, len(s.config.Defaults))
+			for i, m := range s.config.Defaults {
+				matchers[i] = m.String()
+			}
+			actions = append(actions, CodeAction{
+				Title:       fmt.Sprintf("Add missing %s matchers", strings.Join(matchers, ", ")),
+				Kind:        "quickfix",
+				Diagnostics: related(sourceLabels),
+				Edit:        &WorkspaceEdit{Changes: map[string][]TextEdit{uri: lineEdit(doc.text, fixed)}},
+			})
+		}
+	}
+	return actions
+}
+
+func unmarshalParams(msg *message, v any) error {
+	if err := json.Unmarshal(msg.Params, v); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+const rulesURI = "file:///rules/alerts.yml"
+
+const rules = `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: sum(rate(http_requests_total{job="api",code=~"5.."}[5m])) by (job) / sum(rate(http_requests_total{job="api"}[5m])) by (job)
+        for: 5m
+      - record: instance:up:sum
+        expr: sum by (instance) (up)
+`
+
+// session runs a server over the given client messages and returns what it wrote
+func session(t *testing.T, config Config, messages ...any) []map[string]any {
+	t.Helper()
+
+	var in bytes.Buffer
+	for _, msg := range messages {
+		if err := writeMessage(&in, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := NewServer(config, nil).Run(&in, &out); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+
+	var replies []map[string]any
+	r := bufio.NewReader(&out)
+	for {
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+		if err != nil {
+			return replies
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatalf("malformed header %v", header)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+}
+
+func request(id int, method string, params any) map[string]any {
+	return map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notify(method string, params any) map[string]any {
+	return map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func open(uri, text string) map[string]any {
+	return notify("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{"uri": uri, "languageId": "yaml", "version": 1, "text": text},
+	})
+}
+
+// reply finds the response to a request
+func reply(t *testing.T, replies []map[string]any, id int) map[string]any {
+	t.Helper()
+	for _, r := range replies {
+		if r["id"] == float64(id) {
+			return r
+		}
+	}
+	t.Fatalf("no reply to request %d in %v", id, replies)
+	return nil
+}
+
+// diagnosticMessages returns the messages of the last diagnostics published for a document
+func diagnosticMessages(replies []map[string]any, uri string) map[float64][]string {
+	var messages map[float64][]string
+	for _, r := range replies {
+		if r["method"] != "textDocument/publishDiagnostics" {
+			continue
+		}
+		params := r["params"].(map[string]any)
+		if params["uri"] != uri {
+			continue
+		}
+		messages = make(map[float64][]string)
+		for _, d := range params["diagnostics"].([]any) {
+			d := d.(map[string]any)
+			line := d["range"].(map[string]any)["start"].(map[string]any)["line"].(float64)
+			messages[line] = append(messages[line], d["source"].(string)+": "+d["message"].(string))
+		}
+	}
+	return messages
+}
+
+func TestInitializeAndShutdown(t *testing.T) {
+	replies := session(t, Config{},
+		request(1, "initialize", map[string]any{"capabilities": map[string]any{}}),
+		notify("initialized", map[string]any{}),
+		request(2, "shutdown", nil),
+		notify("exit", nil),
+	)
+
+	caps := reply(t, replies, 1)["result"].(map[string]any)["capabilities"].(map[string]any)
+	for _, capability := range []string{"documentFormattingProvider", "hoverProvider", "codeActionProvider", "textDocumentSync"} {
+		if caps[capability] == nil {
+			t.Errorf("initialize result lacks %s", capability)
+		}
+	}
+
+	if r := reply(t, replies, 2); r["error"] != nil || r["result"] != nil {
+		t.Errorf("shutdown reply = %v, want a null result", r)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	var in, out bytes.Buffer
+	if err := writeMessage(&in, notify("exit", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(Config{}, nil).Run(&in, &out); err == nil {
+		t.Error("Run() succeeded after exit without shutdown")
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	replies := session(t, Config{}, request(1, "workspace/symbol", map[string]any{}))
+
+	err, _ := reply(t, replies, 1)["error"].(map[string]any)
+	if err == nil || err["code"] != float64(codeMethodNotFound) {
+		t.Errorf("reply error = %v, want method not found", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	replies := session(t, Config{Labels: []string{"job"}},
+		open(rulesURI, rules),
+		open("file:///rules/broken.yml", "groups:\n  - name: x\n    rules:\n      - record: r\n        expr: sum(rate(x[5m])\n"),
+		open("file:///ci.yml", "steps:\n  - run: make\n"),
+	)
+
+	messages := diagnosticMessages(replies, rulesURI)
+
+	// Zero-based line 4 holds the long alert expression
+	if !containsPrefix(messages[4], "promql-fmt: Redundant aggregation clause") {
+		t.Errorf("line 4 diagnostics = %v, want a redundant aggregation warning", messages[4])
+	}
+	if !containsPrefix(messages[4], "promql-fmt: Expression should use multiline formatting") {
+		t.Errorf("line 4 diagnostics = %v, want a multiline formatting warning", messages[4])
+	}
+	if !containsPrefix(messages[3], "promql-fmt: Alert 'HighErrorRate' has both a 'for: 5m' clause") {
+		t.Errorf("line 3 diagnostics = %v, want the hysteresis warning at the alert", messages[3])
+	}
+	if !containsPrefix(messages[7], "label-check: Missing required labels: job") {
+		t.Errorf("line 7 diagnostics = %v, want a missing label warning", messages[7])
+	}
+
+	broken := diagnosticMessages(replies, "file:///rules/broken.yml")
+	if !containsPrefix(broken[4], "promql: Invalid PromQL") {
+		t.Errorf("broken.yml diagnostics = %v, want a parse error on line 4", broken)
+	}
+
+	if ci := diagnosticMessages(replies, "file:///ci.yml"); ci == nil || len(ci) != 0 {
+		t.Errorf("ci.yml diagnostics = %v, want an empty list", ci)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	replies := session(t, Config{},
+		open(rulesURI, rules),
+		request(1, "textDocument/formatting", map[string]any{
+			"textDocument": map[string]any{"uri": rulesURI},
+			"options":      map[string]any{"tabSize": 2, "insertSpaces": true},
+		}),
+	)
+
+	edits := reply(t, replies, 1)["result"].([]any)
+	if len(edits) != 1 {
+		t.Fatalf("formatting edits = %v, want one", edits)
+	}
+	edit := edits[0].(map[string]any)
+	newText := edit["newText"].(string)
+	if !strings.HasPrefix(newText, "        expr: |\n") {
+		t.Errorf("formatted expression = %q, want a block scalar", newText)
+	}
+	start := edit["range"].(map[string]any)["start"].(map[string]any)
+	if start["line"] != float64(4) {
+		t.Errorf("edit starts at line %v, want 4", start["line"])
+	}
+}
+
+func TestCodeActions(t *testing.T) {
+	config := Config{
+		Labels:   []string{"job"},
+		Defaults: []*promql.LabelMatcher{{Name: "job", Op: promql.MatchEqual, Value: "node"}},
+	}
+	actionsAt := func(id, line int) map[string]any {
+		return request(id, "textDocument/codeAction", map[string]any{
+			"textDocument": map[string]any{"uri": rulesURI},
+			"range": map[string]any{
+				"start": map[string]any{"line": line, "character": 0},
+				"end":   map[string]any{"line": line, "character": 0},
+			},
+			"context": map[string]any{"diagnostics": []any{}},
+		})
+	}
+
+	replies := session(t, config, open(rulesURI, rules), actionsAt(1, 4), actionsAt(2, 7), actionsAt(3, 0))
+
+	titles := func(id int) []string {
+		var titles []string
+		for _, a := range reply(t, replies, id)["result"].([]any) {
+			titles = append(titles, a.(map[string]any)["title"].(string))
+		}
+		return titles
+	}
+
+	if got := titles(1); len(got) != 1 || got[0] != "Reformat PromQL expression" {
+		t.Errorf("actions on the alert expression = %v, want a reformat", got)
+	}
+	if got := titles(2); len(got) != 1 || got[0] != `Add missing job="node" matchers` {
+		t.Errorf("actions on the recording rule = %v, want the label fix", got)
+	}
+	if got := titles(3); len(got) != 0 {
+		t.Errorf("actions on the groups key = %v, want none", got)
+	}
+
+	action := reply(t, replies, 2)["result"].([]any)[0].(map[string]any)
+	edits := action["edit"].(map[string]any)["changes"].(map[string]any)[rulesURI].([]any)
+	if got := edits[0].(map[string]any)["newText"]; got != "        expr: sum by (instance) (up{job=\"node\"})\n" {
+		t.Errorf("label fix = %q", got)
+	}
+}
+
+func TestHover(t *testing.T) {
+	text := rules + "      - alert: InstanceDown\n        expr: instance:up:sum == 0\n"
+	hoverAt := func(id, line, character int) map[string]any {
+		return request(id, "textDocument/hover", map[string]any{
+			"textDocument": map[string]any{"uri": rulesURI},
+			"position":     map[string]any{"line": line, "character": character},
+		})
+	}
+
+	// Line 4 starts with `        expr: sum(rate(http_requests_total`
+	replies := session(t, Config{}, open(rulesURI, text), hoverAt(1, 4, 30), hoverAt(2, 9, 20), hoverAt(3, 4, 19), hoverAt(4, 5, 9))
+
+	value := func(id int) string {
+		result, _ := reply(t, replies, id)["result"].(map[string]any)
+		if result == nil {
+			return ""
+		}
+		return result["contents"].(map[string]any)["value"].(string)
+	}
+
+	if got := value(1); !strings.Contains(got, "**http_requests_total**") || !strings.Contains(got, "counter") {
+		t.Errorf("hover on http_requests_total = %q", got)
+	}
+	if got := value(2); !strings.Contains(got, "Recorded by the rule on line 8") || !strings.Contains(got, "sum by (instance) (up)") {
+		t.Errorf("hover on instance:up:sum = %q", got)
+	}
+	if got := value(3); !strings.Contains(got, "rate(matrix) vector") {
+		t.Errorf("hover on rate = %q", got)
+	}
+	if got := value(4); got != "" {
+		t.Errorf("hover on the for key = %q, want none", got)
+	}
+}
+
+func containsPrefix(items []string, prefix string) bool {
+	for _, item := range items {
+		if strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package lsp
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// document is the text of an open file, split into lines for position conversions
+type document struct {
+	text  string
+	lines []string
+}
+
+func newDocument(text string) *document {
+	return &document{text: text, lines: strings.Split(text, "\n")}
+}
+
+// line returns a zero-based line without its line terminator, or "" past the end
+func (d *document) line(n int) string {
+	if n < 0 || n >= len(d.lines) {
+		return ""
+	}
+	return strings.TrimSuffix(d.lines[n], "\r")
+}
+
+// lineRange spans the text of a 1-based line, from its first non-blank character to its
+// end. Line 0, used for issues that apply to a whole file, spans the first line.
+func (d *document) lineRange(line int) Range {
+	n := max(line-1, 0)
+	text := d.line(n)
+	indent := len(text) - len(strings.TrimLeft(text, " \t"))
+	return Range{
+		Start: Position{Line: n, Character: utf16Len(text[:indent])},
+		End:   Position{Line: n, Character: utf16Len(text)},
+	}
+}
+
+// byteOffset converts a UTF-16 character offset on a line to a byte offset
+func byteOffset(line string, character int) int {
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i
+		}
+		units += utf16RuneLen(r)
+	}
+	return len(line)
+}
+
+// utf16Len returns the length of s in UTF-16 code units, the unit LSP positions count in
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+func utf16RuneLen(r rune) int {
+	if r == utf8.RuneError || r < 0x10000 {
+		return 1
+	}
+	return 2
+}
+
+// lineEdit returns a single edit turning before into after, replacing only the lines that
+// differ, or nil if they are equal
+func lineEdit(before, after string) []TextEdit {
+	if before == after {
+		return nil
+	}
+	a, b := strings.SplitAfter(before, "\n"), strings.SplitAfter(after, "\n")
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	// Replace whole lines, from the start of the first differing line to the start of the
+	// first common trailing line
+	end := Position{Line: len(a) - suffix}
+	if suffix == 0 {
+		// The last line differs: end after its final character instead
+		last := len(a) - 1
+		end = Position{Line: last, Character: utf16Len(a[last])}
+	}
+	return []TextEdit{{
+		Range:   Range{Start: Position{Line: prefix}, End: end},
+		NewText: strings.Join(b[prefix:len(b)-suffix], ""),
+	}}
+}
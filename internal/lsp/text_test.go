@@ -0,0 +1,66 @@
+package lsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineEdit(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   string
+		after    string
+		expected []TextEdit
+	}{
+		{
+			name:     "unchanged",
+			before:   "a\nb\n",
+			after:    "a\nb\n",
+			expected: nil,
+		},
+		{
+			name:   "middle line replaced by two",
+			before: "a\nb\nc\n",
+			after:  "a\nb1\nb2\nc\n",
+			expected: []TextEdit{{
+				Range:   Range{Start: Position{Line: 1}, End: Position{Line: 2}},
+				NewText: "b1\nb2\n",
+			}},
+		},
+		{
+			name:   "last line without newline",
+			before: "a\nb",
+			after:  "a\nc",
+			expected: []TextEdit{{
+				Range:   Range{Start: Position{Line: 1}, End: Position{Line: 1, Character: 1}},
+				NewText: "c",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineEdit(tt.before, tt.after); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("lineEdit() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPositions(t *testing.T) {
+	// é is one UTF-16 unit but two bytes; 😀 is two UTF-16 units and four bytes
+	line := `x{a="é😀"} y`
+
+	if got := utf16Len(line); got != 12 {
+		t.Errorf("utf16Len() = %d, want 12", got)
+	}
+	if got := byteOffset(line, 11); line[got:] != "y" {
+		t.Errorf("byteOffset(11) = %d, want the offset of y", got)
+	}
+
+	doc := newDocument("groups:\n    - name: é\n")
+	expected := Range{Start: Position{Line: 1, Character: 4}, End: Position{Line: 1, Character: 13}}
+	if got := doc.lineRange(2); got != expected {
+		t.Errorf("lineRange(2) = %+v, want %+v", got, expected)
+	}
+}
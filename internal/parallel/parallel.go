@@ -0,0 +1,42 @@
+// Package parallel runs independent work items concurrently while keeping results in order.
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultJobs is the number of workers used when none is specified: one per CPU
+func DefaultJobs() int {
+	return runtime.NumCPU()
+}
+
+// Map calls fn on each item using up to jobs goroutines and returns the results in the order
+// of items, however the calls interleave. A jobs value below 1 uses DefaultJobs.
+func Map[T, R any](items []T, jobs int, fn func(T) R) []R {
+	if jobs < 1 {
+		jobs = DefaultJobs()
+	}
+
+	results := make([]R, len(items))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(jobs, len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = fn(items[i])
+			}
+		}()
+	}
+
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,57 @@
+package parallel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		items int
+		jobs  int
+	}{
+		{"sequential", 10, 1},
+		{"more items than jobs", 50, 4},
+		{"more jobs than items", 3, 8},
+		{"default jobs", 20, 0},
+		{"no items", 0, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]int, tt.items)
+			for i := range items {
+				items[i] = i
+			}
+
+			var running, peak atomic.Int32
+			results := Map(items, tt.jobs, func(i int) int {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				// Finish later items first so results arrive out of order
+				time.Sleep(time.Duration(tt.items-i) * 100 * time.Microsecond)
+				running.Add(-1)
+				return i * i
+			})
+
+			if len(results) != tt.items {
+				t.Fatalf("got %d results, want %d", len(results), tt.items)
+			}
+			for i, r := range results {
+				if r != i*i {
+					t.Errorf("results[%d] = %d, want %d", i, r, i*i)
+				}
+			}
+			if tt.jobs > 0 && int(peak.Load()) > tt.jobs {
+				t.Errorf("%d calls ran at once, want at most %d", peak.Load(), tt.jobs)
+			}
+		})
+	}
+}
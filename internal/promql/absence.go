@@ -0,0 +1,298 @@
+package promql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AbsenceViolation is an alert selector that no absent() alert in the same file covers. Such
+// an alert silently stops working when the series it selects disappear, e.g. because the job
+// exporting them is down.
+type AbsenceViolation struct {
+	AlertName string
+	// Selector is the selector as written in the alert expression
+	Selector string
+	// Absent is the selector an absence alert should check, keeping the equality matchers
+	Absent string
+	Line   int
+}
+
+// defaultAbsenceFor is the for clause of generated absence alerts when the alert they cover
+// has none, so that a single missed scrape does not page
+const defaultAbsenceFor = "5m"
+
+// absenceGap is an uncovered alert selector with the rule nodes needed to generate its
+// absence alert
+type absenceGap struct {
+	AbsenceViolation
+	rule  *yaml.Node
+	rules *yaml.Node
+}
+
+// CheckAbsence finds the selectors of alerting rules that are not covered by an absent() or
+// absent_over_time() call in any alert of the rule file. An absence check covers a selector
+// of the same metric, or of up, whose matchers are all among the selector's matchers.
+func CheckAbsence(content string) []AbsenceViolation {
+	var violations []AbsenceViolation
+	for _, gap := range absenceGaps(content) {
+		violations = append(violations, gap.AbsenceViolation)
+	}
+	return violations
+}
+
+// absenceGaps returns the uncovered alert selectors of a rule file in file order
+func absenceGaps(content string) []absenceGap {
+	type alertRule struct {
+		name  string
+		rule  *yaml.Node
+		rules *yaml.Node
+		expr  Expr
+	}
+
+	var alerts []alertRule
+	var covering []*VectorSelector
+	for _, doc := range yamlDocuments([]byte(content)) {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				name := scalarValue(mappingValue(rule, "alert"))
+				if name == "" {
+					continue
+				}
+				expr, err := ParseExpr(scalarValue(mappingValue(rule, "expr")))
+				if err != nil {
+					continue
+				}
+				alerts = append(alerts, alertRule{name: name, rule: rule, rules: rules, expr: expr})
+
+				Inspect(expr, func(e Expr, _ []Expr) bool {
+					if call, ok := e.(*Call); ok && isAbsenceFunc(call.Func) {
+						covering = append(covering, VectorSelectors(call)...)
+						return false
+					}
+					return true
+				})
+			}
+		}
+	}
+
+	var gaps []absenceGap
+	for _, alert := range alerts {
+		seen := make(map[string]bool)
+		Inspect(alert.expr, func(e Expr, _ []Expr) bool {
+			switch e := e.(type) {
+			case *Call:
+				return !isAbsenceFunc(e.Func)
+			case *VectorSelector:
+				name := e.MetricName()
+				if name == "" || strings.HasPrefix(name, "ALERTS") || coversSelector(covering, e) {
+					return true
+				}
+				absent := absenceSelector(e)
+				if seen[absent.String()] {
+					return true
+				}
+				seen[absent.String()] = true
+				gaps = append(gaps, absenceGap{
+					AbsenceViolation: AbsenceViolation{
+						AlertName: alert.name,
+						Selector:  e.String(),
+						Absent:    absent.String(),
+						Line:      alert.rule.Line,
+					},
+					rule:  alert.rule,
+					rules: alert.rules,
+				})
+			}
+			return true
+		})
+	}
+	return gaps
+}
+
+func isAbsenceFunc(name string) bool {
+	return name == "absent" || name == "absent_over_time"
+}
+
+// coversSelector reports whether any absence check covers a selector
+func coversSelector(covering []*VectorSelector, vs *VectorSelector) bool {
+	for _, c := range covering {
+		if c.MetricName() != vs.MetricName() && c.MetricName() != "up" {
+			continue
+		}
+		covered := true
+		for _, m := range c.Matchers {
+			if m.Name != "__name__" && !hasMatcher(vs.Matchers, m) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMatcher(matchers []*LabelMatcher, m *LabelMatcher) bool {
+	for _, other := range matchers {
+		if *other == *m {
+			return true
+		}
+	}
+	return false
+}
+
+// absenceSelector returns the selector an absence alert for vs checks: the metric with only
+// its equality matchers, as absent() only copies those to its output, and without modifiers
+func absenceSelector(vs *VectorSelector) *VectorSelector {
+	absent := &VectorSelector{Name: vs.MetricName()}
+	for _, m := range vs.Matchers {
+		if m.Op == MatchEqual && m.Name != "__name__" {
+			absent.Matchers = append(absent.Matchers, m)
+		}
+	}
+	return absent
+}
+
+// AddAbsenceAlerts appends an absent() alert for each uncovered alert selector to the group
+// holding the alert, copying the alert's labels so the absence alert is routed alike. Only
+// alerts starting at a 1-based line only accepts are covered; a nil only covers every alert.
+// Alerts in flow sequences such as rules: [{alert: A, expr: ...}] are left uncovered, as new
+// rules cannot be appended to them without rewriting the list. The rest of the file is
+// preserved byte for byte. It returns the new content and the number of alerts added.
+func AddAbsenceAlerts(content string, only func(line int) bool) (string, int) {
+	gaps := absenceGaps(content)
+
+	names := make(map[string]bool)
+	for _, doc := range yamlDocuments([]byte(content)) {
+		if groups := ruleGroups(doc); groups != nil {
+			for _, group := range groups.Content {
+				if rules := mappingValue(group, "rules"); rules != nil {
+					for _, rule := range rules.Content {
+						names[scalarValue(mappingValue(rule, "alert"))] = true
+					}
+				}
+			}
+		}
+	}
+
+	// Group the new alerts by the rule list they are appended to, one per absence selector
+	type insertion struct {
+		after  int
+		indent *yaml.Node
+		text   strings.Builder
+	}
+	var insertions []*insertion
+	byRules := make(map[*yaml.Node]*insertion)
+	covered := make(map[string][]string)
+	var order []absenceGap
+	lines := strings.Split(content, "\n")
+	for _, gap := range gaps {
+		if (only != nil && !only(gap.Line)) || !blockRuleList(gap.rules, lines) {
+			continue
+		}
+		if _, ok := covered[gap.Absent]; !ok {
+			order = append(order, gap)
+		}
+		covered[gap.Absent] = append(covered[gap.Absent], gap.AlertName)
+	}
+
+	for _, gap := range order {
+		ins := byRules[gap.rules]
+		if ins == nil {
+			ins = &insertion{after: lastLine(gap.rules), indent: gap.rules.Content[0]}
+			byRules[gap.rules] = ins
+			insertions = append(insertions, ins)
+		}
+
+		name := absenceAlertName(gap.Absent, names)
+		names[name] = true
+		writeAbsenceAlert(&ins.text, lines, ins.indent, name, gap, covered[gap.Absent])
+	}
+
+	sort.Slice(insertions, func(i, j int) bool { return insertions[i].after > insertions[j].after })
+	for _, ins := range insertions {
+		text := strings.TrimSuffix(ins.text.String(), "\n")
+		lines = append(lines[:ins.after], append([]string{text}, lines[ins.after:]...)...)
+	}
+	return strings.Join(lines, "\n"), len(order)
+}
+
+// blockRuleList reports whether rules is a block sequence whose first rule starts on the line
+// of its dash, so that new rules can be written indented like it
+func blockRuleList(rules *yaml.Node, lines []string) bool {
+	if rules.Style&yaml.FlowStyle != 0 || len(rules.Content) == 0 {
+		return false
+	}
+	first := rules.Content[0]
+	if first.Kind != yaml.MappingNode || first.Style&yaml.FlowStyle != 0 || first.Line > len(lines) {
+		return false
+	}
+	line := lines[first.Line-1]
+	return first.Column-1 <= len(line) && strings.TrimSpace(line[:first.Column-1]) == "-"
+}
+
+// absenceAlertName derives an unused alert name from the metric an absence selector checks,
+// e.g. ErrorsTotalAbsent for errors_total
+func absenceAlertName(absent string, taken map[string]bool) string {
+	metric, _, _ := strings.Cut(absent, "{")
+	var sb strings.Builder
+	for _, word := range strings.FieldsFunc(metric, func(r rune) bool { return r == '_' || r == ':' }) {
+		sb.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	base := sb.String() + "Absent"
+
+	name := base
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return name
+}
+
+// writeAbsenceAlert writes an absence alert as a rule list item, indented like the first rule
+// of the list
+func writeAbsenceAlert(sb *strings.Builder, lines []string, first *yaml.Node, name string, gap absenceGap, alerts []string) {
+	line := lines[first.Line-1]
+	keyIndent := first.Column - 1
+	dash := strings.LastIndex(line[:keyIndent], "-")
+	item := strings.Repeat(" ", dash) + "-" + strings.Repeat(" ", keyIndent-dash-1)
+	key := strings.Repeat(" ", keyIndent)
+
+	forValue := scalarValue(mappingValue(gap.rule, "for"))
+	if forValue == "" {
+		forValue = defaultAbsenceFor
+	}
+
+	fmt.Fprintf(sb, "%salert: %s\n", item, name)
+	fmt.Fprintf(sb, "%sexpr: %s\n", key, yamlScalar("absent("+gap.Absent+")"))
+	fmt.Fprintf(sb, "%sfor: %s\n", key, yamlScalar(forValue))
+	if labels := mappingValue(gap.rule, "labels"); labels != nil && labels.Kind == yaml.MappingNode && len(labels.Content) > 0 {
+		fmt.Fprintf(sb, "%slabels:\n", key)
+		for i := 0; i+1 < len(labels.Content); i += 2 {
+			fmt.Fprintf(sb, "%s  %s: %s\n", key, yamlScalar(labels.Content[i].Value), yamlScalar(labels.Content[i+1].Value))
+		}
+	}
+	fmt.Fprintf(sb, "%sannotations:\n", key)
+	fmt.Fprintf(sb, "%s  summary: %s\n", key, yamlScalar("No data for "+gap.Absent))
+	fmt.Fprintf(sb, "%s  description: %s\n", key, yamlScalar(strings.Join(alerts, ", ")+" cannot fire while "+gap.Absent+" is absent"))
+}
+
+// yamlScalar encodes a string as a YAML scalar, quoting it only when needed
+func yamlScalar(s string) string {
+	out, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("%q", s)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
@@ -0,0 +1,178 @@
+package promql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckAbsence(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []AbsenceViolation
+	}{
+		{
+			name: "uncovered alert",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api",code=~"5.."}[5m]) > 0.1
+`,
+			expected: []AbsenceViolation{{
+				AlertName: "HighErrorRate",
+				Selector:  `errors_total{job="api",code=~"5.."}`,
+				Absent:    `errors_total{job="api"}`,
+				Line:      4,
+			}},
+		},
+		{
+			name: "covered by an absence alert on the metric",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api",code=~"5.."}[5m]) > 0.1
+  - name: absence
+    rules:
+      - alert: ErrorsAbsent
+        expr: absent_over_time(errors_total{job="api"}[10m])
+`,
+		},
+		{
+			name: "covered by an absence alert on up",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: HighLatency
+        expr: histogram_quantile(0.99, sum by (le) (rate(latency_seconds_bucket{job="api"}[5m]))) > 1
+      - alert: ApiDown
+        expr: absent(up{job="api"})
+`,
+		},
+		{
+			name: "absence check with narrower matchers does not cover",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api"}[5m]) > 0.1
+      - alert: ErrorsAbsent
+        expr: absent(errors_total{job="api",instance="a:80"})
+`,
+			expected: []AbsenceViolation{{
+				AlertName: "HighErrorRate",
+				Selector:  `errors_total{job="api"}`,
+				Absent:    `errors_total{job="api"}`,
+				Line:      4,
+			}},
+		},
+		{
+			name: "alert guarding itself with or absent",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: NoRequests
+        expr: rate(requests_total{job="api"}[5m]) == 0 or absent(requests_total{job="api"})
+`,
+		},
+		{
+			name: "recording rules and ALERTS are ignored",
+			content: `groups:
+  - name: api
+    rules:
+      - record: job:errors:rate5m
+        expr: rate(errors_total[5m])
+      - alert: TooManyAlerts
+        expr: count(ALERTS{alertstate="firing"}) > 10
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckAbsence(tt.content); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("CheckAbsence() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddAbsenceAlerts(t *testing.T) {
+	content := `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api"}[5m]) > 0.1
+        for: 10m
+        labels:
+          severity: page
+          team: "api: core"
+      - alert: ErrorSpike
+        expr: deriv(errors_total{job="api"}[5m]) > 1
+  - name: node
+    rules:
+    - alert: DiskFull
+      expr: |
+        node_filesystem_avail_bytes{job="node"} < 1e9
+    - alert: ErrorsTotalAbsent
+      expr: vector(1) == 0
+`
+	expected := `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api"}[5m]) > 0.1
+        for: 10m
+        labels:
+          severity: page
+          team: "api: core"
+      - alert: ErrorSpike
+        expr: deriv(errors_total{job="api"}[5m]) > 1
+      - alert: ErrorsTotalAbsent2
+        expr: absent(errors_total{job="api"})
+        for: 10m
+        labels:
+          severity: page
+          team: 'api: core'
+        annotations:
+          summary: No data for errors_total{job="api"}
+          description: HighErrorRate, ErrorSpike cannot fire while errors_total{job="api"} is absent
+  - name: node
+    rules:
+    - alert: DiskFull
+      expr: |
+        node_filesystem_avail_bytes{job="node"} < 1e9
+    - alert: ErrorsTotalAbsent
+      expr: vector(1) == 0
+`
+
+	got, added := AddAbsenceAlerts(content, func(line int) bool { return line < 12 })
+	if added != 1 {
+		t.Errorf("AddAbsenceAlerts() added %d alerts, want 1", added)
+	}
+	if got != expected {
+		t.Errorf("AddAbsenceAlerts() =\n%s\nwant\n%s", got, expected)
+	}
+
+	if again, added := AddAbsenceAlerts(got, func(line int) bool { return line < 12 }); added != 0 || again != got {
+		t.Errorf("AddAbsenceAlerts() on its own output added %d alerts", added)
+	}
+}
+
+func TestAddAbsenceAlertsFlowStyle(t *testing.T) {
+	// Rules in flow sequences, or starting on the line after their dash, cannot be appended
+	// to without rewriting the list, so their gaps are only reported
+	for _, content := range []string{
+		"groups:\n  - name: api\n    rules: [{alert: A, expr: 'errors_total{job=\"api\"} > 0'}]\n",
+		"groups:\n  - name: api\n    rules:\n      - {alert: A, expr: 'errors_total{job=\"api\"} > 0'}\n",
+		"groups:\n  - name: api\n    rules:\n      -\n        alert: A\n        expr: errors_total{job=\"api\"} > 0\n",
+	} {
+		if len(CheckAbsence(content)) != 1 {
+			t.Errorf("CheckAbsence() did not report the gap in:\n%s", content)
+		}
+		if got, added := AddAbsenceAlerts(content, nil); added != 0 || got != content {
+			t.Errorf("AddAbsenceAlerts() added %d alerts to:\n%s\ngot:\n%s", added, content, got)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnnotationViolation represents a problem with an alert's annotations
+type AnnotationViolation struct {
+	AlertName  string
+	Annotation string
+	Message    string
+	Line       int
+}
+
+// templatePreamble mirrors the variables Prometheus defines before expanding alert templates
+const templatePreamble = "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+
+// templateFunctions stubs the functions Prometheus makes available to alert templates.
+// Only parsing is needed, so the implementations are never called.
+var templateFunctions = func() template.FuncMap {
+	stub := func(...interface{}) interface{} { return nil }
+	funcs := template.FuncMap{}
+	for _, name := range []string{
+		"args", "externalURL", "first", "graphLink", "humanize", "humanize1024",
+		"humanizeDuration", "humanizePercentage", "humanizeTimestamp", "label", "match",
+		"parseDuration", "pathPrefix", "query", "reReplaceAll", "safeHtml", "sortByLabel",
+		"stripDomain", "stripPort", "strvalue", "tableLink", "title", "toDuration", "toLower",
+		"toTime", "toUpper", "urlUnescape", "value",
+	} {
+		funcs[name] = stub
+	}
+	return funcs
+}()
+
+// CheckAnnotations checks alerting rules for required annotations, valid template syntax,
+// and $labels references to labels the alert expression can never produce
+func CheckAnnotations(content string, requiredAnnotations []string) []AnnotationViolation {
+	var violations []AnnotationViolation
+
+	for _, doc := range yamlDocuments([]byte(content)) {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				alert := mappingValue(rule, "alert")
+				if alert == nil {
+					continue
+				}
+				violations = append(violations, checkRuleAnnotations(rule, alert, requiredAnnotations)...)
+			}
+		}
+	}
+
+	return violations
+}
+
+// checkRuleAnnotations checks the annotations of a single alerting rule
+func checkRuleAnnotations(rule, alert *yaml.Node, requiredAnnotations []string) []AnnotationViolation {
+	var violations []AnnotationViolation
+
+	annotations := mappingValue(rule, "annotations")
+	present := make(map[string]bool)
+	if annotations != nil && annotations.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(annotations.Content); i += 2 {
+			present[annotations.Content[i].Value] = true
+		}
+	}
+
+	var missing []string
+	for _, required := range requiredAnnotations {
+		if !present[required] {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 {
+		violations = append(violations, AnnotationViolation{
+			AlertName: alert.Value,
+			Message:   fmt.Sprintf("Missing required annotations: %s", strings.Join(missing, ", ")),
+			Line:      alert.Line,
+		})
+	}
+
+	if annotations == nil || annotations.Kind != yaml.MappingNode {
+		return violations
+	}
+
+	// Label references can only be verified when the expression parses
+	var parsed Expr
+	if expr := mappingValue(rule, "expr"); expr != nil {
+		parsed, _ = ParseExpr(expr.Value)
+	}
+
+	for i := 0; i+1 < len(annotations.Content); i += 2 {
+		name := annotations.Content[i].Value
+		value := annotations.Content[i+1]
+
+		refs, err := templateLabelRefs(name, value.Value)
+		if err != nil {
+			violations = append(violations, AnnotationViolation{
+				AlertName:  alert.Value,
+				Annotation: name,
+				Message:    fmt.Sprintf("Invalid template in annotation '%s': %v", name, err),
+				Line:       value.Line,
+			})
+			continue
+		}
+
+		if parsed == nil || len(refs) == 0 {
+			continue
+		}
+		for _, label := range OutputLabelsMissing(parsed, refs) {
+			violations = append(violations, AnnotationViolation{
+				AlertName:  alert.Value,
+				Annotation: name,
+				Message:    fmt.Sprintf("Annotation '%s' references $labels.%s, which is not present on the series produced by the expression", name, label),
+				Line:       value.Line,
+			})
+		}
+	}
+
+	return violations
+}
+
+// templateLabelRefs parses an annotation template and returns the label names it reads from $labels
+func templateLabelRefs(name, text string) ([]string, error) {
+	tmpl, err := template.New(name).Funcs(templateFunctions).Option("missingkey=zero").Parse(templatePreamble + text)
+	if err != nil {
+		// Strip the template name prefix Go adds, as the annotation is reported separately
+		return nil, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	seen := make(map[string]bool)
+	var refs []string
+	add := func(label string) {
+		if !seen[label] {
+			seen[label] = true
+			refs = append(refs, label)
+		}
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkTemplate(t.Tree.Root, func(node parse.Node) {
+			switch n := node.(type) {
+			case *parse.VariableNode:
+				// {{ $labels.instance }}
+				if len(n.Ident) >= 2 && n.Ident[0] == "$labels" {
+					add(n.Ident[1])
+				}
+			case *parse.FieldNode:
+				// {{ .Labels.instance }}
+				if len(n.Ident) >= 2 && n.Ident[0] == "Labels" {
+					add(n.Ident[1])
+				}
+			case *parse.CommandNode:
+				// {{ index $labels "instance" }}
+				if len(n.Args) == 3 {
+					fn, ok1 := n.Args[0].(*parse.IdentifierNode)
+					v, ok2 := n.Args[1].(*parse.VariableNode)
+					s, ok3 := n.Args[2].(*parse.StringNode)
+					if ok1 && ok2 && ok3 && fn.Ident == "index" && len(v.Ident) == 1 && v.Ident[0] == "$labels" {
+						add(s.Text)
+					}
+				}
+			}
+		})
+	}
+
+	return refs, nil
+}
+
+// walkTemplate calls f for every node in a template parse tree
+func walkTemplate(node parse.Node, f func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	f(node)
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplate(child, f)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, f)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkTemplate(cmd, f)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplate(arg, f)
+		}
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, f)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, f)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, f)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, f)
+	}
+}
+
+func walkBranch(n *parse.BranchNode, f func(parse.Node)) {
+	walkTemplate(n.Pipe, f)
+	walkTemplate(n.List, f)
+	if n.ElseList != nil {
+		walkTemplate(n.ElseList, f)
+	}
+}
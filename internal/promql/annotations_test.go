@@ -0,0 +1,162 @@
+package promql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateLabelRefs(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		expectRefs []string
+		expectErr  bool
+	}{
+		{
+			name:       "plain text",
+			template:   "High error rate",
+			expectRefs: nil,
+		},
+		{
+			name:       "labels variable",
+			template:   "{{ $labels.instance }} of {{ $labels.job }} is down",
+			expectRefs: []string{"instance", "job"},
+		},
+		{
+			name:       "labels field and index",
+			template:   `{{ .Labels.pod }} {{ index $labels "namespace" }}`,
+			expectRefs: []string{"pod", "namespace"},
+		},
+		{
+			name:       "prometheus template functions",
+			template:   `{{ $value | humanizePercentage }} on {{ $labels.instance | stripPort }} since {{ humanizeDuration 60 }}`,
+			expectRefs: []string{"instance"},
+		},
+		{
+			name:       "references inside control structures",
+			template:   `{{ if gt $value 1.0 }}{{ $labels.cluster }}{{ else }}{{ $labels.region }}{{ end }}`,
+			expectRefs: []string{"cluster", "region"},
+		},
+		{
+			name:       "query and range",
+			template:   `{{ range query "up" }}{{ .Labels.instance }}{{ end }}`,
+			expectRefs: []string{"instance"},
+		},
+		{
+			name:      "unclosed action",
+			template:  "{{ $labels.instance",
+			expectErr: true,
+		},
+		{
+			name:      "unknown function",
+			template:  "{{ humanise $value }}",
+			expectErr: true,
+		},
+		{
+			name:      "undefined variable",
+			template:  "{{ $label.instance }}",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs, err := templateLabelRefs("summary", tt.template)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("templateLabelRefs(%q) error = %v, expectErr %v", tt.template, err, tt.expectErr)
+			}
+			if !reflect.DeepEqual(refs, tt.expectRefs) {
+				t.Errorf("templateLabelRefs(%q) = %v, want %v", tt.template, refs, tt.expectRefs)
+			}
+		})
+	}
+}
+
+func TestCheckAnnotations(t *testing.T) {
+	content := `
+groups:
+  - name: test
+    rules:
+      - alert: Good
+        expr: sum by (job, instance) (rate(errors_total[5m])) > 1
+        annotations:
+          summary: "Errors on {{ $labels.instance }}"
+          description: "{{ $value | humanize }} errors/s for {{ $labels.job }}"
+      - alert: MissingDescription
+        expr: up == 0
+        annotations:
+          summary: "{{ $labels.instance }} is down"
+      - alert: DroppedLabel
+        expr: sum by (job) (rate(errors_total[5m])) > 1
+        annotations:
+          summary: "Errors on {{ $labels.instance }}"
+          description: "Errors for {{ $labels.job }}"
+      - alert: BadTemplate
+        expr: up == 0
+        annotations:
+          summary: "{{ $labels.instance"
+          description: "down"
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total[5m]))
+`
+
+	violations := CheckAnnotations(content, []string{"summary", "description"})
+	if len(violations) != 3 {
+		t.Fatalf("Expected 3 violations, got %d: %+v", len(violations), violations)
+	}
+
+	expected := []struct {
+		alertName  string
+		annotation string
+		contains   string
+		line       int
+	}{
+		{"MissingDescription", "", "Missing required annotations: description", 10},
+		{"DroppedLabel", "summary", "$labels.instance", 17},
+		{"BadTemplate", "summary", "Invalid template", 22},
+	}
+	for i, e := range expected {
+		v := violations[i]
+		if v.AlertName != e.alertName || v.Annotation != e.annotation || !strings.Contains(v.Message, e.contains) || v.Line != e.line {
+			t.Errorf("Violation %d = %+v, want alert %q annotation %q containing %q on line %d",
+				i, v, e.alertName, e.annotation, e.contains, e.line)
+		}
+	}
+}
+
+func TestCheckAnnotationsPrometheusRule(t *testing.T) {
+	content := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+spec:
+  groups:
+    - name: test
+      rules:
+        - alert: MissingDescription
+          expr: up == 0
+          annotations:
+            summary: "{{ $labels.instance }} is down"
+---
+groups:
+  - name: second
+    rules:
+      - alert: DroppedLabel
+        expr: sum by (job) (rate(errors_total[5m])) > 1
+        annotations:
+          summary: "Errors on {{ $labels.instance }}"
+          description: "Errors for {{ $labels.job }}"
+`
+
+	violations := CheckAnnotations(content, []string{"summary", "description"})
+	if len(violations) != 2 {
+		t.Fatalf("Expected 2 violations, got %d: %+v", len(violations), violations)
+	}
+	if violations[0].AlertName != "MissingDescription" || violations[0].Line != 9 {
+		t.Errorf("Violation 0 = %+v, want alert MissingDescription on line 9", violations[0])
+	}
+	if violations[1].AlertName != "DroppedLabel" || violations[1].Annotation != "summary" || violations[1].Line != 20 {
+		t.Errorf("Violation 1 = %+v, want alert DroppedLabel annotation summary on line 20", violations[1])
+	}
+}
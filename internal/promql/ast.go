@@ -0,0 +1,477 @@
+package promql
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValueType is the type a PromQL expression evaluates to
+type ValueType string
+
+// PromQL value types
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// Expr is a node in a parsed PromQL expression tree
+type Expr interface {
+	// String returns the canonical single-line form of the expression
+	String() string
+	// Type returns the type the expression evaluates to
+	Type() ValueType
+}
+
+// PosRange is a byte range within the original expression text
+type PosRange struct {
+	Start int
+	End   int
+}
+
+// MatchOp is a label matching operator
+type MatchOp string
+
+// Label matching operators
+const (
+	MatchEqual     MatchOp = "="
+	MatchNotEqual  MatchOp = "!="
+	MatchRegexp    MatchOp = "=~"
+	MatchNotRegexp MatchOp = "!~"
+)
+
+// LabelMatcher is a single label matcher within a vector selector
+type LabelMatcher struct {
+	Name  string
+	Op    MatchOp
+	Value string
+}
+
+func (m *LabelMatcher) String() string {
+	return m.Name + string(m.Op) + strconv.Quote(m.Value)
+}
+
+// VectorMatchCardinality describes how series on each side of a binary operation are matched
+type VectorMatchCardinality int
+
+// Vector matching cardinalities
+const (
+	CardOneToOne VectorMatchCardinality = iota
+	CardManyToOne
+	CardOneToMany
+	CardManyToMany
+)
+
+// VectorMatching holds the on/ignoring and group_left/group_right modifiers of a binary operation
+type VectorMatching struct {
+	Card    VectorMatchCardinality
+	On      bool
+	Labels  []string
+	Include []string
+}
+
+// NumberLiteral is a numeric constant such as 0.5 or 1e3
+type NumberLiteral struct {
+	Val float64
+	// Raw is the literal as written in the source, preserved for printing
+	Raw string
+}
+
+// StringLiteral is a quoted string constant
+type StringLiteral struct {
+	Val string
+}
+
+// VectorSelector selects series by metric name and label matchers
+type VectorSelector struct {
+	Name     string
+	Matchers []*LabelMatcher
+	Offset   time.Duration
+	// At holds the @ modifier: a Unix timestamp, "start()" or "end()"
+	At  string
+	Pos PosRange
+}
+
+// MatrixSelector selects a range of samples for each series of a vector selector
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          time.Duration
+}
+
+// SubqueryExpr evaluates an instant expression over a range at a given resolution
+type SubqueryExpr struct {
+	Expr   Expr
+	Range  time.Duration
+	Step   time.Duration
+	Offset time.Duration
+	At     string
+}
+
+// Call is a function call such as rate(x[5m])
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// AggregateExpr is an aggregation such as sum by (job) (x)
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+	// Grouped is true when a by or without clause was written, even if empty
+	Grouped bool
+	// Postfix is true when the clause was written after the arguments: sum(x) by (job)
+	Postfix bool
+}
+
+// BinaryExpr is a binary operation between two expressions
+type BinaryExpr struct {
+	Op         string
+	LHS        Expr
+	RHS        Expr
+	ReturnBool bool
+	// Matching is nil when no on/ignoring/group modifier was written
+	Matching *VectorMatching
+}
+
+// ParenExpr is a parenthesized expression
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr is a unary minus or plus applied to an expression
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// Type implementations
+
+// Type returns ValueTypeScalar
+func (*NumberLiteral) Type() ValueType { return ValueTypeScalar }
+
+// Type returns ValueTypeString
+func (*StringLiteral) Type() ValueType { return ValueTypeString }
+
+// Type returns ValueTypeVector
+func (*VectorSelector) Type() ValueType { return ValueTypeVector }
+
+// Type returns ValueTypeMatrix
+func (*MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+
+// Type returns ValueTypeMatrix
+func (*SubqueryExpr) Type() ValueType { return ValueTypeMatrix }
+
+// Type returns ValueTypeVector
+func (*AggregateExpr) Type() ValueType { return ValueTypeVector }
+
+// Type returns the return type of the called function
+func (c *Call) Type() ValueType {
+	if fn, ok := Functions[c.Func]; ok {
+		return fn.ReturnType
+	}
+	return ValueTypeVector
+}
+
+// Type returns ValueTypeScalar if both operands are scalars, otherwise ValueTypeVector
+func (b *BinaryExpr) Type() ValueType {
+	if b.LHS.Type() == ValueTypeScalar && b.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+// Type returns the type of the inner expression
+func (p *ParenExpr) Type() ValueType { return p.Expr.Type() }
+
+// Type returns the type of the inner expression
+func (u *UnaryExpr) Type() ValueType { return u.Expr.Type() }
+
+// String implementations
+
+func (n *NumberLiteral) String() string {
+	if n.Raw != "" {
+		return n.Raw
+	}
+	switch {
+	case math.IsInf(n.Val, 1):
+		return "+Inf"
+	case math.IsInf(n.Val, -1):
+		return "-Inf"
+	case math.IsNaN(n.Val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(n.Val, 'f', -1, 64)
+}
+
+func (s *StringLiteral) String() string {
+	return strconv.Quote(s.Val)
+}
+
+func (vs *VectorSelector) String() string {
+	return vs.selectorString() + ModifierString(vs.Offset, vs.At)
+}
+
+// selectorString returns the selector without its offset and @ modifiers
+func (vs *VectorSelector) selectorString() string {
+	if len(vs.Matchers) == 0 {
+		if vs.Name == "" {
+			return "{}"
+		}
+		return vs.Name
+	}
+	matchers := make([]string, len(vs.Matchers))
+	for i, m := range vs.Matchers {
+		matchers[i] = m.String()
+	}
+	return vs.Name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// MetricName returns the metric name selected, either from the name or a __name__ equality matcher
+func (vs *VectorSelector) MetricName() string {
+	if vs.Name != "" {
+		return vs.Name
+	}
+	for _, m := range vs.Matchers {
+		if m.Name == "__name__" && m.Op == MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+func (ms *MatrixSelector) String() string {
+	vs := ms.VectorSelector
+	return vs.selectorString() + "[" + FormatDuration(ms.Range) + "]" + ModifierString(vs.Offset, vs.At)
+}
+
+func (sq *SubqueryExpr) String() string {
+	step := ""
+	if sq.Step != 0 {
+		step = FormatDuration(sq.Step)
+	}
+	return sq.Expr.String() + "[" + FormatDuration(sq.Range) + ":" + step + "]" + ModifierString(sq.Offset, sq.At)
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.String()
+	}
+	return c.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (a *AggregateExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(a.Op)
+	if a.Grouped {
+		sb.WriteString(" " + a.GroupingString() + " ")
+	}
+	sb.WriteString("(")
+	if a.Param != nil {
+		sb.WriteString(a.Param.String() + ", ")
+	}
+	sb.WriteString(a.Expr.String())
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// GroupingString returns the by/without clause, e.g. "by (job, instance)"
+func (a *AggregateExpr) GroupingString() string {
+	keyword := "by"
+	if a.Without {
+		keyword = "without"
+	}
+	return keyword + " (" + strings.Join(a.Grouping, ", ") + ")"
+}
+
+func (b *BinaryExpr) String() string {
+	return b.LHS.String() + " " + b.OperatorString() + " " + b.RHS.String()
+}
+
+// OperatorString returns the operator together with its bool and vector matching modifiers
+func (b *BinaryExpr) OperatorString() string {
+	var sb strings.Builder
+	sb.WriteString(b.Op)
+	if b.ReturnBool {
+		sb.WriteString(" bool")
+	}
+	if m := b.Matching; m != nil {
+		if m.On {
+			sb.WriteString(" on (" + strings.Join(m.Labels, ", ") + ")")
+		} else if len(m.Labels) > 0 || m.Card == CardManyToOne || m.Card == CardOneToMany {
+			// group_left and group_right need an on or ignoring clause, even an empty one
+			sb.WriteString(" ignoring (" + strings.Join(m.Labels, ", ") + ")")
+		}
+		switch m.Card {
+		case CardManyToOne:
+			sb.WriteString(" group_left")
+		case CardOneToMany:
+			sb.WriteString(" group_right")
+		}
+		if len(m.Include) > 0 {
+			sb.WriteString(" (" + strings.Join(m.Include, ", ") + ")")
+		}
+	}
+	return sb.String()
+}
+
+func (p *ParenExpr) String() string {
+	return "(" + p.Expr.String() + ")"
+}
+
+func (u *UnaryExpr) String() string {
+	return u.Op + u.Expr.String()
+}
+
+// ModifierString renders offset and @ modifiers, e.g. " @ end() offset 1h"
+func ModifierString(offset time.Duration, at string) string {
+	var sb strings.Builder
+	if at != "" {
+		sb.WriteString(" @ " + at)
+	}
+	if offset != 0 {
+		if offset < 0 {
+			sb.WriteString(" offset -" + FormatDuration(-offset))
+		} else {
+			sb.WriteString(" offset " + FormatDuration(offset))
+		}
+	}
+	return sb.String()
+}
+
+// durationUnitValues maps PromQL duration units to their length, longest first
+var durationUnitValues = []struct {
+	unit string
+	dur  time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// FormatDuration renders a duration in PromQL notation, e.g. 90m becomes 1h30m
+func FormatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var sb strings.Builder
+	for _, u := range durationUnitValues {
+		if n := d / u.dur; n > 0 {
+			sb.WriteString(strconv.FormatInt(int64(n), 10) + u.unit)
+			d -= n * u.dur
+		}
+	}
+	return sb.String()
+}
+
+// ParseDuration parses a PromQL duration such as 5m or 1h30m
+func ParseDuration(s string) (time.Duration, error) {
+	tokens, err := lex(s)
+	if err != nil || len(tokens) != 2 || tokens[0].typ != tokDuration {
+		return 0, &ParseError{Pos: 0, Msg: "invalid duration " + strconv.Quote(s)}
+	}
+	return parseDurationToken(tokens[0].val)
+}
+
+// parseDurationToken converts a lexed duration token to a time.Duration
+func parseDurationToken(s string) (time.Duration, error) {
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, &ParseError{Pos: 0, Msg: "invalid duration " + strconv.Quote(s)}
+		}
+		rest = rest[i:]
+		matched := false
+		for _, u := range durationUnitValues {
+			if strings.HasPrefix(rest, u.unit) && (u.unit != "m" || !strings.HasPrefix(rest, "ms")) {
+				total += time.Duration(n) * u.dur
+				rest = rest[len(u.unit):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, &ParseError{Pos: 0, Msg: "invalid duration " + strconv.Quote(s)}
+		}
+	}
+	return total, nil
+}
+
+// Children returns the direct sub-expressions of an expression
+func Children(expr Expr) []Expr {
+	switch e := expr.(type) {
+	case *MatrixSelector:
+		return []Expr{e.VectorSelector}
+	case *SubqueryExpr:
+		return []Expr{e.Expr}
+	case *Call:
+		return e.Args
+	case *AggregateExpr:
+		if e.Param != nil {
+			return []Expr{e.Param, e.Expr}
+		}
+		return []Expr{e.Expr}
+	case *BinaryExpr:
+		return []Expr{e.LHS, e.RHS}
+	case *ParenExpr:
+		return []Expr{e.Expr}
+	case *UnaryExpr:
+		return []Expr{e.Expr}
+	}
+	return nil
+}
+
+// Inspect walks the expression tree depth-first, calling f for each node with
+// the path of its ancestors. Children are skipped when f returns false.
+func Inspect(expr Expr, f func(expr Expr, path []Expr) bool) {
+	inspect(expr, nil, f)
+}
+
+func inspect(expr Expr, path []Expr, f func(Expr, []Expr) bool) {
+	if !f(expr, path) {
+		return
+	}
+	path = append(path, expr)
+	for _, child := range Children(expr) {
+		inspect(child, path[:len(path):len(path)], f)
+	}
+}
+
+// VectorSelectors returns all vector selectors in an expression, in source order
+func VectorSelectors(expr Expr) []*VectorSelector {
+	var selectors []*VectorSelector
+	Inspect(expr, func(e Expr, _ []Expr) bool {
+		if vs, ok := e.(*VectorSelector); ok {
+			selectors = append(selectors, vs)
+		}
+		return true
+	})
+	return selectors
+}
+
+// Unwrap strips any parentheses surrounding an expression
+func Unwrap(expr Expr) Expr {
+	for {
+		p, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
@@ -0,0 +1,319 @@
+package promql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DashboardExpr is a PromQL expression embedded in a Grafana dashboard JSON document
+type DashboardExpr struct {
+	// Value is the PromQL expression
+	Value string
+	// Prefix and Suffix surround the expression inside its JSON string, e.g. the
+	// "query_result(" and ")" of a templating variable query
+	Prefix string
+	Suffix string
+	// Start and End are the byte offsets of the JSON string token, including its quotes
+	Start int
+	End   int
+	// Line is the 1-based line of the JSON string token
+	Line int
+	// Path locates the string in the document, e.g. panels[2].targets[0].expr
+	Path string
+	// Panel is the title of the panel or the name of the templating variable
+	Panel string
+}
+
+// jsonString is a string value in a JSON document along with its location
+type jsonString struct {
+	segments []string
+	value    string
+	start    int
+	end      int
+}
+
+// IsDashboard reports whether content is a Grafana dashboard, a dashboard wrapped by the
+// HTTP API ({"dashboard": {...}}), or a library panel export ({"model": {...}})
+func IsDashboard(content []byte) bool {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return false
+	}
+	if inner, ok := doc["dashboard"]; ok {
+		return IsDashboard(inner)
+	}
+	if model, ok := doc["model"]; ok {
+		var panel map[string]json.RawMessage
+		if json.Unmarshal(model, &panel) == nil {
+			_, hasTargets := panel["targets"]
+			return hasTargets
+		}
+	}
+	_, hasPanels := doc["panels"]
+	_, hasRows := doc["rows"]
+	_, hasTemplating := doc["templating"]
+	return hasPanels || hasRows || hasTemplating
+}
+
+// DashboardExpressions returns the PromQL expressions in a Grafana dashboard: the expr of
+// each panel target, including panels nested in rows and library panel models, and the
+// PromQL inside query_result() and label_values() templating variable queries. Targets and
+// variables using a datasource other than Prometheus are skipped.
+func DashboardExpressions(content []byte) ([]DashboardExpr, error) {
+	strs, err := scanJSONStrings(content)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]string, len(strs))
+	for _, s := range strs {
+		byPath[strings.Join(s.segments, "")] = s.value
+	}
+	// usesPrometheus reports whether the nearest of the given objects that names a datasource
+	// type uses Prometheus; when none does, the dashboard default is assumed to
+	usesPrometheus := func(objects ...[]string) bool {
+		for _, object := range objects {
+			if dsType, ok := byPath[strings.Join(object, "")+".datasource.type"]; ok {
+				return dsType == "prometheus"
+			}
+		}
+		return true
+	}
+
+	var exprs []DashboardExpr
+	for _, s := range strs {
+		seg := s.segments
+		n := len(seg)
+		if n == 0 {
+			continue
+		}
+		path := strings.TrimPrefix(strings.Join(seg, ""), ".")
+
+		switch {
+		// <panel>.targets[i].expr
+		case n >= 3 && seg[n-1] == ".expr" && seg[n-3] == ".targets" && isIndex(seg[n-2]):
+			target, panel := seg[:n-1], seg[:n-3]
+			if !usesPrometheus(target, panel) {
+				continue
+			}
+			exprs = append(exprs, DashboardExpr{
+				Value: s.value,
+				Start: s.start,
+				End:   s.end,
+				Line:  lineAt(content, s.start),
+				Path:  path,
+				Panel: byPath[strings.Join(panel, "")+".title"],
+			})
+
+		// templating.list[i].query, or templating.list[i].query.query in newer dashboards
+		case seg[n-1] == ".query":
+			variable := seg[:n-1]
+			if n >= 2 && seg[n-2] == ".query" {
+				variable = seg[:n-2]
+			}
+			k := len(variable)
+			if k < 3 || !isIndex(variable[k-1]) || variable[k-2] != ".list" || variable[k-3] != ".templating" {
+				continue
+			}
+			key := strings.Join(variable, "")
+			if byPath[key+".type"] != "query" {
+				continue
+			}
+			if !usesPrometheus(variable) {
+				continue
+			}
+			prefix, value, suffix, ok := splitVariableQuery(s.value)
+			if !ok {
+				continue
+			}
+			exprs = append(exprs, DashboardExpr{
+				Value:  value,
+				Prefix: prefix,
+				Suffix: suffix,
+				Start:  s.start,
+				End:    s.end,
+				Line:   lineAt(content, s.start),
+				Path:   path,
+				Panel:  "$" + byPath[key+".name"],
+			})
+		}
+	}
+
+	return exprs, nil
+}
+
+// RewriteDashboard replaces the expressions found by DashboardExpressions with rewritten
+// values, leaving every other byte of the document untouched. rewritten[i] replaces
+// exprs[i]; entries equal to the original value are left alone.
+func RewriteDashboard(content []byte, exprs []DashboardExpr, rewritten []string) ([]byte, error) {
+	if len(exprs) != len(rewritten) {
+		return nil, fmt.Errorf("got %d rewritten expressions for %d expressions", len(rewritten), len(exprs))
+	}
+
+	order := make([]int, len(exprs))
+	for i := range order {
+		order[i] = i
+	}
+	// Splice from the end of the document so earlier offsets stay valid
+	sort.Slice(order, func(a, b int) bool { return exprs[order[a]].Start > exprs[order[b]].Start })
+
+	result := append([]byte(nil), content...)
+	for _, i := range order {
+		e := exprs[i]
+		if rewritten[i] == e.Value {
+			continue
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		// Keep <, > and & readable, as Grafana does when saving a dashboard
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(e.Prefix + rewritten[i] + e.Suffix); err != nil {
+			return nil, err
+		}
+		encoded := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+		result = append(result[:e.Start], append(encoded, result[e.End:]...)...)
+	}
+	return result, nil
+}
+
+// splitVariableQuery extracts the PromQL from a Prometheus templating variable query.
+// query_result(expr) yields expr and label_values(selector, label) yields selector; other
+// queries such as label_names() or label_values(label) contain no PromQL.
+func splitVariableQuery(query string) (prefix, expr, suffix string, ok bool) {
+	trimmed := strings.TrimSpace(query)
+	if !strings.HasSuffix(trimmed, ")") {
+		return "", "", "", false
+	}
+	start := strings.Index(query, trimmed)
+
+	switch {
+	case strings.HasPrefix(trimmed, "query_result("):
+		open := start + len("query_result(")
+		end := start + len(trimmed) - 1
+		inner := query[open:end]
+		lead := len(inner) - len(strings.TrimLeft(inner, " \t\n"))
+		trail := len(inner) - len(strings.TrimRight(inner, " \t\n"))
+		return query[:open+lead], strings.TrimSpace(inner), query[end-trail:], strings.TrimSpace(inner) != ""
+
+	case strings.HasPrefix(trimmed, "label_values("):
+		open := start + len("label_values(")
+		end := start + len(trimmed) - 1
+		comma := strings.LastIndex(query[open:end], ",")
+		if comma < 0 {
+			return "", "", "", false
+		}
+		selector := query[open : open+comma]
+		lead := len(selector) - len(strings.TrimLeft(selector, " \t\n"))
+		trail := len(selector) - len(strings.TrimRight(selector, " \t\n"))
+		exprEnd := open + comma - trail
+		return query[:open+lead], strings.TrimSpace(selector), query[exprEnd:], strings.TrimSpace(selector) != ""
+	}
+	return "", "", "", false
+}
+
+// scanJSONStrings returns every string value in a JSON document, with its path and the byte
+// offsets of its token. Path segments are ".key" for object members and "[i]" for array
+// elements, so joining them gives a path such as .panels[0].targets[1].expr.
+func scanJSONStrings(content []byte) ([]jsonString, error) {
+	type frame struct {
+		object  bool
+		wantKey bool
+		key     string
+		index   int
+	}
+
+	var (
+		strs  []jsonString
+		stack []*frame
+		// segments returns the path of the value currently being read
+		segments = func() []string {
+			seg := make([]string, len(stack))
+			for i, f := range stack {
+				if f.object {
+					seg[i] = "." + f.key
+				} else {
+					seg[i] = fmt.Sprintf("[%d]", f.index)
+				}
+			}
+			return seg
+		}
+		// advance moves the enclosing container past the value just read
+		advance = func() {
+			if len(stack) == 0 {
+				return
+			}
+			top := stack[len(stack)-1]
+			if top.object {
+				top.wantKey = true
+			} else {
+				top.index++
+			}
+		}
+	)
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	prev := 0
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(dec.InputOffset())
+
+		if len(stack) > 0 {
+			if top := stack[len(stack)-1]; top.object && top.wantKey {
+				if key, ok := tok.(string); ok {
+					top.key = key
+					top.wantKey = false
+					prev = end
+					continue
+				}
+			}
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				stack = append(stack, &frame{object: t == '{', wantKey: t == '{'})
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				advance()
+			}
+		case string:
+			// Only whitespace, ':' or ',' lies between the previous token and this one
+			start := prev + bytes.IndexByte(content[prev:end], '"')
+			strs = append(strs, jsonString{segments: segments(), value: t, start: start, end: end})
+			advance()
+		default:
+			advance()
+		}
+		prev = end
+	}
+	if len(stack) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return strs, nil
+}
+
+// isIndex reports whether a path segment is an array index
+func isIndex(segment string) bool {
+	return strings.HasPrefix(segment, "[")
+}
+
+// lineAt returns the 1-based line of a byte offset
+func lineAt(content []byte, offset int) int {
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,139 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDashboard = `{
+  "title": "Service",
+  "panels": [
+    {
+      "title": "Requests",
+      "type": "timeseries",
+      "targets": [
+        {"expr": "sum(rate(http_requests_total{job=\"api\"}[5m]))", "refId": "A"}
+      ]
+    },
+    {
+      "title": "Row",
+      "type": "row",
+      "panels": [
+        {
+          "title": "Errors",
+          "targets": [{"expr": "rate(errors_total[5m]) > 0", "refId": "A"}]
+        }
+      ]
+    },
+    {
+      "title": "Logs",
+      "datasource": {"type": "loki", "uid": "logs"},
+      "targets": [{"expr": "{job=\"api\"} |= \"error\"", "refId": "A"}]
+    },
+    {
+      "title": "Mixed",
+      "datasource": {"type": "datasource", "uid": "-- Mixed --"},
+      "targets": [
+        {"datasource": {"type": "prometheus"}, "expr": "up", "refId": "A"},
+        {"datasource": {"type": "loki"}, "expr": "{job=\"x\"}", "refId": "B"}
+      ]
+    },
+    {
+      "title": "Shared",
+      "libraryPanel": {"uid": "abc", "name": "Shared"}
+    }
+  ],
+  "templating": {
+    "list": [
+      {"name": "job", "type": "query", "query": "label_values(up{env=\"prod\"}, job)"},
+      {"name": "instance", "type": "query", "query": {"query": "query_result(topk(5, up))", "refId": "V"}},
+      {"name": "cluster", "type": "query", "query": "label_values(cluster)"},
+      {"name": "env", "type": "custom", "query": "prod,staging"}
+    ]
+  }
+}
+`
+
+func TestDashboardExpressions(t *testing.T) {
+	exprs, err := DashboardExpressions([]byte(testDashboard))
+	if err != nil {
+		t.Fatalf("DashboardExpressions returned error: %v", err)
+	}
+
+	expected := []struct {
+		value string
+		panel string
+		path  string
+		line  int
+	}{
+		{`sum(rate(http_requests_total{job="api"}[5m]))`, "Requests", "panels[0].targets[0].expr", 8},
+		{`rate(errors_total[5m]) > 0`, "Errors", "panels[1].panels[0].targets[0].expr", 17},
+		{`up`, "Mixed", "panels[3].targets[0].expr", 30},
+		{`up{env="prod"}`, "$job", "templating.list[0].query", 41},
+		{`topk(5, up)`, "$instance", "templating.list[1].query.query", 42},
+	}
+
+	if len(exprs) != len(expected) {
+		t.Fatalf("got %d expressions, want %d: %+v", len(exprs), len(expected), exprs)
+	}
+	for i, want := range expected {
+		got := exprs[i]
+		if got.Value != want.value || got.Panel != want.panel || got.Path != want.path || got.Line != want.line {
+			t.Errorf("expression %d = {%q %q %q %d}, want {%q %q %q %d}",
+				i, got.Value, got.Panel, got.Path, got.Line, want.value, want.panel, want.path, want.line)
+		}
+	}
+}
+
+func TestRewriteDashboard(t *testing.T) {
+	content := []byte(testDashboard)
+	exprs, err := DashboardExpressions(content)
+	if err != nil {
+		t.Fatalf("DashboardExpressions returned error: %v", err)
+	}
+
+	rewritten := make([]string, len(exprs))
+	for i, e := range exprs {
+		rewritten[i] = e.Value
+	}
+	rewritten[0] = "sum(\n  rate(http_requests_total{job=\"api\"}[5m])\n)"
+	rewritten[3] = `up{env="prod",region="eu"}`
+
+	got, err := RewriteDashboard(content, exprs, rewritten)
+	if err != nil {
+		t.Fatalf("RewriteDashboard returned error: %v", err)
+	}
+
+	expected := strings.Replace(testDashboard,
+		`"sum(rate(http_requests_total{job=\"api\"}[5m]))"`,
+		`"sum(\n  rate(http_requests_total{job=\"api\"}[5m])\n)"`, 1)
+	expected = strings.Replace(expected,
+		`"label_values(up{env=\"prod\"}, job)"`,
+		`"label_values(up{env=\"prod\",region=\"eu\"}, job)"`, 1)
+	if string(got) != expected {
+		t.Errorf("RewriteDashboard() =\n%s\nwant\n%s", got, expected)
+	}
+}
+
+func TestIsDashboard(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{"dashboard", `{"title": "x", "panels": []}`, true},
+		{"legacy rows", `{"rows": [{"panels": []}]}`, true},
+		{"api wrapper", `{"dashboard": {"panels": []}, "meta": {}}`, true},
+		{"library panel", `{"uid": "abc", "model": {"targets": [{"expr": "up"}]}}`, true},
+		{"other json", `{"name": "package", "version": "1.0.0"}`, false},
+		{"invalid json", `groups: []`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsDashboard([]byte(tt.content)); got != tt.expected {
+				t.Errorf("IsDashboard(%q) = %v, want %v", tt.content, got, tt.expected)
+			}
+		})
+	}
+}
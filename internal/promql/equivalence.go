@@ -0,0 +1,114 @@
+package promql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Equivalent reports whether two expressions have the same meaning, ignoring differences
+// that do not affect evaluation: whitespace, redundant parentheses, the position of
+// by/without clauses, and the order of label matchers and grouping labels.
+func Equivalent(a, b Expr) bool {
+	return Canonical(a) == Canonical(b)
+}
+
+// Canonical renders an expression in a normalized, fully parenthesized form, so that two
+// expressions with the same meaning render identically
+func Canonical(expr Expr) string {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return strconv.FormatFloat(e.Val, 'g', -1, 64)
+
+	case *StringLiteral:
+		return strconv.Quote(e.Val)
+
+	case *VectorSelector:
+		return canonicalSelector(e) + ModifierString(e.Offset, e.At)
+
+	case *MatrixSelector:
+		vs := e.VectorSelector
+		return canonicalSelector(vs) + "[" + FormatDuration(e.Range) + "]" + ModifierString(vs.Offset, vs.At)
+
+	case *SubqueryExpr:
+		step := ""
+		if e.Step != 0 {
+			step = FormatDuration(e.Step)
+		}
+		return "(" + Canonical(e.Expr) + ")[" + FormatDuration(e.Range) + ":" + step + "]" + ModifierString(e.Offset, e.At)
+
+	case *Call:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = Canonical(arg)
+		}
+		return e.Func + "(" + strings.Join(args, ", ") + ")"
+
+	case *AggregateExpr:
+		// sum(x) and sum by () (x) both aggregate away every label
+		keyword := "by"
+		if e.Without {
+			keyword = "without"
+		}
+		args := Canonical(e.Expr)
+		if e.Param != nil {
+			args = Canonical(e.Param) + ", " + args
+		}
+		return e.Op + " " + keyword + " (" + sortedLabels(e.Grouping) + ") (" + args + ")"
+
+	case *BinaryExpr:
+		var sb strings.Builder
+		sb.WriteString("(" + Canonical(e.LHS) + " " + e.Op)
+		if e.ReturnBool {
+			sb.WriteString(" bool")
+		}
+		if m := e.Matching; m != nil {
+			// ignoring () is the default matching behavior
+			if m.On {
+				sb.WriteString(" on (" + sortedLabels(m.Labels) + ")")
+			} else if len(m.Labels) > 0 {
+				sb.WriteString(" ignoring (" + sortedLabels(m.Labels) + ")")
+			}
+			switch m.Card {
+			case CardManyToOne:
+				sb.WriteString(" group_left (" + sortedLabels(m.Include) + ")")
+			case CardOneToMany:
+				sb.WriteString(" group_right (" + sortedLabels(m.Include) + ")")
+			}
+		}
+		sb.WriteString(" " + Canonical(e.RHS) + ")")
+		return sb.String()
+
+	case *ParenExpr:
+		return Canonical(e.Expr)
+
+	case *UnaryExpr:
+		if e.Op == "+" {
+			return Canonical(e.Expr)
+		}
+		return "(" + e.Op + Canonical(e.Expr) + ")"
+	}
+
+	return expr.String()
+}
+
+// canonicalSelector renders a selector with the metric name as a __name__ matcher and
+// matchers sorted, without its modifiers
+func canonicalSelector(vs *VectorSelector) string {
+	matchers := make([]string, 0, len(vs.Matchers)+1)
+	if vs.Name != "" {
+		matchers = append(matchers, (&LabelMatcher{Name: "__name__", Op: MatchEqual, Value: vs.Name}).String())
+	}
+	for _, m := range vs.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	sort.Strings(matchers)
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// sortedLabels joins a copy of labels in sorted order
+func sortedLabels(labels []string) string {
+	sorted := append([]string(nil), labels...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
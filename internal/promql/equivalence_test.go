@@ -0,0 +1,48 @@
+package promql
+
+import (
+	"testing"
+)
+
+func TestEquivalent(t *testing.T) {
+	tests := []struct {
+		name       string
+		a          string
+		b          string
+		equivalent bool
+	}{
+		{"whitespace", `sum(rate(x[5m]))`, "sum(\n  rate(x[5m])\n)", true},
+		{"postfix and prefix clause", `sum(x) by (job, instance)`, `sum by (instance, job) (x)`, true},
+		{"matcher order", `x{a="1",b="2"}`, `x{b="2",a="1"}`, true},
+		{"metric name as matcher", `x{job="a"}`, `{__name__="x",job="a"}`, true},
+		{"redundant parentheses", `(a) / ((b))`, `a / b`, true},
+		{"empty by clause", `sum(x)`, `sum by () (x)`, true},
+		{"empty ignoring clause", `a / ignoring () b`, `a / b`, true},
+		{"duration notation", `rate(x[90m])`, `rate(x[1h30m])`, true},
+		{"number notation", `x > 1e3`, `x > 1000`, true},
+		{"dropped grouping", `sum by (pod) (a) / sum by (instance) (b)`, `sum(a) / on (instance) sum by (instance) (b)`, false},
+		{"added on clause", `a / b`, `a / on (instance) b`, false},
+		{"precedence", `(a + b) * c`, `a + b * c`, false},
+		{"without is not by", `sum without (job) (x)`, `sum by (job) (x)`, false},
+		{"different matcher", `x{job="a"}`, `x{job=~"a"}`, false},
+		{"offset", `x offset 5m`, `x`, false},
+		{"bool modifier", `a > bool b`, `a > b`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := ParseExpr(tt.a)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.a, err)
+			}
+			b, err := ParseExpr(tt.b)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.b, err)
+			}
+			if got := Equivalent(a, b); got != tt.equivalent {
+				t.Errorf("Equivalent(%q, %q) = %v, want %v\ncanonical: %s\n           %s",
+					tt.a, tt.b, got, tt.equivalent, Canonical(a), Canonical(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,583 @@
+package promql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Expression is a PromQL expression found in a configuration file
+type Expression struct {
+	Value string
+	// Line is the 1-based line of the expression in the file
+	Line int
+	// Location describes where the expression lives, e.g. "alert HighErrorRate" or
+	// "SLO availability error_query"
+	Location string
+}
+
+// Extractor finds the PromQL expressions embedded in one kind of configuration file
+type Extractor interface {
+	// Name identifies the file format, e.g. "rules" or "sloth"
+	Name() string
+	// Match reports whether content is in the extractor's format
+	Match(content []byte) bool
+	// Extract returns the expressions in content
+	Extract(content []byte) ([]Expression, error)
+}
+
+// Names of the built-in extractors
+const (
+	FormatRules            = "rules"
+	FormatDashboard        = "dashboard"
+	FormatSloth            = "sloth"
+	FormatPyrra            = "pyrra"
+	FormatPrometheusConfig = "prometheus-config"
+)
+
+// extractors is consulted in order, so the more specific formats come first
+var extractors = []Extractor{
+	dashboardExtractor{},
+	pyrraExtractor{},
+	slothExtractor{},
+	prometheusConfigExtractor{},
+	rulesExtractor{},
+}
+
+// RegisterExtractor adds an extractor for another file format. Registered extractors are
+// consulted before the built-in ones.
+func RegisterExtractor(e Extractor) {
+	extractors = append([]Extractor{e}, extractors...)
+}
+
+// FindExtractor returns the first extractor that recognizes content, or nil if none does
+func FindExtractor(content []byte) Extractor {
+	for _, e := range extractors {
+		if e.Match(content) {
+			return e
+		}
+	}
+	return nil
+}
+
+// LookupExtractor returns the extractor with the given name, or nil if there is none
+func LookupExtractor(name string) Extractor {
+	for _, e := range extractors {
+		if e.Name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// ExtractExpressions returns the expressions in content using the first extractor that
+// recognizes it, along with that extractor's name
+func ExtractExpressions(content []byte) (string, []Expression, error) {
+	e := FindExtractor(content)
+	if e == nil {
+		return "", nil, errors.New("no extractor recognizes the file format")
+	}
+	exprs, err := e.Extract(content)
+	return e.Name(), exprs, err
+}
+
+// CheckExpressionLabels checks extracted expressions for required labels. Template variables
+// such as Grafana's $__rate_interval or Sloth's {{.window}} are allowed.
+func CheckExpressionLabels(exprs []Expression, requiredLabels []string) []LabelViolation {
+	violations := make([]LabelViolation, 0, len(exprs))
+	for _, e := range exprs {
+		missingLabels := checkLabelsInExpression(e.Value, requiredLabels)
+
+		violation := LabelViolation{
+			Expression:    e.Value,
+			MissingLabels: missingLabels,
+			Line:          e.Line,
+		}
+		if parsed, _, err := ParseTemplatedExpr(e.Value); err == nil {
+			violation.MissingOutputLabels = OutputLabelsMissing(parsed, requiredLabels)
+		}
+
+		switch {
+		case len(missingLabels) > 0:
+			violation.Suggestion = generateSuggestion(e.Value, missingLabels)
+		case len(violation.MissingOutputLabels) > 0:
+			violation.Suggestion = generateOutputSuggestion(violation.MissingOutputLabels)
+		}
+
+		violations = append(violations, violation)
+	}
+	return violations
+}
+
+// rulesExtractor handles Prometheus rule files, which Thanos and Cortex rulers load as is,
+// Mimir and Cortex ruler namespaces (mimirtool/cortextool files with a namespace key) and
+// Prometheus Operator PrometheusRule resources
+type rulesExtractor struct{}
+
+func (rulesExtractor) Name() string { return FormatRules }
+
+func (rulesExtractor) Match(content []byte) bool {
+	for _, doc := range yamlDocuments(content) {
+		if ruleGroups(doc) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (rulesExtractor) Extract(content []byte) ([]Expression, error) {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []Expression
+	for _, doc := range docs {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				location := "rule in group " + scalarValue(mappingValue(group, "name"))
+				if name := scalarValue(mappingValue(rule, "alert")); name != "" {
+					location = "alert " + name
+				} else if name := scalarValue(mappingValue(rule, "record")); name != "" {
+					location = "recording rule " + name
+				}
+				exprs = appendField(exprs, rule, "expr", location)
+			}
+		}
+	}
+	return exprs, nil
+}
+
+// ExtractRuleFragments returns the expressions held by expr keys anywhere in content, for
+// fragments of rule files, such as a single rule or a bare expr key, that the rules
+// extractor does not recognize
+func ExtractRuleFragments(content []byte) ([]Expression, error) {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []Expression
+	for _, doc := range docs {
+		exprMappings(doc, func(mapping *yaml.Node) {
+			exprs = appendField(exprs, mapping, "expr", "expr")
+		})
+	}
+	return exprs, nil
+}
+
+// exprMappings calls fn for node and every mapping nested in it that has an expr key, in
+// document order
+func exprMappings(node *yaml.Node, fn func(mapping *yaml.Node)) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		if mappingKey(node, "expr") != nil {
+			fn(node)
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			exprMappings(node.Content[i], fn)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			exprMappings(item, fn)
+		}
+	}
+}
+
+// ruleGroups returns the rule group sequence of a rule file, mimirtool namespace file or
+// PrometheusRule resource
+func ruleGroups(doc *yaml.Node) *yaml.Node {
+	groups := mappingValue(doc, "groups")
+	if scalarValue(mappingValue(doc, "kind")) == "PrometheusRule" {
+		groups = mappingValue(mappingValue(doc, "spec"), "groups")
+	}
+	if groups == nil || groups.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return groups
+}
+
+// RewriteRules replaces the expressions the rules extractor or ExtractRuleFragments found in
+// content with rewritten values, leaving every other byte of the file untouched. rewritten[i] replaces exprs[i];
+// entries equal to the original value are left alone. Values spanning several lines are
+// written as literal blocks. Expressions in flow mappings, or followed by a comment, cannot
+// be replaced without touching their neighbours and are reported as an error.
+func RewriteRules(content []byte, exprs []Expression, rewritten []string) ([]byte, error) {
+	if len(exprs) != len(rewritten) {
+		return nil, fmt.Errorf("got %d rewritten expressions for %d expressions", len(rewritten), len(exprs))
+	}
+	changed := false
+	for i, e := range exprs {
+		changed = changed || rewritten[i] != e.Value
+	}
+	if !changed {
+		return content, nil
+	}
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rules holding each expression, by the line of their expr key
+	rules := make(map[int]*yaml.Node)
+	for _, doc := range docs {
+		exprMappings(doc, func(rule *yaml.Node) {
+			rules[mappingKey(rule, "expr").Line] = rule
+		})
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	// Splice from the end of the file so earlier lines stay valid
+	order := make([]int, len(exprs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return exprs[order[a]].Line > exprs[order[b]].Line })
+
+	for _, i := range order {
+		e := exprs[i]
+		if rewritten[i] == e.Value {
+			continue
+		}
+		rule := rules[e.Line]
+		if rule == nil {
+			return nil, fmt.Errorf("line %d: no rule expression found", e.Line)
+		}
+		key, value := mappingKey(rule, "expr"), mappingValue(rule, "expr")
+		indent := key.Column - 1
+		if rule.Style&yaml.FlowStyle != 0 || key.Style != 0 || value.LineComment != "" ||
+			len(lines[e.Line-1]) <= indent+len(key.Value) || strings.Trim(lines[e.Line-1][:indent], " -") != "" {
+			return nil, fmt.Errorf("line %d: expression cannot be rewritten in place; move it to its own line, without a trailing comment", e.Line)
+		}
+
+		// The value runs from the key to the last following line indented deeper than it.
+		// Plain and quoted values end at a comment line; block scalars may contain them.
+		first := e.Line - 1
+		last := first
+		for l := first + 1; l < len(lines); l++ {
+			text := strings.TrimRight(lines[l], "\r\n")
+			trimmed := strings.TrimSpace(text)
+			if trimmed == "" {
+				continue
+			}
+			if len(text)-len(strings.TrimLeft(text, " \t")) <= indent {
+				break
+			}
+			if strings.HasPrefix(trimmed, "#") && value.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				break
+			}
+			last = l
+		}
+
+		head := lines[first][:indent+len(key.Value)+1]
+		var b strings.Builder
+		b.WriteString(head)
+		if strings.Contains(rewritten[i], "\n") {
+			b.WriteString(" |\n")
+			for _, line := range strings.Split(rewritten[i], "\n") {
+				if line = strings.TrimRight(line, " \t"); line != "" {
+					b.WriteString(strings.Repeat(" ", indent+2) + line)
+				}
+				b.WriteString("\n")
+			}
+		} else {
+			encoded, err := yaml.Marshal(rewritten[i])
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(" " + string(encoded))
+		}
+		// Keep the line ending the replaced value had, or none at the end of the file
+		replacement := strings.TrimSuffix(b.String(), "\n")
+		if strings.HasSuffix(lines[last], "\n") {
+			replacement += lines[last][len(strings.TrimRight(lines[last], "\r\n")):]
+		}
+		lines = append(lines[:first], append([]string{replacement}, lines[last+1:]...)...)
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// dashboardExtractor handles Grafana dashboard JSON
+type dashboardExtractor struct{}
+
+func (dashboardExtractor) Name() string { return FormatDashboard }
+
+func (dashboardExtractor) Match(content []byte) bool { return IsDashboard(content) }
+
+func (dashboardExtractor) Extract(content []byte) ([]Expression, error) {
+	found, err := DashboardExpressions(content)
+	if err != nil {
+		return nil, err
+	}
+	exprs := make([]Expression, len(found))
+	for i, e := range found {
+		location := "panel " + e.Panel
+		if e.Prefix != "" || e.Suffix != "" {
+			location = "variable " + e.Panel
+		}
+		exprs[i] = Expression{Value: e.Value, Line: e.Line, Location: location}
+	}
+	return exprs, nil
+}
+
+// slothExtractor handles Sloth SLO specs (version: prometheus/v1) and PrometheusServiceLevel
+// resources. Sloth substitutes {{.window}} in its queries, which ParseTemplatedExpr accepts.
+type slothExtractor struct{}
+
+func (slothExtractor) Name() string { return FormatSloth }
+
+func (slothExtractor) Match(content []byte) bool {
+	for _, doc := range yamlDocuments(content) {
+		if slothSLOs(doc) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (slothExtractor) Extract(content []byte) ([]Expression, error) {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []Expression
+	for _, doc := range docs {
+		slos := slothSLOs(doc)
+		if slos == nil {
+			continue
+		}
+		for _, slo := range slos.Content {
+			name := scalarValue(mappingValue(slo, "name"))
+			sli := mappingValue(slo, "sli")
+			events := mappingValue(sli, "events")
+			raw := mappingValue(sli, "raw")
+			for _, field := range []struct {
+				parent *yaml.Node
+				key    string
+			}{
+				{events, "error_query"},
+				{events, "total_query"},
+				{raw, "error_ratio_query"},
+			} {
+				exprs = appendField(exprs, field.parent, field.key, fmt.Sprintf("SLO %s %s", name, field.key))
+			}
+		}
+	}
+	return exprs, nil
+}
+
+// slothSLOs returns the SLO sequence of a Sloth spec or PrometheusServiceLevel resource
+func slothSLOs(doc *yaml.Node) *yaml.Node {
+	var slos *yaml.Node
+	switch {
+	case scalarValue(mappingValue(doc, "kind")) == "PrometheusServiceLevel":
+		slos = mappingValue(mappingValue(doc, "spec"), "slos")
+	case strings.HasPrefix(scalarValue(mappingValue(doc, "version")), "prometheus/"):
+		slos = mappingValue(doc, "slos")
+	}
+	if slos == nil || slos.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return slos
+}
+
+// pyrraExtractor handles Pyrra ServiceLevelObjective resources, whose indicators are selectors
+type pyrraExtractor struct{}
+
+func (pyrraExtractor) Name() string { return FormatPyrra }
+
+func (pyrraExtractor) Match(content []byte) bool {
+	for _, doc := range yamlDocuments(content) {
+		if isPyrraSLO(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pyrraExtractor) Extract(content []byte) ([]Expression, error) {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []Expression
+	for _, doc := range docs {
+		if !isPyrraSLO(doc) {
+			continue
+		}
+		name := scalarValue(mappingValue(mappingValue(doc, "metadata"), "name"))
+		indicator := mappingValue(mappingValue(doc, "spec"), "indicator")
+		if indicator == nil || indicator.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(indicator.Content); i += 2 {
+			kind, spec := indicator.Content[i].Value, indicator.Content[i+1]
+			// bool_gauge holds its metric directly; ratio and latency indicators hold one per series
+			if mappingValue(spec, "metric") != nil {
+				exprs = appendField(exprs, spec, "metric", fmt.Sprintf("SLO %s %s", name, kind))
+				continue
+			}
+			if spec.Kind != yaml.MappingNode {
+				continue
+			}
+			for j := 0; j+1 < len(spec.Content); j += 2 {
+				exprs = appendField(exprs, spec.Content[j+1], "metric",
+					fmt.Sprintf("SLO %s %s.%s", name, kind, spec.Content[j].Value))
+			}
+		}
+	}
+	return exprs, nil
+}
+
+// isPyrraSLO reports whether doc is a Pyrra ServiceLevelObjective resource
+func isPyrraSLO(doc *yaml.Node) bool {
+	return scalarValue(mappingValue(doc, "kind")) == "ServiceLevelObjective" &&
+		strings.HasPrefix(scalarValue(mappingValue(doc, "apiVersion")), "pyrra.dev/")
+}
+
+// prometheusConfigExtractor handles Prometheus server configuration. The PromQL it holds is
+// the match[] selectors of federation scrape jobs. Relabel configs, including remote_write
+// write_relabel_configs, match label values with regular expressions rather than PromQL, so
+// there is nothing there to extract.
+type prometheusConfigExtractor struct{}
+
+func (prometheusConfigExtractor) Name() string { return FormatPrometheusConfig }
+
+func (prometheusConfigExtractor) Match(content []byte) bool {
+	for _, doc := range yamlDocuments(content) {
+		if mappingValue(doc, "scrape_configs") != nil || mappingValue(doc, "remote_write") != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (prometheusConfigExtractor) Extract(content []byte) ([]Expression, error) {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []Expression
+	for _, doc := range docs {
+		scrapeConfigs := mappingValue(doc, "scrape_configs")
+		if scrapeConfigs == nil || scrapeConfigs.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, job := range scrapeConfigs.Content {
+			location := "federation job " + scalarValue(mappingValue(job, "job_name"))
+			match := mappingValue(mappingValue(job, "params"), "match[]")
+			if match == nil || match.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, selector := range match.Content {
+				if selector.Kind == yaml.ScalarNode && strings.TrimSpace(selector.Value) != "" {
+					exprs = append(exprs, Expression{Value: strings.TrimSpace(selector.Value), Line: selector.Line, Location: location})
+				}
+			}
+		}
+	}
+	return exprs, nil
+}
+
+// appendField appends the expression held by a mapping's scalar field, reported at the line
+// of its key. Missing or empty fields are skipped.
+func appendField(exprs []Expression, mapping *yaml.Node, field, location string) []Expression {
+	key, value := mappingKey(mapping, field), mappingValue(mapping, field)
+	if key == nil || value.Kind != yaml.ScalarNode || strings.TrimSpace(value.Value) == "" {
+		return exprs
+	}
+	return append(exprs, Expression{Value: strings.TrimSpace(value.Value), Line: key.Line, Location: location})
+}
+
+// scalarValue returns the value of a scalar node, or "" for nil and non-scalar nodes
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+// parseYAMLDocuments returns the root node of each document in a YAML stream
+func parseYAMLDocuments(content []byte) ([]*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return docs, nil
+			}
+			return nil, err
+		}
+		if len(doc.Content) > 0 {
+			docs = append(docs, doc.Content[0])
+		}
+	}
+}
+
+// yamlDocuments is parseYAMLDocuments for format detection, where invalid YAML matches nothing
+func yamlDocuments(content []byte) []*yaml.Node {
+	docs, err := parseYAMLDocuments(content)
+	if err != nil {
+		return nil
+	}
+	return docs
+}
+
+// Span is an inclusive range of 1-based lines in a file
+type Span struct {
+	Start int
+	End   int
+}
+
+// RuleSpans returns the lines each rule of a rule file spans, in file order. Content that
+// is not a rule file has no rule spans.
+func RuleSpans(content []byte) []Span {
+	var spans []Span
+	for _, doc := range yamlDocuments(content) {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				spans = append(spans, Span{Start: rule.Line, End: lastLine(rule)})
+			}
+		}
+	}
+	return spans
+}
+
+// lastLine returns the last line a node's content occupies
+func lastLine(node *yaml.Node) int {
+	last := node.Line
+	if node.Kind == yaml.ScalarNode && (node.Style&(yaml.LiteralStyle|yaml.FoldedStyle)) != 0 {
+		// Block scalars start on the line after their indicator
+		last += strings.Count(strings.TrimRight(node.Value, "\n"), "\n") + 1
+	}
+	for _, child := range node.Content {
+		last = max(last, lastLine(child))
+	}
+	return last
+}
@@ -0,0 +1,378 @@
+package promql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractExpressions(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		format   string
+		expected []Expression
+	}{
+		{
+			name: "rule file",
+			content: `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total{job="api"}[5m]) > 1
+      - record: job:requests:rate5m
+        expr: |
+          sum by (job) (rate(requests_total[5m]))
+`,
+			format: FormatRules,
+			expected: []Expression{
+				{Value: `rate(errors_total{job="api"}[5m]) > 1`, Line: 5, Location: "alert HighErrorRate"},
+				{Value: `sum by (job) (rate(requests_total[5m]))`, Line: 7, Location: "recording rule job:requests:rate5m"},
+			},
+		},
+		{
+			name: "mimirtool namespace",
+			content: `namespace: tenant-a
+groups:
+  - name: api
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`,
+			format:   FormatRules,
+			expected: []Expression{{Value: `sum by (job) (up)`, Line: 6, Location: "recording rule job:up:sum"}},
+		},
+		{
+			name: "PrometheusRule resource",
+			content: `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+spec:
+  groups:
+    - name: api
+      rules:
+        - alert: Down
+          expr: up{job="api"} == 0
+`,
+			format:   FormatRules,
+			expected: []Expression{{Value: `up{job="api"} == 0`, Line: 10, Location: "alert Down"}},
+		},
+		{
+			name: "sloth spec",
+			content: `version: "prometheus/v1"
+service: "api"
+slos:
+  - name: "availability"
+    objective: 99.9
+    sli:
+      events:
+        error_query: sum(rate(http_requests_total{job="api",code=~"5.."}[{{.window}}]))
+        total_query: sum(rate(http_requests_total{job="api"}[{{.window}}]))
+  - name: "latency"
+    objective: 99
+    sli:
+      raw:
+        error_ratio_query: |
+          1 - sum(rate(latency_bucket{job="api",le="0.5"}[{{.window}}])) / sum(rate(latency_count{job="api"}[{{.window}}]))
+`,
+			format: FormatSloth,
+			expected: []Expression{
+				{Value: `sum(rate(http_requests_total{job="api",code=~"5.."}[{{.window}}]))`, Line: 8, Location: "SLO availability error_query"},
+				{Value: `sum(rate(http_requests_total{job="api"}[{{.window}}]))`, Line: 9, Location: "SLO availability total_query"},
+				{Value: `1 - sum(rate(latency_bucket{job="api",le="0.5"}[{{.window}}])) / sum(rate(latency_count{job="api"}[{{.window}}]))`, Line: 14, Location: "SLO latency error_ratio_query"},
+			},
+		},
+		{
+			name: "sloth resource",
+			content: `apiVersion: sloth.slok.dev/v1
+kind: PrometheusServiceLevel
+spec:
+  service: api
+  slos:
+    - name: availability
+      sli:
+        events:
+          error_query: sum(rate(errors_total[{{.window}}]))
+          total_query: sum(rate(requests_total[{{.window}}]))
+`,
+			format: FormatSloth,
+			expected: []Expression{
+				{Value: `sum(rate(errors_total[{{.window}}]))`, Line: 9, Location: "SLO availability error_query"},
+				{Value: `sum(rate(requests_total[{{.window}}]))`, Line: 10, Location: "SLO availability total_query"},
+			},
+		},
+		{
+			name: "pyrra objective",
+			content: `apiVersion: pyrra.dev/v1alpha1
+kind: ServiceLevelObjective
+metadata:
+  name: api-errors
+spec:
+  target: "99"
+  window: 4w
+  indicator:
+    ratio:
+      errors:
+        metric: http_requests_total{job="api",code=~"5.."}
+      total:
+        metric: http_requests_total{job="api"}
+`,
+			format: FormatPyrra,
+			expected: []Expression{
+				{Value: `http_requests_total{job="api",code=~"5.."}`, Line: 11, Location: "SLO api-errors ratio.errors"},
+				{Value: `http_requests_total{job="api"}`, Line: 13, Location: "SLO api-errors ratio.total"},
+			},
+		},
+		{
+			name: "pyrra bool gauge",
+			content: `apiVersion: pyrra.dev/v1alpha1
+kind: ServiceLevelObjective
+metadata:
+  name: probe
+spec:
+  indicator:
+    bool_gauge:
+      metric: probe_success{job="blackbox"}
+`,
+			format:   FormatPyrra,
+			expected: []Expression{{Value: `probe_success{job="blackbox"}`, Line: 8, Location: "SLO probe bool_gauge"}},
+		},
+		{
+			name: "prometheus federation config",
+			content: `global:
+  scrape_interval: 30s
+scrape_configs:
+  - job_name: federate
+    metrics_path: /federate
+    params:
+      match[]:
+        - '{job="api"}'
+        - 'up'
+remote_write:
+  - url: http://mimir/api/v1/push
+    write_relabel_configs:
+      - source_labels: [__name__]
+        regex: go_.*
+        action: drop
+`,
+			format: FormatPrometheusConfig,
+			expected: []Expression{
+				{Value: `{job="api"}`, Line: 8, Location: "federation job federate"},
+				{Value: `up`, Line: 9, Location: "federation job federate"},
+			},
+		},
+		{
+			name:    "dashboard",
+			content: `{"panels": [{"title": "Up", "targets": [{"expr": "up{job=\"api\"}"}]}]}`,
+			format:  FormatDashboard,
+			expected: []Expression{
+				{Value: `up{job="api"}`, Line: 1, Location: "panel Up"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, exprs, err := ExtractExpressions([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("ExtractExpressions returned error: %v", err)
+			}
+			if format != tt.format {
+				t.Errorf("format = %q, want %q", format, tt.format)
+			}
+			if len(exprs) != len(tt.expected) {
+				t.Fatalf("got %d expressions, want %d: %+v", len(exprs), len(tt.expected), exprs)
+			}
+			for i, want := range tt.expected {
+				if exprs[i] != want {
+					t.Errorf("expression %d = %+v, want %+v", i, exprs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractExpressionsUnknownFormat(t *testing.T) {
+	if _, _, err := ExtractExpressions([]byte("name: package\nversion: 1.0.0\n")); err == nil {
+		t.Error("expected an error for an unrecognized format")
+	}
+}
+
+// testExtractor recognizes files starting with "# promql" and treats each other line as an expression
+type testExtractor struct{}
+
+func (testExtractor) Name() string { return "test" }
+
+func (testExtractor) Match(content []byte) bool {
+	return strings.HasPrefix(string(content), "# promql")
+}
+
+func (testExtractor) Extract(_ []byte) ([]Expression, error) {
+	return []Expression{{Value: "up", Line: 2}}, nil
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	saved := extractors
+	defer func() { extractors = saved }()
+
+	RegisterExtractor(testExtractor{})
+
+	format, exprs, err := ExtractExpressions([]byte("# promql\nup\n"))
+	if err != nil {
+		t.Fatalf("ExtractExpressions returned error: %v", err)
+	}
+	if format != "test" || len(exprs) != 1 {
+		t.Errorf("registered extractor was not used: format %q, expressions %+v", format, exprs)
+	}
+}
+
+func TestCheckExpressionLabels(t *testing.T) {
+	exprs := []Expression{
+		{Value: `sum by (job) (rate(x{job="$job"}[$__rate_interval]))`, Line: 2},
+		{Value: `sum(rate(x{job="api"}[{{.window}}]))`, Line: 3},
+		{Value: `rate(y[5m])`, Line: 4},
+	}
+
+	violations := CheckExpressionLabels(exprs, []string{"job"})
+	if len(violations) != 3 {
+		t.Fatalf("got %d violations, want 3", len(violations))
+	}
+	if len(violations[0].MissingLabels) != 0 || len(violations[0].MissingOutputLabels) != 0 {
+		t.Errorf("expression 0 should have no violations, got %+v", violations[0])
+	}
+	if len(violations[1].MissingOutputLabels) != 1 || violations[1].Line != 3 {
+		t.Errorf("expression 1 should drop job on line 3, got %+v", violations[1])
+	}
+	if len(violations[2].MissingLabels) != 1 {
+		t.Errorf("expression 2 should be missing job, got %+v", violations[2])
+	}
+}
+
+func TestRuleSpans(t *testing.T) {
+	content := `groups:
+  - name: example
+    rules:
+      - alert: HighErrorRate
+        expr: |
+          sum(rate(errors_total[5m]))
+            /
+          sum(rate(requests_total[5m]))
+        for: 5m
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`
+
+	expected := []Span{{Start: 4, End: 9}, {Start: 10, End: 11}}
+	if got := RuleSpans([]byte(content)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("RuleSpans() = %v, want %v", got, expected)
+	}
+
+	if got := RuleSpans([]byte(`{"panels": []}`)); got != nil {
+		t.Errorf("RuleSpans() of a dashboard = %v, want nil", got)
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	content := `groups:
+  - name: api
+    rules:
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total[5m]))
+        labels:
+          team: api
+      - alert: Errors
+        expr: |
+          job:errors:rate5m
+            > 0
+        for: 5m
+      - {alert: Flow, expr: up == 0}
+`
+	exprs, err := rulesExtractor{}.Extract([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := []string{"sum by (job) (\n  rate(errors_total[5m])\n)", "job:errors:rate5m > 0", "up == 0"}
+	got, err := RewriteRules([]byte(content), exprs, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `groups:
+  - name: api
+    rules:
+      - record: job:errors:rate5m
+        expr: |
+          sum by (job) (
+            rate(errors_total[5m])
+          )
+        labels:
+          team: api
+      - alert: Errors
+        expr: job:errors:rate5m > 0
+        for: 5m
+      - {alert: Flow, expr: up == 0}
+`
+	if string(got) != expected {
+		t.Errorf("RewriteRules() =\n%s\nwant:\n%s", got, expected)
+	}
+
+	// Values that need quoting are quoted, and flow mappings cannot be rewritten in place
+	rewritten = []string{exprs[0].Value, exprs[1].Value, `{__name__="up"} == 0`}
+	if _, err := RewriteRules([]byte(content), exprs, rewritten); err == nil || !strings.Contains(err.Error(), "line 13") {
+		t.Errorf("RewriteRules() of a flow mapping: error = %v, want one for line 13", err)
+	}
+	rewritten = []string{`{__name__="errors"}`, exprs[1].Value, exprs[2].Value}
+	got, err = RewriteRules([]byte(content), exprs, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "        expr: '{__name__=\"errors\"}'\n        labels:") {
+		t.Errorf("RewriteRules() did not quote the value:\n%s", got)
+	}
+}
+
+func TestExtractRuleFragments(t *testing.T) {
+	content := `- alert: Down
+  expr: up == 0
+  for: 5m
+- record: job:errors:rate5m
+  expr: |
+    sum by (job) (rate(errors_total[5m]))
+`
+	if (rulesExtractor{}).Match([]byte(content)) {
+		t.Fatal("rulesExtractor matched a rule list without groups")
+	}
+	exprs, err := ExtractRuleFragments([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exprs) != 2 || exprs[0].Value != "up == 0" || exprs[0].Line != 2 ||
+		exprs[1].Value != "sum by (job) (rate(errors_total[5m]))" || exprs[1].Line != 5 {
+		t.Fatalf("ExtractRuleFragments() = %+v", exprs)
+	}
+
+	rewritten := []string{exprs[0].Value, "sum by (job) (\n  rate(errors_total[5m])\n)"}
+	got, err := RewriteRules([]byte(content), exprs, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `- alert: Down
+  expr: up == 0
+  for: 5m
+- record: job:errors:rate5m
+  expr: |
+    sum by (job) (
+      rate(errors_total[5m])
+    )
+`
+	if string(got) != expected {
+		t.Errorf("RewriteRules() =\n%s\nwant:\n%s", got, expected)
+	}
+
+	// A bare expr key is a fragment too
+	exprs, err = ExtractRuleFragments([]byte(`expr: up{job="test"}`))
+	if err != nil || len(exprs) != 1 || exprs[0].Value != `up{job="test"}` || exprs[0].Line != 1 {
+		t.Errorf("ExtractRuleFragments() of a bare expr = %+v, %v", exprs, err)
+	}
+}
@@ -0,0 +1,248 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// exprLinePattern matches a line holding an expr or query key, capturing the key prefix and raw value
+const exprLinePattern = `^(\s*(?:-\s+)?(?:expr|query):[ \t]*)(.*?)\s*$`
+
+// textEdit is an insertion of text at a byte offset
+type textEdit struct {
+	pos  int
+	text string
+}
+
+// matcherEdits computes the insertions that add missing default matchers, in source order
+func matcherEdits(expr string, parsed Expr, defaults []*LabelMatcher) []textEdit {
+	var edits []textEdit
+	for _, vs := range VectorSelectors(parsed) {
+		var add []string
+		for _, d := range defaults {
+			present := false
+			for _, m := range vs.Matchers {
+				if m.Name == d.Name {
+					present = true
+					break
+				}
+			}
+			if !present {
+				add = append(add, d.String())
+			}
+		}
+		if len(add) == 0 {
+			continue
+		}
+
+		src := expr[vs.Pos.Start:vs.Pos.End]
+		if !strings.HasSuffix(src, "}") {
+			// Bare metric name: append a new matcher block
+			edits = append(edits, textEdit{pos: vs.Pos.End, text: "{" + strings.Join(add, ",") + "}"})
+			continue
+		}
+
+		// Insert before the closing brace, after any existing matchers
+		inner := strings.TrimSpace(src[strings.Index(src, "{")+1 : len(src)-1])
+		closing := vs.Pos.End - 1
+		for closing > 0 && (expr[closing-1] == ' ' || expr[closing-1] == '\t' || expr[closing-1] == '\n') {
+			closing--
+		}
+		text := strings.Join(add, ",")
+		if inner != "" && !strings.HasSuffix(inner, ",") {
+			text = "," + text
+		}
+		edits = append(edits, textEdit{pos: closing, text: text})
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].pos < edits[j].pos })
+	return edits
+}
+
+// exprSource maps an expression value back to the lines of the YAML file it was read from
+type exprSource struct {
+	value string
+	// line and col give the file position of each byte offset of value, plus one past the end
+	line []int
+	col  []int
+	// escape encodes inserted text for the scalar style the value was written in
+	escape func(string) string
+}
+
+// DefaultMatchers collects repeated label=value command-line flags into the matchers
+// FixRequiredLabels adds. It implements flag.Value.
+type DefaultMatchers []*LabelMatcher
+
+func (d *DefaultMatchers) String() string {
+	parts := make([]string, len(*d))
+	for i, m := range *d {
+		parts[i] = m.Name + "=" + m.Value
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set adds the matcher of a label=value flag
+func (d *DefaultMatchers) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("expected label=value, got %q", value)
+	}
+	*d = append(*d, &LabelMatcher{Name: name, Op: MatchEqual, Value: val})
+	return nil
+}
+
+// FixRequiredLabels rewrites the expr/query values in a YAML file so that every vector
+// selector carries the default matchers. Only the inserted matchers change; all other
+// bytes of the file are preserved. Plain, quoted and literal block (|) values are supported;
+// values that cannot be parsed are left untouched. It returns the new content and the
+// number of selectors changed.
+func FixRequiredLabels(content string, defaults []*LabelMatcher) (string, int) {
+	return FixRequiredLabelsIn(content, defaults, nil)
+}
+
+// FixRequiredLabelsIn is FixRequiredLabels limited to the expressions whose key is on a
+// 1-based line only accepts. A nil only fixes every expression.
+func FixRequiredLabelsIn(content string, defaults []*LabelMatcher, only func(line int) bool) (string, int) {
+	exprRegex := regexp.MustCompile(exprLinePattern)
+
+	lines := strings.Split(content, "\n")
+	total := 0
+
+	for lineNum := 0; lineNum < len(lines); lineNum++ {
+		matches := exprRegex.FindStringSubmatch(lines[lineNum])
+		if len(matches) < 3 || matches[2] == "" || (only != nil && !only(lineNum+1)) {
+			continue
+		}
+
+		src := locateExpr(lines, lineNum, len(matches[1]), matches[2])
+		if src == nil {
+			continue
+		}
+
+		parsed, err := ParseExpr(src.value)
+		if err != nil {
+			continue
+		}
+		edits := matcherEdits(src.value, parsed, defaults)
+		for i := len(edits) - 1; i >= 0; i-- {
+			l, c := src.line[edits[i].pos], src.col[edits[i].pos]
+			lines[l] = lines[l][:c] + src.escape(edits[i].text) + lines[l][c:]
+		}
+		total += len(edits)
+	}
+
+	return strings.Join(lines, "\n"), total
+}
+
+// locateExpr decodes the YAML scalar starting at column start of lines[lineNum]
+func locateExpr(lines []string, lineNum, start int, raw string) *exprSource {
+	identity := func(s string) string { return s }
+
+	switch {
+	case raw == "|" || raw == "|-" || raw == "|+":
+		return locateBlockExpr(lines, lineNum)
+	case strings.HasPrefix(raw, `"`):
+		return locateQuotedExpr(lineNum, start, raw, '"', func(s string) string {
+			return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+		})
+	case strings.HasPrefix(raw, "'"):
+		return locateQuotedExpr(lineNum, start, raw, '\'', func(s string) string {
+			return strings.ReplaceAll(s, "'", "''")
+		})
+	case strings.HasPrefix(raw, ">") || strings.HasPrefix(raw, "|"):
+		// Folded and indentation-indicated block scalars are not rewritten
+		return nil
+	}
+
+	src := &exprSource{value: raw, escape: identity}
+	for i := 0; i <= len(raw); i++ {
+		src.line = append(src.line, lineNum)
+		src.col = append(src.col, start+i)
+	}
+	return src
+}
+
+// locateQuotedExpr decodes a single-line quoted scalar, tracking where each byte came from
+func locateQuotedExpr(lineNum, start int, raw string, quote byte, escape func(string) string) *exprSource {
+	if len(raw) < 2 || raw[len(raw)-1] != quote {
+		return nil
+	}
+
+	src := &exprSource{escape: escape}
+	var value strings.Builder
+	for i := 1; i < len(raw)-1; i++ {
+		src.line = append(src.line, lineNum)
+		src.col = append(src.col, start+i)
+
+		c := raw[i]
+		switch {
+		case quote == '"' && c == '\\':
+			// Only escapes that map to a single character are supported
+			if i+1 >= len(raw)-1 || (raw[i+1] != '"' && raw[i+1] != '\\') {
+				return nil
+			}
+			i++
+		case quote == '\'' && c == '\'':
+			i++
+		}
+		value.WriteByte(raw[i])
+	}
+	src.line = append(src.line, lineNum)
+	src.col = append(src.col, start+len(raw)-1)
+	src.value = value.String()
+	return src
+}
+
+// locateBlockExpr decodes a literal block scalar following the key on lines[lineNum]
+func locateBlockExpr(lines []string, lineNum int) *exprSource {
+	keyIndent := len(lines[lineNum]) - len(strings.TrimLeft(lines[lineNum], " "))
+
+	// The block's indentation is that of its first non-empty line
+	indent := -1
+	end := lineNum + 1
+	for ; end < len(lines); end++ {
+		trimmed := strings.TrimLeft(lines[end], " ")
+		if trimmed == "" {
+			continue
+		}
+		lineIndent := len(lines[end]) - len(trimmed)
+		if indent < 0 {
+			if lineIndent <= keyIndent {
+				break
+			}
+			indent = lineIndent
+		}
+		if lineIndent < indent {
+			break
+		}
+	}
+	if indent < 0 {
+		return nil
+	}
+
+	src := &exprSource{escape: func(s string) string { return s }}
+	var value strings.Builder
+	for l := lineNum + 1; l < end; l++ {
+		text := ""
+		if len(lines[l]) > indent {
+			text = lines[l][indent:]
+		}
+		if l > lineNum+1 {
+			src.line = append(src.line, l-1)
+			src.col = append(src.col, len(lines[l-1]))
+			value.WriteByte('\n')
+		}
+		for i := 0; i < len(text); i++ {
+			src.line = append(src.line, l)
+			src.col = append(src.col, indent+i)
+		}
+		value.WriteString(text)
+	}
+	src.line = append(src.line, end-1)
+	src.col = append(src.col, len(lines[end-1]))
+	src.value = value.String()
+	return src
+}
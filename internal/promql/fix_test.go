@@ -0,0 +1,170 @@
+package promql
+
+import (
+	"testing"
+)
+
+func TestFixRequiredLabels(t *testing.T) {
+	defaults := []*LabelMatcher{{Name: "job", Op: MatchEqual, Value: "myservice"}}
+
+	tests := []struct {
+		name          string
+		input         string
+		expected      string
+		expectChanged int
+	}{
+		{
+			name:          "bare selector",
+			input:         "expr: up == 0",
+			expected:      `expr: up{job="myservice"} == 0`,
+			expectChanged: 1,
+		},
+		{
+			name:          "existing matchers",
+			input:         `expr: rate(errors_total{status="500"}[5m]) > 1`,
+			expected:      `expr: rate(errors_total{status="500",job="myservice"}[5m]) > 1`,
+			expectChanged: 1,
+		},
+		{
+			name:          "empty braces and trailing comma",
+			input:         `expr: a{} / b{status="500", }`,
+			expected:      `expr: a{job="myservice"} / b{status="500",job="myservice" }`,
+			expectChanged: 2,
+		},
+		{
+			name:          "nested selectors keep existing job",
+			input:         `expr: sum by (job) (rate(a{job="api"}[5m])) / on (job) sum by (job) (rate(b[5m] offset 1h))`,
+			expected:      `expr: sum by (job) (rate(a{job="api"}[5m])) / on (job) sum by (job) (rate(b{job="myservice"}[5m] offset 1h))`,
+			expectChanged: 1,
+		},
+		{
+			name:          "selector without metric name",
+			input:         `expr: count({__name__=~"http_.*"})`,
+			expected:      `expr: count({__name__=~"http_.*",job="myservice"})`,
+			expectChanged: 1,
+		},
+		{
+			name:          "double quoted value",
+			input:         `  - expr: "rate(x{a=\"b\"}[5m])"`,
+			expected:      `  - expr: "rate(x{a=\"b\",job=\"myservice\"}[5m])"`,
+			expectChanged: 1,
+		},
+		{
+			name:          "single quoted value",
+			input:         `query: 'up'`,
+			expected:      `query: 'up{job="myservice"}'`,
+			expectChanged: 1,
+		},
+		{
+			name:          "literal block",
+			input:         "- alert: X\n  expr: |\n    sum(rate(x[5m]))\n      /\n    sum(rate(y{a=\"b\"}[5m]))\n  for: 5m\n",
+			expected:      "- alert: X\n  expr: |\n    sum(rate(x{job=\"myservice\"}[5m]))\n      /\n    sum(rate(y{a=\"b\",job=\"myservice\"}[5m]))\n  for: 5m\n",
+			expectChanged: 2,
+		},
+		{
+			name:          "unparseable expression is left alone",
+			input:         "expr: sum(rate(x[5m])",
+			expected:      "expr: sum(rate(x[5m])",
+			expectChanged: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := FixRequiredLabels(tt.input, defaults)
+			if got != tt.expected {
+				t.Errorf("FixRequiredLabels() =\n%s\nwant\n%s", got, tt.expected)
+			}
+			if changed != tt.expectChanged {
+				t.Errorf("FixRequiredLabels() changed %d selectors, want %d", changed, tt.expectChanged)
+			}
+		})
+	}
+}
+
+func TestFixRequiredLabelsPreservesYAML(t *testing.T) {
+	defaults := []*LabelMatcher{
+		{Name: "job", Op: MatchEqual, Value: "api"},
+		{Name: "namespace", Op: MatchEqual, Value: "prod"},
+	}
+
+	input := `# Alerts for the API
+groups:
+  - name: api   # owned by platform
+    rules:
+      - alert: APIDown
+        expr: up{namespace="prod"} == 0
+        for: 5m
+        labels:
+          severity: critical
+`
+	expected := `# Alerts for the API
+groups:
+  - name: api   # owned by platform
+    rules:
+      - alert: APIDown
+        expr: up{namespace="prod",job="api"} == 0
+        for: 5m
+        labels:
+          severity: critical
+`
+
+	got, changed := FixRequiredLabels(input, defaults)
+	if got != expected {
+		t.Errorf("FixRequiredLabels() =\n%s\nwant\n%s", got, expected)
+	}
+	if changed != 1 {
+		t.Errorf("FixRequiredLabels() changed %d selectors, want 1", changed)
+	}
+}
+
+func TestFixRequiredLabelsIn(t *testing.T) {
+	defaults := []*LabelMatcher{{Name: "job", Op: MatchEqual, Value: "api"}}
+	input := `groups:
+  - name: api
+    rules:
+      - record: a
+        expr: sum(up)
+      - record: b
+        expr: sum(up)
+`
+	expected := `groups:
+  - name: api
+    rules:
+      - record: a
+        expr: sum(up)
+      - record: b
+        expr: sum(up{job="api"})
+`
+
+	got, changed := FixRequiredLabelsIn(input, defaults, func(line int) bool { return line == 7 })
+	if got != expected {
+		t.Errorf("FixRequiredLabelsIn() =\n%s\nwant\n%s", got, expected)
+	}
+	if changed != 1 {
+		t.Errorf("FixRequiredLabelsIn() changed %d selectors, want 1", changed)
+	}
+}
+
+func TestDefaultMatchers(t *testing.T) {
+	var d DefaultMatchers
+	for _, value := range []string{"job=api", " env =prod", "empty="} {
+		if err := d.Set(value); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", value, err)
+		}
+	}
+	if got := d.String(); got != "job=api,env=prod,empty=" {
+		t.Errorf("String() = %q, want %q", got, "job=api,env=prod,empty=")
+	}
+	for _, m := range d {
+		if m.Op != MatchEqual {
+			t.Errorf("matcher %s is not an equality matcher", m)
+		}
+	}
+
+	for _, value := range []string{"job", "=api"} {
+		if err := d.Set(value); err == nil {
+			t.Errorf("Set(%q) returned no error", value)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package promql
+
+// Function describes the signature of a PromQL function
+type Function struct {
+	Name     string
+	ArgTypes []ValueType
+	// Variadic is 0 for a fixed argument list, N > 0 when up to N trailing
+	// arguments are optional, and -1 when the last argument may repeat
+	Variadic   int
+	ReturnType ValueType
+}
+
+// minArgs returns the minimum number of arguments the function accepts
+func (f Function) minArgs() int {
+	if f.Variadic == 0 {
+		return len(f.ArgTypes)
+	}
+	return len(f.ArgTypes) - 1
+}
+
+// maxArgs returns the maximum number of arguments, or -1 if unbounded
+func (f Function) maxArgs() int {
+	switch {
+	case f.Variadic < 0:
+		return -1
+	case f.Variadic == 0:
+		return len(f.ArgTypes)
+	}
+	return len(f.ArgTypes) - 1 + f.Variadic
+}
+
+// argType returns the expected type of the i-th argument
+func (f Function) argType(i int) ValueType {
+	if i < len(f.ArgTypes) {
+		return f.ArgTypes[i]
+	}
+	return f.ArgTypes[len(f.ArgTypes)-1]
+}
+
+var (
+	vectorArg = []ValueType{ValueTypeVector}
+	matrixArg = []ValueType{ValueTypeMatrix}
+)
+
+// Functions lists the PromQL functions supported by the parser
+var Functions = map[string]Function{}
+
+func init() {
+	add := func(name string, args []ValueType, variadic int, ret ValueType) {
+		Functions[name] = Function{Name: name, ArgTypes: args, Variadic: variadic, ReturnType: ret}
+	}
+
+	// Instant vector transformations
+	for _, name := range []string{
+		"abs", "absent", "acos", "acosh", "asin", "asinh", "atan", "atanh", "ceil", "cos", "cosh",
+		"deg", "exp", "floor", "histogram_avg", "histogram_count", "histogram_stddev",
+		"histogram_stdvar", "histogram_sum", "ln", "log10", "log2", "rad", "sgn", "sin", "sinh",
+		"sort", "sort_desc", "sqrt", "tan", "tanh", "timestamp",
+	} {
+		add(name, vectorArg, 0, ValueTypeVector)
+	}
+
+	// Range vector functions
+	for _, name := range []string{
+		"absent_over_time", "avg_over_time", "changes", "count_over_time", "delta", "deriv",
+		"idelta", "increase", "irate", "last_over_time", "mad_over_time", "max_over_time",
+		"min_over_time", "present_over_time", "rate", "resets", "stddev_over_time",
+		"stdvar_over_time", "sum_over_time",
+	} {
+		add(name, matrixArg, 0, ValueTypeVector)
+	}
+
+	// Date functions default to vector(time()) when called without arguments
+	for _, name := range []string{
+		"day_of_month", "day_of_week", "day_of_year", "days_in_month", "hour", "minute", "month", "year",
+	} {
+		add(name, vectorArg, 1, ValueTypeVector)
+	}
+
+	add("clamp", []ValueType{ValueTypeVector, ValueTypeScalar, ValueTypeScalar}, 0, ValueTypeVector)
+	add("clamp_max", []ValueType{ValueTypeVector, ValueTypeScalar}, 0, ValueTypeVector)
+	add("clamp_min", []ValueType{ValueTypeVector, ValueTypeScalar}, 0, ValueTypeVector)
+	add("double_exponential_smoothing", []ValueType{ValueTypeMatrix, ValueTypeScalar, ValueTypeScalar}, 0, ValueTypeVector)
+	add("holt_winters", []ValueType{ValueTypeMatrix, ValueTypeScalar, ValueTypeScalar}, 0, ValueTypeVector)
+	add("histogram_fraction", []ValueType{ValueTypeScalar, ValueTypeScalar, ValueTypeVector}, 0, ValueTypeVector)
+	add("histogram_quantile", []ValueType{ValueTypeScalar, ValueTypeVector}, 0, ValueTypeVector)
+	add("info", []ValueType{ValueTypeVector, ValueTypeVector}, 1, ValueTypeVector)
+	add("label_join", []ValueType{ValueTypeVector, ValueTypeString, ValueTypeString, ValueTypeString}, -1, ValueTypeVector)
+	add("label_replace", []ValueType{ValueTypeVector, ValueTypeString, ValueTypeString, ValueTypeString, ValueTypeString}, 0, ValueTypeVector)
+	add("pi", nil, 0, ValueTypeScalar)
+	add("predict_linear", []ValueType{ValueTypeMatrix, ValueTypeScalar}, 0, ValueTypeVector)
+	add("quantile_over_time", []ValueType{ValueTypeScalar, ValueTypeMatrix}, 0, ValueTypeVector)
+	add("round", []ValueType{ValueTypeVector, ValueTypeScalar}, 1, ValueTypeVector)
+	add("scalar", vectorArg, 0, ValueTypeScalar)
+	add("sort_by_label", []ValueType{ValueTypeVector, ValueTypeString}, -1, ValueTypeVector)
+	add("sort_by_label_desc", []ValueType{ValueTypeVector, ValueTypeString}, -1, ValueTypeVector)
+	add("time", nil, 0, ValueTypeScalar)
+	add("vector", []ValueType{ValueTypeScalar}, 0, ValueTypeVector)
+}
+
+// aggregationOps lists the aggregation operators, mapped to whether they take a parameter
+var aggregationOps = map[string]bool{
+	"avg":          false,
+	"bottomk":      true,
+	"count":        false,
+	"count_values": true,
+	"group":        false,
+	"limit_ratio":  true,
+	"limitk":       true,
+	"max":          false,
+	"min":          false,
+	"quantile":     true,
+	"stddev":       false,
+	"stdvar":       false,
+	"sum":          false,
+	"topk":         true,
+}
+
+// IsAggregationOp reports whether name is a PromQL aggregation operator
+func IsAggregationOp(name string) bool {
+	_, ok := aggregationOps[name]
+	return ok
+}
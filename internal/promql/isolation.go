@@ -0,0 +1,116 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IsolationViolation represents an expression that can mix series from different tenants
+type IsolationViolation struct {
+	Expression string
+	// Operand is the part of the expression that breaks isolation
+	Operand string
+	Message string
+	Line    int
+}
+
+// CheckTenantIsolation checks that every vector selector in each expression pins the tenant
+// label to the same value, and that every binary operation between vectors matches on it
+func CheckTenantIsolation(content string, tenantLabel string) []IsolationViolation {
+	exprs, err := rulesExtractor{}.Extract([]byte(content))
+	if err != nil {
+		return nil
+	}
+
+	var violations []IsolationViolation
+	for _, re := range exprs {
+		parsed, err := ParseExpr(re.Value)
+		if err != nil {
+			continue
+		}
+		for _, v := range checkExprIsolation(parsed, tenantLabel) {
+			v.Expression = re.Value
+			v.Line = re.Line
+			violations = append(violations, v)
+		}
+	}
+
+	return violations
+}
+
+// checkExprIsolation checks a single parsed expression for tenant isolation
+func checkExprIsolation(expr Expr, tenantLabel string) []IsolationViolation {
+	var violations []IsolationViolation
+
+	// Every selector must select exactly one tenant, and the same one throughout
+	tenant := ""
+	for _, vs := range VectorSelectors(expr) {
+		value := ""
+		for _, m := range vs.Matchers {
+			if m.Name == tenantLabel && m.Op == MatchEqual && m.Value != "" {
+				value = m.Value
+				break
+			}
+		}
+
+		switch {
+		case value == "":
+			violations = append(violations, IsolationViolation{
+				Operand: vs.String(),
+				Message: fmt.Sprintf("Selector %s has no %s=\"...\" matcher and may select series from any tenant", vs, tenantLabel),
+			})
+		case tenant == "":
+			tenant = value
+		case value != tenant:
+			violations = append(violations, IsolationViolation{
+				Operand: vs.String(),
+				Message: fmt.Sprintf("Selector %s selects %s %q, but the expression also selects %q", vs, tenantLabel, value, tenant),
+			})
+		}
+	}
+
+	// Binary operations must not match series across tenants
+	Inspect(expr, func(e Expr, _ []Expr) bool {
+		bin, ok := e.(*BinaryExpr)
+		if !ok || bin.LHS.Type() != ValueTypeVector || bin.RHS.Type() != ValueTypeVector {
+			return true
+		}
+
+		if m := bin.Matching; m != nil {
+			listed := false
+			for _, name := range m.Labels {
+				if name == tenantLabel {
+					listed = true
+					break
+				}
+			}
+			switch {
+			case m.On && !listed:
+				violations = append(violations, IsolationViolation{
+					Operand: bin.String(),
+					Message: fmt.Sprintf("Binary operation %s matches on (%s), which does not include %s", bin.Op, strings.Join(m.Labels, ", "), tenantLabel),
+				})
+			case !m.On && listed:
+				violations = append(violations, IsolationViolation{
+					Operand: bin.String(),
+					Message: fmt.Sprintf("Binary operation %s ignores %s when matching series", bin.Op, tenantLabel),
+				})
+			}
+		}
+
+		for _, side := range []struct {
+			name    string
+			operand Expr
+		}{{"Left", bin.LHS}, {"Right", bin.RHS}} {
+			if len(OutputLabelsMissing(side.operand, []string{tenantLabel})) > 0 {
+				violations = append(violations, IsolationViolation{
+					Operand: side.operand.String(),
+					Message: fmt.Sprintf("%s operand of %s drops %s, so it can be matched against series of any tenant", side.name, bin.Op, tenantLabel),
+				})
+			}
+		}
+		return true
+	})
+
+	return violations
+}
@@ -0,0 +1,110 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckExprIsolation(t *testing.T) {
+	tests := []struct {
+		name           string
+		expr           string
+		expectOperands []string
+		expectMessages []string
+	}{
+		{
+			name:           "all selectors pinned to one tenant",
+			expr:           `rate(a{tenant="x"}[5m]) / rate(b{tenant="x"}[5m])`,
+			expectOperands: nil,
+		},
+		{
+			name:           "right operand without tenant matcher",
+			expr:           `a{tenant="x"} / b`,
+			expectOperands: []string{"b"},
+			expectMessages: []string{"no tenant"},
+		},
+		{
+			name:           "selectors for different tenants",
+			expr:           `a{tenant="x"} / b{tenant="y"}`,
+			expectOperands: []string{`b{tenant="y"}`},
+			expectMessages: []string{`also selects "x"`},
+		},
+		{
+			name:           "regex tenant matcher is not isolated",
+			expr:           `a{tenant=~"x|y"}`,
+			expectOperands: []string{`a{tenant=~"x|y"}`},
+			expectMessages: []string{"no tenant"},
+		},
+		{
+			name:           "on clause without tenant",
+			expr:           `a{tenant="x"} / on (instance) b{tenant="x"}`,
+			expectOperands: []string{`a{tenant="x"} / on (instance) b{tenant="x"}`},
+			expectMessages: []string{"matches on (instance)"},
+		},
+		{
+			name:           "ignoring tenant",
+			expr:           `a{tenant="x"} / ignoring (tenant) b{tenant="x"}`,
+			expectOperands: []string{`a{tenant="x"} / ignoring (tenant) b{tenant="x"}`},
+			expectMessages: []string{"ignores tenant"},
+		},
+		{
+			name:           "aggregation drops tenant before matching",
+			expr:           `sum(a{tenant="x"}) / on (tenant) sum by (tenant) (b{tenant="x"})`,
+			expectOperands: []string{`sum(a{tenant="x"})`},
+			expectMessages: []string{"Left operand"},
+		},
+		{
+			name:           "aggregation keeping tenant",
+			expr:           `sum by (tenant) (a{tenant="x"}) / on (tenant) sum by (tenant) (b{tenant="x"})`,
+			expectOperands: nil,
+		},
+		{
+			name:           "scalar comparison does not match series",
+			expr:           `sum(a{tenant="x"}) > 1`,
+			expectOperands: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParseExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.expr, err)
+			}
+			violations := checkExprIsolation(expr, "tenant")
+			if len(violations) != len(tt.expectOperands) {
+				t.Fatalf("Expected %d violations, got %d: %+v", len(tt.expectOperands), len(violations), violations)
+			}
+			for i, v := range violations {
+				if v.Operand != tt.expectOperands[i] {
+					t.Errorf("Violation %d operand = %q, want %q", i, v.Operand, tt.expectOperands[i])
+				}
+				if !strings.Contains(v.Message, tt.expectMessages[i]) {
+					t.Errorf("Violation %d message = %q, want it to contain %q", i, v.Message, tt.expectMessages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTenantIsolation(t *testing.T) {
+	content := `groups:
+  - name: test
+    rules:
+      - record: tenant:errors:ratio
+        expr: |
+          sum by (tenant) (rate(errors_total{tenant="x"}[5m]))
+            /
+          sum by (tenant) (rate(requests_total{tenant="x"}[5m]))
+      - alert: Leaky
+        expr: 'a{tenant="x"} / b'
+`
+
+	violations := CheckTenantIsolation(content, "tenant")
+	if len(violations) != 1 {
+		t.Fatalf("Expected 1 violation, got %d: %+v", len(violations), violations)
+	}
+	if v := violations[0]; v.Operand != "b" || v.Line != 10 || v.Expression != `a{tenant="x"} / b` {
+		t.Errorf("Unexpected violation: %+v", v)
+	}
+}
@@ -5,14 +5,19 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 // LabelViolation represents a PromQL expression that's missing required labels
 type LabelViolation struct {
 	Expression    string
 	MissingLabels []string
-	Line          int
-	Suggestion    string
+	// MissingOutputLabels lists required labels dropped from the resulting series,
+	// e.g. by an aggregation or on() clause that doesn't preserve them
+	MissingOutputLabels []string
+	Line                int
+	Suggestion          string
 }
 
 // AlertViolation represents an alert that's missing required labels
@@ -22,36 +27,38 @@ type AlertViolation struct {
 	Line          int
 }
 
-// CheckRequiredLabels checks PromQL expressions for required labels
+// CheckRequiredLabels checks the expression of each rule in a rule file for required labels.
+// Expressions are read from the parsed YAML, so block scalars spanning several lines are
+// checked like single-line ones; content that does not parse has no expressions.
 func CheckRequiredLabels(content string, requiredLabels []string) []LabelViolation {
 	var violations []LabelViolation
 
-	// Find all PromQL expressions in YAML
-	exprRegex := regexp.MustCompile(`(?m)^(\s*(?:expr|query):)\s*(.+?)$`)
-
-	lines := strings.Split(content, "\n")
-	for lineNum, line := range lines {
-		matches := exprRegex.FindStringSubmatch(line)
-		if len(matches) < 3 {
-			continue
-		}
+	exprs, err := rulesExtractor{}.Extract([]byte(content))
+	if err != nil {
+		return nil
+	}
 
-		expression := strings.TrimSpace(matches[2])
+	// Static labels set by a rule are also attached to its resulting series
+	staticLabels := ruleLabelsByExprLine(content)
 
-		// Remove quotes
-		expression = strings.Trim(expression, `"'`)
+	for _, expr := range exprs {
+		expression := expr.Value
 
 		// Check for required labels
 		missingLabels := checkLabelsInExpression(expression, requiredLabels)
 
 		violation := LabelViolation{
-			Expression:    expression,
-			MissingLabels: missingLabels,
-			Line:          lineNum + 1,
+			Expression:          expression,
+			MissingLabels:       missingLabels,
+			MissingOutputLabels: checkOutputLabels(expression, requiredLabels, staticLabels[expr.Line]),
+			Line:                expr.Line,
 		}
 
-		if len(missingLabels) > 0 {
+		switch {
+		case len(missingLabels) > 0:
 			violation.Suggestion = generateSuggestion(expression, missingLabels)
+		case len(violation.MissingOutputLabels) > 0:
+			violation.Suggestion = generateOutputSuggestion(violation.MissingOutputLabels)
 		}
 
 		violations = append(violations, violation)
@@ -84,6 +91,86 @@ func checkLabelsInExpression(expr string, requiredLabels []string) []string {
 	return missing
 }
 
+// checkOutputLabels checks that required labels survive to the series produced by an expression.
+// Labels the rule sets statically are always present. Expressions that fail to parse are
+// skipped, as the selector check still applies to them.
+func checkOutputLabels(expr string, requiredLabels []string, staticLabels []string) []string {
+	parsed, err := ParseExpr(expr)
+	if err != nil {
+		return nil
+	}
+
+	var missing []string
+	for _, label := range OutputLabelsMissing(parsed, requiredLabels) {
+		static := false
+		for _, s := range staticLabels {
+			if s == label {
+				static = true
+				break
+			}
+		}
+		if !static {
+			missing = append(missing, label)
+		}
+	}
+	return missing
+}
+
+// ruleLabelsByExprLine maps the line of each rule's expr to the names in its labels section
+func ruleLabelsByExprLine(content string) map[int][]string {
+	result := make(map[int][]string)
+
+	for _, doc := range yamlDocuments([]byte(content)) {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				exprKey := mappingKey(rule, "expr")
+				labels := mappingValue(rule, "labels")
+				if exprKey == nil || labels == nil || labels.Kind != yaml.MappingNode {
+					continue
+				}
+				for i := 0; i+1 < len(labels.Content); i += 2 {
+					result[exprKey.Line] = append(result[exprKey.Line], labels.Content[i].Value)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// mappingKey returns the key node for key in a YAML mapping node
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value node for key in a YAML mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
 // extractLabelsFromExpression extracts all label names from a PromQL expression
 func extractLabelsFromExpression(expr string) []string {
 	labels := make(map[string]bool)
@@ -174,6 +261,12 @@ func generateSuggestion(expr string, missingLabels []string) string {
 	return "Add label matcher: " + match + "{" + strings.Join(labels, ", ") + "}"
 }
 
+// generateOutputSuggestion generates a suggestion for preserving labels on the resulting series
+func generateOutputSuggestion(missingLabels []string) string {
+	labelStr := strings.Join(missingLabels, ", ")
+	return fmt.Sprintf("Preserve %s on the result by adding it to by (...) / on (...) clauses, or re-add it with label_replace()", labelStr)
+}
+
 // CheckAlertLabels checks that alerts have required labels in their labels section
 func CheckAlertLabels(content string, requiredLabels []string) []AlertViolation {
 	var violations []AlertViolation
@@ -305,3 +305,66 @@ groups:
 		t.Errorf("Expected no violations for alert with location label, got %d: %v", len(violations), violations)
 	}
 }
+
+func TestCheckRequiredLabelsOutput(t *testing.T) {
+	content := `
+groups:
+  - name: test
+    rules:
+      - alert: DropsJob
+        expr: sum by (instance) (rate(errors_total{job="api"}[5m])) > 1
+      - alert: KeepsJob
+        expr: sum by (job, instance) (rate(errors_total{job="api"}[5m])) > 1
+      - alert: RelabelsJob
+        expr: label_replace(sum(rate(errors_total{job="api"}[5m])), "job", "api", "", "") > 1
+      - alert: StaticJob
+        expr: sum(rate(errors_total{job="api"}[5m])) > 1
+        labels:
+          job: api
+`
+
+	violations := CheckRequiredLabels(content, []string{"job"})
+	if len(violations) != 4 {
+		t.Fatalf("Expected 4 expressions, got %d", len(violations))
+	}
+
+	expected := [][]string{{"job"}, nil, nil, nil}
+	for i, v := range violations {
+		if len(v.MissingLabels) != 0 {
+			t.Errorf("Expression %d: expected no missing selector labels, got %v", i, v.MissingLabels)
+		}
+		if len(v.MissingOutputLabels) != len(expected[i]) {
+			t.Errorf("Expression %d: expected missing output labels %v, got %v", i, expected[i], v.MissingOutputLabels)
+		}
+	}
+
+	if violations[0].Suggestion == "" {
+		t.Error("Expected a suggestion for the expression dropping 'job'")
+	}
+}
+
+func TestCheckRequiredLabelsBlockScalar(t *testing.T) {
+	content := `groups:
+  - name: test
+    rules:
+      - alert: DropsJob
+        expr: |
+          sum by (instance) (
+            rate(errors_total{job="api"}[5m])
+          ) > 1
+      - alert: Folded
+        expr: >
+          rate(errors_total[5m]) > 1
+`
+
+	violations := CheckRequiredLabels(content, []string{"job"})
+	if len(violations) != 2 {
+		t.Fatalf("Expected 2 expressions, got %d: %+v", len(violations), violations)
+	}
+	if violations[0].Line != 5 || len(violations[0].MissingLabels) != 0 || len(violations[0].MissingOutputLabels) != 1 {
+		t.Errorf("Block scalar expression: got %+v, want 'job' dropped from the result at line 5", violations[0])
+	}
+	if violations[1].Line != 10 || len(violations[1].MissingLabels) != 1 {
+		t.Errorf("Folded expression: got %+v, want 'job' missing at line 10", violations[1])
+	}
+}
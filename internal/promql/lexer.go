@@ -0,0 +1,303 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenType identifies the kind of a lexed PromQL token
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdentifier
+	tokNumber
+	tokDuration
+	tokString
+	tokLeftBrace
+	tokRightBrace
+	tokLeftParen
+	tokRightParen
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+	tokColon
+	tokAt
+	tokAssign   // =
+	tokEqlRegex // =~
+	tokNeqRegex // !~
+	tokOperator // + - * / % ^ == != > < >= <= and or unless atan2
+	tokKeyword  // by without on ignoring group_left group_right bool offset
+)
+
+// token is a single lexical element of a PromQL expression
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokEOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+// keywords are identifiers with special meaning in PromQL
+var keywords = map[string]tokenType{
+	"and":         tokOperator,
+	"or":          tokOperator,
+	"unless":      tokOperator,
+	"atan2":       tokOperator,
+	"by":          tokKeyword,
+	"without":     tokKeyword,
+	"on":          tokKeyword,
+	"ignoring":    tokKeyword,
+	"group_left":  tokKeyword,
+	"group_right": tokKeyword,
+	"bool":        tokKeyword,
+	"offset":      tokKeyword,
+}
+
+// durationUnits lists valid PromQL duration unit suffixes, longest first
+var durationUnits = []string{"ms", "s", "m", "h", "d", "w", "y"}
+
+// lex splits a PromQL expression into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+
+	for i < len(input) {
+		ch := input[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			continue
+		case ch == '#':
+			// Comments run to the end of the line
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		start := i
+		switch ch {
+		case '{':
+			tokens = append(tokens, token{tokLeftBrace, "{", start})
+			i++
+		case '}':
+			tokens = append(tokens, token{tokRightBrace, "}", start})
+			i++
+		case '(':
+			tokens = append(tokens, token{tokLeftParen, "(", start})
+			i++
+		case ')':
+			tokens = append(tokens, token{tokRightParen, ")", start})
+			i++
+		case '[':
+			tokens = append(tokens, token{tokLeftBracket, "[", start})
+			i++
+		case ']':
+			tokens = append(tokens, token{tokRightBracket, "]", start})
+			i++
+		case ',':
+			tokens = append(tokens, token{tokComma, ",", start})
+			i++
+		case ':':
+			tokens = append(tokens, token{tokColon, ":", start})
+			i++
+		case '@':
+			tokens = append(tokens, token{tokAt, "@", start})
+			i++
+		case '+', '-', '*', '/', '%', '^':
+			tokens = append(tokens, token{tokOperator, string(ch), start})
+			i++
+		case '=':
+			switch {
+			case strings.HasPrefix(input[i:], "=="):
+				tokens = append(tokens, token{tokOperator, "==", start})
+				i += 2
+			case strings.HasPrefix(input[i:], "=~"):
+				tokens = append(tokens, token{tokEqlRegex, "=~", start})
+				i += 2
+			default:
+				tokens = append(tokens, token{tokAssign, "=", start})
+				i++
+			}
+		case '!':
+			switch {
+			case strings.HasPrefix(input[i:], "!="):
+				tokens = append(tokens, token{tokOperator, "!=", start})
+				i += 2
+			case strings.HasPrefix(input[i:], "!~"):
+				tokens = append(tokens, token{tokNeqRegex, "!~", start})
+				i += 2
+			default:
+				return nil, fmt.Errorf("unexpected character '!' at position %d", start)
+			}
+		case '>', '<':
+			if i+1 < len(input) && input[i+1] == '=' {
+				tokens = append(tokens, token{tokOperator, input[i : i+2], start})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokOperator, string(ch), start})
+				i++
+			}
+		case '"', '\'', '`':
+			end, err := scanString(input, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokString, input[start:end], start})
+			i = end
+		default:
+			switch {
+			case isDigit(ch) || (ch == '.' && i+1 < len(input) && isDigit(input[i+1])):
+				typ, end := scanNumberOrDuration(input, i)
+				tokens = append(tokens, token{typ, input[start:end], start})
+				i = end
+			case isIdentStart(ch):
+				for i < len(input) && isIdentChar(input[i]) {
+					i++
+				}
+				word := input[start:i]
+				typ := tokIdentifier
+				if kw, ok := keywords[strings.ToLower(word)]; ok {
+					typ = kw
+					word = strings.ToLower(word)
+				}
+				tokens = append(tokens, token{typ, word, start})
+			default:
+				r := []rune(input[i:])[0]
+				if unicode.IsSpace(r) {
+					i += len(string(r))
+					continue
+				}
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+			}
+		}
+	}
+
+	tokens = append(tokens, token{tokEOF, "", len(input)})
+	return tokens, nil
+}
+
+// scanString returns the end offset of the quoted string starting at pos
+func scanString(input string, pos int) (int, error) {
+	quote := input[pos]
+	i := pos + 1
+	for i < len(input) {
+		switch input[i] {
+		case '\\':
+			if quote != '`' {
+				i += 2
+				continue
+			}
+		case quote:
+			return i + 1, nil
+		case '\n':
+			if quote != '`' {
+				return 0, fmt.Errorf("unterminated string starting at position %d", pos)
+			}
+		}
+		i++
+	}
+	return 0, fmt.Errorf("unterminated string starting at position %d", pos)
+}
+
+// scanNumberOrDuration scans a numeric literal or a duration such as 1h30m
+func scanNumberOrDuration(input string, pos int) (tokenType, int) {
+	i := pos
+
+	// Hexadecimal literals
+	if strings.HasPrefix(input[i:], "0x") || strings.HasPrefix(input[i:], "0X") {
+		i += 2
+		for i < len(input) && isHexDigit(input[i]) {
+			i++
+		}
+		return tokNumber, i
+	}
+
+	for i < len(input) && isDigit(input[i]) {
+		i++
+	}
+
+	// A duration is a sequence of integer/unit pairs, e.g. 1h30m
+	if unitLen := durationUnitAt(input, i); unitLen > 0 {
+		for {
+			i += unitLen
+			j := i
+			for j < len(input) && isDigit(input[j]) {
+				j++
+			}
+			if j == i {
+				break
+			}
+			unitLen = durationUnitAt(input, j)
+			if unitLen == 0 {
+				break
+			}
+			i = j
+		}
+		return tokDuration, i
+	}
+
+	if i < len(input) && input[i] == '.' {
+		i++
+		for i < len(input) && isDigit(input[i]) {
+			i++
+		}
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		j := i + 1
+		if j < len(input) && (input[j] == '+' || input[j] == '-') {
+			j++
+		}
+		if j < len(input) && isDigit(input[j]) {
+			i = j
+			for i < len(input) && isDigit(input[i]) {
+				i++
+			}
+		}
+	}
+	return tokNumber, i
+}
+
+// durationUnitAt returns the length of the duration unit at pos, or 0 if there is none
+func durationUnitAt(input string, pos int) int {
+	for _, unit := range durationUnits {
+		if !strings.HasPrefix(input[pos:], unit) {
+			continue
+		}
+		// The unit must not be the start of a longer identifier
+		end := pos + len(unit)
+		if end < len(input) && isIdentStart(input[end]) {
+			continue
+		}
+		return len(unit)
+	}
+	return 0
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// isIdentStart reports whether ch can start an identifier. Colons are only
+// allowed after the first character so that subquery steps such as [5m:1m]
+// lex unambiguously.
+func isIdentStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || isDigit(ch) || ch == ':'
+}
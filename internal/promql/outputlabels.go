@@ -0,0 +1,275 @@
+package promql
+
+import (
+	"sort"
+)
+
+// labelSet tracks which labels can be present on the series produced by an expression.
+// An open set stands for the arbitrary labels of selected series, minus those known to
+// be dropped; a closed set lists exactly the labels that can remain.
+type labelSet struct {
+	open    bool
+	present map[string]bool
+	dropped map[string]bool
+}
+
+func openLabelSet() *labelSet {
+	return &labelSet{open: true, present: map[string]bool{}, dropped: map[string]bool{}}
+}
+
+func closedLabelSet(names ...string) *labelSet {
+	ls := &labelSet{present: map[string]bool{}, dropped: map[string]bool{}}
+	for _, name := range names {
+		ls.present[name] = true
+	}
+	return ls
+}
+
+// has reports whether the label can be present on the output series
+func (ls *labelSet) has(name string) bool {
+	if ls.open {
+		return !ls.dropped[name]
+	}
+	return ls.present[name]
+}
+
+func (ls *labelSet) add(name string) {
+	if ls.open {
+		delete(ls.dropped, name)
+		return
+	}
+	ls.present[name] = true
+}
+
+func (ls *labelSet) drop(names ...string) {
+	for _, name := range names {
+		if ls.open {
+			ls.dropped[name] = true
+		} else {
+			delete(ls.present, name)
+		}
+	}
+}
+
+// keep returns a closed set of the given labels that can be present in ls
+func (ls *labelSet) keep(names []string) *labelSet {
+	kept := closedLabelSet()
+	for _, name := range names {
+		if ls.has(name) {
+			kept.present[name] = true
+		}
+	}
+	return kept
+}
+
+// intersect returns the labels that can be present in both sets
+func (ls *labelSet) intersect(other *labelSet) *labelSet {
+	switch {
+	case ls.open && other.open:
+		result := openLabelSet()
+		for name := range ls.dropped {
+			result.dropped[name] = true
+		}
+		for name := range other.dropped {
+			result.dropped[name] = true
+		}
+		return result
+	case ls.open:
+		return other.intersect(ls)
+	}
+	result := closedLabelSet()
+	for name := range ls.present {
+		if other.has(name) {
+			result.present[name] = true
+		}
+	}
+	return result
+}
+
+// OutputLabelsMissing returns the labels from required that cannot be present on the
+// series produced by expr, following the label set through aggregations, vector
+// matching and label functions.
+func OutputLabelsMissing(expr Expr, required []string) []string {
+	ls := outputLabels(expr)
+	var missing []string
+	for _, name := range required {
+		if !ls.has(name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// OutputLabels returns the labels known to be present on the series produced by expr,
+// and whether other labels of the selected series may also be present.
+func OutputLabels(expr Expr) (labels []string, open bool) {
+	ls := outputLabels(expr)
+	if ls.open {
+		return nil, true
+	}
+	for name := range ls.present {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	return labels, false
+}
+
+// outputLabels computes the label set of the series an expression evaluates to
+func outputLabels(expr Expr) *labelSet {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		ls := openLabelSet()
+		for _, m := range e.Matchers {
+			if matcherRequiresEmpty(m) {
+				ls.drop(m.Name)
+			}
+		}
+		return ls
+	case *MatrixSelector:
+		return outputLabels(e.VectorSelector)
+	case *SubqueryExpr:
+		return outputLabels(e.Expr)
+	case *ParenExpr:
+		return outputLabels(e.Expr)
+	case *UnaryExpr:
+		return outputLabels(e.Expr)
+	case *AggregateExpr:
+		return aggregateOutputLabels(e)
+	case *Call:
+		return callOutputLabels(e)
+	case *BinaryExpr:
+		return binaryOutputLabels(e)
+	}
+	// Literals carry no labels
+	return closedLabelSet()
+}
+
+func aggregateOutputLabels(e *AggregateExpr) *labelSet {
+	inner := outputLabels(e.Expr)
+
+	var ls *labelSet
+	switch {
+	case e.Op == "topk" || e.Op == "bottomk" || e.Op == "limitk" || e.Op == "limit_ratio":
+		// Selection aggregations return the input series unchanged
+		return inner
+	case e.Without:
+		ls = inner
+		ls.drop(e.Grouping...)
+	default:
+		ls = inner.keep(e.Grouping)
+	}
+
+	if e.Op == "count_values" {
+		if s, ok := Unwrap(e.Param).(*StringLiteral); ok {
+			ls.add(s.Val)
+		}
+	}
+	return ls
+}
+
+func callOutputLabels(e *Call) *labelSet {
+	switch e.Func {
+	case "vector", "time", "pi", "scalar":
+		return closedLabelSet()
+	case "absent", "absent_over_time":
+		// absent() only carries labels from equality matchers of a plain selector
+		ls := closedLabelSet()
+		var vs *VectorSelector
+		switch arg := Unwrap(e.Args[0]).(type) {
+		case *VectorSelector:
+			vs = arg
+		case *MatrixSelector:
+			vs = arg.VectorSelector
+		}
+		if vs != nil {
+			for _, m := range vs.Matchers {
+				if m.Op == MatchEqual && m.Name != "__name__" && m.Value != "" {
+					ls.add(m.Name)
+				}
+			}
+		}
+		return ls
+	case "label_replace", "label_join":
+		ls := outputLabels(e.Args[0])
+		if dst, ok := Unwrap(e.Args[1]).(*StringLiteral); ok {
+			ls.add(dst.Val)
+		}
+		return ls
+	case "histogram_quantile", "histogram_fraction":
+		ls := outputLabels(e.Args[len(e.Args)-1])
+		ls.drop("le")
+		return ls
+	}
+
+	// Everything else passes through the labels of its first series argument
+	for _, arg := range e.Args {
+		if typ := arg.Type(); typ == ValueTypeVector || typ == ValueTypeMatrix {
+			return outputLabels(arg)
+		}
+	}
+	return closedLabelSet()
+}
+
+func binaryOutputLabels(e *BinaryExpr) *labelSet {
+	lt, rt := e.LHS.Type(), e.RHS.Type()
+	switch {
+	case lt == ValueTypeScalar && rt == ValueTypeScalar:
+		return closedLabelSet()
+	case lt == ValueTypeScalar:
+		return outputLabels(e.RHS)
+	case rt == ValueTypeScalar:
+		return outputLabels(e.LHS)
+	}
+
+	lhs := outputLabels(e.LHS)
+	rhs := outputLabels(e.RHS)
+
+	switch e.Op {
+	case "and", "unless":
+		return lhs
+	case "or":
+		return lhs.intersect(rhs)
+	}
+
+	m := e.Matching
+	if m == nil {
+		return lhs
+	}
+
+	switch m.Card {
+	case CardManyToOne:
+		includeLabels(lhs, rhs, m.Include)
+		return lhs
+	case CardOneToMany:
+		includeLabels(rhs, lhs, m.Include)
+		return rhs
+	}
+
+	if m.On {
+		return lhs.keep(m.Labels)
+	}
+	lhs.drop(m.Labels...)
+	return lhs
+}
+
+// includeLabels copies group_left/group_right labels from the "one" side to the "many" side
+func includeLabels(many, one *labelSet, include []string) {
+	for _, name := range include {
+		if one.has(name) {
+			many.add(name)
+		} else {
+			many.drop(name)
+		}
+	}
+}
+
+// matcherRequiresEmpty reports whether a matcher only selects series without the label
+func matcherRequiresEmpty(m *LabelMatcher) bool {
+	switch m.Op {
+	case MatchEqual:
+		return m.Value == ""
+	case MatchRegexp:
+		return m.Value == "" || m.Value == "^$"
+	}
+	return false
+}
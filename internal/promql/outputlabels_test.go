@@ -0,0 +1,181 @@
+package promql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutputLabelsMissing(t *testing.T) {
+	tests := []struct {
+		name          string
+		expr          string
+		required      []string
+		expectMissing []string
+	}{
+		{
+			name:          "plain selector keeps all labels",
+			expr:          `rate(x{job="a"}[5m])`,
+			required:      []string{"job", "instance"},
+			expectMissing: nil,
+		},
+		{
+			name:          "by clause drops labels not listed",
+			expr:          `sum by (instance) (rate(x{job="a"}[5m]))`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "postfix by clause keeps listed labels",
+			expr:          `sum(rate(x[5m])) by (job, instance) > 1`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "without clause drops listed labels",
+			expr:          `sum without (job) (x)`,
+			required:      []string{"job", "instance"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "aggregation without grouping drops everything",
+			expr:          `count(up{job="a"} == 0)`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "label_replace adds the label back",
+			expr:          `label_replace(sum by (instance) (x), "job", "api", "", "")`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "label_join adds the label back",
+			expr:          `label_join(sum(x), "job", "-", "a", "b")`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "on clause keeps only matching labels",
+			expr:          `a / on (instance) b`,
+			required:      []string{"job", "instance"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "ignoring clause drops ignored labels",
+			expr:          `a / ignoring (job) b`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "group_left keeps many side and includes labels from one side",
+			expr:          `sum by (instance) (a) * on (instance) group_left (job) b`,
+			required:      []string{"job", "instance"},
+			expectMissing: nil,
+		},
+		{
+			name:          "group_left include from side without the label",
+			expr:          `a * on (instance) group_left (job) sum by (instance) (b)`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "group_right keeps right side labels",
+			expr:          `sum by (instance) (a) * on (instance) group_right b`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "and keeps left side labels",
+			expr:          `sum by (instance) (a) and on (instance) b{job="x"}`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "or requires both sides",
+			expr:          `a or sum by (instance) (b)`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "vector literal has no labels",
+			expr:          `vector(1)`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+		{
+			name:          "absent keeps equality matchers",
+			expr:          `absent(up{job="api",instance=~".+"})`,
+			required:      []string{"job", "instance"},
+			expectMissing: []string{"instance"},
+		},
+		{
+			name:          "histogram_quantile drops le",
+			expr:          `histogram_quantile(0.9, sum by (le, job) (rate(x_bucket[5m])))`,
+			required:      []string{"job", "le"},
+			expectMissing: []string{"le"},
+		},
+		{
+			name:          "count_values adds its label",
+			expr:          `count_values("version", build_info)`,
+			required:      []string{"version"},
+			expectMissing: nil,
+		},
+		{
+			name:          "topk keeps input labels",
+			expr:          `topk(3, x)`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "comparison with scalar keeps vector labels",
+			expr:          `1 < sum by (job) (x)`,
+			required:      []string{"job"},
+			expectMissing: nil,
+		},
+		{
+			name:          "matcher on empty value removes label",
+			expr:          `x{job=""}`,
+			required:      []string{"job"},
+			expectMissing: []string{"job"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParseExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.expr, err)
+			}
+			got := OutputLabelsMissing(expr, tt.required)
+			if !reflect.DeepEqual(got, tt.expectMissing) {
+				t.Errorf("OutputLabelsMissing(%q) = %v, want %v", tt.expr, got, tt.expectMissing)
+			}
+		})
+	}
+}
+
+func TestOutputLabels(t *testing.T) {
+	tests := []struct {
+		expr         string
+		expectLabels []string
+		expectOpen   bool
+	}{
+		{`up`, nil, true},
+		{`sum by (job, instance) (up)`, []string{"instance", "job"}, false},
+		{`sum(up)`, nil, false},
+		{`label_replace(sum(up), "env", "prod", "", "")`, []string{"env"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := ParseExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.expr, err)
+			}
+			labels, open := OutputLabels(expr)
+			if open != tt.expectOpen || !reflect.DeepEqual(labels, tt.expectLabels) {
+				t.Errorf("OutputLabels(%q) = %v, %v; want %v, %v", tt.expr, labels, open, tt.expectLabels, tt.expectOpen)
+			}
+		})
+	}
+}
@@ -0,0 +1,732 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseError describes a syntax error in a PromQL expression
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Binary operator precedences, lowest first
+const (
+	precOr = iota + 1
+	precAnd
+	precComparison
+	precAdd
+	precMul
+	precPow
+)
+
+var binaryPrecedence = map[string]int{
+	"or":     precOr,
+	"and":    precAnd,
+	"unless": precAnd,
+	"==":     precComparison,
+	"!=":     precComparison,
+	">":      precComparison,
+	"<":      precComparison,
+	">=":     precComparison,
+	"<=":     precComparison,
+	"+":      precAdd,
+	"-":      precAdd,
+	"*":      precMul,
+	"/":      precMul,
+	"%":      precMul,
+	"atan2":  precMul,
+	"^":      precPow,
+}
+
+// IsComparisonOperator reports whether op is a comparison operator
+func IsComparisonOperator(op string) bool {
+	return binaryPrecedence[op] == precComparison
+}
+
+// IsSetOperator reports whether op is one of the set operators and, or, unless
+func IsSetOperator(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+// parser is a recursive-descent parser over lexed PromQL tokens
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr parses a PromQL expression into an expression tree
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, &ParseError{Pos: 0, Msg: err.Error()}
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.errorf(t, "expected %s, got %s", what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &ParseError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parseExpr parses a binary expression whose operators bind at least as tightly as minPrec
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.typ != tokOperator {
+			return lhs, nil
+		}
+		prec := binaryPrecedence[t.val]
+		if prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		bin := &BinaryExpr{Op: t.val, LHS: lhs}
+		if err := p.parseBinaryModifiers(bin); err != nil {
+			return nil, err
+		}
+
+		// ^ is right-associative, everything else is left-associative
+		nextPrec := prec + 1
+		if t.val == "^" {
+			nextPrec = prec
+		}
+		bin.RHS, err = p.parseExpr(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBinaryExpr(bin, t); err != nil {
+			return nil, err
+		}
+		lhs = bin
+	}
+}
+
+// parseBinaryModifiers parses bool, on/ignoring and group_left/group_right after an operator
+func (p *parser) parseBinaryModifiers(bin *BinaryExpr) error {
+	if t := p.peek(); t.typ == tokKeyword && t.val == "bool" {
+		if !IsComparisonOperator(bin.Op) {
+			return p.errorf(t, "bool modifier can only be used on comparison operators")
+		}
+		p.next()
+		bin.ReturnBool = true
+	}
+
+	t := p.peek()
+	if t.typ != tokKeyword || (t.val != "on" && t.val != "ignoring") {
+		if t.typ == tokKeyword && (t.val == "group_left" || t.val == "group_right") {
+			return p.errorf(t, "%s requires on or ignoring", t.val)
+		}
+		return nil
+	}
+	p.next()
+
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return err
+	}
+	bin.Matching = &VectorMatching{On: t.val == "on", Labels: labels}
+	if IsSetOperator(bin.Op) {
+		bin.Matching.Card = CardManyToMany
+	}
+
+	t = p.peek()
+	if t.typ == tokKeyword && (t.val == "group_left" || t.val == "group_right") {
+		if IsSetOperator(bin.Op) {
+			return p.errorf(t, "no grouping allowed for %q operation", bin.Op)
+		}
+		p.next()
+		bin.Matching.Card = CardManyToOne
+		if t.val == "group_right" {
+			bin.Matching.Card = CardOneToMany
+		}
+		if p.peek().typ == tokLeftParen {
+			bin.Matching.Include, err = p.parseLabelList()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkBinaryExpr validates operand types of a binary expression
+func checkBinaryExpr(bin *BinaryExpr, opTok token) error {
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+	for _, typ := range []ValueType{lt, rt} {
+		if typ != ValueTypeScalar && typ != ValueTypeVector {
+			return &ParseError{Pos: opTok.pos, Msg: fmt.Sprintf("binary expression must contain only scalar and instant vector types, got %s", typ)}
+		}
+	}
+	if IsSetOperator(bin.Op) && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		return &ParseError{Pos: opTok.pos, Msg: fmt.Sprintf("set operator %q not allowed in binary scalar expression", bin.Op)}
+	}
+	if IsComparisonOperator(bin.Op) && !bin.ReturnBool && lt == ValueTypeScalar && rt == ValueTypeScalar {
+		return &ParseError{Pos: opTok.pos, Msg: "comparisons between scalars must use bool modifier"}
+	}
+	if bin.Matching != nil && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		return &ParseError{Pos: opTok.pos, Msg: "vector matching only allowed between instant vectors"}
+	}
+	return nil
+}
+
+// parseUnary parses an optional unary + or - followed by a postfix expression
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	if t.typ == tokOperator && (t.val == "-" || t.val == "+") {
+		p.next()
+		// Unary operators bind tighter than multiplication but looser than ^
+		expr, err := p.parseExpr(precPow)
+		if err != nil {
+			return nil, err
+		}
+		if typ := expr.Type(); typ != ValueTypeScalar && typ != ValueTypeVector {
+			return nil, p.errorf(t, "unary expression only allowed on expressions of type scalar or instant vector, got %s", typ)
+		}
+		if num, ok := expr.(*NumberLiteral); ok && t.val == "-" {
+			return &NumberLiteral{Val: -num.Val, Raw: "-" + num.String()}, nil
+		}
+		return &UnaryExpr{Op: t.val, Expr: expr}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a primary expression followed by range, subquery, offset and @ modifiers
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == tokLeftBracket:
+			expr, err = p.parseRange(expr)
+		case t.typ == tokKeyword && t.val == "offset":
+			err = p.parseOffset(expr)
+		case t.typ == tokAt:
+			err = p.parseAt(expr)
+		default:
+			return expr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRange parses [range] or [range:step] following an expression
+func (p *parser) parseRange(expr Expr) (Expr, error) {
+	open := p.next()
+	rng, err := p.parseDurationLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().typ == tokColon {
+		p.next()
+		var step time.Duration
+		if p.peek().typ != tokRightBracket {
+			step, err = p.parseDurationLiteral()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.expect(tokRightBracket, "]"); err != nil {
+			return nil, err
+		}
+		if typ := expr.Type(); typ != ValueTypeVector {
+			return nil, p.errorf(open, "subquery is only allowed on instant vector, got %s", typ)
+		}
+		return &SubqueryExpr{Expr: expr, Range: rng, Step: step}, nil
+	}
+
+	if _, err := p.expect(tokRightBracket, "]"); err != nil {
+		return nil, err
+	}
+	vs, ok := expr.(*VectorSelector)
+	if !ok {
+		return nil, p.errorf(open, "ranges only allowed for vector selectors")
+	}
+	if vs.Offset != 0 || vs.At != "" {
+		return nil, p.errorf(open, "no offset or @ modifiers allowed before range")
+	}
+	return &MatrixSelector{VectorSelector: vs, Range: rng}, nil
+}
+
+// parseDurationLiteral parses a duration, also accepting a plain number of seconds
+func (p *parser) parseDurationLiteral() (time.Duration, error) {
+	t := p.next()
+	switch t.typ {
+	case tokDuration:
+		d, err := parseDurationToken(t.val)
+		if err != nil {
+			return 0, p.errorf(t, "invalid duration %q", t.val)
+		}
+		return d, nil
+	case tokNumber:
+		secs, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return 0, p.errorf(t, "invalid duration %q", t.val)
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return 0, p.errorf(t, "expected duration, got %s", t)
+}
+
+// parseOffset parses an offset modifier and attaches it to the selector or subquery
+func (p *parser) parseOffset(expr Expr) error {
+	t := p.next()
+	negative := false
+	if op := p.peek(); op.typ == tokOperator && (op.val == "-" || op.val == "+") {
+		p.next()
+		negative = op.val == "-"
+	}
+	d, err := p.parseDurationLiteral()
+	if err != nil {
+		return err
+	}
+	if negative {
+		d = -d
+	}
+
+	switch e := expr.(type) {
+	case *VectorSelector:
+		e.Offset = d
+	case *MatrixSelector:
+		e.VectorSelector.Offset = d
+	case *SubqueryExpr:
+		e.Offset = d
+	default:
+		return p.errorf(t, "offset modifier must be preceded by an instant vector selector, range vector selector, or subquery")
+	}
+	return nil
+}
+
+// parseAt parses an @ modifier and attaches it to the selector or subquery
+func (p *parser) parseAt(expr Expr) error {
+	t := p.next()
+
+	var at string
+	switch v := p.next(); {
+	case v.typ == tokNumber:
+		at = v.val
+	case v.typ == tokIdentifier && (v.val == "start" || v.val == "end"):
+		if _, err := p.expect(tokLeftParen, "("); err != nil {
+			return err
+		}
+		if _, err := p.expect(tokRightParen, ")"); err != nil {
+			return err
+		}
+		at = v.val + "()"
+	default:
+		return p.errorf(v, "unexpected %s in @ modifier", v)
+	}
+
+	switch e := expr.(type) {
+	case *VectorSelector:
+		e.At = at
+	case *MatrixSelector:
+		e.VectorSelector.At = at
+	case *SubqueryExpr:
+		e.At = at
+	default:
+		return p.errorf(t, "@ modifier must be preceded by an instant vector selector, range vector selector, or subquery")
+	}
+	return nil
+}
+
+// parsePrimary parses literals, selectors, function calls, aggregations and parentheses
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+
+	switch t.typ {
+	case tokNumber:
+		p.next()
+		return parseNumber(t)
+	case tokString:
+		p.next()
+		val, err := unquoteString(t.val)
+		if err != nil {
+			return nil, p.errorf(t, "%v", err)
+		}
+		return &StringLiteral{Val: val}, nil
+	case tokLeftParen:
+		p.next()
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRightParen, ")"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case tokLeftBrace:
+		return p.parseVectorSelector()
+	case tokIdentifier:
+		lower := strings.ToLower(t.val)
+		if lower == "inf" || lower == "nan" {
+			p.next()
+			return parseNumber(t)
+		}
+		next := p.peekN(1)
+		if IsAggregationOp(t.val) && (next.typ == tokLeftParen ||
+			(next.typ == tokKeyword && (next.val == "by" || next.val == "without"))) {
+			return p.parseAggregate()
+		}
+		if next.typ == tokLeftParen {
+			return p.parseCall()
+		}
+		return p.parseVectorSelector()
+	}
+
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// parseNumber converts a number token to a literal
+func parseNumber(t token) (Expr, error) {
+	lower := strings.ToLower(t.val)
+	switch {
+	case lower == "inf":
+		return &NumberLiteral{Val: math.Inf(1), Raw: t.val}, nil
+	case lower == "nan":
+		return &NumberLiteral{Val: math.NaN(), Raw: t.val}, nil
+	case strings.HasPrefix(lower, "0x"):
+		v, err := strconv.ParseInt(lower[2:], 16, 64)
+		if err != nil {
+			return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.val)}
+		}
+		return &NumberLiteral{Val: float64(v), Raw: t.val}, nil
+	}
+	v, err := strconv.ParseFloat(t.val, 64)
+	if err != nil {
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.val)}
+	}
+	return &NumberLiteral{Val: v, Raw: t.val}, nil
+}
+
+// parseVectorSelector parses metric{matchers} where either part may be omitted
+func (p *parser) parseVectorSelector() (Expr, error) {
+	start := p.peek()
+	vs := &VectorSelector{Pos: PosRange{Start: start.pos}}
+
+	if start.typ == tokIdentifier {
+		p.next()
+		vs.Name = start.val
+		vs.Pos.End = start.pos + len(start.val)
+	}
+
+	if p.peek().typ == tokLeftBrace {
+		p.next()
+		for p.peek().typ != tokRightBrace {
+			m, err := p.parseLabelMatcher()
+			if err != nil {
+				return nil, err
+			}
+			vs.Matchers = append(vs.Matchers, m)
+			if p.peek().typ == tokComma {
+				p.next()
+				continue
+			}
+			if p.peek().typ != tokRightBrace {
+				t := p.peek()
+				return nil, p.errorf(t, "unexpected %s in label matching, expected \",\" or \"}\"", t)
+			}
+		}
+		end := p.next()
+		vs.Pos.End = end.pos + 1
+	}
+
+	if vs.MetricName() == "" {
+		hasNonEmpty := false
+		for _, m := range vs.Matchers {
+			if !matchesEmpty(m) {
+				hasNonEmpty = true
+				break
+			}
+		}
+		if !hasNonEmpty {
+			return nil, p.errorf(start, "vector selector must contain at least one non-empty matcher")
+		}
+	}
+	return vs, nil
+}
+
+// matchesEmpty reports whether a matcher accepts the empty label value
+func matchesEmpty(m *LabelMatcher) bool {
+	switch m.Op {
+	case MatchEqual:
+		return m.Value == ""
+	case MatchNotEqual:
+		return m.Value != ""
+	case MatchRegexp:
+		return m.Value == "" || m.Value == ".*"
+	case MatchNotRegexp:
+		return m.Value != ".*"
+	}
+	return false
+}
+
+// parseLabelMatcher parses a single name<op>"value" matcher
+func (p *parser) parseLabelMatcher() (*LabelMatcher, error) {
+	name, err := p.parseLabelName()
+	if err != nil {
+		return nil, err
+	}
+
+	opTok := p.next()
+	var op MatchOp
+	switch {
+	case opTok.typ == tokAssign:
+		op = MatchEqual
+	case opTok.typ == tokOperator && opTok.val == "!=":
+		op = MatchNotEqual
+	case opTok.typ == tokEqlRegex:
+		op = MatchRegexp
+	case opTok.typ == tokNeqRegex:
+		op = MatchNotRegexp
+	default:
+		return nil, p.errorf(opTok, "expected label matching operator, got %s", opTok)
+	}
+
+	valTok, err := p.expect(tokString, "label value string")
+	if err != nil {
+		return nil, err
+	}
+	val, err := unquoteString(valTok.val)
+	if err != nil {
+		return nil, p.errorf(valTok, "%v", err)
+	}
+	return &LabelMatcher{Name: name, Op: op, Value: val}, nil
+}
+
+// parseLabelName parses a label name, which may coincide with a keyword
+func (p *parser) parseLabelName() (string, error) {
+	t := p.next()
+	switch t.typ {
+	case tokIdentifier, tokKeyword:
+		return t.val, nil
+	case tokOperator:
+		if isIdentStart(t.val[0]) {
+			return t.val, nil
+		}
+	case tokString:
+		return unquoteString(t.val)
+	}
+	return "", p.errorf(t, "expected label name, got %s", t)
+}
+
+// parseLabelList parses a parenthesized, comma-separated list of label names
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokLeftParen, "("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek().typ != tokRightParen {
+		name, err := p.parseLabelName()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, name)
+		if p.peek().typ == tokComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokRightParen {
+			t := p.peek()
+			return nil, p.errorf(t, "unexpected %s in grouping, expected \",\" or \")\"", t)
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+// parseAggregate parses an aggregation with an optional prefix or postfix by/without clause
+func (p *parser) parseAggregate() (Expr, error) {
+	opTok := p.next()
+	agg := &AggregateExpr{Op: opTok.val}
+
+	parseGrouping := func() error {
+		kw := p.next()
+		agg.Without = kw.val == "without"
+		agg.Grouped = true
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return err
+		}
+		agg.Grouping = labels
+		return nil
+	}
+
+	if t := p.peek(); t.typ == tokKeyword && (t.val == "by" || t.val == "without") {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); !agg.Grouped && t.typ == tokKeyword && (t.val == "by" || t.val == "without") {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+		agg.Postfix = true
+	}
+
+	wantArgs := 1
+	if aggregationOps[agg.Op] {
+		wantArgs = 2
+	}
+	if len(args) != wantArgs {
+		return nil, p.errorf(opTok, "wrong number of arguments for aggregate expression provided, expected %d, got %d", wantArgs, len(args))
+	}
+	agg.Expr = args[len(args)-1]
+	if wantArgs == 2 {
+		agg.Param = args[0]
+	}
+	if typ := agg.Expr.Type(); typ != ValueTypeVector {
+		return nil, p.errorf(opTok, "expected type instant vector in aggregation expression, got %s", typ)
+	}
+	return agg, nil
+}
+
+// parseCall parses a function call and checks its arguments against the function signature
+func (p *parser) parseCall() (Expr, error) {
+	nameTok := p.next()
+	fn, ok := Functions[nameTok.val]
+	if !ok {
+		return nil, p.errorf(nameTok, "unknown function with name %q", nameTok.val)
+	}
+
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) < fn.minArgs() || (fn.maxArgs() >= 0 && len(args) > fn.maxArgs()) {
+		return nil, p.errorf(nameTok, "wrong number of arguments for function %s(), got %d", fn.Name, len(args))
+	}
+	for i, arg := range args {
+		want := fn.argType(i)
+		got := arg.Type()
+		if want != got {
+			return nil, p.errorf(nameTok, "expected type %s in call to function %s(), got %s", want, fn.Name, got)
+		}
+	}
+	return &Call{Func: fn.Name, Args: args}, nil
+}
+
+// parseArgs parses a parenthesized, comma-separated argument list
+func (p *parser) parseArgs() ([]Expr, error) {
+	if _, err := p.expect(tokLeftParen, "("); err != nil {
+		return nil, err
+	}
+	var args []Expr
+	for p.peek().typ != tokRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek().typ == tokComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokRightParen {
+			t := p.peek()
+			return nil, p.errorf(t, "unexpected %s in argument list, expected \",\" or \")\"", t)
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+// unquoteString decodes a double-quoted, single-quoted or backtick-quoted string
+func unquoteString(s string) (string, error) {
+	if len(s) < 2 {
+		return "", fmt.Errorf("invalid string %s", s)
+	}
+	switch s[0] {
+	case '`':
+		return s[1 : len(s)-1], nil
+	case '\'':
+		// Convert to a double-quoted string so strconv can decode escapes
+		var sb strings.Builder
+		sb.WriteByte('"')
+		inner := s[1 : len(s)-1]
+		for i := 0; i < len(inner); i++ {
+			switch {
+			case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+				sb.WriteByte('\'')
+				i++
+			case inner[i] == '\\' && i+1 < len(inner):
+				sb.WriteString(inner[i : i+2])
+				i++
+			case inner[i] == '"':
+				sb.WriteString(`\"`)
+			default:
+				sb.WriteByte(inner[i])
+			}
+		}
+		sb.WriteByte('"')
+		s = sb.String()
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s: %w", s, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,249 @@
+package promql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExprRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "bare metric",
+			input:    `up`,
+			expected: `up`,
+		},
+		{
+			name:     "selector with matchers",
+			input:    `http_requests_total{job="api", status=~'5..'}`,
+			expected: `http_requests_total{job="api",status=~"5.."}`,
+		},
+		{
+			name:     "selector without metric name",
+			input:    `{__name__="up",job!=""}`,
+			expected: `{__name__="up",job!=""}`,
+		},
+		{
+			name:     "rate with range",
+			input:    `rate(errors_total{job="api"}[5m])`,
+			expected: `rate(errors_total{job="api"}[5m])`,
+		},
+		{
+			name:     "postfix aggregation is printed as prefix",
+			input:    `sum(rate(x[5m])) by (job, instance)`,
+			expected: `sum by (job, instance) (rate(x[5m]))`,
+		},
+		{
+			name:     "aggregation with parameter",
+			input:    `topk(5, sum without (pod) (x))`,
+			expected: `topk(5, sum without (pod) (x))`,
+		},
+		{
+			name:     "binary operation with vector matching",
+			input:    `a / on(instance) group_left(team) b`,
+			expected: `a / on (instance) group_left (team) b`,
+		},
+		{
+			name:     "empty ignoring with group modifier",
+			input:    `a * ignoring() group_left b`,
+			expected: `a * ignoring () group_left b`,
+		},
+		{
+			name:     "comparison with bool",
+			input:    `a > bool 1`,
+			expected: `a > bool 1`,
+		},
+		{
+			name:     "subquery with offset and at",
+			input:    `max_over_time(rate(x[1m])[1h:30s] offset 1d)`,
+			expected: `max_over_time(rate(x[1m])[1h:30s] offset 1d)`,
+		},
+		{
+			name:     "matrix selector with offset",
+			input:    `increase(x[90m] offset 1h @ end())`,
+			expected: `increase(x[1h30m] @ end() offset 1h)`,
+		},
+		{
+			name:     "recording rule name with colons",
+			input:    `job:http_requests:rate5m{job="api"}`,
+			expected: `job:http_requests:rate5m{job="api"}`,
+		},
+		{
+			name:     "label_replace",
+			input:    `label_replace(up, "host", "$1", "instance", "(.*):.*")`,
+			expected: `label_replace(up, "host", "$1", "instance", "(.*):.*")`,
+		},
+		{
+			name:     "negative number literal",
+			input:    `x * -1`,
+			expected: `x * -1`,
+		},
+		{
+			name:     "keyword used as label name",
+			input:    `sum by (on) (x)`,
+			expected: `sum by (on) (x)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.input, err)
+			}
+			if got := expr.String(); got != tt.expected {
+				t.Errorf("ParseExpr(%q).String() = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	tests := []struct {
+		input string
+		// expected is the string of the top-level operator's operands, fully parenthesized
+		expectedOp string
+		expectedL  string
+		expectedR  string
+	}{
+		{`a + b * c`, "+", `a`, `b * c`},
+		{`a * b + c`, "+", `a * b`, `c`},
+		{`a - b - c`, "-", `a - b`, `c`},
+		{`2 ^ 3 ^ 2`, "^", `2`, `3 ^ 2`},
+		{`a or b and c`, "or", `a`, `b and c`},
+		{`a > 1 and b`, "and", `a > 1`, `b`},
+		{`-a ^ 2 + 1`, "+", `-a ^ 2`, `1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			expr, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.input, err)
+			}
+			bin, ok := expr.(*BinaryExpr)
+			if !ok {
+				t.Fatalf("expected *BinaryExpr, got %T", expr)
+			}
+			if bin.Op != tt.expectedOp || bin.LHS.String() != tt.expectedL || bin.RHS.String() != tt.expectedR {
+				t.Errorf("got (%s) %s (%s), want (%s) %s (%s)",
+					bin.LHS, bin.Op, bin.RHS, tt.expectedL, tt.expectedOp, tt.expectedR)
+			}
+		})
+	}
+}
+
+func TestParseExprAggregation(t *testing.T) {
+	expr, err := ParseExpr(`sum(rate(x[5m])) by (job)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	agg, ok := expr.(*AggregateExpr)
+	if !ok {
+		t.Fatalf("expected *AggregateExpr, got %T", expr)
+	}
+	if agg.Op != "sum" || !agg.Grouped || agg.Without || !agg.Postfix {
+		t.Errorf("unexpected aggregation fields: %+v", agg)
+	}
+	if len(agg.Grouping) != 1 || agg.Grouping[0] != "job" {
+		t.Errorf("expected grouping [job], got %v", agg.Grouping)
+	}
+}
+
+func TestParseExprSelectorPosition(t *testing.T) {
+	input := `sum(rate(errors_total{job="api"}[5m])) / up`
+	expr, err := ParseExpr(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	selectors := VectorSelectors(expr)
+	if len(selectors) != 2 {
+		t.Fatalf("expected 2 selectors, got %d", len(selectors))
+	}
+
+	expected := []string{`errors_total{job="api"}`, `up`}
+	for i, vs := range selectors {
+		if got := input[vs.Pos.Start:vs.Pos.End]; got != expected[i] {
+			t.Errorf("selector %d position covers %q, want %q", i, got, expected[i])
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unbalanced parentheses", `sum(rate(x[5m])`},
+		{"unknown function", `foo(x)`},
+		{"range on expression", `(x)[5m]`},
+		{"rate on instant vector", `rate(x)`},
+		{"missing label value", `x{job=}`},
+		{"empty selector", `{}`},
+		{"group_left without on", `a / group_left b`},
+		{"bool on arithmetic", `a + bool b`},
+		{"trailing garbage", `x y`},
+		{"unterminated string", `x{job="api}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseExpr(tt.input); err == nil {
+				t.Errorf("ParseExpr(%q) expected error, got nil", tt.input)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"5m", 5 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"2d", 48 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"5", 0, true},
+		{"abc", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseDuration(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDuration(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseDuration(%q) = %v, want %v", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		input    time.Duration
+		expected string
+	}{
+		{5 * time.Minute, "5m"},
+		{90 * time.Minute, "1h30m"},
+		{1500 * time.Millisecond, "1s500ms"},
+		{14 * 24 * time.Hour, "2w"},
+		{0, "0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := FormatDuration(tt.input); got != tt.expected {
+				t.Errorf("FormatDuration(%v) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package promql
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValueRule constrains the values a label or annotation may take
+type ValueRule struct {
+	// AllowedValues lists the only permitted values
+	AllowedValues []string `yaml:"allowed_values,omitempty"`
+	// Pattern is a regular expression values must fully match
+	Pattern string `yaml:"pattern,omitempty"`
+	// ForbidWildcard rejects regex matchers such as =~".*" that select every value
+	ForbidWildcard bool `yaml:"forbid_wildcard,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// LabelPolicy describes value rules for labels and annotations
+type LabelPolicy struct {
+	// Labels apply to selector matchers and to the labels section of rules
+	Labels map[string]*ValueRule `yaml:"labels,omitempty"`
+	// Annotations apply to the annotations section of alerting rules
+	Annotations map[string]*ValueRule `yaml:"annotations,omitempty"`
+}
+
+// PolicyViolation represents a label or annotation value that breaks the policy
+type PolicyViolation struct {
+	// RuleName is the alert or recording rule name, empty for expression matchers
+	RuleName   string
+	Expression string
+	Message    string
+	Line       int
+}
+
+// LoadPolicy reads a label policy from a YAML file
+func LoadPolicy(path string) (*LabelPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	return ParsePolicy(content)
+}
+
+// ParsePolicy parses and validates a label policy
+func ParsePolicy(content []byte) (*LabelPolicy, error) {
+	var policy LabelPolicy
+	if err := yaml.Unmarshal(content, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	for _, rules := range []map[string]*ValueRule{policy.Labels, policy.Annotations} {
+		for name, rule := range rules {
+			if rule == nil || rule.Pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for %q: %w", name, err)
+			}
+			rule.pattern = re
+		}
+	}
+
+	return &policy, nil
+}
+
+// checkValue returns a description of why value breaks the rule, or "" if it is allowed
+func (r *ValueRule) checkValue(value string) string {
+	if len(r.AllowedValues) > 0 {
+		allowed := false
+		for _, v := range r.AllowedValues {
+			if v == value {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("is not one of the allowed values (%s)", strings.Join(r.AllowedValues, ", "))
+		}
+	}
+	if r.pattern != nil && !r.pattern.MatchString(value) {
+		return fmt.Sprintf("does not match pattern %q", r.Pattern)
+	}
+	return ""
+}
+
+// checkMatcher returns a description of why a selector matcher breaks the rule, or "" if it is
+// allowed. Negative matchers only exclude values, so they cannot select a disallowed one.
+func (r *ValueRule) checkMatcher(m *LabelMatcher) string {
+	switch m.Op {
+	case MatchEqual:
+		return r.checkValue(m.Value)
+	case MatchRegexp:
+		if r.ForbidWildcard && isWildcardRegex(m.Value) {
+			return "is a bare wildcard that matches every value"
+		}
+		// Regexes can only be verified when they are an alternation of literals
+		alternatives, ok := literalAlternatives(m.Value)
+		if !ok {
+			return ""
+		}
+		for _, alt := range alternatives {
+			if problem := r.checkValue(alt); problem != "" {
+				return fmt.Sprintf("alternative %q %s", alt, problem)
+			}
+		}
+	}
+	return ""
+}
+
+// wildcardSamples are values a bare wildcard regex matches but a meaningful one would not all match
+var wildcardSamples = []string{"x", "prod-eu-1", "ANY/Value:42", " "}
+
+// isWildcardRegex reports whether a regex matcher value matches effectively any label value
+func isWildcardRegex(value string) bool {
+	re, err := regexp.Compile("^(?:" + value + ")$")
+	if err != nil {
+		return false
+	}
+	for _, sample := range wildcardSamples {
+		if !re.MatchString(sample) {
+			return false
+		}
+	}
+	return true
+}
+
+// literalAlternatives splits a regex like "a|b|c" into its literal alternatives
+func literalAlternatives(value string) ([]string, bool) {
+	if value == "" {
+		return nil, false
+	}
+	alternatives := strings.Split(value, "|")
+	for _, alt := range alternatives {
+		if alt == "" || regexp.QuoteMeta(alt) != alt {
+			return nil, false
+		}
+	}
+	return alternatives, true
+}
+
+// CheckLabelPolicy checks selector matchers and rule labels/annotations against a policy
+func CheckLabelPolicy(content string, policy *LabelPolicy) []PolicyViolation {
+	var violations []PolicyViolation
+
+	for _, doc := range yamlDocuments([]byte(content)) {
+		groups := ruleGroups(doc)
+		if groups == nil {
+			continue
+		}
+		for _, group := range groups.Content {
+			rules := mappingValue(group, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, rule := range rules.Content {
+				ruleName := ""
+				isAlert := false
+				if alert := mappingValue(rule, "alert"); alert != nil {
+					ruleName = alert.Value
+					isAlert = true
+				} else if record := mappingValue(rule, "record"); record != nil {
+					ruleName = record.Value
+				}
+
+				if expr := mappingValue(rule, "expr"); expr != nil {
+					violations = append(violations, checkMatcherPolicy(expr, policy)...)
+				}
+
+				violations = append(violations, checkSectionPolicy(rule, "labels", ruleName, policy.Labels)...)
+				if isAlert {
+					violations = append(violations, checkSectionPolicy(rule, "annotations", ruleName, policy.Annotations)...)
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+// checkMatcherPolicy checks the label matchers of a rule expression against the policy
+func checkMatcherPolicy(exprNode *yaml.Node, policy *LabelPolicy) []PolicyViolation {
+	var violations []PolicyViolation
+
+	parsed, err := ParseExpr(exprNode.Value)
+	if err != nil {
+		return violations
+	}
+
+	for _, vs := range VectorSelectors(parsed) {
+		for _, m := range vs.Matchers {
+			rule, ok := policy.Labels[m.Name]
+			if !ok || rule == nil {
+				continue
+			}
+			if problem := rule.checkMatcher(m); problem != "" {
+				violations = append(violations, PolicyViolation{
+					Expression: exprNode.Value,
+					Message:    fmt.Sprintf("Matcher %s %s", m.String(), problem),
+					Line:       exprNode.Line,
+				})
+			}
+		}
+	}
+
+	return violations
+}
+
+// checkSectionPolicy checks the labels or annotations section of a rule against value rules
+func checkSectionPolicy(rule *yaml.Node, section, ruleName string, rules map[string]*ValueRule) []PolicyViolation {
+	var violations []PolicyViolation
+
+	values := mappingValue(rule, section)
+	if values == nil || values.Kind != yaml.MappingNode {
+		return violations
+	}
+
+	kind := "Label"
+	if section == "annotations" {
+		kind = "Annotation"
+	}
+
+	for i := 0; i+1 < len(values.Content); i += 2 {
+		name := values.Content[i].Value
+		node := values.Content[i+1]
+		valueRule, ok := rules[name]
+		if !ok || valueRule == nil {
+			continue
+		}
+		// Templated values are only known at evaluation time
+		if strings.Contains(node.Value, "{{") {
+			continue
+		}
+		if problem := valueRule.checkValue(node.Value); problem != "" {
+			violations = append(violations, PolicyViolation{
+				RuleName: ruleName,
+				Message:  fmt.Sprintf("%s %s=%q %s", kind, name, node.Value, problem),
+				Line:     node.Line,
+			})
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,155 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+labels:
+  severity:
+    allowed_values: [critical, warning, info]
+  team:
+    allowed_values: [platform, payments]
+  job:
+    forbid_wildcard: true
+annotations:
+  runbook_url:
+    pattern: 'https://wiki\.example\.com/.+'
+`
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy returned error: %v", err)
+	}
+	if len(policy.Labels) != 3 || len(policy.Annotations) != 1 {
+		t.Errorf("Expected 3 label rules and 1 annotation rule, got %d and %d", len(policy.Labels), len(policy.Annotations))
+	}
+
+	if _, err := ParsePolicy([]byte("labels:\n  team:\n    pattern: '('\n")); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestCheckMatcher(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy returned error: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		matcher     *LabelMatcher
+		expectIssue bool
+	}{
+		{"allowed value", &LabelMatcher{Name: "team", Op: MatchEqual, Value: "platform"}, false},
+		{"disallowed value", &LabelMatcher{Name: "team", Op: MatchEqual, Value: "unknown"}, true},
+		{"excluding a disallowed value", &LabelMatcher{Name: "team", Op: MatchNotEqual, Value: "unknown"}, false},
+		{"excluding disallowed values by regex", &LabelMatcher{Name: "team", Op: MatchNotRegexp, Value: "unknown|other"}, false},
+		{"regex alternation of allowed values", &LabelMatcher{Name: "team", Op: MatchRegexp, Value: "platform|payments"}, false},
+		{"regex alternation with disallowed value", &LabelMatcher{Name: "team", Op: MatchRegexp, Value: "platform|other"}, true},
+		{"complex regex is not verified", &LabelMatcher{Name: "team", Op: MatchRegexp, Value: "pay.*"}, false},
+		{"bare wildcard", &LabelMatcher{Name: "job", Op: MatchRegexp, Value: ".*"}, true},
+		{"non-empty wildcard", &LabelMatcher{Name: "job", Op: MatchRegexp, Value: ".+"}, true},
+		{"specific regex", &LabelMatcher{Name: "job", Op: MatchRegexp, Value: "api-.*"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := policy.Labels[tt.matcher.Name].checkMatcher(tt.matcher)
+			if (problem != "") != tt.expectIssue {
+				t.Errorf("checkMatcher(%s) = %q, expectIssue %v", tt.matcher, problem, tt.expectIssue)
+			}
+		})
+	}
+}
+
+func TestCheckLabelPolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy returned error: %v", err)
+	}
+
+	content := `
+groups:
+  - name: test
+    rules:
+      - alert: Good
+        expr: rate(errors_total{job="api"}[5m]) > 1
+        labels:
+          severity: critical
+          team: platform
+        annotations:
+          runbook_url: https://wiki.example.com/runbooks/errors
+      - alert: BadValues
+        expr: rate(errors_total{job=~".*"}[5m]) > 1
+        labels:
+          severity: sev1
+          team: "{{ $labels.team }}"
+        annotations:
+          runbook_url: http://example.com/runbook
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total{team="unknown"}[5m]))
+`
+
+	violations := CheckLabelPolicy(content, policy)
+	if len(violations) != 4 {
+		t.Fatalf("Expected 4 violations, got %d: %+v", len(violations), violations)
+	}
+
+	expected := []struct {
+		ruleName string
+		contains string
+		line     int
+	}{
+		{"", `job=~".*"`, 13},
+		{"BadValues", "severity=\"sev1\"", 15},
+		{"BadValues", "runbook_url", 18},
+		{"", `team="unknown"`, 20},
+	}
+	for i, e := range expected {
+		v := violations[i]
+		if v.RuleName != e.ruleName || !strings.Contains(v.Message, e.contains) || v.Line != e.line {
+			t.Errorf("Violation %d = %+v, want rule %q containing %q on line %d", i, v, e.ruleName, e.contains, e.line)
+		}
+	}
+}
+
+func TestCheckLabelPolicyPrometheusRule(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy returned error: %v", err)
+	}
+
+	content := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+spec:
+  groups:
+    - name: test
+      rules:
+        - alert: BadSeverity
+          expr: rate(errors_total{job="api"}[5m]) > 1
+          labels:
+            severity: sev1
+---
+groups:
+  - name: second
+    rules:
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total{team="unknown"}[5m]))
+`
+
+	violations := CheckLabelPolicy(content, policy)
+	if len(violations) != 2 {
+		t.Fatalf("Expected 2 violations, got %d: %+v", len(violations), violations)
+	}
+	if violations[0].RuleName != "BadSeverity" || violations[0].Line != 12 {
+		t.Errorf("Violation 0 = %+v, want rule BadSeverity on line 12", violations[0])
+	}
+	if !strings.Contains(violations[1].Message, `team="unknown"`) || violations[1].Line != 18 {
+		t.Errorf("Violation 1 = %+v, want team=\"unknown\" on line 18", violations[1])
+	}
+}
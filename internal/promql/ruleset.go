@@ -0,0 +1,138 @@
+package promql
+
+import (
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleGroup is a rule group of a rule file
+type RuleGroup struct {
+	File string
+	Name string
+	// Interval is the group's evaluation interval, or 0 if it uses the global default
+	Interval time.Duration
+	Line     int
+	Rules    []Rule
+}
+
+// Rule is an alerting or recording rule of a rule group
+type Rule struct {
+	// Alert is the alert name of an alerting rule
+	Alert string
+	// Record is the metric name a recording rule writes
+	Record string
+	Expr   string
+	Labels map[string]string
+	// Line is the line the rule starts at
+	Line int
+	// ExprLine is the line of the rule's expr key, or 0 if it has none
+	ExprLine int
+}
+
+// Name returns the alert name or recorded metric name of a rule
+func (r Rule) Name() string {
+	if r.Alert != "" {
+		return r.Alert
+	}
+	return r.Record
+}
+
+// Metrics returns the metric names a rule's expression selects, in order of appearance
+func (r Rule) Metrics() []string {
+	return MetricNames(r.Expr)
+}
+
+// MetricNames returns the metric names an expression selects, in order of appearance and
+// without duplicates. Template variables are accepted; expressions that do not parse select
+// nothing.
+func MetricNames(expr string) []string {
+	parsed, _, err := ParseTemplatedExpr(expr)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, vs := range VectorSelectors(parsed) {
+		if name := vs.MetricName(); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// MetricNamePatterns returns the regular expressions of the __name__=~ matchers an expression
+// selects metrics by when it names no metric, such as job:.* for {__name__=~"job:.*"}, in
+// order of appearance and without duplicates. Like all Prometheus regular expressions, they
+// must match the whole name. Patterns holding template variables are skipped.
+func MetricNamePatterns(expr string) []string {
+	parsed, _, err := ParseTemplatedExpr(expr)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, vs := range VectorSelectors(parsed) {
+		if vs.MetricName() != "" {
+			continue
+		}
+		for _, m := range vs.Matchers {
+			if m.Name == "__name__" && m.Op == MatchRegexp && !HasTemplateVariable(m.Value) && !seen[m.Value] {
+				seen[m.Value] = true
+				patterns = append(patterns, m.Value)
+			}
+		}
+	}
+	return patterns
+}
+
+// LoadRuleGroups returns the rule groups of a rule file, mimirtool namespace file or
+// PrometheusRule resource, in file order. Content that is not a rule file has no groups.
+func LoadRuleGroups(file string, content []byte) []RuleGroup {
+	var groups []RuleGroup
+	for _, doc := range yamlDocuments(content) {
+		seq := ruleGroups(doc)
+		if seq == nil {
+			continue
+		}
+		for _, node := range seq.Content {
+			group := RuleGroup{
+				File: file,
+				Name: scalarValue(mappingValue(node, "name")),
+				Line: node.Line,
+			}
+			if interval := scalarValue(mappingValue(node, "interval")); interval != "" {
+				if d, err := ParseDuration(interval); err == nil {
+					group.Interval = d
+				}
+			}
+
+			rules := mappingValue(node, "rules")
+			if rules == nil || rules.Kind != yaml.SequenceNode {
+				groups = append(groups, group)
+				continue
+			}
+			for _, rule := range rules.Content {
+				r := Rule{
+					Alert:  scalarValue(mappingValue(rule, "alert")),
+					Record: scalarValue(mappingValue(rule, "record")),
+					Expr:   scalarValue(mappingValue(rule, "expr")),
+					Line:   rule.Line,
+				}
+				if key := mappingKey(rule, "expr"); key != nil {
+					r.ExprLine = key.Line
+				}
+				if labels := mappingValue(rule, "labels"); labels != nil && labels.Kind == yaml.MappingNode {
+					r.Labels = make(map[string]string)
+					for i := 0; i+1 < len(labels.Content); i += 2 {
+						r.Labels[labels.Content[i].Value] = labels.Content[i+1].Value
+					}
+				}
+				group.Rules = append(group.Rules, r)
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,97 @@
+package promql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadRuleGroups(t *testing.T) {
+	content := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+spec:
+  groups:
+    - name: api
+      interval: 30s
+      rules:
+        - record: job:http_requests:rate5m
+          expr: sum by (job) (rate(http_requests_total[5m]))
+        - alert: HighErrorRate
+          expr: |
+            job:http_errors:rate5m / job:http_requests:rate5m > 0.05
+          labels:
+            severity: page
+---
+groups:
+  - name: node
+    rules: []
+`
+	expected := []RuleGroup{
+		{
+			File:     "rules.yaml",
+			Name:     "api",
+			Interval: 30 * time.Second,
+			Line:     5,
+			Rules: []Rule{
+				{Record: "job:http_requests:rate5m", Expr: "sum by (job) (rate(http_requests_total[5m]))", Line: 8, ExprLine: 9},
+				{
+					Alert:    "HighErrorRate",
+					Expr:     "job:http_errors:rate5m / job:http_requests:rate5m > 0.05\n",
+					Labels:   map[string]string{"severity": "page"},
+					Line:     10,
+					ExprLine: 11,
+				},
+			},
+		},
+		{File: "rules.yaml", Name: "node", Line: 17},
+	}
+
+	groups := LoadRuleGroups("rules.yaml", []byte(content))
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("LoadRuleGroups() = %+v, want %+v", groups, expected)
+	}
+
+	if got := groups[0].Rules[1].Metrics(); !reflect.DeepEqual(got, []string{"job:http_errors:rate5m", "job:http_requests:rate5m"}) {
+		t.Errorf("Metrics() = %v", got)
+	}
+	if got := groups[0].Rules[1].Name(); got != "HighErrorRate" {
+		t.Errorf("Name() = %q, want HighErrorRate", got)
+	}
+}
+
+func TestMetricNamePatterns(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		{`sum by (__name__) ({__name__=~"job:.*",job="api"}) + on () count({__name__=~"job:.*"})`, []string{"job:.*"}},
+		{`{__name__=~"job:errors:.+"} / {__name__=~"job:requests:.+"}`, []string{"job:errors:.+", "job:requests:.+"}},
+		{`http_requests_total{__name__=~"http_.*"}`, nil},
+		{`{__name__!~"go_.*",job="api"}`, nil},
+		{`{__name__=~"$metric"}`, nil},
+		{`{__name__=~"job:.*_total$"}`, []string{"job:.*_total$"}},
+		{`sum(`, nil},
+	}
+	for _, tt := range tests {
+		if got := MetricNamePatterns(tt.expr); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("MetricNamePatterns(%q) = %v, want %v", tt.expr, got, tt.expected)
+		}
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		{`sum(rate(http_requests_total{job="api"}[5m])) / sum(rate(http_requests_total[5m]))`, []string{"http_requests_total"}},
+		{`job:errors:rate5m{job="$job"} / on (job) avg_over_time(job:requests:rate5m[$__rate_interval])`, []string{"job:errors:rate5m", "job:requests:rate5m"}},
+		{`{__name__=~"job:.*"}`, nil},
+		{`sum(`, nil},
+	}
+	for _, tt := range tests {
+		if got := MetricNames(tt.expr); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("MetricNames(%q) = %v, want %v", tt.expr, got, tt.expected)
+		}
+	}
+}
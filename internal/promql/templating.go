@@ -0,0 +1,120 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateVariableRegex matches Grafana template variables ($var, ${var}, ${var:format} and
+// [[var]]) and Go template actions such as Sloth's {{.window}}
+var templateVariableRegex = regexp.MustCompile(`^(?:\$\{[^}]+\}|\$\w+|\[\[\w+(?::\w+)?\]\]|\{\{[^}]*\}\})`)
+
+// placeholderBase is added to duration placeholders so they cannot clash with real durations
+const placeholderBase = 99 * 365 * 24 * time.Hour
+
+// ParseTemplatedExpr parses an expression that may contain Grafana template variables such
+// as $job, ${job}, [[job]] or $__rate_interval, or Go template actions such as {{.window}}.
+// Variables outside string literals are replaced by placeholders before parsing: durations
+// inside [...] or after offset, and identifiers elsewhere. The returned restore function maps
+// text printed from the parsed expression back to the original variables.
+func ParseTemplatedExpr(input string) (Expr, func(string) string, error) {
+	substituted, replacements := substituteVariables(input)
+
+	expr, err := ParseExpr(substituted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restore := func(s string) string { return s }
+	if len(replacements) > 0 {
+		pairs := make([]string, 0, 2*len(replacements))
+		for placeholder, variable := range replacements {
+			pairs = append(pairs, placeholder, variable)
+		}
+		replacer := strings.NewReplacer(pairs...)
+		restore = replacer.Replace
+	}
+	return expr, restore, nil
+}
+
+// HasTemplateVariable reports whether s, such as the value of a label matcher, holds a template
+// variable. A $ not followed by a variable name, like the end anchor of a regular expression,
+// is not one.
+func HasTemplateVariable(s string) bool {
+	for i := range s {
+		if (s[i] == '$' || strings.HasPrefix(s[i:], "[[") || strings.HasPrefix(s[i:], "{{")) && templateVariableRegex.MatchString(s[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// substituteVariables replaces template variables outside string literals with placeholders,
+// returning the substituted expression and a map from placeholder to variable
+func substituteVariables(input string) (string, map[string]string) {
+	replacements := make(map[string]string)
+	durations := make(map[string]string)
+	identifiers := make(map[string]string)
+
+	var sb strings.Builder
+	bracketDepth := 0
+	var quote byte
+
+	for i := 0; i < len(input); {
+		c := input[i]
+
+		if quote != 0 {
+			sb.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(input) {
+				sb.WriteByte(input[i+1])
+				i += 2
+				continue
+			}
+			if c == quote {
+				quote = 0
+			}
+			i++
+			continue
+		}
+
+		if c == '$' || strings.HasPrefix(input[i:], "[[") || strings.HasPrefix(input[i:], "{{") {
+			if variable := templateVariableRegex.FindString(input[i:]); variable != "" {
+				var placeholder string
+				if bracketDepth > 0 || strings.HasSuffix(strings.TrimRight(sb.String(), " \t\n"), "offset") {
+					placeholder = durations[variable]
+					if placeholder == "" {
+						placeholder = FormatDuration(placeholderBase + time.Duration(len(durations)+1)*time.Millisecond)
+						durations[variable] = placeholder
+					}
+				} else {
+					placeholder = identifiers[variable]
+					if placeholder == "" {
+						placeholder = fmt.Sprintf("__grafana_var_%d__", len(identifiers)+1)
+						identifiers[variable] = placeholder
+					}
+				}
+				replacements[placeholder] = variable
+				sb.WriteString(placeholder)
+				i += len(variable)
+				continue
+			}
+		}
+
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '[':
+			bracketDepth++
+		case ']':
+			if bracketDepth > 0 {
+				bracketDepth--
+			}
+		}
+		sb.WriteByte(c)
+		i++
+	}
+
+	return sb.String(), replacements
+}
@@ -0,0 +1,35 @@
+package promql
+
+import (
+	"testing"
+)
+
+func TestParseTemplatedExpr(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"range variable", `rate(http_requests_total{job="$job"}[$__rate_interval])`, `rate(http_requests_total{job="$job"}[$__rate_interval])`},
+		{"braced variable", `sum by (${group}) (rate(x[${interval}]))`, `sum by (${group}) (rate(x[${interval}]))`},
+		{"legacy variable", `rate(x[[[interval]]])`, `rate(x[[[interval]]])`},
+		{"subquery step", `max_over_time(rate(x[5m])[$__range:$__interval])`, `max_over_time(rate(x[5m])[$__range:$__interval])`},
+		{"offset", `x offset $offset`, `x offset $offset`},
+		{"metric name", `$metric{job="a"} > $threshold`, `$metric{job="a"} > $threshold`},
+		{"variable in string is untouched", `x{instance=~"$instance:.*"}`, `x{instance=~"$instance:.*"}`},
+		{"go template", `sum(rate(x{job="a"}[{{.window}}]))`, `sum(rate(x{job="a"}[{{.window}}]))`},
+		{"no variables", `sum(rate(x[5m]))`, `sum(rate(x[5m]))`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, restore, err := ParseTemplatedExpr(tt.input)
+			if err != nil {
+				t.Fatalf("ParseTemplatedExpr(%q) returned error: %v", tt.input, err)
+			}
+			if got := restore(expr.String()); got != tt.expected {
+				t.Errorf("restore(%q) = %q, want %q", expr.String(), got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+// Package rulegraph builds the dependency graph of a rule set, linking each recording rule to
+// the rules reading the series it records, and analyzes the evaluation order it implies.
+package rulegraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// Rule kinds of a Node
+const (
+	KindRecord = "record"
+	KindAlert  = "alert"
+)
+
+// Node is a rule of the rule set
+type Node struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	File  string `json:"file"`
+	Group string `json:"group"`
+	Line  int    `json:"line"`
+	// Depth is the number of dependencies on the longest chain of recording rules feeding the
+	// rule: 0 for rules reading only scraped series. Dependencies within a cycle are not counted.
+	Depth int `json:"depth"`
+}
+
+// Location returns the file:line a rule starts at
+func (n Node) Location() string {
+	return fmt.Sprintf("%s:%d", n.File, n.Line)
+}
+
+// Edge is a rule reading the series a recording rule records
+type Edge struct {
+	// From is the ID of the recording rule
+	From int `json:"from"`
+	// To is the ID of the rule reading its series
+	To int `json:"to"`
+	// CrossGroup is set when the rules are in different groups, which Prometheus evaluates
+	// independently and in no particular order
+	CrossGroup bool `json:"cross_group"`
+}
+
+// Graph is the dependency graph of a rule set
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+
+	// inputs and outputs index Edges by node
+	inputs  [][]int
+	outputs [][]int
+	// component maps each node to its strongly connected component
+	component []int
+}
+
+// Build returns the dependency graph of groups. Rules with neither an alert nor a record name
+// are skipped.
+func Build(groups []promql.RuleGroup) *Graph {
+	g := &Graph{}
+	producers := make(map[string][]int)
+	type ruleNode struct {
+		group int
+		rule  promql.Rule
+	}
+	var rules []ruleNode
+	for gi, group := range groups {
+		for _, rule := range group.Rules {
+			node := Node{ID: len(g.Nodes), Name: rule.Name(), File: group.File, Group: group.Name, Line: rule.Line}
+			switch {
+			case rule.Record != "":
+				node.Kind = KindRecord
+				producers[rule.Record] = append(producers[rule.Record], node.ID)
+			case rule.Alert != "":
+				node.Kind = KindAlert
+			default:
+				continue
+			}
+			g.Nodes = append(g.Nodes, node)
+			rules = append(rules, ruleNode{group: gi, rule: rule})
+		}
+	}
+
+	g.inputs = make([][]int, len(g.Nodes))
+	g.outputs = make([][]int, len(g.Nodes))
+	for to, r := range rules {
+		// Selectors matching metric names by regex read every recorded metric they match
+		metrics := r.rule.Metrics()
+		for _, pattern := range promql.MetricNamePatterns(r.rule.Expr) {
+			metrics = append(metrics, g.matchRecords(pattern)...)
+		}
+		for _, metric := range metrics {
+			for _, from := range producers[metric] {
+				g.addEdge(Edge{From: from, To: to, CrossGroup: rules[from].group != r.group})
+			}
+		}
+	}
+
+	g.component = g.components()
+	done := make(map[int]bool)
+	for id := range g.Nodes {
+		g.depth(id, done)
+	}
+	return g
+}
+
+// matchRecords returns the names of the recording rules whose name matches a __name__=~
+// pattern, in rule order and without duplicates. Patterns that are not valid regular
+// expressions match nothing.
+func (g *Graph) matchRecords(pattern string) []string {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, n := range g.Nodes {
+		if n.Kind == KindRecord && re.MatchString(n.Name) && !slices.Contains(names, n.Name) {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+func (g *Graph) addEdge(e Edge) {
+	for _, i := range g.inputs[e.To] {
+		if g.Edges[i].From == e.From {
+			return
+		}
+	}
+	g.inputs[e.To] = append(g.inputs[e.To], len(g.Edges))
+	g.outputs[e.From] = append(g.outputs[e.From], len(g.Edges))
+	g.Edges = append(g.Edges, e)
+}
+
+// depth sets and returns the depth of a node, following only edges between components so
+// that cycles terminate
+func (g *Graph) depth(id int, done map[int]bool) int {
+	if done[id] {
+		return g.Nodes[id].Depth
+	}
+	done[id] = true
+	for _, i := range g.inputs[id] {
+		from := g.Edges[i].From
+		if g.component[from] == g.component[id] {
+			continue
+		}
+		g.Nodes[id].Depth = max(g.Nodes[id].Depth, g.depth(from, done)+1)
+	}
+	return g.Nodes[id].Depth
+}
+
+// components returns the strongly connected component of each node, using Tarjan's algorithm
+func (g *Graph) components() []int {
+	component := make([]int, len(g.Nodes))
+	index := make([]int, len(g.Nodes))
+	low := make([]int, len(g.Nodes))
+	onStack := make([]bool, len(g.Nodes))
+	var stack []int
+	next, count := 1, 0
+
+	var visit func(int)
+	visit = func(id int) {
+		index[id], low[id] = next, next
+		next++
+		stack = append(stack, id)
+		onStack[id] = true
+		for _, i := range g.outputs[id] {
+			to := g.Edges[i].To
+			switch {
+			case index[to] == 0:
+				visit(to)
+				low[id] = min(low[id], low[to])
+			case onStack[to]:
+				low[id] = min(low[id], index[to])
+			}
+		}
+		if low[id] != index[id] {
+			return
+		}
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component[top] = count
+			if top == id {
+				break
+			}
+		}
+		count++
+	}
+
+	for id := range g.Nodes {
+		if index[id] == 0 {
+			visit(id)
+		}
+	}
+	return component
+}
+
+// Cycles returns the dependency cycles of the graph, each as the IDs of the rules along it
+// starting from its lowest ID, ordered by that ID. A recording rule reading its own series is
+// a cycle of one rule.
+func (g *Graph) Cycles() [][]int {
+	members := make(map[int][]int)
+	for id := range g.Nodes {
+		members[g.component[id]] = append(members[g.component[id]], id)
+	}
+
+	var cycles [][]int
+	for id := range g.Nodes {
+		ids := members[g.component[id]]
+		if ids[0] != id {
+			continue
+		}
+		if len(ids) > 1 || g.readsItself(id) {
+			cycles = append(cycles, g.cycleFrom(id))
+		}
+	}
+	return cycles
+}
+
+func (g *Graph) readsItself(id int) bool {
+	for _, i := range g.inputs[id] {
+		if g.Edges[i].From == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cycleFrom returns the shortest path from a node back to itself, breadth first through the
+// node's component
+func (g *Graph) cycleFrom(start int) []int {
+	prev := map[int]int{}
+	queue := []int{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, i := range g.outputs[id] {
+			to := g.Edges[i].To
+			if g.component[to] != g.component[start] {
+				continue
+			}
+			if to == start {
+				path := []int{id}
+				for path[0] != start {
+					path = append([]int{prev[path[0]]}, path...)
+				}
+				return path
+			}
+			if _, seen := prev[to]; !seen {
+				prev[to] = id
+				queue = append(queue, to)
+			}
+		}
+	}
+	return []int{start}
+}
+
+// CrossGroup returns the edges between rules of different groups
+func (g *Graph) CrossGroup() []Edge {
+	var edges []Edge
+	for _, e := range g.Edges {
+		if e.CrossGroup {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+// Unused returns the IDs of recording rules no rule of the rule set reads
+func (g *Graph) Unused() []int {
+	var ids []int
+	for _, n := range g.Nodes {
+		if n.Kind == KindRecord && len(g.outputs[n.ID]) == 0 {
+			ids = append(ids, n.ID)
+		}
+	}
+	return ids
+}
+
+// Chain returns the IDs of the rules along the longest chain of recording rules feeding a
+// rule, ending with the rule itself
+func (g *Graph) Chain(id int) []int {
+	chain := []int{id}
+	for g.Nodes[id].Depth > 0 {
+		for _, i := range g.inputs[id] {
+			from := g.Edges[i].From
+			if g.component[from] != g.component[id] && g.Nodes[from].Depth == g.Nodes[id].Depth-1 {
+				id = from
+				break
+			}
+		}
+		chain = append([]int{id}, chain...)
+	}
+	return chain
+}
+
+// Names returns the names of the rules with the given IDs
+func (g *Graph) Names(ids []int) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = g.Nodes[id].Name
+	}
+	return names
+}
+
+// WriteJSON writes the graph as JSON, with its cycles and unused recording rules
+func (g *Graph) WriteJSON(w io.Writer) error {
+	out := struct {
+		Nodes  []Node  `json:"nodes"`
+		Edges  []Edge  `json:"edges"`
+		Cycles [][]int `json:"cycles"`
+		Unused []int   `json:"unused"`
+	}{g.Nodes, g.Edges, g.Cycles(), g.Unused()}
+	// Empty lists are written as [] rather than null
+	if out.Nodes == nil {
+		out.Nodes = []Node{}
+	}
+	if out.Edges == nil {
+		out.Edges = []Edge{}
+	}
+	if out.Cycles == nil {
+		out.Cycles = [][]int{}
+	}
+	if out.Unused == nil {
+		out.Unused = []int{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// WriteDOT writes the graph in Graphviz DOT format, clustering rules by group. Recording rules
+// are boxes and alerts octagons; unused recording rules are dashed, cross-group dependencies
+// dashed and cycles red.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph rules {\n  rankdir=LR;\n  node [fontname=\"Helvetica\"];\n")
+
+	type groupKey struct{ file, name string }
+	var keys []groupKey
+	clusters := make(map[groupKey][]int)
+	for _, n := range g.Nodes {
+		k := groupKey{n.File, n.Group}
+		if _, ok := clusters[k]; !ok {
+			keys = append(keys, k)
+		}
+		clusters[k] = append(clusters[k], n.ID)
+	}
+
+	unused := g.Unused()
+	for i, k := range keys {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n    label=%q;\n", i, k.file+": "+k.name)
+		for _, id := range clusters[k] {
+			n := g.Nodes[id]
+			attrs := []string{fmt.Sprintf("label=%q", n.Name), "shape=box"}
+			if n.Kind == KindAlert {
+				attrs[1] = "shape=octagon"
+			}
+			if slices.Contains(unused, id) {
+				attrs = append(attrs, "style=dashed")
+			}
+			fmt.Fprintf(&b, "    n%d [%s];\n", id, strings.Join(attrs, ", "))
+		}
+		b.WriteString("  }\n")
+	}
+
+	edges := slices.Clone(g.Edges)
+	sort.SliceStable(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	for _, e := range edges {
+		var attrs []string
+		if e.CrossGroup {
+			attrs = append(attrs, "style=dashed")
+		}
+		if g.component[e.From] == g.component[e.To] {
+			attrs = append(attrs, "color=red")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "  n%d -> n%d [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "  n%d -> n%d;\n", e.From, e.To)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,149 @@
+package rulegraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+func testGraph() *Graph {
+	var groups []promql.RuleGroup
+	groups = append(groups, promql.LoadRuleGroups("api.yml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+      - record: job:http_errors:rate5m
+        expr: sum by (job) (rate(http_errors_total[5m]))
+      - record: job:http_errors:ratio5m
+        expr: job:http_errors:rate5m / job:http_requests:rate5m
+      - alert: HighErrorRate
+        expr: job:http_errors:ratio5m > 0.05
+      - record: job:unused:rate5m
+        expr: sum by (job) (rate(unused_total[5m]))
+`))...)
+	groups = append(groups, promql.LoadRuleGroups("slo.yml", []byte(`groups:
+  - name: slo
+    rules:
+      - record: job:slo:burn1h
+        expr: avg_over_time(job:http_errors:ratio5m[1h])
+      - alert: SLOBurn
+        expr: job:slo:burn1h > 14.4
+  - name: loop
+    rules:
+      - record: a
+        expr: b + 1
+      - record: b
+        expr: a - 1
+      - record: c
+        expr: c offset 1m
+`))...)
+	return Build(groups)
+}
+
+func TestBuild(t *testing.T) {
+	g := testGraph()
+
+	names := g.Names([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	expectedNames := []string{
+		"job:http_requests:rate5m", "job:http_errors:rate5m", "job:http_errors:ratio5m", "HighErrorRate",
+		"job:unused:rate5m", "job:slo:burn1h", "SLOBurn", "a", "b", "c",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Nodes = %v, want %v", names, expectedNames)
+	}
+
+	var depths []int
+	for _, n := range g.Nodes {
+		depths = append(depths, n.Depth)
+	}
+	if expected := []int{0, 0, 1, 2, 0, 2, 3, 0, 0, 0}; !reflect.DeepEqual(depths, expected) {
+		t.Errorf("depths = %v, want %v", depths, expected)
+	}
+
+	if got := g.Names(g.Chain(6)); !reflect.DeepEqual(got, []string{"job:http_errors:rate5m", "job:http_errors:ratio5m", "job:slo:burn1h", "SLOBurn"}) {
+		t.Errorf("Chain(SLOBurn) = %v", got)
+	}
+
+	if got := g.CrossGroup(); !reflect.DeepEqual(got, []Edge{{From: 2, To: 5, CrossGroup: true}}) {
+		t.Errorf("CrossGroup() = %+v", got)
+	}
+
+	if got := g.Unused(); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("Unused() = %v, want [4]", got)
+	}
+
+	if got := g.Cycles(); !reflect.DeepEqual(got, [][]int{{7, 8}, {9}}) {
+		t.Errorf("Cycles() = %v, want [[7 8] [9]]", got)
+	}
+}
+
+func TestBuildMetricNamePatterns(t *testing.T) {
+	g := Build(promql.LoadRuleGroups("rules.yml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+      - record: job:http_errors:rate5m
+        expr: sum by (job) (rate(http_errors_total[5m]))
+      - alert: RatesMissing
+        expr: count({__name__=~"job:http_.*:rate5m"}) < 2
+`)))
+	expected := []Edge{{From: 0, To: 2}, {From: 1, To: 2}}
+	if !reflect.DeepEqual(g.Edges, expected) {
+		t.Errorf("Build() edges = %+v, want %+v", g.Edges, expected)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testGraph().WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Nodes  []Node  `json:"nodes"`
+		Edges  []Edge  `json:"edges"`
+		Cycles [][]int `json:"cycles"`
+		Unused []int   `json:"unused"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("WriteJSON() wrote invalid JSON: %v", err)
+	}
+	if len(out.Nodes) != 10 || len(out.Edges) != 8 || len(out.Cycles) != 2 || !reflect.DeepEqual(out.Unused, []int{4}) {
+		t.Errorf("WriteJSON() = %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := Build(nil).WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"nodes": []`) || !strings.Contains(buf.String(), `"cycles": []`) {
+		t.Errorf("WriteJSON() of an empty graph = %s, want empty lists", buf.String())
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testGraph().WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	for _, expected := range []string{
+		"digraph rules {",
+		`subgraph cluster_0 {` + "\n" + `    label="api.yml: api";`,
+		`n3 [label="HighErrorRate", shape=octagon];`,
+		`n4 [label="job:unused:rate5m", shape=box, style=dashed];`,
+		"n0 -> n2;",
+		"n2 -> n5 [style=dashed];",
+		"n7 -> n8 [color=red];",
+		"n9 -> n9 [color=red];",
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Errorf("WriteDOT() does not contain %q:\n%s", expected, dot)
+		}
+	}
+}
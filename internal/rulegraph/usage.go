@@ -0,0 +1,219 @@
+package rulegraph
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// Reference is a read of a series from outside the rule set, such as a dashboard panel or a
+// query in Prometheus' query log
+type Reference struct {
+	Metric string
+	// Pattern, set instead of Metric, is the regular expression of a __name__=~ matcher,
+	// which reads every metric whose name it matches
+	Pattern string
+	// Source describes the reader, e.g. "dashboards/api.json:42 (panel Error rate)"
+	Source string
+	// Time is when the series was last queried, for references from the query log
+	Time time.Time
+}
+
+// ExpressionReferences returns the metrics read by the expressions of a file, one reference
+// per metric or metric name pattern and expression
+func ExpressionReferences(file string, exprs []promql.Expression) []Reference {
+	var refs []Reference
+	for _, e := range exprs {
+		source := fmt.Sprintf("%s:%d", file, e.Line)
+		if e.Location != "" {
+			source += " (" + e.Location + ")"
+		}
+		for _, metric := range promql.MetricNames(e.Value) {
+			refs = append(refs, Reference{Metric: metric, Source: source})
+		}
+		for _, pattern := range promql.MetricNamePatterns(e.Value) {
+			refs = append(refs, Reference{Pattern: pattern, Source: source})
+		}
+	}
+	return refs
+}
+
+// Resolve returns refs with each metric name pattern replaced by a reference to every
+// recorded metric of the graph whose name it matches. Patterns that are not valid regular
+// expressions match nothing.
+func (g *Graph) Resolve(refs []Reference) []Reference {
+	var resolved []Reference
+	for _, ref := range refs {
+		if ref.Pattern == "" {
+			resolved = append(resolved, ref)
+			continue
+		}
+		source := fmt.Sprintf("%s, by {__name__=~%q}", ref.Source, ref.Pattern)
+		for _, metric := range g.matchRecords(ref.Pattern) {
+			resolved = append(resolved, Reference{Metric: metric, Source: source, Time: ref.Time})
+		}
+	}
+	return resolved
+}
+
+// queryLogEntry is a line of Prometheus' query log
+type queryLogEntry struct {
+	Params struct {
+		Query string `json:"query"`
+	} `json:"params"`
+	// RuleGroup is set for queries of rule evaluations
+	RuleGroup *struct {
+		Name string `json:"name"`
+	} `json:"ruleGroup"`
+	HTTPRequest *struct {
+		ClientIP string `json:"clientIP"`
+	} `json:"httpRequest"`
+	TS time.Time `json:"ts"`
+}
+
+// QueryLogReferences returns the metrics read by the queries of a Prometheus query log logged
+// at or after since, one reference per metric or metric name pattern for its latest query. It also returns the time
+// of the oldest query considered, or the zero time if there is none, as the log may have been
+// rotated or enabled after since. Queries of rule evaluations are skipped, as the rule files
+// already tell which rules read a series, and so are lines that are not query log entries.
+func QueryLogReferences(r io.Reader, since time.Time) ([]Reference, time.Time, error) {
+	latest := make(map[string]Reference)
+	var oldest time.Time
+
+	scanner := bufio.NewScanner(r)
+	// Queries, and so log lines, can be long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Params.Query == "" || entry.RuleGroup != nil {
+			continue
+		}
+		if entry.TS.Before(since) {
+			continue
+		}
+		if oldest.IsZero() || entry.TS.Before(oldest) {
+			oldest = entry.TS
+		}
+
+		source := "query log"
+		if entry.HTTPRequest != nil && entry.HTTPRequest.ClientIP != "" {
+			source = fmt.Sprintf("query log (client %s)", entry.HTTPRequest.ClientIP)
+		}
+		var read []Reference
+		for _, metric := range promql.MetricNames(entry.Params.Query) {
+			read = append(read, Reference{Metric: metric})
+		}
+		for _, pattern := range promql.MetricNamePatterns(entry.Params.Query) {
+			read = append(read, Reference{Pattern: pattern})
+		}
+		for _, ref := range read {
+			// Patterns are keyed apart from metric names, which cannot contain =~
+			key := ref.Metric
+			if ref.Pattern != "" {
+				key = "=~" + ref.Pattern
+			}
+			if prev, ok := latest[key]; !ok || entry.TS.After(prev.Time) {
+				ref.Source, ref.Time = source, entry.TS
+				latest[key] = ref
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read query log: %w", err)
+	}
+
+	refs := make([]Reference, 0, len(latest))
+	for _, ref := range latest {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Metric != refs[j].Metric {
+			return refs[i].Metric < refs[j].Metric
+		}
+		return refs[i].Pattern < refs[j].Pattern
+	})
+	return refs, oldest, nil
+}
+
+// QueryLogFile returns the path of the query log a Prometheus server writes, as set by
+// global.query_log_file in its configuration. The path is on the server's filesystem,
+// relative to its working directory.
+func QueryLogFile(prometheusURL string) (path string, err error) {
+	resp, err := http.Get(prometheusURL + "/api/v1/status/config")
+	if err != nil {
+		return "", fmt.Errorf("failed to query Prometheus: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("prometheus returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var configResp struct {
+		Data struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&configResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var config struct {
+		Global struct {
+			QueryLogFile string `yaml:"query_log_file"`
+		} `yaml:"global"`
+	}
+	if err := yaml.Unmarshal([]byte(configResp.Data.YAML), &config); err != nil {
+		return "", fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	if config.Global.QueryLogFile == "" {
+		return "", errors.New("query logging is disabled: global.query_log_file is not set")
+	}
+	return config.Global.QueryLogFile, nil
+}
+
+// Unreferenced returns the IDs of recording rules whose series nothing reads: no alert, no
+// recording rule whose own series are read, and none of the metrics in used. A recording rule
+// only read by unreferenced recording rules, including itself, is unreferenced too.
+func (g *Graph) Unreferenced(used map[string]bool) []int {
+	live := make([]bool, len(g.Nodes))
+	var queue []int
+	for _, n := range g.Nodes {
+		if n.Kind == KindAlert || used[n.Name] {
+			live[n.ID] = true
+			queue = append(queue, n.ID)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, i := range g.inputs[id] {
+			if from := g.Edges[i].From; !live[from] {
+				live[from] = true
+				queue = append(queue, from)
+			}
+		}
+	}
+
+	var ids []int
+	for _, n := range g.Nodes {
+		if n.Kind == KindRecord && !live[n.ID] {
+			ids = append(ids, n.ID)
+		}
+	}
+	return ids
+}
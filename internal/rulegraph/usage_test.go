@@ -0,0 +1,140 @@
+package rulegraph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+func TestExpressionReferences(t *testing.T) {
+	exprs := []promql.Expression{
+		{Value: `sum(job:http_errors:rate5m{job="$job"}) / sum(avg_over_time(job:http_requests:rate5m[$__rate_interval]))`, Line: 12, Location: "panel Error rate"},
+		{Value: `up`, Line: 20},
+		{Value: `sum by (__name__) ({__name__=~"job:.*:rate5m",job="$job"})`, Line: 25, Location: "panel Rates"},
+		{Value: `not valid (`, Line: 30},
+	}
+	expected := []Reference{
+		{Metric: "job:http_errors:rate5m", Source: "api.json:12 (panel Error rate)"},
+		{Metric: "job:http_requests:rate5m", Source: "api.json:12 (panel Error rate)"},
+		{Metric: "up", Source: "api.json:20"},
+		{Pattern: "job:.*:rate5m", Source: "api.json:25 (panel Rates)"},
+	}
+	if got := ExpressionReferences("api.json", exprs); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ExpressionReferences() = %+v, want %+v", got, expected)
+	}
+}
+
+func TestQueryLogReferences(t *testing.T) {
+	log := `{"httpRequest":{"clientIP":"10.0.0.1","method":"GET","path":"/api/v1/query_range"},"params":{"end":"2026-10-10T12:00:00Z","query":"job:http_errors:rate5m / job:http_requests:rate5m","start":"2026-10-10T11:00:00Z","step":15},"ts":"2026-10-10T12:00:01Z"}
+{"httpRequest":{"clientIP":"10.0.0.2","method":"GET","path":"/api/v1/query"},"params":{"query":"job:http_errors:rate5m > 0"},"ts":"2026-10-12T08:00:00Z"}
+{"params":{"query":"sum by (job) (rate(job:unused:rate5m[5m]))"},"ruleGroup":{"file":"rules.yml","name":"api"},"ts":"2026-10-12T09:00:00Z"}
+{"httpRequest":{"clientIP":"10.0.0.3"},"params":{"query":"job:old:rate5m"},"ts":"2026-09-01T00:00:00Z"}
+{"httpRequest":{"clientIP":"10.0.0.4"},"params":{"query":"{__name__=~\"job:.*\"}"},"ts":"2026-10-11T00:00:00Z"}
+not a query log line
+`
+	refs, oldest, err := QueryLogReferences(strings.NewReader(log), time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Reference{
+		{Metric: "job:http_errors:rate5m", Source: "query log (client 10.0.0.2)", Time: time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC)},
+		{Metric: "job:http_requests:rate5m", Source: "query log (client 10.0.0.1)", Time: time.Date(2026, 10, 10, 12, 0, 1, 0, time.UTC)},
+	}
+	// Patterns sort before metric names, as their Metric is empty
+	expected = append([]Reference{
+		{Pattern: "job:.*", Source: "query log (client 10.0.0.4)", Time: time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC)},
+	}, expected...)
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("QueryLogReferences() = %+v, want %+v", refs, expected)
+	}
+	if !oldest.Equal(time.Date(2026, 10, 10, 12, 0, 1, 0, time.UTC)) {
+		t.Errorf("QueryLogReferences() oldest = %v, want 2026-10-10T12:00:01Z", oldest)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	g := testGraph()
+	refs := []Reference{
+		{Metric: "up", Source: "api.json:20"},
+		{Pattern: "job:http_.*:rate5m", Source: "api.json:25"},
+		{Pattern: "(", Source: "api.json:30"},
+	}
+	expected := []Reference{
+		{Metric: "up", Source: "api.json:20"},
+		{Metric: "job:http_requests:rate5m", Source: `api.json:25, by {__name__=~"job:http_.*:rate5m"}`},
+		{Metric: "job:http_errors:rate5m", Source: `api.json:25, by {__name__=~"job:http_.*:rate5m"}`},
+	}
+	if got := g.Resolve(refs); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Resolve() = %+v, want %+v", got, expected)
+	}
+}
+
+func TestQueryLogFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		err      string
+	}{
+		{
+			name:     "query log enabled",
+			config:   "global:\n  scrape_interval: 15s\n  query_log_file: /prometheus/query.log\n",
+			expected: "/prometheus/query.log",
+		},
+		{
+			name:   "query log disabled",
+			config: "global:\n  scrape_interval: 15s\n",
+			err:    "query logging is disabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/status/config" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"success","data":{"yaml":` + strconv.Quote(tt.config) + `}}`))
+			}))
+			defer server.Close()
+
+			path, err := QueryLogFile(server.URL)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("QueryLogFile() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.expected {
+				t.Errorf("QueryLogFile() = %q, want %q", path, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnreferenced(t *testing.T) {
+	g := testGraph()
+
+	// job:unused:rate5m is read by nothing, and the cycle a <-> b and c reading itself by
+	// nothing else
+	if got := g.Names(g.Unreferenced(nil)); !reflect.DeepEqual(got, []string{"job:unused:rate5m", "a", "b", "c"}) {
+		t.Errorf("Unreferenced(nil) = %v", got)
+	}
+
+	// A dashboard reading b keeps a alive through the cycle
+	used := map[string]bool{"b": true, "job:unused:rate5m": true}
+	if got := g.Names(g.Unreferenced(used)); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Unreferenced(%v) = %v, want [c]", used, got)
+	}
+}
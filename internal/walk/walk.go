@@ -0,0 +1,340 @@
+// Package walk finds the files under a directory that the tools should check, honoring
+// .gitignore files and include/exclude glob patterns.
+package walk
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Options filters the files returned by Files
+type Options struct {
+	// Extensions lists the file suffixes to return, e.g. ".yml"
+	Extensions []string
+	// Include, if not empty, limits files to those matching at least one pattern
+	Include []string
+	// Exclude skips files and directories matching any pattern
+	Exclude []string
+	// NoGitignore disables .gitignore handling
+	NoGitignore bool
+}
+
+// Patterns collects repeated glob pattern flags
+type Patterns []string
+
+func (p *Patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+// Set adds a pattern
+func (p *Patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// Files returns the files under root that pass opts, in lexical order. Include and exclude
+// patterns are matched against paths relative to root: a pattern without a slash matches the
+// file or directory name at any depth, and ** matches any number of directories. Files and
+// directories ignored by git, through .gitignore files or .git/info/exclude, are skipped. A
+// root that is a file is returned as is, since naming a file explicitly overrides the filters.
+func Files(root string, opts Options) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+
+	var ignore *gitignore
+	if !opts.NoGitignore {
+		ignore, err = newGitignore(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel == "." {
+				if ignore != nil {
+					return ignore.enter(p)
+				}
+				return nil
+			}
+			if d.Name() == ".git" || matchAny(opts.Exclude, rel) {
+				return filepath.SkipDir
+			}
+			if ignore != nil {
+				ignored, err := ignore.ignored(p, true)
+				if err != nil {
+					return err
+				}
+				if ignored {
+					return filepath.SkipDir
+				}
+				return ignore.enter(p)
+			}
+			return nil
+		}
+
+		if !hasExtension(p, opts.Extensions) || matchAny(opts.Exclude, rel) {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchAny(opts.Include, rel) {
+			return nil
+		}
+		if ignore != nil {
+			ignored, err := ignore.ignored(p, false)
+			if err != nil {
+				return err
+			}
+			if ignored {
+				return nil
+			}
+		}
+
+		files = append(files, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Match reports whether a slash-separated path matches a glob pattern. Pattern segments use
+// path.Match syntax, and a ** segment matches any number of path segments.
+func Match(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchPattern matches a path relative to the walk root, matching patterns without a slash
+// against the last path segment only
+func matchPattern(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		return Match(pattern, path.Base(rel))
+	}
+	return Match(strings.TrimPrefix(pattern, "/"), rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExtension(p string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreRule is one pattern line from a .gitignore file
+type ignoreRule struct {
+	// base is the directory holding the ignore file, relative to the repository root, or ""
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// gitignore tracks the ignore rules that apply while walking a directory tree
+type gitignore struct {
+	// repoRoot is the absolute path of the repository, or of the walk root outside a repository
+	repoRoot string
+	rules    []ignoreRule
+}
+
+// newGitignore loads the ignore rules that apply above root: .git/info/exclude and the
+// .gitignore files between the repository root and root. Rules in root and below are added
+// by enter as the walk reaches each directory.
+func newGitignore(root string) (*gitignore, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &gitignore{repoRoot: abs}
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			g.repoRoot = dir
+			break
+		}
+		if filepath.Dir(dir) == dir {
+			// Not in a repository: only .gitignore files under root apply
+			return g, nil
+		}
+	}
+
+	if err := g.load(filepath.Join(g.repoRoot, ".git", "info", "exclude"), ""); err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(g.repoRoot, abs)
+	if err != nil {
+		return nil, err
+	}
+	if rel != "." {
+		dir := g.repoRoot
+		for _, segment := range strings.Split(filepath.ToSlash(rel), "/") {
+			if err := g.enter(dir); err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(dir, segment)
+		}
+	}
+	return g, nil
+}
+
+// enter adds the rules of dir's .gitignore file, if it has one
+func (g *gitignore) enter(dir string) error {
+	base, err := g.rel(dir)
+	if err != nil {
+		return err
+	}
+	if base == "." {
+		base = ""
+	}
+	return g.load(filepath.Join(dir, ".gitignore"), base)
+}
+
+// load adds the rules in an ignore file; a missing file has no rules
+func (g *gitignore) load(file, base string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), base); ok {
+			g.rules = append(g.rules, rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseIgnoreRule parses a .gitignore line, reporting false for blank lines and comments
+func parseIgnoreRule(line, base string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// A slash anywhere but the end anchors the pattern to the ignore file's directory
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	return rule, rule.pattern != ""
+}
+
+// ignored reports whether git ignores a path. The last matching rule wins, so rules from
+// deeper .gitignore files override those above them.
+func (g *gitignore) ignored(p string, isDir bool) (bool, error) {
+	rel, err := g.rel(p)
+	if err != nil {
+		return false, err
+	}
+
+	ignored := false
+	for _, rule := range g.rules {
+		if rule.matches(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored, nil
+}
+
+// rel returns a path relative to the repository root, slash-separated
+func (g *gitignore) rel(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(g.repoRoot, abs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	if r.anchored {
+		return Match(r.pattern, rel)
+	}
+	return Match(r.pattern, path.Base(rel))
+}
@@ -0,0 +1,202 @@
+package walk
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.yml", "alerts.yml", true},
+		{"*.yml", "alerts.yaml", false},
+		{"rules/*.yml", "rules/a.yml", true},
+		{"rules/*.yml", "rules/sub/a.yml", false},
+		{"rules/**/*.yml", "rules/sub/deep/a.yml", true},
+		{"rules/**/*.yml", "rules/a.yml", true},
+		{"**/node_modules", "web/node_modules", true},
+		{"**/node_modules", "node_modules", true},
+		{"vendor/**", "vendor/chart/values.yaml", true},
+		{"vendor/**", "other/vendor/x.yml", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected ignoreRule
+		ok       bool
+	}{
+		{"", ignoreRule{}, false},
+		{"# comment", ignoreRule{}, false},
+		{"node_modules/", ignoreRule{pattern: "node_modules", dirOnly: true}, true},
+		{"/build", ignoreRule{pattern: "build", anchored: true}, true},
+		{"docs/*.yml", ignoreRule{pattern: "docs/*.yml", anchored: true}, true},
+		{"!keep.yml", ignoreRule{pattern: "keep.yml", negate: true}, true},
+		{`\#file`, ignoreRule{pattern: "#file"}, true},
+		{"trailing.yml   ", ignoreRule{pattern: "trailing.yml"}, true},
+	}
+
+	for _, tt := range tests {
+		rule, ok := parseIgnoreRule(tt.line, "")
+		if ok != tt.ok || (ok && rule != tt.expected) {
+			t.Errorf("parseIgnoreRule(%q) = %+v, %v; want %+v, %v", tt.line, rule, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+// writeTree creates files under dir, with parent directories as needed
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	repo := t.TempDir()
+	writeTree(t, repo, map[string]string{
+		".git/HEAD":                    "ref: refs/heads/main\n",
+		".git/info/exclude":            "scratch.yml\n",
+		".gitignore":                   "node_modules/\n/build\n*.generated.yml\n",
+		"rules/alerts.yml":             "",
+		"rules/recording.yaml":         "",
+		"rules/api.generated.yml":      "",
+		"rules/notes.txt":              "",
+		"rules/scratch.yml":            "",
+		"rules/sub/.gitignore":         "*.yml\n!keep.yml\n",
+		"rules/sub/drop.yml":           "",
+		"rules/sub/keep.yml":           "",
+		"node_modules/pkg/config.yml":  "",
+		"build/out.yml":                "",
+		"charts/build/rules.yml":       "",
+		"vendor/chart/values.yaml":     "",
+		"dashboards/api.json":          "",
+		".github/workflows/test.yml":   "",
+		"charts/templates/rules.yaml":  "",
+		"charts/templates/config.yaml": "",
+	})
+
+	exts := []string{".yml", ".yaml", ".json"}
+	tests := []struct {
+		name     string
+		root     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "gitignore",
+			root: ".",
+			opts: Options{Extensions: exts},
+			expected: []string{
+				".github/workflows/test.yml",
+				"charts/build/rules.yml",
+				"charts/templates/config.yaml",
+				"charts/templates/rules.yaml",
+				"dashboards/api.json",
+				"rules/alerts.yml",
+				"rules/recording.yaml",
+				"rules/sub/keep.yml",
+				"vendor/chart/values.yaml",
+			},
+		},
+		{
+			name: "exclude",
+			root: ".",
+			opts: Options{Extensions: exts, Exclude: []string{"vendor/**", ".github", "config.yaml"}},
+			expected: []string{
+				"charts/build/rules.yml",
+				"charts/templates/rules.yaml",
+				"dashboards/api.json",
+				"rules/alerts.yml",
+				"rules/recording.yaml",
+				"rules/sub/keep.yml",
+			},
+		},
+		{
+			name:     "include",
+			root:     ".",
+			opts:     Options{Extensions: exts, Include: []string{"rules/**/*.yml", "*.json"}},
+			expected: []string{"dashboards/api.json", "rules/alerts.yml", "rules/sub/keep.yml"},
+		},
+		{
+			name:     "subdirectory honors parent gitignore",
+			root:     "rules",
+			opts:     Options{Extensions: exts},
+			expected: []string{"rules/alerts.yml", "rules/recording.yaml", "rules/sub/keep.yml"},
+		},
+		{
+			name: "gitignore disabled",
+			root: "rules",
+			opts: Options{Extensions: exts, NoGitignore: true},
+			expected: []string{
+				"rules/alerts.yml",
+				"rules/api.generated.yml",
+				"rules/recording.yaml",
+				"rules/scratch.yml",
+				"rules/sub/drop.yml",
+				"rules/sub/keep.yml",
+			},
+		},
+		{
+			name:     "explicit file",
+			root:     "rules/api.generated.yml",
+			opts:     Options{Extensions: exts, Exclude: []string{"*.yml"}},
+			expected: []string{"rules/api.generated.yml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Files(filepath.Join(repo, filepath.FromSlash(tt.root)), tt.opts)
+			if err != nil {
+				t.Fatalf("Files returned error: %v", err)
+			}
+			got := make([]string, len(files))
+			for i, f := range files {
+				rel, err := filepath.Rel(repo, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[i] = filepath.ToSlash(rel)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Files() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFilesOutsideRepository(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".gitignore":  "ignored.yml\n",
+		"ignored.yml": "",
+		"rules.yml":   "",
+	})
+
+	files, err := Files(dir, Options{Extensions: []string{".yml"}})
+	if err != nil {
+		t.Fatalf("Files returned error: %v", err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "rules.yml" {
+		t.Errorf("Files() = %v, want only rules.yml", files)
+	}
+}
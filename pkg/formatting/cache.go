@@ -0,0 +1,104 @@
+package formatting
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LookupCache shares the results of remote Prometheus lookups across files, so each metric is
+// queried once per run even when files are checked concurrently. Create one with
+// NewLookupCache; a nil cache performs every lookup.
+type LookupCache struct {
+	continuity lookups[bool]
+	targets    lookups[map[string]time.Duration]
+	meta       lookups[Metadata]
+	series     lookups[int]
+}
+
+// lookups holds the remote queries of one kind that are in flight or complete, by key
+type lookups[T any] struct {
+	mu      sync.Mutex
+	entries map[string]*lookup[T]
+}
+
+// lookup is a remote query that is in flight or complete
+type lookup[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// NewLookupCache returns an empty cache
+func NewLookupCache() *LookupCache {
+	return &LookupCache{}
+}
+
+// get returns the result of fetch for key, calling it only for the first caller. Concurrent
+// callers for the same key wait for that call.
+func (l *lookups[T]) get(key string, fetch func() (T, error)) (T, error) {
+	l.mu.Lock()
+	if entry, ok := l.entries[key]; ok {
+		l.mu.Unlock()
+		<-entry.done
+		return entry.value, entry.err
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]*lookup[T])
+	}
+	entry := &lookup[T]{done: make(chan struct{})}
+	l.entries[key] = entry
+	l.mu.Unlock()
+
+	// Waiters are released even if fetch panics, with an error in place of the value
+	defer func() {
+		if r := recover(); r != nil {
+			entry.err = fmt.Errorf("lookup panicked: %v", r)
+			close(entry.done)
+			panic(r)
+		}
+		close(entry.done)
+	}()
+	entry.value, entry.err = fetch()
+	return entry.value, entry.err
+}
+
+// metricContinuity returns the result of checkMetricContinuity, querying Prometheus only for
+// the first caller. Concurrent callers for the same metric wait for that query.
+func (c *LookupCache) metricContinuity(prometheusURL, metricName string) (bool, error) {
+	fetch := func() (bool, error) { return checkMetricContinuity(prometheusURL, metricName) }
+	if c == nil {
+		return fetch()
+	}
+	return c.continuity.get(prometheusURL+"\x00"+metricName, fetch)
+}
+
+// scrapeIntervals returns the result of fetchScrapeIntervals, querying each Prometheus server
+// only for the first caller
+func (c *LookupCache) scrapeIntervals(prometheusURL string) (map[string]time.Duration, error) {
+	fetch := func() (map[string]time.Duration, error) { return fetchScrapeIntervals(prometheusURL) }
+	if c == nil {
+		return fetch()
+	}
+	return c.targets.get(prometheusURL, fetch)
+}
+
+// metadata returns the result of fetchMetadata, querying each Prometheus server only for the
+// first caller
+func (c *LookupCache) metadata(prometheusURL string) (Metadata, error) {
+	fetch := func() (Metadata, error) { return fetchMetadata(prometheusURL) }
+	if c == nil {
+		return fetch()
+	}
+	return c.meta.get(prometheusURL, fetch)
+}
+
+// seriesCount returns the result of countSeries, querying Prometheus only for the first caller
+// counting a selector
+func (c *LookupCache) seriesCount(prometheusURL, selector string) (int, error) {
+	fetch := func() (int, error) { return countSeries(prometheusURL, selector) }
+	if c == nil {
+		return fetch()
+	}
+	return c.series.get(prometheusURL+"\x00"+selector, fetch)
+}
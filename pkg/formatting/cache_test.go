@@ -0,0 +1,78 @@
+package formatting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupCacheDeduplicatesQueries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+			`{"metric":{"__name__":"` + r.URL.Query().Get("query") + `"},"values":[[1609459200,"1"],[1609459500,"1"]]}]}}`)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	cache := NewLookupCache()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		for _, metric := range []string{"metric_a", "metric_b"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				isSparse, err := cache.metricContinuity(server.URL, metric)
+				if err != nil || !isSparse {
+					t.Errorf("metricContinuity(%s) = %v, %v; want sparse", metric, isSparse, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Prometheus was queried %d times, want once per metric (2)", got)
+	}
+}
+
+func TestLookupCacheNil(t *testing.T) {
+	var cache *LookupCache
+	if _, err := cache.metricContinuity("http://invalid-prometheus-url-that-does-not-exist:9999", "m"); err == nil {
+		t.Error("Expected a nil cache to perform the lookup and return its error")
+	}
+}
+
+func TestLookupsPanic(t *testing.T) {
+	var l lookups[int]
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic of fetch to reach its caller")
+			}
+		}()
+		_, _ = l.get("key", func() (int, error) { panic("boom") })
+	}()
+
+	// Later callers get an error instead of waiting forever
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.get("key", func() (int, error) { return 1, nil })
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error for a lookup that panicked")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup waiting on a panicked fetch never returned")
+	}
+}
@@ -0,0 +1,309 @@
+package formatting
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// checkBinaryOperators validates binary operations between vectors by the label sets of
+// their operands: one-to-one matches and and/unless filters between operands whose labels
+// differ or whose selectors pin a matched label to different values, on() clauses naming
+// labels an operand lacks, and comparisons of ratios that are NaN when their denominator is
+// 0. The labels of raw series are unknown, so operands such as rate(foo_total[5m]) are only
+// compared by the values their equality matchers pin.
+func checkBinaryOperators(expr string) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+
+	var issues []string
+	promql.Inspect(parsed, func(e promql.Expr, _ []promql.Expr) bool {
+		b, ok := e.(*promql.BinaryExpr)
+		if !ok {
+			return true
+		}
+		if issue := checkRatioComparison(b); issue != "" {
+			issues = append(issues, issue)
+		}
+		if b.LHS.Type() == promql.ValueTypeVector && b.RHS.Type() == promql.ValueTypeVector && b.Op != "or" {
+			issues = append(issues, checkVectorMatching(b)...)
+		}
+		return true
+	})
+
+	for i, issue := range issues {
+		issues[i] = restore(issue)
+	}
+	return issues
+}
+
+// checkVectorMatching checks that the series of both operands of a binary operation can
+// match: by their label sets where the labels of both are known, and otherwise by the values
+// their selectors pin matched labels to
+func checkVectorMatching(b *promql.BinaryExpr) []string {
+	if issue := checkPinnedLabels(b); issue != "" {
+		return []string{issue}
+	}
+
+	lhs, lhsOpen := promql.OutputLabels(b.LHS)
+	rhs, rhsOpen := promql.OutputLabels(b.RHS)
+
+	if m := b.Matching; m != nil && m.On {
+		var issues []string
+		for _, side := range []struct {
+			name   string
+			labels []string
+			open   bool
+		}{{"left", lhs, lhsOpen}, {"right", rhs, rhsOpen}} {
+			if side.open {
+				continue
+			}
+			var missing []string
+			for _, label := range m.Labels {
+				if !slices.Contains(side.labels, label) {
+					missing = append(missing, label)
+				}
+			}
+			if len(missing) > 0 {
+				issues = append(issues, fmt.Sprintf("'%s' matches on (%s), but the %s side only has %s - "+
+					"its series match on an empty %s; match on labels both sides keep",
+					quoteOperation(b), strings.Join(m.Labels, ", "), side.name, describeLabels(side.labels), strings.Join(missing, ", ")))
+			}
+		}
+		return issues
+	}
+
+	if lhsOpen || rhsOpen {
+		return nil
+	}
+	if m := b.Matching; m != nil {
+		if m.Card != promql.CardOneToOne && m.Card != promql.CardManyToMany {
+			// group_left and group_right without on() are checked by Prometheus at runtime
+			return nil
+		}
+		lhs = slices.DeleteFunc(slices.Clone(lhs), func(l string) bool { return slices.Contains(m.Labels, l) })
+		rhs = slices.DeleteFunc(slices.Clone(rhs), func(l string) bool { return slices.Contains(m.Labels, l) })
+	}
+	if slices.Equal(lhs, rhs) {
+		return nil
+	}
+
+	common := slices.DeleteFunc(slices.Clone(lhs), func(l string) bool { return !slices.Contains(rhs, l) })
+	on := "on (" + strings.Join(common, ", ") + ")"
+	if b.Op == "and" || b.Op == "unless" {
+		effect := "never matches, so the result is always empty"
+		if b.Op == "unless" {
+			effect = "never removes a series"
+		}
+		return []string{fmt.Sprintf("'%s' matches series with identical label sets, but the left side has %s and the right side %s - "+
+			"'%s' %s; use '%s %s'",
+			quoteOperation(b), describeLabels(lhs), describeLabels(rhs), b.Op, effect, b.Op, on)}
+	}
+
+	suggestion := on
+	switch {
+	case len(common) == len(rhs):
+		suggestion += " group_left"
+	case len(common) == len(lhs):
+		suggestion += " group_right"
+	}
+	return []string{fmt.Sprintf("'%s' matches series with identical label sets, but the left side has %s and the right side %s - "+
+		"no series match, so the result is always empty; use '%s %s'",
+		quoteOperation(b), describeLabels(lhs), describeLabels(rhs), b.Op, suggestion)}
+}
+
+// checkPinnedLabels flags binary operations matching on a label that the selectors of the two
+// operands pin to different values, so that no series match, even where the rest of their
+// label sets is unknown
+func checkPinnedLabels(b *promql.BinaryExpr) string {
+	lhs, rhs := pinnedLabels(b.LHS), pinnedLabels(b.RHS)
+	m := b.Matching
+
+	var names, left, right []string
+	for _, name := range slices.Sorted(maps.Keys(lhs)) {
+		value, ok := rhs[name]
+		if !ok || value == lhs[name] {
+			continue
+		}
+		if m != nil && m.On != slices.Contains(m.Labels, name) {
+			// The label is not matched on
+			continue
+		}
+		names = append(names, name)
+		left = append(left, fmt.Sprintf("%s=%q", name, lhs[name]))
+		right = append(right, fmt.Sprintf("%s=%q", name, value))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	effect := "no series match, so the result is always empty"
+	switch b.Op {
+	case "and":
+		effect = "'and' never matches, so the result is always empty"
+	case "unless":
+		effect = "'unless' never removes a series"
+	}
+	fix := fmt.Sprintf("leave %s out of on()", strings.Join(names, ", "))
+	if m == nil || !m.On {
+		var ignoring []string
+		if m != nil {
+			ignoring = slices.Clone(m.Labels)
+		}
+		fix = fmt.Sprintf("use 'ignoring (%s)'", strings.Join(append(ignoring, names...), ", "))
+	}
+	return fmt.Sprintf("'%s' matches on %s, but the left side selects %s and the right side %s - %s; %s",
+		quoteOperation(b), strings.Join(names, ", "), strings.Join(left, ", "), strings.Join(right, ", "), effect, fix)
+}
+
+// pinnedLabels returns the label values every series of an operand is known to have: those
+// of the equality matchers of a selector, also inside functions that keep the labels of their
+// argument. Values holding template variables are unknown. Other operands pin no labels.
+func pinnedLabels(expr promql.Expr) map[string]string {
+	for {
+		switch e := promql.Unwrap(expr).(type) {
+		case *promql.VectorSelector:
+			pinned := make(map[string]string)
+			for _, m := range e.Matchers {
+				if m.Op == promql.MatchEqual && m.Name != "__name__" && m.Value != "" && !promql.HasTemplateVariable(m.Value) {
+					pinned[m.Name] = m.Value
+				}
+			}
+			return pinned
+		case *promql.MatrixSelector:
+			expr = e.VectorSelector
+		case *promql.SubqueryExpr:
+			expr = e.Expr
+		case *promql.Call:
+			switch e.Func {
+			case "label_replace", "label_join", "absent", "absent_over_time", "histogram_quantile", "histogram_fraction":
+				// These set or drop labels
+				return nil
+			}
+			expr = nil
+			for _, arg := range e.Args {
+				if typ := arg.Type(); typ == promql.ValueTypeVector || typ == promql.ValueTypeMatrix {
+					expr = arg
+					break
+				}
+			}
+			if expr == nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// checkRatioComparison flags comparisons filtering a ratio whose denominator is not guarded
+// against 0, where the NaN of 0/0 changes which series pass: '!=', which NaN always passes,
+// and filters such as '> 0' and '>= 0' meant to keep every series with a value. Thresholds
+// such as '> 0.05' drop NaN just as they drop a ratio of 0, so they are left to the division
+// check.
+func checkRatioComparison(b *promql.BinaryExpr) string {
+	if !promql.IsComparisonOperator(b.Op) || b.ReturnBool {
+		return ""
+	}
+	// comparison quotes the operator and the threshold the ratio is compared with
+	ratio, ok := promql.Unwrap(b.LHS).(*promql.BinaryExpr)
+	comparison := "... " + b.OperatorString() + " " + b.RHS.String()
+	threshold, filters := b.RHS, b.Op == ">" || b.Op == ">="
+	if !ok || b.RHS.Type() != promql.ValueTypeScalar {
+		ratio, ok = promql.Unwrap(b.RHS).(*promql.BinaryExpr)
+		comparison = b.LHS.String() + " " + b.OperatorString() + " ..."
+		threshold, filters = b.LHS, b.Op == "<" || b.Op == "<="
+		if !ok || b.LHS.Type() != promql.ValueTypeScalar {
+			return ""
+		}
+	}
+	zero, _ := promql.Unwrap(threshold).(*promql.NumberLiteral)
+	if b.Op != "!=" && (!filters || zero == nil || zero.Val != 0) {
+		return ""
+	}
+	if ratio.Op != "/" || ratio.LHS.Type() != promql.ValueTypeVector || ratio.RHS.Type() != promql.ValueTypeVector {
+		return ""
+	}
+
+	switch denominator := promql.Unwrap(ratio.RHS).(type) {
+	case *promql.BinaryExpr:
+		if (promql.IsComparisonOperator(denominator.Op) && !denominator.ReturnBool) || denominator.Op == "or" {
+			return ""
+		}
+	case *promql.Call:
+		if denominator.Func == "clamp_min" || denominator.Func == "clamp" {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Comparison '%s' filters a ratio that is NaN when its denominator '%s' is 0 - "+
+		"NaN fails every comparison but '!=', which it always passes, so series without traffic are silently dropped or kept; "+
+		"filter the denominator, e.g. '/ (%s > 0)'",
+		comparison, truncate(ratio.RHS.String(), 60), truncate(ratio.RHS.String(), 60))
+}
+
+// describeLabels names a label set for messages
+func describeLabels(labels []string) string {
+	if len(labels) == 0 {
+		return "no labels"
+	}
+	return "(" + strings.Join(labels, ", ") + ")"
+}
+
+// quoteOperation shortens a binary operation to its operator between its operands' text,
+// truncating long operands
+func quoteOperation(b *promql.BinaryExpr) string {
+	return truncate(b.LHS.String(), 40) + " " + b.OperatorString() + " " + truncate(b.RHS.String(), 40)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// boolConditionIssues reports alerts whose condition compares with the bool modifier. If only
+// is set, rules whose expression starts at a line it rejects are skipped.
+func boolConditionIssues(content string, only func(line int) bool) []Issue {
+	var issues []Issue
+	for _, r := range ruleExprs(content, only) {
+		if r.Alert == "" {
+			continue
+		}
+		parsed, restore, err := promql.ParseTemplatedExpr(r.Expr)
+		if err != nil {
+			continue
+		}
+		for _, b := range boolConditions(parsed) {
+			issues = append(issues, Issue{Line: r.Line, Message: restore(fmt.Sprintf(
+				"Alert '%s' compares with '%s bool', which returns 0 or 1 for every series instead of filtering them - "+
+					"the alert fires whenever the series exist; drop 'bool' from '%s'",
+				r.Alert, b.Op, b.String()))})
+		}
+	}
+	return issues
+}
+
+// boolConditions returns the bool comparisons that decide which series an alert condition
+// returns: the condition itself, or the operands of set operators passing series on
+func boolConditions(expr promql.Expr) []*promql.BinaryExpr {
+	b, ok := promql.Unwrap(expr).(*promql.BinaryExpr)
+	if !ok {
+		return nil
+	}
+	switch {
+	case b.ReturnBool:
+		return []*promql.BinaryExpr{b}
+	case b.Op == "and" || b.Op == "unless":
+		return boolConditions(b.LHS)
+	case b.Op == "or":
+		return append(boolConditions(b.LHS), boolConditions(b.RHS)...)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package formatting
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckBinaryOperators(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name: "matching label sets",
+			expr: `sum by (job) (rate(errors_total[5m])) > sum by (job) (rate(requests_total[5m])) * 0.1`,
+		},
+		{
+			name: "selectors with unknown labels",
+			expr: `node_filesystem_avail_bytes < node_filesystem_size_bytes * 0.1`,
+		},
+		{
+			name: "comparison between different groupings",
+			expr: `sum by (job, instance) (rate(errors_total[5m])) > sum by (job) (rate(errors_total[5m] offset 1d))`,
+			expected: []string{
+				"matches series with identical label sets, but the left side has (instance, job) and the right side (job) - " +
+					"no series match, so the result is always empty; use '> on (job) group_left'",
+			},
+		},
+		{
+			name: "disjoint groupings",
+			expr: `sum by (pod) (x) / sum by (node) (y)`,
+			expected: []string{
+				"the left side has (pod) and the right side (node) - no series match, so the result is always empty; use '/ on ()'",
+			},
+		},
+		{
+			name: "ignoring reconciles the label sets",
+			expr: `sum by (job, code) (rate(requests_total[5m])) / ignoring (code) group_left sum by (job) (rate(requests_total[5m]))`,
+		},
+		{
+			name: "and with mismatched labels",
+			expr: `sum by (job) (up) == 0 and sum by (instance) (up) > 0`,
+			expected: []string{
+				"the left side has (job) and the right side (instance) - 'and' never matches, so the result is always empty; use 'and on ()'",
+			},
+		},
+		{
+			name: "unless with mismatched labels",
+			expr: `sum by (job, instance) (up) == 0 unless sum by (job) (maintenance)`,
+			expected: []string{
+				"'unless' never removes a series; use 'unless on (job)'",
+			},
+		},
+		{
+			name: "on names a label an operand lacks",
+			expr: `sum by (job) (rate(errors_total[5m])) / on (job, instance) sum by (job, instance) (rate(requests_total[5m]))`,
+			expected: []string{
+				"matches on (job, instance), but the left side only has (job) - its series match on an empty instance",
+			},
+		},
+		{
+			name: "histogram_quantile drops le",
+			expr: `histogram_quantile(0.99, sum by (job, le) (rate(x_bucket[5m]))) > on (job) sum by (job) (slo)`,
+		},
+		{
+			name: "unguarded ratio filter",
+			expr: `sum(rate(errors_total[5m])) / sum(rate(requests_total[5m])) > 0`,
+			expected: []string{
+				"Comparison '... > 0' filters a ratio that is NaN when its denominator 'sum(rate(requests_total[5m]))' is 0",
+			},
+		},
+		{
+			name: "unguarded ratio compared with !=",
+			expr: `sum(rate(errors_total[5m])) / sum(rate(requests_total[5m])) != 0`,
+			expected: []string{
+				"Comparison '... != 0' filters a ratio",
+			},
+		},
+		{
+			name: "ratio on the right",
+			expr: `0 <= (sum(rate(ok_total[5m])) / sum(rate(requests_total[5m])))`,
+			expected: []string{
+				"Comparison '0 <= ...' filters a ratio",
+			},
+		},
+		{
+			name: "threshold drops NaN like a ratio of 0",
+			expr: `sum(rate(errors_total[5m])) / sum(rate(requests_total[5m])) > 0.05`,
+		},
+		{
+			name: "threshold on the right",
+			expr: `0.99 > (sum(rate(ok_total[5m])) / sum(rate(requests_total[5m])))`,
+		},
+		{
+			name: "selectors with unknown labels and different metric names",
+			expr: `rate(foo_total[5m]) > rate(bar_total[5m])`,
+		},
+		{
+			name: "selectors pinning a matched label to different values",
+			expr: `rate(errors_total{job="api"}[5m]) > rate(errors_total{job="web"}[5m])`,
+			expected: []string{
+				`matches on job, but the left side selects job="api" and the right side job="web" - ` +
+					"no series match, so the result is always empty; use 'ignoring (job)'",
+			},
+		},
+		{
+			name: "and between selectors pinning a label on() matches",
+			expr: `up{job="api"} and on (job, instance) up{job="web"}`,
+			expected: []string{
+				`matches on job, but the left side selects job="api" and the right side job="web" - ` +
+					"'and' never matches, so the result is always empty; leave job out of on()",
+			},
+		},
+		{
+			name: "ignoring the pinned label",
+			expr: `rate(errors_total{job="api"}[5m]) / ignoring (job) rate(errors_total{job="web"}[5m])`,
+		},
+		{
+			name: "on() without the pinned label",
+			expr: `up{job="api"} unless on (instance) up{job="web"}`,
+		},
+		{
+			name: "pinned values set by templates",
+			expr: `rate(errors_total{job="$a"}[5m]) > rate(errors_total{job="$b"}[5m])`,
+		},
+		{
+			name: "label_replace sets the pinned label",
+			expr: `label_replace(up{job="api"}, "job", "web", "", "") > up{job="web"}`,
+		},
+		{
+			name: "guarded denominator",
+			expr: `sum(rate(errors_total[5m])) / (sum(rate(requests_total[5m])) > 0) > 0.05`,
+		},
+		{
+			name: "bool comparison of a ratio",
+			expr: `sum(rate(errors_total[5m])) / sum(rate(requests_total[5m])) > bool 0.05`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkBinaryOperators(tt.expr)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkBinaryOperators() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(issues[i], expected) {
+					t.Errorf("checkBinaryOperators()[%d] = %q, want it to contain %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestBoolConditionIssues(t *testing.T) {
+	content := `groups:
+  - name: api
+    rules:
+      - record: job:up:bool
+        expr: up == bool 1
+      - alert: Down
+        expr: up == bool 0
+      - alert: DownOutsideMaintenance
+        expr: (up == bool 0) unless on (job) maintenance
+      - alert: Healthy
+        expr: up == 0
+`
+	issues := boolConditionIssues(content, nil)
+	var lines []int
+	for _, issue := range issues {
+		lines = append(lines, issue.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{7, 9}) {
+		t.Fatalf("boolConditionIssues() = %+v, want issues on lines 7 and 9", issues)
+	}
+	expected := "Alert 'Down' compares with '== bool', which returns 0 or 1 for every series instead of filtering them - " +
+		"the alert fires whenever the series exist; drop 'bool' from 'up == bool 0'"
+	if issues[0].Message != expected {
+		t.Errorf("boolConditionIssues()[0] = %q, want %q", issues[0].Message, expected)
+	}
+}
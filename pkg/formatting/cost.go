@@ -0,0 +1,338 @@
+package formatting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// highCardinalityLabels hold values without a bound, such as identifiers of requests and
+// users, so every aggregation keeping them can produce a series per request or user
+var highCardinalityLabels = []string{
+	"client_ip", "email", "id", "ip", "path", "request_id", "session_id", "trace_id",
+	"uid", "uri", "url", "user", "user_id",
+}
+
+// maxRawRange is the longest range window worth reading from raw series on every evaluation
+const maxRawRange = 24 * time.Hour
+
+// maxSubquerySteps is how many times a subquery may evaluate its inner query
+const maxSubquerySteps = 10000
+
+// SelectorCost is the estimated cost of one selector of a rule
+type SelectorCost struct {
+	Selector string
+	// Series is the number of series the selector matches
+	Series int
+	// Samples is the number of samples an evaluation reads through the selector
+	Samples int
+}
+
+// RuleCost is the estimated cost of evaluating a rule once
+type RuleCost struct {
+	// Name is the alert or recorded metric name
+	Name      string
+	Line      int
+	Series    int
+	Samples   int
+	Selectors []SelectorCost
+}
+
+// GroupCost is the estimated cost of evaluating every rule of a group once
+type GroupCost struct {
+	Name    string
+	Line    int
+	Series  int
+	Samples int
+	Rules   []RuleCost
+}
+
+// checkQueryCost flags patterns that make queries touch far more series or samples than
+// they need: metric name regexes, selectors without a limiting matcher, aggregations keeping
+// unbounded labels, long windows over raw series and subqueries with many steps
+func checkQueryCost(expr string) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+	templated := func(d time.Duration) bool {
+		return restore(promql.FormatDuration(d)) != promql.FormatDuration(d)
+	}
+
+	var issues []string
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		switch e := e.(type) {
+		case *promql.VectorSelector:
+			if issue := checkSelectorCost(e); issue != "" {
+				issues = append(issues, issue)
+			}
+		case *promql.MatrixSelector:
+			name := e.VectorSelector.MetricName()
+			if e.Range > maxRawRange && name != "" && !isRecordedMetric(name) && !templated(e.Range) {
+				issues = append(issues, fmt.Sprintf("Range [%s] over raw series '%s' reads every sample of the window on each evaluation - "+
+					"record a coarser aggregate and query that instead",
+					promql.FormatDuration(e.Range), name))
+			}
+		case *promql.SubqueryExpr:
+			step := subqueryStep(e)
+			if steps := int(e.Range / step); steps > maxSubquerySteps && !templated(e.Range) && !templated(step) {
+				issues = append(issues, fmt.Sprintf("Subquery '%s' evaluates its inner query %d times - use a coarser resolution or a recording rule",
+					e.String(), steps))
+			}
+		case *promql.AggregateExpr:
+			if !e.Grouped || e.Without || insideAggregation(path) {
+				return true
+			}
+			switch e.Op {
+			case "topk", "bottomk", "limitk", "limit_ratio":
+				// These return their input series, not a series per group
+				return true
+			}
+			for _, label := range e.Grouping {
+				if slices.Contains(highCardinalityLabels, label) {
+					issues = append(issues, fmt.Sprintf("Aggregation '%s %s' keeps the high-cardinality label '%s' - "+
+						"it produces a series per %s value without bound; aggregate it away or use a bounded label",
+						e.Op, e.GroupingString(), label, label))
+				}
+			}
+		}
+		return true
+	})
+
+	for i, issue := range issues {
+		issues[i] = restore(issue)
+	}
+	return issues
+}
+
+// checkSelectorCost flags selectors that match metric names by regex or that select every
+// series of the TSDB
+func checkSelectorCost(vs *promql.VectorSelector) string {
+	var nameRegex *promql.LabelMatcher
+	limited := vs.MetricName() != ""
+	for _, m := range vs.Matchers {
+		if m.Name == "__name__" {
+			if m.Op == promql.MatchRegexp || m.Op == promql.MatchNotRegexp {
+				nameRegex = m
+			}
+			continue
+		}
+		if limitsSeries(m) {
+			limited = true
+		}
+	}
+
+	switch {
+	case !limited && (nameRegex == nil || !limitsSeries(nameRegex) || nameRegex.Value == ".+"):
+		// The parser rejects selectors whose matchers all match the empty value, so a name
+		// regex matching any name is what lets such a selector through
+		return fmt.Sprintf("Selector '%s' has no matcher that limits the series it selects, so it reads every series in the TSDB - "+
+			"select a metric by name", vs.String())
+	case nameRegex != nil:
+		return fmt.Sprintf("Selector '%s' matches metric names by regex, so it reads every series of every matching metric - "+
+			"select each metric by name", vs.String())
+	}
+	return ""
+}
+
+// limitsSeries reports whether a matcher excludes series without the label, i.e. it does not
+// match the empty value
+func limitsSeries(m *promql.LabelMatcher) bool {
+	switch m.Op {
+	case promql.MatchEqual:
+		return m.Value != ""
+	case promql.MatchRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		return err == nil && !re.MatchString("")
+	}
+	return false
+}
+
+// isRecordedMetric reports whether a metric name follows the level:metric:operations
+// convention of recording rules
+func isRecordedMetric(name string) bool {
+	return regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*:.+`).MatchString(name)
+}
+
+// insideAggregation reports whether an expression is an argument of an aggregation
+func insideAggregation(path []promql.Expr) bool {
+	for _, e := range path {
+		if _, ok := e.(*promql.AggregateExpr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EstimateRuleCosts estimates the series and samples each rule of a rule file touches per
+// evaluation, counting the series of each selector with a count() query against
+// opts.PrometheusURL. Samples of range windows are estimated from the scrape interval.
+func EstimateRuleCosts(content string, opts CheckOptions) ([]GroupCost, error) {
+	if opts.PrometheusURL == "" {
+		return nil, fmt.Errorf("estimating rule costs requires a Prometheus URL")
+	}
+
+	iv, err := opts.scrapeIntervals()
+	if err != nil {
+		return nil, err
+	}
+	var groups []GroupCost
+	for _, group := range promql.LoadRuleGroups("", []byte(content)) {
+		gc := GroupCost{Name: group.Name, Line: group.Line}
+		for _, rule := range group.Rules {
+			rc, err := estimateRuleCost(rule.Expr, iv, opts)
+			if err != nil {
+				return nil, err
+			}
+			rc.Name = rule.Name()
+			rc.Line = rule.Line
+			gc.Series += rc.Series
+			gc.Samples += rc.Samples
+			gc.Rules = append(gc.Rules, rc)
+		}
+		groups = append(groups, gc)
+	}
+	return groups, nil
+}
+
+// estimateRuleCost counts the series each selector of an expression matches. A selector
+// reads a sample per series, a range window a sample per scrape interval of the window, and
+// a subquery multiplies the samples of its inner query by its number of steps.
+func estimateRuleCost(expr string, iv intervals, opts CheckOptions) (RuleCost, error) {
+	var rc RuleCost
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return rc, nil
+	}
+
+	var lookupErr error
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		vs, ok := e.(*promql.VectorSelector)
+		if !ok || lookupErr != nil {
+			return lookupErr == nil
+		}
+		selector := vs.String()
+		if restore(selector) != selector {
+			// Template variables cannot be resolved against Prometheus
+			return true
+		}
+
+		points := 1
+		for _, parent := range path {
+			switch parent := parent.(type) {
+			case *promql.MatrixSelector:
+				scrape := iv.of(vs)
+				if scrape == 0 {
+					scrape = defaultScrapeInterval
+				}
+				points *= max(1, int(parent.Range/scrape))
+			case *promql.SubqueryExpr:
+				points *= max(1, int(parent.Range/subqueryStep(parent)))
+			}
+		}
+
+		series, err := opts.Cache.seriesCount(opts.PrometheusURL, selector)
+		if err != nil {
+			lookupErr = fmt.Errorf("failed to count series of %s: %w", selector, err)
+			return false
+		}
+		rc.Series += series
+		rc.Samples += series * points
+		rc.Selectors = append(rc.Selectors, SelectorCost{Selector: selector, Series: series, Samples: series * points})
+		return true
+	})
+	return rc, lookupErr
+}
+
+// costIssues reports rules and groups whose estimated series exceed the budgets of the
+// options. If only is set, rules starting at lines it rejects are skipped, and groups are
+// only reported if they hold an accepted rule. A budget that cannot be checked, e.g. as
+// Prometheus is unreachable, is reported as an issue rather than passing unchecked.
+func costIssues(content string, opts CheckOptions) []Issue {
+	groups, err := EstimateRuleCosts(content, opts)
+	if err != nil {
+		return []Issue{{Message: fmt.Sprintf("Error: cannot check the series budgets: %v", err)}}
+	}
+
+	var issues []Issue
+	for _, group := range groups {
+		accepted := opts.Only == nil
+		for _, rule := range group.Rules {
+			if opts.Only != nil && !opts.Only(rule.Line) {
+				continue
+			}
+			accepted = true
+			if opts.SeriesBudget <= 0 || rule.Series <= opts.SeriesBudget {
+				continue
+			}
+			costliest := slices.MaxFunc(rule.Selectors, func(a, b SelectorCost) int { return a.Series - b.Series })
+			issues = append(issues, Issue{Line: rule.Line, Message: fmt.Sprintf(
+				"Rule '%s' touches ~%d series (~%d samples) per evaluation, over the budget of %d series per rule - "+
+					"most are selected by '%s' (%d series); narrow its matchers or record a pre-aggregated series",
+				rule.Name, rule.Series, rule.Samples, opts.SeriesBudget, costliest.Selector, costliest.Series)})
+		}
+		if accepted && opts.GroupSeriesBudget > 0 && group.Series > opts.GroupSeriesBudget {
+			issues = append(issues, Issue{Line: group.Line, Message: fmt.Sprintf(
+				"Group '%s' touches ~%d series (~%d samples) per evaluation, over the budget of %d series per group - "+
+					"split it or make its rules cheaper",
+				group.Name, group.Series, group.Samples, opts.GroupSeriesBudget)})
+		}
+	}
+	return issues
+}
+
+// countSeries returns the number of series a selector matches in Prometheus
+func countSeries(prometheusURL, selector string) (count int, err error) {
+	params := url.Values{}
+	params.Add("query", "count("+selector+")")
+
+	resp, err := http.Get(prometheusURL + "/api/v1/query?" + params.Encode())
+	if err != nil {
+		return 0, fmt.Errorf("failed to query Prometheus: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("prometheus returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var queryResp struct {
+		Data struct {
+			Result []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&queryResp); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	// count() returns no result when nothing matches
+	if len(queryResp.Data.Result) == 0 || len(queryResp.Data.Result[0].Value) != 2 {
+		return 0, nil
+	}
+	value, ok := queryResp.Data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected sample value %v", queryResp.Data.Result[0].Value[1])
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse sample value: %w", err)
+	}
+	return int(f), nil
+}
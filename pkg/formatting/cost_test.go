@@ -0,0 +1,211 @@
+package formatting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckQueryCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name: "bounded query",
+			expr: `sum by (job, code) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			name: "selector by label only",
+			expr: `count({job="api"})`,
+		},
+		{
+			name: "every metric by name regex",
+			expr: `count({__name__=~".+"})`,
+			expected: []string{
+				`Selector '{__name__=~".+"}' has no matcher that limits the series it selects`,
+			},
+		},
+		{
+			name: "other matchers match the empty value",
+			expr: `count({__name__=~".+",env!="prod"})`,
+			expected: []string{
+				`Selector '{__name__=~".+",env!="prod"}' has no matcher that limits the series it selects`,
+			},
+		},
+		{
+			name: "name regex",
+			expr: `sum(rate({__name__=~"http_.*_total",job="api"}[5m]))`,
+			expected: []string{
+				`Selector '{__name__=~"http_.*_total",job="api"}' matches metric names by regex`,
+			},
+		},
+		{
+			name: "unbounded grouping label",
+			expr: `sum by (job, path) (rate(http_requests_total[5m]))`,
+			expected: []string{
+				"Aggregation 'sum by (job, path)' keeps the high-cardinality label 'path'",
+			},
+		},
+		{
+			name: "unbounded label aggregated away",
+			expr: `max by (job) (sum by (job, path) (rate(http_requests_total[5m])))`,
+		},
+		{
+			name: "topk keeps its input series",
+			expr: `topk by (path) (5, rate(http_requests_total[5m]))`,
+		},
+		{
+			name: "long window over raw series",
+			expr: `increase(http_requests_total[2d])`,
+			expected: []string{
+				"Range [2d] over raw series 'http_requests_total' reads every sample of the window",
+			},
+		},
+		{
+			name: "long window over recorded series",
+			expr: `avg_over_time(job:http_requests:rate5m[30d])`,
+		},
+		{
+			name: "subquery with many steps",
+			expr: `max_over_time(rate(http_requests_total[5m])[2w:1m])`,
+			expected: []string{
+				"Subquery 'rate(http_requests_total[5m])[2w:1m]' evaluates its inner query 20160 times",
+			},
+		},
+		{
+			name: "templated range",
+			expr: `sum by (job) (rate(http_requests_total[$__range]))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkQueryCost(tt.expr)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkQueryCost() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(issues[i], expected) {
+					t.Errorf("checkQueryCost()[%d] = %q, want it to contain %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateRuleCosts(t *testing.T) {
+	counts := map[string]string{
+		`count(http_requests_total{job="api"})`: "200",
+		`count(up{job="api"})`:                  "4",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/api/v1/query":
+			result := "[]"
+			if count, ok := counts[r.URL.Query().Get("query")]; ok {
+				result = `[{"metric":{},"value":[1700000000,"` + count + `"]}]`
+			}
+			body = `{"status":"success","data":{"resultType":"vector","result":` + result + `}}`
+		case "/api/v1/targets":
+			body = `{"status":"success","data":{"activeTargets":[{"labels":{"job":"api"},"scrapeInterval":"30s"}]}}`
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	content := `groups:
+  - name: api
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total{job="api"}[5m]))
+      - alert: ApiDown
+        expr: up{job="api"} == 0 or absent(missing_metric)
+`
+
+	groups, err := EstimateRuleCosts(content, CheckOptions{PrometheusURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []GroupCost{{
+		Name:    "api",
+		Line:    2,
+		Series:  204,
+		Samples: 2004,
+		Rules: []RuleCost{
+			{
+				Name: "job:http_requests:rate5m", Line: 4, Series: 200, Samples: 2000,
+				Selectors: []SelectorCost{{Selector: `http_requests_total{job="api"}`, Series: 200, Samples: 2000}},
+			},
+			{
+				Name: "ApiDown", Line: 6, Series: 4, Samples: 4,
+				Selectors: []SelectorCost{
+					{Selector: `up{job="api"}`, Series: 4, Samples: 4},
+					{Selector: `missing_metric`, Series: 0, Samples: 0},
+				},
+			},
+		},
+	}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("EstimateRuleCosts() = %+v, want %+v", groups, expected)
+	}
+
+	issues := costIssues(content, CheckOptions{PrometheusURL: server.URL, SeriesBudget: 100, GroupSeriesBudget: 150})
+	if len(issues) != 2 {
+		t.Fatalf("costIssues() = %+v, want 2 issues", issues)
+	}
+	if issues[0].Line != 4 || !strings.Contains(issues[0].Message, "Rule 'job:http_requests:rate5m' touches ~200 series (~2000 samples) per evaluation, over the budget of 100") {
+		t.Errorf("costIssues()[0] = %+v", issues[0])
+	}
+	if issues[1].Line != 2 || !strings.Contains(issues[1].Message, "Group 'api' touches ~204 series") {
+		t.Errorf("costIssues()[1] = %+v", issues[1])
+	}
+
+	// PrometheusRule resources and later documents of a file are estimated too
+	crd := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+spec:
+  groups:
+    - name: api
+      rules:
+        - alert: ApiDown
+          expr: up{job="api"} == 0
+---
+groups:
+  - name: requests
+    rules:
+      - record: job:http_requests:sum
+        expr: sum by (job) (http_requests_total{job="api"})
+`
+	groups, err = EstimateRuleCosts(crd, CheckOptions{PrometheusURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Name != "api" || groups[0].Line != 5 || groups[0].Series != 4 ||
+		groups[1].Name != "requests" || groups[1].Line != 11 || groups[1].Series != 200 {
+		t.Errorf("EstimateRuleCosts() of a PrometheusRule = %+v", groups)
+	}
+
+	if _, err := EstimateRuleCosts(content, CheckOptions{}); err == nil {
+		t.Error("EstimateRuleCosts() without a Prometheus URL should fail")
+	}
+
+	// Budgets that cannot be checked are reported rather than passing
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	issues = costIssues(content, CheckOptions{PrometheusURL: failing.URL, SeriesBudget: 100})
+	if len(issues) != 1 || !strings.HasPrefix(issues[0].Message, "Error: cannot check the series budgets: ") {
+		t.Errorf("costIssues() with a failing Prometheus = %+v, want one error", issues)
+	}
+}
@@ -0,0 +1,82 @@
+package formatting
+
+import (
+	"fmt"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// CheckAndFormatDashboard analyzes the PromQL expressions in a Grafana dashboard JSON document
+// and formats them. Only the expression strings are rewritten; every other byte of the
+// document, including key order and indentation, is preserved. Templating variable queries
+// are checked but never split across lines, as Grafana edits them on a single line.
+func CheckAndFormatDashboard(content string, opts CheckOptions) ([]string, string) {
+	issues, formatted := checkDashboard(content, opts)
+	return issueStrings(issues), formatted
+}
+
+// checkDashboard is CheckAndFormatDashboard with located issues
+func checkDashboard(content string, opts CheckOptions) ([]Issue, string) {
+	var issues []Issue
+	style := opts.Style.withDefaults()
+
+	exprs, err := promql.DashboardExpressions([]byte(content))
+	if err != nil {
+		return []Issue{{Message: fmt.Sprintf("Error: invalid dashboard JSON: %v", err)}}, content
+	}
+
+	iv, err := opts.scrapeIntervals()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+	md, err := opts.metadata()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+	rewritten := make([]string, len(exprs))
+	for i, e := range exprs {
+		rewritten[i] = e.Value
+		if opts.Only != nil && !opts.Only(e.Line) {
+			continue
+		}
+
+		var exprIssues []string
+		exprIssues = append(exprIssues, checkRedundantAggregations(e.Value)...)
+		exprIssues = append(exprIssues, checkAggregationPlacement(e.Value)...)
+
+		if e.Prefix == "" && shouldBeMultilineWidth(e.Value, opts.DisableLineLength, style.MaxLineWidth) {
+			exprIssues = append(exprIssues, fmt.Sprintf("Expression should use multiline formatting: %.60s...", e.Value))
+
+			// Format the expression, refusing any rewrite that would change its meaning
+			formattedExpr, err := formatExpression(e.Value, style, true)
+			if err != nil {
+				exprIssues = append(exprIssues, fmt.Sprintf("Error: refusing to reformat expression %.60s...: %v", e.Value, err))
+			} else {
+				rewritten[i] = formattedExpr
+			}
+		}
+
+		exprIssues = append(exprIssues, checkPrometheusBestPractices(e.Value, md)...)
+		exprIssues = append(exprIssues, checkRangeWindows(e.Value, iv, 0)...)
+		exprIssues = append(exprIssues, checkQueryCost(e.Value)...)
+
+		issues = append(issues, issuesAt(e.Line, dashboardLocation(e), exprIssues)...)
+	}
+
+	formatted, err := promql.RewriteDashboard([]byte(content), exprs, rewritten)
+	if err != nil {
+		return append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)}), content
+	}
+	return issues, string(formatted)
+}
+
+// dashboardLocation describes where in a dashboard an expression lives
+func dashboardLocation(e promql.DashboardExpr) string {
+	switch {
+	case e.Prefix != "" || e.Suffix != "":
+		return "variable " + e.Panel
+	case e.Panel != "":
+		return fmt.Sprintf("panel %q", e.Panel)
+	}
+	return e.Path
+}
@@ -0,0 +1,76 @@
+package formatting
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAndFormatDashboard(t *testing.T) {
+	long := `sum by (job) (rate(http_requests_total{job=\"$job\",status=~\"5..\"}[$__rate_interval])) / sum by (job) (rate(http_requests_total{job=\"$job\"}[$__rate_interval]))`
+	content := `{
+  "panels": [
+    {
+      "title": "Error ratio",
+      "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0},
+      "targets": [{"expr": "` + long + `", "refId": "A"}]
+    },
+    {
+      "title": "Up",
+      "targets": [{"expr": "up{job=\"$job\"}", "refId": "A"}]
+    }
+  ],
+  "templating": {"list": [{"name": "job", "type": "query", "query": "label_values(up, job)"}]}
+}
+`
+
+	issues, formatted := CheckAndFormatDashboard(content, CheckOptions{})
+
+	foundMultiline := false
+	for _, issue := range issues {
+		if strings.HasPrefix(issue, `panel "Error ratio" (line 6): Expression should use multiline formatting`) {
+			foundMultiline = true
+		}
+		if strings.Contains(issue, "Error:") {
+			t.Errorf("unexpected error issue: %s", issue)
+		}
+	}
+	if !foundMultiline {
+		t.Errorf("expected multiline issue for the error ratio panel, got %v", issues)
+	}
+
+	formattedExpr := `sum by (job) (rate(http_requests_total{job=\"$job\",status=~\"5..\"}[$__rate_interval]))\n  /\nsum by (job) (rate(http_requests_total{job=\"$job\"}[$__rate_interval]))`
+	expected := strings.Replace(content, long, formattedExpr, 1)
+	if formatted != expected {
+		t.Errorf("CheckAndFormatDashboard() formatted =\n%s\nwant\n%s", formatted, expected)
+	}
+}
+
+func TestCheckAndFormatDashboardInvalidJSON(t *testing.T) {
+	issues, formatted := CheckAndFormatDashboard(`{"panels": [`, CheckOptions{})
+	if len(issues) != 1 || !strings.HasPrefix(issues[0], "Error: invalid dashboard JSON") {
+		t.Errorf("expected an invalid JSON issue, got %v", issues)
+	}
+	if formatted != `{"panels": [` {
+		t.Errorf("invalid JSON should be returned unchanged, got %q", formatted)
+	}
+}
+
+func TestCheckAndFormatDashboardQueryCost(t *testing.T) {
+	content := `{
+  "panels": [
+    {
+      "title": "Everything",
+      "targets": [{"expr": "count({__name__=~\"job:.*\"})", "refId": "A"}]
+    }
+  ]
+}
+`
+	issues, _ := CheckAndFormatDashboard(content, CheckOptions{})
+	found := false
+	for _, issue := range issues {
+		found = found || strings.HasPrefix(issue, `panel "Everything" (line 5): Selector '{__name__=~"job:.*"}' matches metric names by regex`)
+	}
+	if !found {
+		t.Errorf("expected a query cost issue for the panel, got %v", issues)
+	}
+}
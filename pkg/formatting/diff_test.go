@@ -0,0 +1,109 @@
+package formatting
+
+import (
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		to       string
+		expected string
+	}{
+		{
+			name:     "identical content",
+			from:     "a\nb\n",
+			to:       "a\nb\n",
+			expected: "",
+		},
+		{
+			name: "single line replaced by a block",
+			from: "groups:\n  - name: a\n    rules:\n      - record: x\n        expr: a / b\n",
+			to:   "groups:\n  - name: a\n    rules:\n      - record: x\n        expr: |\n          a\n            /\n          b\n",
+			expected: `--- a/rules.yml
++++ b/rules.yml
+@@ -2,4 +2,7 @@
+   - name: a
+     rules:
+       - record: x
+-        expr: a / b
++        expr: |
++          a
++            /
++          b
+`,
+		},
+		{
+			name: "distant changes produce separate hunks",
+			from: "1\nx\n3\n4\n5\n6\n7\n8\n9\n10\ny\n12\n",
+			to:   "1\nX\n3\n4\n5\n6\n7\n8\n9\n10\nY\n12\n",
+			expected: `--- a/rules.yml
++++ b/rules.yml
+@@ -1,5 +1,5 @@
+ 1
+-x
++X
+ 3
+ 4
+ 5
+@@ -8,5 +8,5 @@
+ 8
+ 9
+ 10
+-y
++Y
+ 12
+`,
+		},
+		{
+			name: "nearby changes share a hunk",
+			from: "1\nx\n3\n4\ny\n6\n",
+			to:   "1\nX\n3\n4\nY\n6\n",
+			expected: `--- a/rules.yml
++++ b/rules.yml
+@@ -1,6 +1,6 @@
+ 1
+-x
++X
+ 3
+ 4
+-y
++Y
+ 6
+`,
+		},
+		{
+			name: "missing final newline",
+			from: "a\nb",
+			to:   "a\nb\n",
+			expected: `--- a/rules.yml
++++ b/rules.yml
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+		{
+			name: "content added to empty file",
+			from: "",
+			to:   "a\n",
+			expected: `--- a/rules.yml
++++ b/rules.yml
+@@ -0,0 +1,1 @@
++a
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UnifiedDiff("a/rules.yml", "b/rules.yml", tt.from, tt.to)
+			if got != tt.expected {
+				t.Errorf("UnifiedDiff() output mismatch.\nExpected:\n%s\nGot:\n%s", tt.expected, got)
+			}
+		})
+	}
+}
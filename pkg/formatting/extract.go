@@ -0,0 +1,79 @@
+package formatting
+
+import (
+	"fmt"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// CheckAndFormat checks a file in any format a promql extractor recognizes. Rule files and
+// Grafana dashboards are also formatted; for other formats, such as SLO specs, only the
+// lint checks apply and content is returned unchanged. Content no extractor recognizes is
+// treated as a rule file.
+func CheckAndFormat(content []byte, opts CheckOptions) ([]string, string) {
+	issues, formatted := Check(content, opts)
+	return issueStrings(issues), formatted
+}
+
+// Check is CheckAndFormat with each issue located at the line it applies to, for tools such
+// as editors that show issues in place
+func Check(content []byte, opts CheckOptions) ([]Issue, string) {
+	ext := promql.FindExtractor(content)
+	if ext == nil {
+		return checkRules(string(content), opts)
+	}
+
+	switch ext.Name() {
+	case promql.FormatRules:
+		return checkRules(string(content), opts)
+	case promql.FormatDashboard:
+		return checkDashboard(string(content), opts)
+	}
+
+	exprs, err := ext.Extract(content)
+	if err != nil {
+		return []Issue{{Message: fmt.Sprintf("Error: invalid %s file: %v", ext.Name(), err)}}, string(content)
+	}
+	if opts.Only != nil {
+		var only []promql.Expression
+		for _, e := range exprs {
+			if opts.Only(e.Line) {
+				only = append(only, e)
+			}
+		}
+		exprs = only
+	}
+	var issues []Issue
+	iv, err := opts.scrapeIntervals()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+	md, err := opts.metadata()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+	return append(issues, expressionIssues(exprs, iv, md)...), string(content)
+}
+
+// CheckExpressions runs the expression lint checks on extracted expressions, prefixing each
+// issue with where the expression lives
+func CheckExpressions(exprs []promql.Expression) []string {
+	return issueStrings(expressionIssues(exprs, intervals{}, nil))
+}
+
+// expressionIssues is CheckExpressions with located issues, checking range windows against
+// the given scrape intervals and metric usage against the given metadata
+func expressionIssues(exprs []promql.Expression, iv intervals, md Metadata) []Issue {
+	var issues []Issue
+	for _, e := range exprs {
+		var exprIssues []string
+		exprIssues = append(exprIssues, checkRedundantAggregations(e.Value)...)
+		exprIssues = append(exprIssues, checkAggregationPlacement(e.Value)...)
+		exprIssues = append(exprIssues, checkPrometheusBestPractices(e.Value, md)...)
+		exprIssues = append(exprIssues, checkRangeWindows(e.Value, iv, 0)...)
+		exprIssues = append(exprIssues, checkQueryCost(e.Value)...)
+
+		issues = append(issues, issuesAt(e.Line, e.Location, exprIssues)...)
+	}
+	return issues
+}
@@ -0,0 +1,71 @@
+package formatting
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAndFormatSlothSpec(t *testing.T) {
+	content := `version: "prometheus/v1"
+service: "api"
+slos:
+  - name: "availability"
+    sli:
+      events:
+        error_query: sum(rate(http_requests_total{job="api",code=~"5.."}[{{.window}}])) by (job) / sum(rate(http_requests_total{job="api"}[{{.window}}])) by (job)
+        total_query: sum(rate(http_requests_total{job="api"}[{{.window}}]))
+`
+
+	issues, formatted := CheckAndFormat([]byte(content), CheckOptions{})
+	if formatted != content {
+		t.Errorf("SLO specs should not be rewritten, got:\n%s", formatted)
+	}
+
+	found := false
+	for _, issue := range issues {
+		if strings.HasPrefix(issue, "SLO availability error_query (line 7): Redundant aggregation clause") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a redundant aggregation issue for the error query, got %v", issues)
+	}
+}
+
+func TestCheckAndFormatDispatch(t *testing.T) {
+	rules := "groups:\n  - name: g\n    rules:\n      - record: r\n        expr: up\n"
+	if _, formatted := CheckAndFormat([]byte(rules), CheckOptions{}); formatted != rules {
+		t.Errorf("rule file changed unexpectedly: %s", formatted)
+	}
+
+	dashboard := `{"panels": [{"title": "Up", "targets": [{"expr": "up"}]}]}`
+	if _, formatted := CheckAndFormat([]byte(dashboard), CheckOptions{}); formatted != dashboard {
+		t.Errorf("dashboard changed unexpectedly: %s", formatted)
+	}
+}
+
+func TestCheckAndFormatOnly(t *testing.T) {
+	long := `sum(rate(http_requests_total{job="api",code=~"5.."}[5m])) by (job) / sum(rate(http_requests_total{job="api"}[5m])) by (job)`
+	content := "groups:\n  - name: g\n    rules:\n" +
+		"      - alert: Unchanged\n        expr: " + long + "\n        for: 5m\n" +
+		"      - alert: Changed\n        expr: " + long + "\n        for: 5m\n"
+
+	// Only the second alert, at lines 7-9, changed
+	opts := CheckOptions{Only: func(line int) bool { return line >= 7 }}
+	issues, formatted := CheckAndFormat([]byte(content), opts)
+
+	if len(issues) == 0 {
+		t.Fatal("expected issues for the changed alert")
+	}
+	for _, issue := range issues {
+		if strings.Contains(issue, "Unchanged") {
+			t.Errorf("unexpected issue for the unchanged alert: %s", issue)
+		}
+	}
+	if !strings.Contains(formatted, "alert: Unchanged\n        expr: "+long+"\n") {
+		t.Errorf("unchanged alert was rewritten:\n%s", formatted)
+	}
+	if strings.Contains(formatted, "alert: Changed\n        expr: "+long+"\n") {
+		t.Errorf("changed alert was not rewritten:\n%s", formatted)
+	}
+}
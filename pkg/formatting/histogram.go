@@ -0,0 +1,319 @@
+package formatting
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// counterRateFuncs turn cumulative counters into increases over a window
+var counterRateFuncs = map[string]bool{"rate": true, "irate": true, "increase": true}
+
+// nativeHistogramFuncs only return results for native histogram samples
+var nativeHistogramFuncs = map[string]bool{
+	"histogram_avg":      true,
+	"histogram_count":    true,
+	"histogram_fraction": true,
+	"histogram_stddev":   true,
+	"histogram_stdvar":   true,
+	"histogram_sum":      true,
+}
+
+// suggestedRateRange is the window used in suggested rate() rewrites
+const suggestedRateRange = 5 * time.Minute
+
+// checkHistograms validates the use of classic histograms, native histograms and summaries:
+// bucket aggregations that drop le, quantiles of quantiles, and raw bucket counters
+func checkHistograms(expr string) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+
+	var issues []string
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		switch e := e.(type) {
+		case *promql.Call:
+			if e.Func == "histogram_quantile" {
+				issues = append(issues, checkHistogramQuantile(e)...)
+			} else if nativeHistogramFuncs[e.Func] {
+				issues = append(issues, checkNativeHistogramFunc(e)...)
+			}
+		case *promql.AggregateExpr:
+			issues = append(issues, checkQuantileAggregation(e)...)
+		case *promql.VectorSelector:
+			if issue := checkBucketRate(e, path); issue != "" {
+				issues = append(issues, issue)
+			}
+		}
+		return true
+	})
+
+	for i, issue := range issues {
+		issues[i] = restore(issue)
+	}
+	return issues
+}
+
+// checkHistogramQuantile validates the quantile and bucket arguments of histogram_quantile()
+func checkHistogramQuantile(call *promql.Call) []string {
+	var issues []string
+	if len(call.Args) != 2 {
+		return nil
+	}
+
+	if phi, ok := promql.Unwrap(call.Args[0]).(*promql.NumberLiteral); ok && (phi.Val < 0 || phi.Val > 1) {
+		if phi.Val > 1 && phi.Val <= 100 {
+			issues = append(issues, fmt.Sprintf("histogram_quantile() takes a quantile between 0 and 1, not %s - use %g for the %sth percentile",
+				phi, phi.Val/100, phi))
+		} else {
+			issues = append(issues, fmt.Sprintf("histogram_quantile() takes a quantile between 0 and 1, not %s", phi))
+		}
+	}
+
+	buckets := call.Args[1]
+	for _, vs := range promql.VectorSelectors(buckets) {
+		name := vs.MetricName()
+		if matcher := quantileMatcher(vs); matcher != nil {
+			issues = append(issues, fmt.Sprintf("histogram_quantile() cannot be applied to the summary quantile '%s' - "+
+				"select the precomputed quantile directly, or expose a histogram and use its '_bucket' series", vs))
+			continue
+		}
+		for _, suffix := range []string{"_sum", "_count"} {
+			if base, ok := strings.CutSuffix(name, suffix); ok && !strings.Contains(name, ":") {
+				issues = append(issues, fmt.Sprintf("histogram_quantile() needs bucket series, not '%s' - use '%s_bucket'", name, base))
+			}
+		}
+	}
+
+	promql.Inspect(buckets, func(e promql.Expr, _ []promql.Expr) bool {
+		switch e := e.(type) {
+		case *promql.Call:
+			// A nested histogram_quantile is checked on its own
+			return e.Func != "histogram_quantile"
+		case *promql.AggregateExpr:
+			issues = append(issues, checkBucketAggregation(e)...)
+		}
+		return true
+	})
+
+	return issues
+}
+
+// checkBucketAggregation validates an aggregation feeding histogram_quantile(), which must
+// sum buckets while keeping the le label that holds their upper bounds
+func checkBucketAggregation(agg *promql.AggregateExpr) []string {
+	if !hasClassicBuckets(agg.Expr) {
+		return nil
+	}
+
+	dropsLe := slices.Contains(agg.Grouping, "le") == agg.Without
+	combines := agg.Op != "sum" && agg.Op != "avg"
+	if !dropsLe && !combines {
+		return nil
+	}
+
+	fixed := *agg
+	if dropsLe {
+		if agg.Without {
+			fixed.Grouping = slices.DeleteFunc(slices.Clone(agg.Grouping), func(l string) bool { return l == "le" })
+		} else {
+			fixed.Grouping = append(slices.Clone(agg.Grouping), "le")
+		}
+		fixed.Grouped = true
+	}
+	if combines {
+		fixed.Op = "sum"
+		fixed.Param = nil
+	}
+
+	var issues []string
+	if dropsLe {
+		issues = append(issues, fmt.Sprintf("histogram_quantile() over '%s' drops the 'le' label holding the bucket boundaries - use '%s'",
+			agg, &fixed))
+	}
+	if combines {
+		issues = append(issues, fmt.Sprintf("histogram_quantile() over '%s' combines buckets with %s(), which does not preserve bucket counts - use '%s'",
+			agg, agg.Op, &fixed))
+	}
+	return issues
+}
+
+// checkQuantileAggregation flags averaging or summing quantiles, whether precomputed by a
+// summary or returned by histogram_quantile(); neither yields a quantile of the combined series
+func checkQuantileAggregation(agg *promql.AggregateExpr) []string {
+	if agg.Op != "avg" && agg.Op != "sum" {
+		return nil
+	}
+
+	if call, ok := promql.Unwrap(agg.Expr).(*promql.Call); ok && call.Func == "histogram_quantile" && len(call.Args) == 2 {
+		inner := call.Args[1]
+		if bucketAgg, ok := promql.Unwrap(inner).(*promql.AggregateExpr); ok && bucketAgg.Op == "sum" {
+			inner = bucketAgg.Expr
+		}
+		grouping := agg.Grouping
+		if !agg.Without {
+			grouping = append(slices.Clone(grouping), "le")
+		}
+		fixed := &promql.Call{Func: "histogram_quantile", Args: []promql.Expr{
+			call.Args[0],
+			&promql.AggregateExpr{Op: "sum", Expr: inner, Grouping: grouping, Without: agg.Without, Grouped: true},
+		}}
+		return []string{fmt.Sprintf("%s() of histogram_quantile() results does not yield a quantile of the combined series - aggregate the buckets first: '%s'",
+			agg.Op, fixed)}
+	}
+
+	for _, vs := range promql.VectorSelectors(agg.Expr) {
+		matcher := quantileMatcher(vs)
+		if matcher == nil && !(slices.Contains(agg.Grouping, "quantile") && !agg.Without) {
+			continue
+		}
+
+		phi := "0.99"
+		if matcher != nil && matcher.Op == promql.MatchEqual {
+			phi = matcher.Value
+		}
+		grouping := slices.DeleteFunc(slices.Clone(agg.Grouping), func(l string) bool { return l == "quantile" })
+		buckets := &promql.AggregateExpr{
+			Op:       "sum",
+			Expr:     &promql.Call{Func: "rate", Args: []promql.Expr{bucketSelector(vs)}},
+			Grouping: append(grouping, "le"),
+			Grouped:  true,
+		}
+		if agg.Without {
+			buckets.Grouping = grouping
+			buckets.Without = true
+		}
+		return []string{fmt.Sprintf("%s() over the summary quantiles of '%s' does not yield a valid quantile - "+
+			"summaries cannot be aggregated; expose a histogram and use 'histogram_quantile(%s, %s)'", agg.Op, vs.MetricName(), phi, buckets)}
+	}
+	return nil
+}
+
+// checkNativeHistogramFunc flags native histogram functions applied to classic bucket series,
+// which they silently ignore
+func checkNativeHistogramFunc(call *promql.Call) []string {
+	arg := call.Args[len(call.Args)-1]
+
+	var issues []string
+	for _, vs := range promql.VectorSelectors(arg) {
+		base, ok := strings.CutSuffix(vs.MetricName(), "_bucket")
+		if !ok {
+			continue
+		}
+
+		issue := fmt.Sprintf("%s() only works on native histograms, but '%s' is a classic histogram bucket series", call.Func, vs.MetricName())
+		switch call.Func {
+		case "histogram_count":
+			issue += fmt.Sprintf(" - use '%s'", renameSeries(arg, vs.MetricName(), base+"_count"))
+		case "histogram_sum":
+			issue += fmt.Sprintf(" - use '%s'", renameSeries(arg, vs.MetricName(), base+"_sum"))
+		case "histogram_avg":
+			issue += fmt.Sprintf(" - use '%s / %s'", renameSeries(arg, vs.MetricName(), base+"_sum"), renameSeries(arg, vs.MetricName(), base+"_count"))
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// checkBucketRate flags raw classic bucket counters that are aggregated or passed to
+// histogram_quantile() without rate(), which measures counts accumulated since each target
+// started rather than recent observations
+func checkBucketRate(vs *promql.VectorSelector, path []promql.Expr) string {
+	name := vs.MetricName()
+	if !strings.HasSuffix(name, "_bucket") || strings.Contains(name, ":") {
+		// Recorded series are assumed to be rates already
+		return ""
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		var consumer string
+		switch e := path[i].(type) {
+		case *promql.ParenExpr, *promql.MatrixSelector:
+			continue
+		case *promql.Call:
+			if counterRateFuncs[e.Func] || slices.Contains(promql.Functions[e.Func].ArgTypes, promql.ValueTypeMatrix) {
+				return ""
+			}
+			if e.Func != "histogram_quantile" {
+				continue
+			}
+			consumer = "histogram_quantile()"
+		case *promql.AggregateExpr:
+			consumer = e.Op + "()"
+		default:
+			return ""
+		}
+
+		rated := (&promql.Call{Func: "rate", Args: []promql.Expr{&promql.MatrixSelector{VectorSelector: vs, Range: suggestedRateRange}}}).String()
+		return fmt.Sprintf("%s over the raw bucket counter '%s' uses counts accumulated since each target started - apply rate() first: '%s'",
+			consumer, vs, replaceTerm(path[i].String(), vs.String(), rated, func(b byte) bool { return isIdentByte(b) || b == '{' }))
+	}
+	return ""
+}
+
+// hasClassicBuckets reports whether an expression selects classic histogram bucket series,
+// raw or recorded
+func hasClassicBuckets(expr promql.Expr) bool {
+	for _, vs := range promql.VectorSelectors(expr) {
+		if strings.Contains(vs.MetricName(), "_bucket") {
+			return true
+		}
+	}
+	return false
+}
+
+// quantileMatcher returns the matcher on a summary's quantile label, if any
+func quantileMatcher(vs *promql.VectorSelector) *promql.LabelMatcher {
+	for _, m := range vs.Matchers {
+		if m.Name == "quantile" && (m.Op == promql.MatchEqual || m.Op == promql.MatchRegexp) {
+			return m
+		}
+	}
+	return nil
+}
+
+// bucketSelector returns the bucket series of the histogram matching a summary selector,
+// without the quantile matcher
+func bucketSelector(vs *promql.VectorSelector) *promql.MatrixSelector {
+	buckets := &promql.VectorSelector{Name: vs.MetricName() + "_bucket", Offset: vs.Offset, At: vs.At}
+	for _, m := range vs.Matchers {
+		if m.Name != "quantile" && m.Name != "__name__" {
+			buckets.Matchers = append(buckets.Matchers, m)
+		}
+	}
+	return &promql.MatrixSelector{VectorSelector: buckets, Range: suggestedRateRange}
+}
+
+// renameSeries prints an expression with one metric name replaced by another
+func renameSeries(expr promql.Expr, from, to string) string {
+	return replaceTerm(expr.String(), from, to, isIdentByte)
+}
+
+// replaceTerm replaces each occurrence of from in s that is not preceded by an identifier
+// byte and not followed by a byte for which joined reports true
+func replaceTerm(s, from, to string, joined func(byte) bool) string {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, from)
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String()
+		}
+		end := i + len(from)
+		if (i > 0 && isIdentByte(s[i-1])) || (end < len(s) && joined(s[end])) {
+			sb.WriteString(s[:end])
+		} else {
+			sb.WriteString(s[:i] + to)
+		}
+		s = s[end:]
+	}
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b == ':' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
@@ -0,0 +1,163 @@
+package formatting
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckHistograms(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name: "aggregated buckets with le",
+			expr: `histogram_quantile(0.99, sum by (job, le) (rate(http_request_duration_seconds_bucket[5m])))`,
+		},
+		{
+			name: "native histogram",
+			expr: `histogram_quantile(0.99, sum by (job) (rate(http_request_duration_seconds[5m])))`,
+		},
+		{
+			name: "recorded bucket rates",
+			expr: `histogram_quantile(0.9, sum by (le) (job:http_request_duration_seconds_bucket:rate5m))`,
+		},
+		{
+			name: "aggregation drops le",
+			expr: `histogram_quantile(0.99, sum by (job) (rate(http_request_duration_seconds_bucket[5m])))`,
+			expected: []string{
+				"histogram_quantile() over 'sum by (job) (rate(http_request_duration_seconds_bucket[5m]))' drops the 'le' label holding the bucket boundaries - " +
+					"use 'sum by (job, le) (rate(http_request_duration_seconds_bucket[5m]))'",
+			},
+		},
+		{
+			name: "aggregation without grouping drops le",
+			expr: `histogram_quantile(0.5, sum(rate(x_bucket[5m])))`,
+			expected: []string{
+				"drops the 'le' label holding the bucket boundaries - use 'sum by (le) (rate(x_bucket[5m]))'",
+			},
+		},
+		{
+			name: "without clause removes le",
+			expr: `histogram_quantile(0.5, sum without (instance, le) (rate(x_bucket[5m])))`,
+			expected: []string{
+				"use 'sum without (instance) (rate(x_bucket[5m]))'",
+			},
+		},
+		{
+			name: "buckets combined with max",
+			expr: `histogram_quantile(0.5, max by (le) (rate(x_bucket[5m])))`,
+			expected: []string{
+				"combines buckets with max(), which does not preserve bucket counts - use 'sum by (le) (rate(x_bucket[5m]))'",
+			},
+		},
+		{
+			name: "percentile instead of quantile",
+			expr: `histogram_quantile(99, sum by (le) (rate(x_bucket[5m])))`,
+			expected: []string{
+				"histogram_quantile() takes a quantile between 0 and 1, not 99 - use 0.99 for the 99th percentile",
+			},
+		},
+		{
+			name: "summary quantile",
+			expr: `histogram_quantile(0.99, rpc_duration_seconds{quantile="0.99"})`,
+			expected: []string{
+				`histogram_quantile() cannot be applied to the summary quantile 'rpc_duration_seconds{quantile="0.99"}'`,
+			},
+		},
+		{
+			name: "count series instead of buckets",
+			expr: `histogram_quantile(0.9, sum by (le) (rate(x_count[5m])))`,
+			expected: []string{
+				"histogram_quantile() needs bucket series, not 'x_count' - use 'x_bucket'",
+			},
+		},
+		{
+			name: "averaged summary quantiles",
+			expr: `avg by (job) (rpc_duration_seconds{job="api",quantile="0.9"})`,
+			expected: []string{
+				"avg() over the summary quantiles of 'rpc_duration_seconds' does not yield a valid quantile - summaries cannot be aggregated; " +
+					`expose a histogram and use 'histogram_quantile(0.9, sum by (job, le) (rate(rpc_duration_seconds_bucket{job="api"}[5m])))'`,
+			},
+		},
+		{
+			name: "averaged by quantile label",
+			expr: `avg by (quantile) (rpc_duration_seconds)`,
+			expected: []string{
+				"use 'histogram_quantile(0.99, sum by (le) (rate(rpc_duration_seconds_bucket[5m])))'",
+			},
+		},
+		{
+			name: "max of summary quantiles is an upper bound",
+			expr: `max by (job) (rpc_duration_seconds{quantile="0.9"})`,
+		},
+		{
+			name: "averaged histogram quantiles",
+			expr: `avg by (job) (histogram_quantile(0.9, sum by (instance, job, le) (rate(x_bucket[5m]))))`,
+			expected: []string{
+				"avg() of histogram_quantile() results does not yield a quantile of the combined series - " +
+					"aggregate the buckets first: 'histogram_quantile(0.9, sum by (job, le) (rate(x_bucket[5m])))'",
+			},
+		},
+		{
+			name: "buckets aggregated before rate",
+			expr: `histogram_quantile(0.9, sum by (le) (x_bucket{job="api"}))`,
+			expected: []string{
+				`sum() over the raw bucket counter 'x_bucket{job="api"}' uses counts accumulated since each target started - ` +
+					`apply rate() first: 'sum by (le) (rate(x_bucket{job="api"}[5m]))'`,
+			},
+		},
+		{
+			name: "raw buckets in histogram_quantile",
+			expr: `histogram_quantile(0.9, x_bucket)`,
+			expected: []string{
+				"histogram_quantile() over the raw bucket counter 'x_bucket' uses counts accumulated since each target started - " +
+					"apply rate() first: 'histogram_quantile(0.9, rate(x_bucket[5m]))'",
+			},
+		},
+		{
+			name: "increase on buckets",
+			expr: `histogram_quantile(0.9, sum by (le) (increase(x_bucket[1h])))`,
+		},
+		{
+			name: "native histogram function on classic buckets",
+			expr: `histogram_count(rate(x_bucket{job="api"}[5m]))`,
+			expected: []string{
+				`histogram_count() only works on native histograms, but 'x_bucket' is a classic histogram bucket series - use 'rate(x_count{job="api"}[5m])'`,
+			},
+		},
+		{
+			name: "native histogram average on classic buckets",
+			expr: `histogram_avg(rate(x_bucket[5m]))`,
+			expected: []string{
+				"use 'rate(x_sum[5m]) / rate(x_count[5m])'",
+			},
+		},
+		{
+			name: "template variables are restored",
+			expr: `histogram_quantile(0.99, sum by (job) (rate(x_bucket{job="$job"}[$__rate_interval])))`,
+			expected: []string{
+				`use 'sum by (job, le) (rate(x_bucket{job="$job"}[$__rate_interval]))'`,
+			},
+		},
+		{
+			name: "invalid expression",
+			expr: `histogram_quantile(0.9, sum(`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkHistograms(tt.expr)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkHistograms() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(issues[i], expected) {
+					t.Errorf("issue %d = %q, want it to contain %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package formatting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// Prometheus' defaults for scrape_interval and evaluation_interval. Range windows are only
+// checked against scrape intervals that are configured or fetched, as many setups scrape
+// more often than the default; cost estimates assume it for jobs whose interval is unknown.
+const (
+	defaultScrapeInterval     = time.Minute
+	defaultEvaluationInterval = time.Minute
+)
+
+// minSamplesPerWindow is how many scrape intervals a range window should span, so that it
+// holds at least two samples even when a scrape is missed or delayed
+const minSamplesPerWindow = 4
+
+// intervals holds the scrape intervals range windows are checked against
+type intervals struct {
+	// byJob holds the scrape interval of each job, fetched from Prometheus targets
+	byJob map[string]time.Duration
+	// fallback applies to selectors of jobs not in byJob; 0 if unknown
+	fallback time.Duration
+}
+
+// scrapeIntervals returns the scrape intervals configured by the options: those of the
+// Prometheus targets if PrometheusURL is set, with ScrapeInterval for other selectors. If the
+// targets cannot be fetched, the error is returned along with ScrapeInterval alone.
+func (o CheckOptions) scrapeIntervals() (intervals, error) {
+	iv := intervals{fallback: max(o.ScrapeInterval, 0)}
+	if o.PrometheusURL != "" {
+		byJob, err := o.Cache.scrapeIntervals(o.PrometheusURL)
+		if err != nil {
+			return iv, fmt.Errorf("cannot fetch scrape intervals: %w", err)
+		}
+		iv.byJob = byJob
+	}
+	return iv, nil
+}
+
+// of returns the scrape interval of the series a selector matches, or 0 if it is unknown
+func (iv intervals) of(vs *promql.VectorSelector) time.Duration {
+	for _, m := range vs.Matchers {
+		if m.Name == "job" && m.Op == promql.MatchEqual {
+			if d, ok := iv.byJob[m.Value]; ok {
+				return d
+			}
+		}
+	}
+	return iv.fallback
+}
+
+// ofExpr returns the longest known scrape interval of the series an expression selects, or 0
+// if none is known
+func (iv intervals) ofExpr(expr promql.Expr) time.Duration {
+	var longest time.Duration
+	for _, vs := range promql.VectorSelectors(expr) {
+		longest = max(longest, iv.of(vs))
+	}
+	return longest
+}
+
+// ruleExpr is the expression of a rule in a rule file
+type ruleExpr struct {
+	// Line is the line of the expr key
+	Line  int
+	Expr  string
+	Alert string
+	// Evaluation is the evaluation interval of the rule's group
+	Evaluation time.Duration
+}
+
+// ruleExprs returns the expressions of the rules of a rule file, mimirtool namespace file or
+// PrometheusRule resource, or nil if content is not a rule file. If only is set, expressions
+// starting at a line it rejects are skipped.
+func ruleExprs(content string, only func(line int) bool) []ruleExpr {
+	var exprs []ruleExpr
+	for _, group := range promql.LoadRuleGroups("", []byte(content)) {
+		evaluation := group.Interval
+		if evaluation == 0 {
+			evaluation = defaultEvaluationInterval
+		}
+		for _, rule := range group.Rules {
+			if rule.ExprLine == 0 || (only != nil && !only(rule.ExprLine)) {
+				continue
+			}
+			exprs = append(exprs, ruleExpr{Line: rule.ExprLine, Expr: rule.Expr, Alert: rule.Alert, Evaluation: evaluation})
+		}
+	}
+	return exprs
+}
+
+// rangeWindowIssues checks the range windows of each rule against its group's evaluation
+// interval. If only is set, rules whose expression starts at a line it rejects are skipped.
+func rangeWindowIssues(content string, only func(line int) bool, iv intervals) []Issue {
+	var issues []Issue
+	for _, r := range ruleExprs(content, only) {
+		issues = append(issues, issuesAt(r.Line, "", checkRangeWindows(r.Expr, iv, r.Evaluation))...)
+	}
+	return issues
+}
+
+// checkRangeWindows validates range windows and subquery resolutions against the scrape
+// interval of the series they select. Evaluation is the interval of the rule group holding
+// the expression, or 0 for queries that are not evaluated by rules.
+func checkRangeWindows(expr string, iv intervals, evaluation time.Duration) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+	// templated reports whether a duration is a placeholder for a variable such as
+	// $__rate_interval, which adapts to the scrape interval
+	templated := func(d time.Duration) bool {
+		return restore(promql.FormatDuration(d)) != promql.FormatDuration(d)
+	}
+
+	var issues []string
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		switch e := e.(type) {
+		case *promql.MatrixSelector:
+			if templated(e.Range) {
+				return true
+			}
+			fn := enclosingFunc(path)
+			scrape := iv.of(e.VectorSelector)
+			if scrape > 0 && e.Range < minSamplesPerWindow*scrape {
+				issues = append(issues, fmt.Sprintf("Range [%s] in %s is shorter than %d scrape intervals (%d × %s) - "+
+					"it can hold fewer than two samples, so %s returns no data for some evaluations; use at least [%s]",
+					promql.FormatDuration(e.Range), quoteExpr(fn, e, restore), minSamplesPerWindow, minSamplesPerWindow,
+					promql.FormatDuration(scrape), funcName(fn), promql.FormatDuration(minSamplesPerWindow*scrape)))
+			}
+			// Inside a subquery, the selector is evaluated at each of the innermost subquery's
+			// steps rather than at each evaluation of the group
+			if sq := enclosingSubquery(path); sq != nil {
+				if step := subqueryStep(sq); !templated(step) && e.Range < step {
+					issues = append(issues, fmt.Sprintf("Range [%s] in %s is shorter than the %s resolution of '%s' - "+
+						"samples between steps are never seen; use at least [%s]",
+						promql.FormatDuration(e.Range), quoteExpr(fn, e, restore), promql.FormatDuration(step),
+						restore(sq.String()), promql.FormatDuration(step)))
+				}
+			} else if evaluation > 0 && e.Range < evaluation {
+				issues = append(issues, fmt.Sprintf("Range [%s] in %s is shorter than the group's %s evaluation interval - "+
+					"samples between evaluations are never seen; use at least [%s]",
+					promql.FormatDuration(e.Range), quoteExpr(fn, e, restore), promql.FormatDuration(evaluation), promql.FormatDuration(evaluation)))
+			}
+		case *promql.SubqueryExpr:
+			step := subqueryStep(e)
+			if templated(e.Range) || templated(step) {
+				return true
+			}
+			if scrape := iv.ofExpr(e.Expr); scrape > 0 && step < scrape {
+				issues = append(issues, fmt.Sprintf("Subquery resolution %s in '%s' is finer than the %s scrape interval - "+
+					"extra steps only repeat the same samples; use [%s:%s]",
+					promql.FormatDuration(step), restore(e.String()), promql.FormatDuration(scrape),
+					promql.FormatDuration(e.Range), promql.FormatDuration(scrape)))
+			} else if evaluation > 0 && step < evaluation {
+				issues = append(issues, fmt.Sprintf("Subquery resolution %s in '%s' is finer than the group's %s evaluation interval - "+
+					"each evaluation recomputes %d steps, most of them computed by the previous evaluation; "+
+					"record the inner expression with a recording rule and use a range over its series",
+					promql.FormatDuration(step), restore(e.String()), promql.FormatDuration(evaluation), int(e.Range/step)))
+			}
+			if e.Range < minSamplesPerWindow*step {
+				issues = append(issues, fmt.Sprintf("Subquery range %s in '%s' is shorter than %d resolution steps (%d × %s); use at least [%s:%s]",
+					promql.FormatDuration(e.Range), restore(e.String()), minSamplesPerWindow, minSamplesPerWindow,
+					promql.FormatDuration(step), promql.FormatDuration(minSamplesPerWindow*step), promql.FormatDuration(step)))
+			}
+		case *promql.Call:
+			if e.Func != "irate" || evaluation == 0 || len(e.Args) != 1 {
+				return true
+			}
+			if scrape := iv.ofExpr(e.Args[0]); scrape > 0 && evaluation > scrape {
+				issues = append(issues, fmt.Sprintf("irate() in '%s' only uses the last two samples, so a rule evaluated every %s ignores "+
+					"most samples scraped every %s - use rate(), which averages over the whole window",
+					restore(e.String()), promql.FormatDuration(evaluation), promql.FormatDuration(scrape)))
+			}
+		}
+		return true
+	})
+	return issues
+}
+
+// enclosingFunc returns the function a matrix selector is passed to, if any
+func enclosingFunc(path []promql.Expr) *promql.Call {
+	for i := len(path) - 1; i >= 0; i-- {
+		switch e := path[i].(type) {
+		case *promql.ParenExpr:
+			continue
+		case *promql.Call:
+			return e
+		}
+		return nil
+	}
+	return nil
+}
+
+// enclosingSubquery returns the innermost subquery of a node's ancestors, or nil if it is not
+// inside one
+func enclosingSubquery(path []promql.Expr) *promql.SubqueryExpr {
+	for i := len(path) - 1; i >= 0; i-- {
+		if sq, ok := path[i].(*promql.SubqueryExpr); ok {
+			return sq
+		}
+	}
+	return nil
+}
+
+// subqueryStep returns the resolution of a subquery. Without one, Prometheus uses the global
+// evaluation interval, whatever the interval of the group evaluating the subquery.
+func subqueryStep(sq *promql.SubqueryExpr) time.Duration {
+	if sq.Step > 0 {
+		return sq.Step
+	}
+	return defaultEvaluationInterval
+}
+
+// quoteExpr quotes the function call holding a matrix selector, or the selector itself
+func quoteExpr(fn *promql.Call, ms *promql.MatrixSelector, restore func(string) string) string {
+	if fn != nil {
+		return "'" + restore(fn.String()) + "'"
+	}
+	return "'" + restore(ms.String()) + "'"
+}
+
+// funcName names the function a matrix selector is passed to for messages
+func funcName(fn *promql.Call) string {
+	if fn == nil {
+		return "the query"
+	}
+	return fn.Func + "()"
+}
+
+// fetchScrapeIntervals returns the scrape interval of each job with active Prometheus targets.
+// Jobs whose targets are scraped at different intervals map to the longest.
+func fetchScrapeIntervals(prometheusURL string) (byJob map[string]time.Duration, err error) {
+	resp, err := http.Get(prometheusURL + "/api/v1/targets?state=active")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Prometheus: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("prometheus returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var targetsResp struct {
+		Data struct {
+			ActiveTargets []struct {
+				Labels         map[string]string `json:"labels"`
+				ScrapePool     string            `json:"scrapePool"`
+				ScrapeInterval string            `json:"scrapeInterval"`
+			} `json:"activeTargets"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&targetsResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	byJob = make(map[string]time.Duration)
+	for _, target := range targetsResp.Data.ActiveTargets {
+		interval, err := promql.ParseDuration(target.ScrapeInterval)
+		if err != nil {
+			// Servers before Prometheus 2.35 do not report scrape intervals
+			continue
+		}
+		job := target.Labels["job"]
+		if job == "" {
+			job = target.ScrapePool
+		}
+		byJob[job] = max(byJob[job], interval)
+	}
+	return byJob, nil
+}
@@ -0,0 +1,266 @@
+package formatting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckRangeWindows(t *testing.T) {
+	tests := []struct {
+		name       string
+		expr       string
+		intervals  intervals
+		evaluation time.Duration
+		expected   []string
+	}{
+		{
+			name:      "window of four scrape intervals",
+			expr:      `rate(http_requests_total[4m])`,
+			intervals: intervals{fallback: time.Minute},
+		},
+		{
+			name:      "window of one scrape interval",
+			expr:      `sum(rate(http_requests_total[1m]))`,
+			intervals: intervals{fallback: time.Minute},
+			expected: []string{
+				"Range [1m] in 'rate(http_requests_total[1m])' is shorter than 4 scrape intervals (4 × 1m) - " +
+					"it can hold fewer than two samples, so rate() returns no data for some evaluations; use at least [4m]",
+			},
+		},
+		{
+			name:      "job scrape interval from targets",
+			expr:      `rate(http_requests_total{job="api"}[1m]) / rate(http_requests_total{job="batch"}[1m])`,
+			intervals: intervals{byJob: map[string]time.Duration{"api": 15 * time.Second, "batch": 30 * time.Second}, fallback: time.Minute},
+			expected: []string{
+				`Range [1m] in 'rate(http_requests_total{job="batch"}[1m])' is shorter than 4 scrape intervals (4 × 30s)`,
+			},
+		},
+		{
+			name:       "unknown scrape interval only checks the evaluation interval",
+			expr:       `rate(http_requests_total[2m]) / rate(errors_total[30s])`,
+			evaluation: time.Minute,
+			expected: []string{
+				"Range [30s] in 'rate(errors_total[30s])' is shorter than the group's 1m evaluation interval",
+			},
+		},
+		{
+			name:       "window shorter than evaluation interval",
+			expr:       `increase(errors_total[1m])`,
+			intervals:  intervals{fallback: 15 * time.Second},
+			evaluation: 5 * time.Minute,
+			expected: []string{
+				"Range [1m] in 'increase(errors_total[1m])' is shorter than the group's 5m evaluation interval - " +
+					"samples between evaluations are never seen; use at least [5m]",
+			},
+		},
+		{
+			name:      "template variable window",
+			expr:      `rate(http_requests_total{job="$job"}[$__rate_interval])`,
+			intervals: intervals{fallback: time.Minute},
+		},
+		{
+			name:      "subquery finer than scrape interval",
+			expr:      `max_over_time(rate(x_total[5m])[1h:10s])`,
+			intervals: intervals{fallback: time.Minute},
+			expected: []string{
+				"Subquery resolution 10s in 'rate(x_total[5m])[1h:10s]' is finer than the 1m scrape interval - " +
+					"extra steps only repeat the same samples; use [1h:1m]",
+			},
+		},
+		{
+			name:       "subquery finer than evaluation interval",
+			expr:       `max_over_time(rate(x_total[5m])[1h:15s])`,
+			intervals:  intervals{fallback: 15 * time.Second},
+			evaluation: time.Minute,
+			expected: []string{
+				"Subquery resolution 15s in 'rate(x_total[5m])[1h:15s]' is finer than the group's 1m evaluation interval - " +
+					"each evaluation recomputes 240 steps",
+			},
+		},
+		{
+			name:       "subquery range shorter than four steps",
+			expr:       `max_over_time(rate(x_total[5m])[10m:5m])`,
+			intervals:  intervals{fallback: 15 * time.Second},
+			evaluation: 5 * time.Minute,
+			expected: []string{
+				"Subquery range 10m in 'rate(x_total[5m])[10m:5m]' is shorter than 4 resolution steps (4 × 5m); use at least [20m:5m]",
+			},
+		},
+		{
+			name:       "subquery without resolution uses the global evaluation interval",
+			expr:       `max_over_time(rate(x_total[5m])[10m:])`,
+			evaluation: 5 * time.Minute,
+			expected: []string{
+				"Subquery resolution 1m in 'rate(x_total[5m])[10m:]' is finer than the group's 5m evaluation interval",
+			},
+		},
+		{
+			name:       "range in a subquery covers its resolution",
+			expr:       `max_over_time(rate(x_total[1m])[1h:30s])`,
+			evaluation: 5 * time.Minute,
+			expected: []string{
+				"Subquery resolution 30s in 'rate(x_total[1m])[1h:30s]' is finer than the group's 5m evaluation interval",
+			},
+		},
+		{
+			name:       "range in a subquery shorter than its resolution",
+			expr:       `max_over_time(rate(x_total[1m])[1h:5m])`,
+			evaluation: 5 * time.Minute,
+			expected: []string{
+				"Range [1m] in 'rate(x_total[1m])' is shorter than the 5m resolution of 'rate(x_total[1m])[1h:5m]' - " +
+					"samples between steps are never seen; use at least [5m]",
+			},
+		},
+		{
+			name:       "range in a subquery without resolution",
+			expr:       `max_over_time(rate(x_total[30s])[1h:])`,
+			evaluation: 15 * time.Second,
+			expected: []string{
+				"Range [30s] in 'rate(x_total[30s])' is shorter than the 1m resolution of 'rate(x_total[30s])[1h:]'",
+			},
+		},
+		{
+			name:       "irate in a slowly evaluated rule",
+			expr:       `irate(http_requests_total[5m])`,
+			intervals:  intervals{fallback: 15 * time.Second},
+			evaluation: time.Minute,
+			expected: []string{
+				"irate() in 'irate(http_requests_total[5m])' only uses the last two samples, so a rule evaluated every 1m ignores " +
+					"most samples scraped every 15s - use rate(), which averages over the whole window",
+			},
+		},
+		{
+			name:      "irate in a dashboard",
+			expr:      `irate(http_requests_total[5m])`,
+			intervals: intervals{fallback: 15 * time.Second},
+		},
+		{
+			name:      "invalid expression",
+			expr:      `rate(x[1m]`,
+			intervals: intervals{fallback: time.Minute},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkRangeWindows(tt.expr, tt.intervals, tt.evaluation)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkRangeWindows() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.HasPrefix(issues[i], expected) {
+					t.Errorf("issue %d = %q, want prefix %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRangeWindowIssues(t *testing.T) {
+	content := `groups:
+  - name: fast
+    interval: 15s
+    rules:
+      - record: job:http_requests:rate1m
+        expr: sum by (job) (rate(http_requests_total[1m]))
+  - name: slow
+    interval: 5m
+    rules:
+      - record: job:errors:increase1m
+        expr: |
+          sum by (job) (increase(errors_total[1m]))
+`
+	issues := rangeWindowIssues(content, nil, intervals{fallback: 15 * time.Second})
+
+	var lines []int
+	for _, issue := range issues {
+		lines = append(lines, issue.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{11}) {
+		t.Fatalf("rangeWindowIssues() = %v, want one issue on line 11", issues)
+	}
+	if !strings.Contains(issues[0].Message, "5m evaluation interval") {
+		t.Errorf("issue = %q, want the group's evaluation interval", issues[0].Message)
+	}
+
+	if got := rangeWindowIssues(content, func(line int) bool { return line != 11 }, intervals{fallback: 15 * time.Second}); len(got) != 0 {
+		t.Errorf("rangeWindowIssues() with line 11 excluded = %v, want none", got)
+	}
+
+	// PrometheusRule resources and later documents of a file are checked too
+	crd := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+spec:
+  groups:
+    - name: slow
+      interval: 5m
+      rules:
+        - record: job:errors:increase1m
+          expr: sum by (job) (increase(errors_total[1m]))
+---
+groups:
+  - name: slow
+    interval: 5m
+    rules:
+      - record: job:requests:increase1m
+        expr: sum by (job) (increase(requests_total[1m]))
+`
+	lines = nil
+	for _, issue := range rangeWindowIssues(crd, nil, intervals{}) {
+		lines = append(lines, issue.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{9, 16}) {
+		t.Errorf("rangeWindowIssues() of a PrometheusRule = issues on lines %v, want 9 and 16", lines)
+	}
+}
+
+func TestFetchScrapeIntervals(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/targets" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(`{"status":"success","data":{"activeTargets":[` +
+			`{"labels":{"job":"api"},"scrapePool":"api","scrapeInterval":"15s"},` +
+			`{"labels":{"job":"api"},"scrapePool":"api","scrapeInterval":"30s"},` +
+			`{"labels":{},"scrapePool":"node","scrapeInterval":"1m"},` +
+			`{"labels":{"job":"old"},"scrapePool":"old"}]}}`)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	byJob, err := fetchScrapeIntervals(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Duration{"api": 30 * time.Second, "node": time.Minute}
+	if !reflect.DeepEqual(byJob, expected) {
+		t.Errorf("fetchScrapeIntervals() = %v, want %v", byJob, expected)
+	}
+
+	iv, err := CheckOptions{PrometheusURL: server.URL, ScrapeInterval: 10 * time.Second}.scrapeIntervals()
+	if err != nil {
+		t.Fatalf("scrapeIntervals() returned error: %v", err)
+	}
+	if iv.fallback != 10*time.Second || iv.byJob["api"] != 30*time.Second {
+		t.Errorf("scrapeIntervals() = %+v", iv)
+	}
+
+	// Targets that cannot be fetched are reported rather than silently ignored
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	issues, _ := Check([]byte("groups:\n  - name: test\n    rules:\n      - record: job:up:sum\n        expr: sum by (job) (up)\n"),
+		CheckOptions{PrometheusURL: failing.URL})
+	found := false
+	for _, issue := range issues {
+		found = found || strings.Contains(issue.Message, "cannot fetch scrape intervals")
+	}
+	if !found {
+		t.Errorf("Check() with unreachable targets = %v, want an issue for the scrape intervals", issues)
+	}
+}
@@ -0,0 +1,42 @@
+package formatting
+
+import "fmt"
+
+// Issue is a problem found in a file, located so that editors can show it in place
+type Issue struct {
+	// Line is the 1-based line the issue applies to, or 0 if it applies to the whole file
+	Line int
+	// Location describes where an expression lives in files other than rule files, e.g.
+	// `panel "Errors"`; it is empty for rule files
+	Location string
+	Message  string
+}
+
+// String formats the issue as the command line tools report it
+func (i Issue) String() string {
+	if i.Location == "" {
+		return i.Message
+	}
+	return fmt.Sprintf("%s (line %d): %s", i.Location, i.Line, i.Message)
+}
+
+// issuesAt builds issues for messages found at a line
+func issuesAt(line int, location string, messages []string) []Issue {
+	issues := make([]Issue, len(messages))
+	for i, m := range messages {
+		issues[i] = Issue{Line: line, Location: location, Message: m}
+	}
+	return issues
+}
+
+// issueStrings formats issues as the command line tools report them
+func issueStrings(issues []Issue) []string {
+	if issues == nil {
+		return nil
+	}
+	s := make([]string, len(issues))
+	for i, issue := range issues {
+		s[i] = issue.String()
+	}
+	return s
+}
@@ -0,0 +1,208 @@
+package formatting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MetricMetadata is the type, help text and unit of a metric family, as reported by the
+// Prometheus metadata API
+type MetricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// Metadata maps metric family names to their metadata
+type Metadata map[string]MetricMetadata
+
+// Metric types reported by the metadata API
+const (
+	metricTypeCounter        = "counter"
+	metricTypeGauge          = "gauge"
+	metricTypeHistogram      = "histogram"
+	metricTypeGaugeHistogram = "gaugehistogram"
+	metricTypeSummary        = "summary"
+)
+
+// LoadMetadata reads metric metadata for offline checks from a JSON file, either a response
+// saved from the /api/v1/metadata endpoint or just its data object
+func LoadMetadata(path string) (Metadata, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+	md, err := parseMetadata(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata file: %w", err)
+	}
+	return md, nil
+}
+
+// parseMetadata decodes a metadata API response or its data object. Targets may disagree
+// about a metric; the first entry listed wins.
+func parseMetadata(content []byte) (Metadata, error) {
+	var response struct {
+		Data map[string][]MetricMetadata `json:"data"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, err
+	}
+	data := response.Data
+	if data == nil {
+		if err := json.Unmarshal(content, &data); err != nil {
+			return nil, err
+		}
+	}
+
+	md := make(Metadata, len(data))
+	for name, entries := range data {
+		if len(entries) > 0 {
+			md[name] = entries[0]
+		}
+	}
+	return md, nil
+}
+
+// fetchMetadata queries the metadata of every metric Prometheus scrapes
+func fetchMetadata(prometheusURL string) (md Metadata, err error) {
+	resp, err := http.Get(prometheusURL + "/api/v1/metadata")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Prometheus: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("prometheus returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	md, err = parseMetadata(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return md, nil
+}
+
+// metadata returns the metadata configured by the options: Metadata, completed by
+// the metadata of PrometheusURL if set. It is nil when neither is configured. If the metadata
+// of PrometheusURL cannot be fetched, the error is returned along with Metadata alone.
+func (o CheckOptions) metadata() (Metadata, error) {
+	if o.PrometheusURL == "" {
+		return o.Metadata, nil
+	}
+
+	remote, err := o.Cache.metadata(o.PrometheusURL)
+	if err != nil {
+		return o.Metadata, fmt.Errorf("cannot fetch metric metadata: %w", err)
+	}
+	if len(o.Metadata) == 0 {
+		return remote, nil
+	}
+
+	merged := make(Metadata, len(remote)+len(o.Metadata))
+	for name, m := range remote {
+		merged[name] = m
+	}
+	for name, m := range o.Metadata {
+		merged[name] = m
+	}
+	return merged, nil
+}
+
+// seriesType returns the type of the series a metric name selects: counter for counters and
+// the _bucket, _count and _sum series of classic histograms and summaries, gauge for gauges
+// and summary quantiles, histogram for native histograms, or "" if the metric is unknown
+func (md Metadata) seriesType(name string) string {
+	if m, ok := md.family(name); ok {
+		switch m.Type {
+		case metricTypeSummary:
+			// Summary quantiles are exposed under the family name
+			return metricTypeGauge
+		case metricTypeGaugeHistogram:
+			return metricTypeGauge
+		}
+		return m.Type
+	}
+
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		base, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		if m, ok := md.family(base); ok {
+			switch m.Type {
+			case metricTypeHistogram, metricTypeSummary:
+				return metricTypeCounter
+			case metricTypeGaugeHistogram:
+				return metricTypeGauge
+			}
+		}
+	}
+	return ""
+}
+
+// family looks up the metadata of a metric, also under its family name without _total, as
+// OpenMetrics exposes counter families
+func (md Metadata) family(name string) (MetricMetadata, bool) {
+	if m, ok := md[name]; ok && m.Type != "" && m.Type != "unknown" {
+		return m, true
+	}
+	if base, ok := strings.CutSuffix(name, "_total"); ok {
+		if m, ok := md[base]; ok && m.Type == metricTypeCounter {
+			return m, true
+		}
+	}
+	return MetricMetadata{}, false
+}
+
+// checkMetadataTypes checks how an expression uses metrics against their types and units
+// in metadata, replacing the name heuristics for the metrics metadata knows
+func checkMetadataTypes(expr string, md Metadata) []string {
+	var issues []string
+
+	// rate-like functions need counters, delta-like functions ignore counter resets
+	callRegex := regexp.MustCompile(`\b(rate|irate|increase|resets|delta|idelta|deriv|predict_linear)\s*\(\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*[\[\{]`)
+	for _, match := range callRegex.FindAllStringSubmatch(expr, -1) {
+		fn, metricName := match[1], match[2]
+		switch typ := md.seriesType(metricName); {
+		case typ == metricTypeGauge && (fn == "rate" || fn == "irate" || fn == "increase" || fn == "resets"):
+			issues = append(issues, fmt.Sprintf("Using %s() on '%s', a gauge according to Prometheus metadata - %s() is only meaningful for counters; use deriv() or delta() for gauges",
+				fn, metricName, fn))
+		case typ == metricTypeCounter && fn != "rate" && fn != "irate" && fn != "increase" && fn != "resets":
+			issues = append(issues, fmt.Sprintf("Using %s() on '%s', a counter according to Prometheus metadata - %s() does not handle counter resets; use rate() or increase()",
+				fn, metricName, fn))
+		}
+	}
+
+	for _, metricName := range extractMetricNames(expr) {
+		m, ok := md.family(metricName)
+		if !ok {
+			continue
+		}
+		switch {
+		case m.Type == metricTypeGauge && strings.HasSuffix(metricName, "_total"):
+			issues = append(issues, fmt.Sprintf("Metric '%s' is a gauge according to Prometheus metadata, but the '_total' suffix is reserved for counters", metricName))
+		case m.Type == metricTypeCounter && !strings.HasSuffix(metricName, "_total"):
+			issues = append(issues, fmt.Sprintf("Counter metric '%s' should have '_total' suffix", metricName))
+		}
+		if m.Unit != "" && !strings.Contains(metricName, "_"+m.Unit) {
+			issues = append(issues, fmt.Sprintf("Metric '%s' has unit '%s' according to Prometheus metadata, but its name lacks the '_%s' suffix", metricName, m.Unit, m.Unit))
+		}
+	}
+
+	return issues
+}
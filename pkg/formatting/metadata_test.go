@@ -0,0 +1,189 @@
+package formatting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testMetadata = Metadata{
+	"http_requests_total":       {Type: "counter"},
+	"jobs_processed":            {Type: "counter"},
+	"queue_length_count":        {Type: "gauge"},
+	"temperature_total":         {Type: "gauge"},
+	"request_duration_seconds":  {Type: "histogram", Unit: "seconds"},
+	"rpc_latency":               {Type: "summary", Unit: "seconds"},
+	"process_cpu_seconds_total": {Type: "counter"},
+}
+
+func TestCheckMetadataTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name: "rate on a counter",
+			expr: `rate(http_requests_total{job="api"}[5m])`,
+		},
+		{
+			name: "rate on histogram buckets",
+			expr: `sum by (le) (rate(request_duration_seconds_bucket[5m]))`,
+		},
+		{
+			name: "rate on a gauge named like a counter",
+			expr: `rate(queue_length_count[5m])`,
+			expected: []string{
+				"Using rate() on 'queue_length_count', a gauge according to Prometheus metadata - rate() is only meaningful for counters; use deriv() or delta() for gauges",
+			},
+		},
+		{
+			name: "delta on a counter",
+			expr: `delta(process_cpu_seconds_total[5m])`,
+			expected: []string{
+				"Using delta() on 'process_cpu_seconds_total', a counter according to Prometheus metadata - delta() does not handle counter resets; use rate() or increase()",
+			},
+		},
+		{
+			name: "deriv on summary count",
+			expr: `deriv(rpc_latency_count[5m])`,
+			expected: []string{
+				"Using deriv() on 'rpc_latency_count', a counter according to Prometheus metadata",
+			},
+		},
+		{
+			name: "gauge with _total suffix",
+			expr: `temperature_total > 30`,
+			expected: []string{
+				"Metric 'temperature_total' is a gauge according to Prometheus metadata, but the '_total' suffix is reserved for counters",
+			},
+		},
+		{
+			name: "legacy counter without _total",
+			expr: `increase(jobs_processed[1h])`,
+			expected: []string{
+				"Counter metric 'jobs_processed' should have '_total' suffix",
+			},
+		},
+		{
+			name: "unit missing from name",
+			expr: `rpc_latency{quantile="0.99"} > 1`,
+			expected: []string{
+				"Metric 'rpc_latency' has unit 'seconds' according to Prometheus metadata, but its name lacks the '_seconds' suffix",
+			},
+		},
+		{
+			name: "unknown metric",
+			expr: `rate(unknown_metric[5m])`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkMetadataTypes(tt.expr, testMetadata)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkMetadataTypes() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.HasPrefix(issues[i], expected) {
+					t.Errorf("issue %d = %q, want prefix %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataReplacesHeuristics(t *testing.T) {
+	// Without metadata, the names suggest a counter missing _total and rate() on a gauge
+	if issues := checkMetricSuffixes("queue_length_count", nil); len(issues) == 0 {
+		t.Error("checkMetricSuffixes() without metadata reported nothing for queue_length_count")
+	}
+	if issues := checkInstrumentationPatterns("rate(request_duration_seconds_bucket[5m])", nil); len(issues) != 0 {
+		t.Errorf("checkInstrumentationPatterns() without metadata = %v", issues)
+	}
+	if issues := checkInstrumentationPatterns("rate(jobs_processed[5m])", nil); len(issues) == 0 {
+		t.Error("checkInstrumentationPatterns() without metadata reported nothing for jobs_processed")
+	}
+
+	// With metadata, the heuristics defer to the known types
+	if issues := checkMetricSuffixes("queue_length_count", testMetadata); len(issues) != 0 {
+		t.Errorf("checkMetricSuffixes() with metadata = %v", issues)
+	}
+	if issues := checkInstrumentationPatterns("rate(jobs_processed[5m])", testMetadata); len(issues) != 0 {
+		t.Errorf("checkInstrumentationPatterns() with metadata = %v", issues)
+	}
+}
+
+func TestLoadMetadata(t *testing.T) {
+	dir := t.TempDir()
+	expected := Metadata{"up": {Type: "gauge", Help: "Target health"}}
+
+	for name, content := range map[string]string{
+		"response.json": `{"status":"success","data":{"up":[{"type":"gauge","help":"Target health","unit":""},{"type":"counter"}]}}`,
+		"data.json":     `{"up":[{"type":"gauge","help":"Target health","unit":""}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		md, err := LoadMetadata(path)
+		if err != nil {
+			t.Fatalf("LoadMetadata(%s) error: %v", name, err)
+		}
+		if !reflect.DeepEqual(md, expected) {
+			t.Errorf("LoadMetadata(%s) = %v, want %v", name, md, expected)
+		}
+	}
+
+	if _, err := LoadMetadata(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("LoadMetadata() of a missing file succeeded")
+	}
+}
+
+func TestOptionsMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/metadata" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(`{"status":"success","data":{"a":[{"type":"counter"}],"b":[{"type":"counter"}]}}`)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	opts := CheckOptions{
+		PrometheusURL: server.URL,
+		Metadata:      Metadata{"b": {Type: "gauge"}},
+		Cache:         NewLookupCache(),
+	}
+	expected := Metadata{"a": {Type: "counter"}, "b": {Type: "gauge"}}
+	if md, err := opts.metadata(); err != nil || !reflect.DeepEqual(md, expected) {
+		t.Errorf("metadata() = %v, %v, want %v", md, err, expected)
+	}
+
+	issues, _ := CheckAndFormatPromQL("groups:\n  - name: g\n    rules:\n      - record: job:b:rate5m\n        expr: rate(b[5m])\n", opts)
+	found := false
+	for _, issue := range issues {
+		found = found || strings.HasPrefix(issue, "Using rate() on 'b', a gauge according to Prometheus metadata")
+	}
+	if !found {
+		t.Errorf("issues = %v, want rate() on a gauge", issues)
+	}
+
+	// Metadata that cannot be fetched is reported, and the configured metadata still applies
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	opts.PrometheusURL = failing.URL
+	md, err := opts.metadata()
+	if err == nil || !strings.Contains(err.Error(), "cannot fetch metric metadata") {
+		t.Errorf("metadata() error = %v, want one for the unreachable metadata", err)
+	}
+	if !reflect.DeepEqual(md, opts.Metadata) {
+		t.Errorf("metadata() = %v, want the configured %v", md, opts.Metadata)
+	}
+}
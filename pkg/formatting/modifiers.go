@@ -0,0 +1,141 @@
+package formatting
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// maxAlertOffset is the longest offset an alert may read all of its data with; beyond it the
+// alert reacts too late to an incident and keeps firing long after it ends
+const maxAlertOffset = 10 * time.Minute
+
+// checkSubqueries flags subqueries that are costly or needless wherever they are evaluated:
+// subqueries nested in other subqueries, and subqueries resampling a plain selector
+func checkSubqueries(expr string) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+
+	var issues []string
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		sq, ok := e.(*promql.SubqueryExpr)
+		if !ok {
+			return true
+		}
+
+		if vs, ok := promql.Unwrap(sq.Expr).(*promql.VectorSelector); ok {
+			// The range selector takes over the subquery's modifiers
+			selector := *vs
+			selector.Offset += sq.Offset
+			if selector.At == "" {
+				selector.At = sq.At
+			}
+			ms := &promql.MatrixSelector{VectorSelector: &selector, Range: sq.Range}
+			issues = append(issues, fmt.Sprintf("Subquery '%s' resamples a plain selector - use the range selector '%s', "+
+				"which reads the raw samples without evaluating the selector at every step",
+				restore(sq.String()), restore(ms.String())))
+		}
+
+		for i := len(path) - 1; i >= 0; i-- {
+			outer, ok := path[i].(*promql.SubqueryExpr)
+			if !ok {
+				continue
+			}
+			runs := subquerySteps(outer) * subquerySteps(sq)
+			issues = append(issues, fmt.Sprintf("Subquery '%s' is nested in subquery '%s', so its inner expression is evaluated ~%d times per query - "+
+				"record the inner subquery's expression with a recording rule and use a range over its series",
+				restore(sq.String()), restore(outer.String()), runs))
+			break
+		}
+		return true
+	})
+	return issues
+}
+
+// subquerySteps is the number of steps a subquery evaluates its expression at, assuming
+// the default evaluation interval when the subquery has no step
+func subquerySteps(sq *promql.SubqueryExpr) int {
+	step := sq.Step
+	if step == 0 {
+		step = defaultEvaluationInterval
+	}
+	return max(1, int(sq.Range/step))
+}
+
+// modifierIssues checks the offset and @ modifiers of each rule. If only is set, rules whose
+// expression starts at a line it rejects are skipped.
+func modifierIssues(content string, only func(line int) bool) []Issue {
+	var issues []Issue
+	for _, r := range ruleExprs(content, only) {
+		issues = append(issues, issuesAt(r.Line, "", checkRuleModifiers(r.Expr, r.Alert))...)
+	}
+	return issues
+}
+
+// checkRuleModifiers checks offset and @ modifiers of a rule expression, which rules evaluate
+// as instant queries at the current time. Alert is the name of the alert, or "" for recording
+// rules.
+func checkRuleModifiers(expr, alert string) []string {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		// Syntax errors are reported by the formatter
+		return nil
+	}
+
+	var issues []string
+	check := func(quoted string, offset time.Duration, at string) {
+		if offset < 0 {
+			issues = append(issues, fmt.Sprintf("'%s' has a negative offset, so it reads samples after the evaluation time - "+
+				"a rule never sees them and returns no data; remove the offset", quoted))
+		}
+		switch at {
+		case "":
+		case "start()", "end()":
+			issues = append(issues, fmt.Sprintf("'@ %s' in '%s' has no effect in a rule - rules are instant queries, "+
+				"so start() and end() are both the evaluation time; remove it", at, quoted))
+		default:
+			issues = append(issues, fmt.Sprintf("'%s' is pinned to the time '@ %s', so the rule reads the same samples at every evaluation "+
+				"and never reflects new data; remove the @ modifier", quoted, at))
+		}
+	}
+
+	// current is the selector reading the most recent data, at offset including that of
+	// enclosing subqueries
+	var current *promql.VectorSelector
+	var offset time.Duration
+	promql.Inspect(parsed, func(e promql.Expr, path []promql.Expr) bool {
+		switch e := e.(type) {
+		case *promql.SubqueryExpr:
+			check(restore(e.String()), e.Offset, e.At)
+		case *promql.VectorSelector:
+			check(restore(e.String()), e.Offset, e.At)
+			total := e.Offset
+			for _, p := range path {
+				if sq, ok := p.(*promql.SubqueryExpr); ok {
+					total += sq.Offset
+				}
+			}
+			if current == nil || total < offset {
+				offset, current = total, e
+			}
+		}
+		return true
+	})
+
+	if alert != "" && current != nil && offset > maxAlertOffset {
+		issue := fmt.Sprintf("Alert '%s' only reads data from %s ago, e.g. '%s' - it fires %s after a problem starts "+
+			"and keeps firing %s after it ends; drop the offset",
+			alert, promql.FormatDuration(offset), restore(current.String()), promql.FormatDuration(offset), promql.FormatDuration(offset))
+		if current.Offset == offset {
+			plain := *current
+			plain.Offset = 0
+			issue += fmt.Sprintf(", or compare current data with the past such as '%s / %s'", restore(plain.String()), restore(current.String()))
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
@@ -0,0 +1,158 @@
+package formatting
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckSubqueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name: "subquery over a function",
+			expr: `max_over_time(rate(http_requests_total[5m])[1h:1m])`,
+		},
+		{
+			name: "subquery over a plain selector",
+			expr: `max_over_time(node_load1[1h:1m])`,
+			expected: []string{
+				"Subquery 'node_load1[1h:1m]' resamples a plain selector - use the range selector 'node_load1[1h]'",
+			},
+		},
+		{
+			name: "modifiers move to the range selector",
+			expr: `max_over_time((node_load1)[1h:1m] offset 1d)`,
+			expected: []string{
+				"use the range selector 'node_load1[1h] offset 1d'",
+			},
+		},
+		{
+			name: "nested subqueries",
+			expr: `max_over_time(deriv(rate(http_requests_total[5m])[10m:1m])[1h:5m])`,
+			expected: []string{
+				"Subquery 'rate(http_requests_total[5m])[10m:1m]' is nested in subquery 'deriv(rate(http_requests_total[5m])[10m:1m])[1h:5m]', " +
+					"so its inner expression is evaluated ~120 times per query",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkSubqueries(tt.expr)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkSubqueries() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(issues[i], expected) {
+					t.Errorf("checkSubqueries()[%d] = %q, want it to contain %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRuleModifiers(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		alert    string
+		expected []string
+	}{
+		{
+			name:  "baseline comparison",
+			expr:  `rate(http_requests_total[5m]) > 2 * rate(http_requests_total[5m] offset 1w)`,
+			alert: "TrafficSpike",
+		},
+		{
+			name:  "short offset for late data",
+			expr:  `rate(http_requests_total[5m] offset 1m) == 0`,
+			alert: "NoTraffic",
+		},
+		{
+			name:  "alert only reading old data",
+			expr:  `rate(errors_total[5m] offset 1d) > 1`,
+			alert: "HighErrors",
+			expected: []string{
+				"Alert 'HighErrors' only reads data from 1d ago, e.g. 'errors_total offset 1d' - it fires 1d after a problem starts " +
+					"and keeps firing 1d after it ends; drop the offset, or compare current data with the past such as 'errors_total / errors_total offset 1d'",
+			},
+		},
+		{
+			name:  "offset on the enclosing subquery",
+			expr:  `max_over_time(rate(errors_total[5m])[1h:1m] offset 1h) > 1`,
+			alert: "HighErrors",
+			expected: []string{
+				"Alert 'HighErrors' only reads data from 1h ago, e.g. 'errors_total' - it fires 1h after a problem starts and keeps firing 1h after it ends; drop the offset",
+			},
+		},
+		{
+			name: "recording rule of past data",
+			expr: `sum(rate(http_requests_total[5m] offset 1w))`,
+		},
+		{
+			name: "negative offset",
+			expr: `sum(rate(http_requests_total[5m] offset -5m))`,
+			expected: []string{
+				"'http_requests_total offset -5m' has a negative offset",
+			},
+		},
+		{
+			name: "@ end()",
+			expr: `sum(rate(http_requests_total[5m] @ end()))`,
+			expected: []string{
+				"'@ end()' in 'http_requests_total @ end()' has no effect in a rule",
+			},
+		},
+		{
+			name:  "pinned timestamp",
+			expr:  `max_over_time(up[1h:1m] @ 1700000000) == 0`,
+			alert: "Down",
+			expected: []string{
+				"'up[1h:1m] @ 1700000000' is pinned to the time '@ 1700000000'",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := checkRuleModifiers(tt.expr, tt.alert)
+			if len(issues) != len(tt.expected) {
+				t.Fatalf("checkRuleModifiers() = %q, want %d issues", issues, len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(issues[i], expected) {
+					t.Errorf("checkRuleModifiers()[%d] = %q, want it to contain %q", i, issues[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestModifierIssues(t *testing.T) {
+	content := `groups:
+  - name: api
+    rules:
+      - record: job:http_requests:rate5m_1w
+        expr: sum by (job) (rate(http_requests_total[5m] offset 1w))
+      - alert: HighErrors
+        expr: sum by (job) (rate(errors_total[5m] offset 1w)) > 1
+`
+	var lines []int
+	for _, issue := range modifierIssues(content, nil) {
+		lines = append(lines, issue.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{7}) {
+		t.Errorf("modifierIssues() lines = %v, want [7]", lines)
+	}
+}
+
+func TestExtractMetricNamesModifiers(t *testing.T) {
+	got := extractMetricNames(`rate(http_requests_total[5m] offset 1d) > bool 0 and up @ end()`)
+	if !reflect.DeepEqual(got, []string{"http_requests_total", "up"}) {
+		t.Errorf("extractMetricNames() = %v, want [http_requests_total up]", got)
+	}
+}
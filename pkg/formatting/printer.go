@@ -0,0 +1,231 @@
+package formatting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// Default pretty printer settings
+const (
+	defaultIndentWidth  = 2
+	defaultMaxLineWidth = 80
+)
+
+// MatcherOrder controls how label matchers are ordered inside selectors
+type MatcherOrder int
+
+// Label matcher orderings
+const (
+	// MatcherOrderPreserve keeps matchers in the order they were written
+	MatcherOrderPreserve MatcherOrder = iota
+	// MatcherOrderSorted sorts matchers by label name, keeping __name__ first
+	MatcherOrderSorted
+)
+
+// FormatStyle configures the AST pretty printer used to rewrite expressions
+type FormatStyle struct {
+	// IndentWidth is the number of spaces per nesting level (default 2)
+	IndentWidth int
+	// MaxLineWidth is the width above which expressions are split across lines (default 80)
+	MaxLineWidth int
+	// AggregationStyle places by/without clauses before or after the aggregated expression;
+	// AggregationStyleUnknown keeps each clause where it was written
+	AggregationStyle AggregationStyle
+	// MatcherOrder controls the order of label matchers
+	MatcherOrder MatcherOrder
+}
+
+// ParseAggregationStyle parses an --aggregation-clause flag value: prefix, postfix, or
+// preserve to keep each clause where it was written
+func ParseAggregationStyle(s string) (AggregationStyle, error) {
+	switch s {
+	case "prefix":
+		return AggregationStylePrefix, nil
+	case "postfix":
+		return AggregationStylePostfix, nil
+	case "preserve":
+		return AggregationStyleUnknown, nil
+	}
+	return AggregationStyleUnknown, fmt.Errorf("aggregation clause position must be prefix, postfix or preserve, got %q", s)
+}
+
+// withDefaults fills in unset style fields
+func (s FormatStyle) withDefaults() FormatStyle {
+	if s.IndentWidth <= 0 {
+		s.IndentWidth = defaultIndentWidth
+	}
+	if s.MaxLineWidth <= 0 {
+		s.MaxLineWidth = defaultMaxLineWidth
+	}
+	return s
+}
+
+// PrettyPrint renders a parsed PromQL expression in canonical form. Sub-expressions that
+// fit within the maximum line width stay on one line; others are split with binary
+// operators on their own line and function and aggregation arguments indented.
+func PrettyPrint(expr promql.Expr, style FormatStyle) string {
+	p := &printer{style: style.withDefaults()}
+	return p.format(expr, 0, false)
+}
+
+// prettyPrintMultiline is like PrettyPrint but always splits the outermost expression
+func prettyPrintMultiline(expr promql.Expr, style FormatStyle) string {
+	p := &printer{style: style.withDefaults()}
+	return p.format(expr, 0, true)
+}
+
+type printer struct {
+	style FormatStyle
+}
+
+func (p *printer) indent(level int) string {
+	return strings.Repeat(" ", level*p.style.IndentWidth)
+}
+
+// format renders expr at the given nesting level. The first line is returned without
+// indentation, as it continues the caller's line; following lines are fully indented.
+// split forces expr onto multiple lines even when it would fit on one.
+func (p *printer) format(expr promql.Expr, level int, split bool) string {
+	flat := p.flat(expr)
+	if !split && level*p.style.IndentWidth+len(flat) <= p.style.MaxLineWidth {
+		return flat
+	}
+
+	ind := p.indent(level)
+	inner := p.indent(level + 1)
+
+	switch e := expr.(type) {
+	case *promql.BinaryExpr:
+		// Split chains of binary operations consistently rather than only the last one
+		_, lhsIsBinary := e.LHS.(*promql.BinaryExpr)
+		return p.format(e.LHS, level, lhsIsBinary) + "\n" +
+			inner + e.OperatorString() + "\n" +
+			ind + p.format(e.RHS, level, false)
+
+	case *promql.AggregateExpr:
+		var sb strings.Builder
+		sb.WriteString(e.Op)
+		postfix := p.postfixClause(e)
+		if e.Grouped && !postfix {
+			sb.WriteString(" " + e.GroupingString() + " ")
+		}
+		sb.WriteString("(\n")
+		if e.Param != nil {
+			sb.WriteString(inner + p.format(e.Param, level+1, false) + ",\n")
+		}
+		sb.WriteString(inner + p.format(e.Expr, level+1, false) + "\n" + ind + ")")
+		if e.Grouped && postfix {
+			sb.WriteString(" " + e.GroupingString())
+		}
+		return sb.String()
+
+	case *promql.Call:
+		if len(e.Args) == 0 {
+			return flat
+		}
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = inner + p.format(arg, level+1, false)
+		}
+		return e.Func + "(\n" + strings.Join(args, ",\n") + "\n" + ind + ")"
+
+	case *promql.ParenExpr:
+		return "(\n" + inner + p.format(e.Expr, level+1, false) + "\n" + ind + ")"
+
+	case *promql.SubqueryExpr:
+		return p.format(e.Expr, level, split) + subquerySuffix(e)
+
+	case *promql.UnaryExpr:
+		return e.Op + p.format(e.Expr, level, split)
+	}
+
+	// Selectors and literals cannot be split
+	return flat
+}
+
+// flat renders expr on a single line in the configured style
+func (p *printer) flat(expr promql.Expr) string {
+	switch e := expr.(type) {
+	case *promql.VectorSelector:
+		return p.selector(e).String()
+
+	case *promql.MatrixSelector:
+		ms := *e
+		ms.VectorSelector = p.selector(e.VectorSelector)
+		return ms.String()
+
+	case *promql.SubqueryExpr:
+		return p.flat(e.Expr) + subquerySuffix(e)
+
+	case *promql.Call:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = p.flat(arg)
+		}
+		return e.Func + "(" + strings.Join(args, ", ") + ")"
+
+	case *promql.AggregateExpr:
+		args := p.flat(e.Expr)
+		if e.Param != nil {
+			args = p.flat(e.Param) + ", " + args
+		}
+		switch {
+		case !e.Grouped:
+			return e.Op + "(" + args + ")"
+		case p.postfixClause(e):
+			return e.Op + "(" + args + ") " + e.GroupingString()
+		}
+		return e.Op + " " + e.GroupingString() + " (" + args + ")"
+
+	case *promql.BinaryExpr:
+		return p.flat(e.LHS) + " " + e.OperatorString() + " " + p.flat(e.RHS)
+
+	case *promql.ParenExpr:
+		return "(" + p.flat(e.Expr) + ")"
+
+	case *promql.UnaryExpr:
+		return e.Op + p.flat(e.Expr)
+	}
+
+	return expr.String()
+}
+
+// postfixClause reports whether an aggregation's by/without clause is printed after its arguments
+func (p *printer) postfixClause(e *promql.AggregateExpr) bool {
+	switch p.style.AggregationStyle {
+	case AggregationStylePostfix:
+		return true
+	case AggregationStylePrefix:
+		return false
+	}
+	return e.Postfix
+}
+
+// selector returns vs with its matchers in the configured order
+func (p *printer) selector(vs *promql.VectorSelector) *promql.VectorSelector {
+	if p.style.MatcherOrder != MatcherOrderSorted {
+		return vs
+	}
+	sorted := *vs
+	sorted.Matchers = append([]*promql.LabelMatcher(nil), vs.Matchers...)
+	sort.SliceStable(sorted.Matchers, func(i, j int) bool {
+		a, b := sorted.Matchers[i].Name, sorted.Matchers[j].Name
+		if a == "__name__" || b == "__name__" {
+			return a == "__name__" && b != "__name__"
+		}
+		return a < b
+	})
+	return &sorted
+}
+
+// subquerySuffix renders the range, step and modifiers of a subquery
+func subquerySuffix(sq *promql.SubqueryExpr) string {
+	step := ""
+	if sq.Step != 0 {
+		step = promql.FormatDuration(sq.Step)
+	}
+	return "[" + promql.FormatDuration(sq.Range) + ":" + step + "]" + promql.ModifierString(sq.Offset, sq.At)
+}
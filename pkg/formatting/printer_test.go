@@ -0,0 +1,153 @@
+package formatting
+
+import (
+	"testing"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+func TestPrettyPrint(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		style    FormatStyle
+		expected string
+	}{
+		{
+			name:     "short expression stays on one line",
+			input:    `sum(rate(x{job="api"}[5m])) by (instance)`,
+			expected: `sum(rate(x{job="api"}[5m])) by (instance)`,
+		},
+		{
+			name:     "aggregation clause moved to prefix",
+			input:    `sum(rate(x[5m])) by (instance)`,
+			style:    FormatStyle{AggregationStyle: AggregationStylePrefix},
+			expected: `sum by (instance) (rate(x[5m]))`,
+		},
+		{
+			name:     "aggregation clause moved to postfix",
+			input:    `topk by (job) (3, x)`,
+			style:    FormatStyle{AggregationStyle: AggregationStylePostfix},
+			expected: `topk(3, x) by (job)`,
+		},
+		{
+			name:     "matchers sorted with __name__ first",
+			input:    `{job="api",__name__="up",env="prod"}`,
+			style:    FormatStyle{MatcherOrder: MatcherOrderSorted},
+			expected: `{__name__="up",env="prod",job="api"}`,
+		},
+		{
+			name:  "binary operation split on operator",
+			input: `sum by (instance) (rate(http_requests_total{job="api",status=~"5.."}[5m])) / sum by (instance) (rate(http_requests_total{job="api"}[5m]))`,
+			expected: `sum by (instance) (rate(http_requests_total{job="api",status=~"5.."}[5m]))
+  /
+sum by (instance) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			name:  "nested functions indented",
+			input: `histogram_quantile(0.99, sum by (le) (rate(request_duration_seconds_bucket{job="api"}[5m])))`,
+			style: FormatStyle{MaxLineWidth: 60},
+			expected: `histogram_quantile(
+  0.99,
+  sum by (le) (
+    rate(request_duration_seconds_bucket{job="api"}[5m])
+  )
+)`,
+		},
+		{
+			name:  "group_left and subquery",
+			input: `max_over_time(rate(errors_total[1m])[1h:1m]) * on (instance) group_left (team) team_info{source="cmdb"}`,
+			style: FormatStyle{MaxLineWidth: 50, IndentWidth: 4},
+			expected: `max_over_time(rate(errors_total[1m])[1h:1m])
+    * on (instance) group_left (team)
+team_info{source="cmdb"}`,
+		},
+		{
+			name:  "chains of operators split consistently",
+			input: `aaaaaaaaaaaaaaaa + bbbbbbbbbbbbbbbb + cccccccccccccccc`,
+			style: FormatStyle{MaxLineWidth: 40},
+			expected: `aaaaaaaaaaaaaaaa
+  +
+bbbbbbbbbbbbbbbb
+  +
+cccccccccccccccc`,
+		},
+		{
+			name:  "parentheses keep their contents indented",
+			input: `(errors_total{job="api"} + failures_total{job="api"}) / requests_total{job="api"}`,
+			style: FormatStyle{MaxLineWidth: 50},
+			expected: `(
+  errors_total{job="api"}
+    +
+  failures_total{job="api"}
+)
+  /
+requests_total{job="api"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := promql.ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.input, err)
+			}
+			if got := PrettyPrint(expr, tt.style); got != tt.expected {
+				t.Errorf("PrettyPrint() output mismatch.\nExpected:\n%s\n\nGot:\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPrettyPrintRoundTrip(t *testing.T) {
+	inputs := []string{
+		`sum by (instance) (rate(http_requests_total{job="api",status=~"5.."}[5m])) / on (instance) sum by (instance) (rate(http_requests_total{job="api"}[5m]))`,
+		`histogram_quantile(0.99, sum by (le, job) (rate(request_duration_seconds_bucket{job="api"}[5m]))) > bool 0.5`,
+		`-(a{job="x"} offset 5m - b{job="x"} @ end()) ^ 2`,
+		`count_values("version", build_info{job="api"}) unless on (version) max_over_time(deploys{job="api"}[1d:5m] offset 1h)`,
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			expr, err := promql.ParseExpr(input)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", input, err)
+			}
+			for _, width := range []int{20, 60, 200} {
+				out := prettyPrintMultiline(expr, FormatStyle{MaxLineWidth: width})
+				reparsed, err := promql.ParseExpr(out)
+				if err != nil {
+					t.Fatalf("pretty printed output does not parse (width %d): %v\n%s", width, err, out)
+				}
+				if reparsed.String() != expr.String() {
+					t.Errorf("pretty printing changed the expression (width %d):\n%s\nbecame\n%s", width, expr, reparsed)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAggregationStyle(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected AggregationStyle
+		wantErr  bool
+	}{
+		{input: "prefix", expected: AggregationStylePrefix},
+		{input: "postfix", expected: AggregationStylePostfix},
+		{input: "preserve", expected: AggregationStyleUnknown},
+		{input: "infix", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseAggregationStyle(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAggregationStyle(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseAggregationStyle(%q) = %v, want %v", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
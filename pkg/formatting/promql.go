@@ -8,10 +8,13 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
 )
 
 // CheckOptions configures the behavior of CheckAndFormatPromQL
@@ -19,6 +22,30 @@ type CheckOptions struct {
 	DisableLineLength bool
 	PrometheusURL     string
 	Verbose           bool
+	// Style configures how multiline expressions are rewritten
+	Style FormatStyle
+	// ScrapeInterval is the interval range windows are checked against for series whose job's
+	// interval is not known from PrometheusURL; if 0, such range windows are only checked
+	// against the evaluation interval
+	ScrapeInterval time.Duration
+	// Metadata, if set, gives the types and units of metrics, e.g. for offline checks in CI.
+	// Its entries take precedence over the metadata fetched from PrometheusURL. Metrics with
+	// known types are checked by type rather than by name.
+	Metadata Metadata
+	// Cache, if set, shares remote lookups between calls
+	Cache *LookupCache
+	// AbsenceAlerts reports alerts whose selectors no absent() alert covers
+	AbsenceAlerts bool
+	// FixAbsenceAlerts, with AbsenceAlerts, also appends the missing absence alerts to the
+	// formatted content
+	FixAbsenceAlerts bool
+	// SeriesBudget and GroupSeriesBudget, if positive, report rules and rule groups whose
+	// selectors match more series per evaluation than the budget, counted in PrometheusURL
+	SeriesBudget      int
+	GroupSeriesBudget int
+	// Only, if set, limits findings and rewrites to expressions and alerts starting at lines
+	// it accepts, e.g. those changed in a pull request
+	Only func(line int) bool
 }
 
 // AggregationStyle tracks the position of aggregation clauses
@@ -56,43 +83,69 @@ type PrometheusRules struct {
 	Groups []PrometheusRuleGroup `yaml:"groups"`
 }
 
-// CheckAndFormatPromQL analyzes YAML content for PromQL expressions and formats them
+// CheckAndFormatPromQL analyzes the PromQL expressions of a rule file and formats them
 func CheckAndFormatPromQL(content string, opts CheckOptions) ([]string, string) {
-	var issues []string
-	formatted := content
+	issues, formatted := checkRules(content, opts)
+	return issueStrings(issues), formatted
+}
+
+// checkRules is CheckAndFormatPromQL with located issues
+func checkRules(content string, opts CheckOptions) ([]Issue, string) {
+	var issues []Issue
+	style := opts.Style.withDefaults()
 
 	// Check for alert rules with both duration and hysteresis
-	hysteresisIssues := checkAlertHysteresisWithDuration(content)
+	hysteresisIssues := alertHysteresisIssues(content, opts.Only)
 	issues = append(issues, hysteresisIssues...)
 
+	// Check range windows against scrape and evaluation intervals
+	iv, err := opts.scrapeIntervals()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+	issues = append(issues, rangeWindowIssues(content, opts.Only, iv)...)
+
+	// Check offset and @ modifiers, which behave differently in rules than in dashboards
+	issues = append(issues, modifierIssues(content, opts.Only)...)
+
+	// Check alert conditions that return every series
+	issues = append(issues, boolConditionIssues(content, opts.Only)...)
+
+	md, err := opts.metadata()
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	}
+
 	// Check timeseries continuity if Prometheus URL provided
 	if opts.PrometheusURL != "" {
-		continuityIssues := checkTimeseriesContinuity(content, opts.PrometheusURL, opts.Verbose)
-		issues = append(issues, continuityIssues...)
+		continuityIssues := checkTimeseriesContinuity(content, opts.PrometheusURL, opts.Verbose, opts.Cache)
+		issues = append(issues, issuesAt(0, "", continuityIssues)...)
+	}
+
+	// Check rule and group costs against the series budgets
+	if opts.PrometheusURL != "" && (opts.SeriesBudget > 0 || opts.GroupSeriesBudget > 0) {
+		issues = append(issues, costIssues(content, opts)...)
+	}
+
+	// Rule expressions are read through the rules extractor, which decodes block scalars,
+	// quoting and comments as YAML. Fragments of rule files, such as a single rule or a bare
+	// expr key, have their expr keys checked wherever they are.
+	extract := promql.ExtractRuleFragments
+	if rules := promql.LookupExtractor(promql.FormatRules); rules.Match([]byte(content)) {
+		extract = rules.Extract
+	}
+	exprs, err := extract([]byte(content))
+	if err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: invalid YAML: %v", err)})
 	}
 
 	// Track aggregation clause positioning for consistency
 	var dominantStyle AggregationStyle
 	styleCount := make(map[AggregationStyle]int)
 
-	// Find all PromQL expressions in YAML (expr: or query: fields)
-	exprRegex := regexp.MustCompile(`(?m)^(\s*(?:expr|query):)\s*(.+)$`)
-
-	matches := exprRegex.FindAllStringSubmatch(content, -1)
-
 	// First pass: detect dominant style
-	for _, match := range matches {
-		if len(match) < 3 {
-			continue
-		}
-		expression := strings.TrimSpace(match[2])
-		if strings.HasPrefix(expression, `"`) && strings.HasSuffix(expression, `"`) {
-			expression = strings.Trim(expression, `"`)
-		} else if strings.HasPrefix(expression, "'") && strings.HasSuffix(expression, "'") {
-			expression = strings.Trim(expression, "'")
-		}
-
-		style := detectAggregationStyle(expression)
+	for _, e := range exprs {
+		style := detectAggregationStyle(e.Value)
 		if style != AggregationStyleUnknown {
 			styleCount[style]++
 		}
@@ -112,47 +165,45 @@ func CheckAndFormatPromQL(content string, opts CheckOptions) ([]string, string)
 		dominantStyle = AggregationStylePostfix
 	}
 
-	// Second pass: check each expression
-	for _, match := range matches {
-		if len(match) < 3 {
+	// Second pass: check each expression, collecting rewrites to splice at its own key so
+	// that identical expressions elsewhere in the file are left alone
+	rewritten := make([]string, len(exprs))
+	for i, e := range exprs {
+		rewritten[i] = e.Value
+		line := e.Line
+		if opts.Only != nil && !opts.Only(line) {
 			continue
 		}
-
-		fullMatch := match[0]
-		prefix := match[1]
-		expression := strings.TrimSpace(match[2])
-
-		// Remove quotes if present
-		if strings.HasPrefix(expression, `"`) && strings.HasSuffix(expression, `"`) {
-			expression = strings.Trim(expression, `"`)
-		} else if strings.HasPrefix(expression, "'") && strings.HasSuffix(expression, "'") {
-			expression = strings.Trim(expression, "'")
-		}
+		expression := e.Value
 
 		// Check for redundant aggregation clauses
 		redundantIssues := checkRedundantAggregations(expression)
-		issues = append(issues, redundantIssues...)
+		issues = append(issues, issuesAt(line, "", redundantIssues)...)
 
 		// Check for aggregation placement
 		placementIssues := checkAggregationPlacement(expression)
-		issues = append(issues, placementIssues...)
-
-		// Check if expression should be multiline
-		if shouldBeMultiline(expression, opts.DisableLineLength) {
-			issues = append(issues, fmt.Sprintf("Expression should use multiline formatting: %.60s...", expression))
-
-			// Format the expression
-			formattedExpr := formatPromQLMultiline(expression)
-
-			// Replace in the content
-			indentation := getIndentation(fullMatch)
-			newBlock := formatYAMLBlock(prefix, formattedExpr, indentation)
-			formatted = strings.Replace(formatted, fullMatch, newBlock, 1)
+		issues = append(issues, issuesAt(line, "", placementIssues)...)
+
+		// Check if expression should be multiline; expressions already written over several
+		// lines are left as their author laid them out
+		if !strings.Contains(expression, "\n") && shouldBeMultilineWidth(expression, opts.DisableLineLength, style.MaxLineWidth) {
+			issues = append(issues, Issue{Line: line, Message: fmt.Sprintf("Expression should use multiline formatting: %.60s...", expression)})
+
+			// Format the expression, refusing any rewrite that would change its meaning
+			formattedExpr, err := formatExpression(expression, style, true)
+			if err != nil {
+				issues = append(issues, Issue{Line: line, Message: fmt.Sprintf("Error: refusing to reformat expression %.60s...: %v", expression, err)})
+			} else {
+				rewritten[i] = formattedExpr
+			}
 		}
 
 		// Check Prometheus best practices
-		bestPracticeIssues := checkPrometheusBestPractices(expression)
-		issues = append(issues, bestPracticeIssues...)
+		bestPracticeIssues := checkPrometheusBestPractices(expression, md)
+		issues = append(issues, issuesAt(line, "", bestPracticeIssues)...)
+
+		// Check for patterns that make evaluation expensive
+		issues = append(issues, issuesAt(line, "", checkQueryCost(expression))...)
 
 		// Check aggregation clause consistency
 		if dominantStyle != AggregationStyleUnknown {
@@ -162,12 +213,55 @@ func CheckAndFormatPromQL(content string, opts CheckOptions) ([]string, string)
 					AggregationStylePostfix: "postfix (e.g., 'sum(metric) by (label)')",
 					AggregationStylePrefix:  "prefix (e.g., 'sum by (label) (metric)')",
 				}
-				issues = append(issues, fmt.Sprintf("Inconsistent aggregation clause positioning: expression uses %s style, but file predominantly uses %s",
-					styleName[style], styleName[dominantStyle]))
+				issues = append(issues, Issue{Line: line, Message: fmt.Sprintf("Inconsistent aggregation clause positioning: expression uses %s style, but file predominantly uses %s",
+					styleName[style], styleName[dominantStyle])})
 			}
 		}
 	}
 
+	result := content
+	if formatted, err := promql.RewriteRules([]byte(content), exprs, rewritten); err != nil {
+		issues = append(issues, Issue{Message: fmt.Sprintf("Error: %v", err)})
+	} else {
+		result = string(formatted)
+	}
+
+	if opts.AbsenceAlerts {
+		var absenceIssues []Issue
+		absenceIssues, result = checkAbsence(content, result, opts.Only, opts.FixAbsenceAlerts)
+		issues = append(issues, absenceIssues...)
+	}
+
+	return issues, result
+}
+
+// checkAbsence reports alert selectors no absent() alert covers and, if fix is set, appends the
+// missing absence alerts to formatted, the rewritten content. If only is set, alerts starting
+// at lines it rejects are skipped.
+func checkAbsence(content, formatted string, only func(line int) bool, fix bool) ([]Issue, string) {
+	var issues []Issue
+	accepted := make(map[string]bool)
+	for _, v := range promql.CheckAbsence(content) {
+		if only != nil && !only(v.Line) {
+			continue
+		}
+		issues = append(issues, Issue{Line: v.Line, Message: fmt.Sprintf(
+			"Alert '%s' cannot fire once %s disappears and no absent() alert covers it - add an alert on 'absent(%s)'",
+			v.AlertName, v.Selector, v.Absent)})
+		accepted[v.AlertName] = true
+	}
+	if len(issues) == 0 || !fix {
+		return issues, formatted
+	}
+
+	// Rewrites may have moved the alerts, so they are found again in the formatted content
+	lines := make(map[int]bool)
+	for _, v := range promql.CheckAbsence(formatted) {
+		if accepted[v.AlertName] {
+			lines[v.Line] = true
+		}
+	}
+	formatted, _ = promql.AddAbsenceAlerts(formatted, func(line int) bool { return lines[line] })
 	return issues, formatted
 }
 
@@ -200,14 +294,15 @@ func detectAggregationStyle(expr string) AggregationStyle {
 	return AggregationStyleUnknown
 }
 
-// shouldBeMultiline determines if a PromQL expression should be formatted as multiline
-func shouldBeMultiline(expr string, disableLineLength bool) bool {
+// shouldBeMultilineWidth determines if a PromQL expression should be formatted as multiline
+// for the given maximum line width
+func shouldBeMultilineWidth(expr string, disableLineLength bool, maxLineWidth int) bool {
 	// Expression should be multiline if:
-	// 1. It's longer than 80 characters (unless disabled)
+	// 1. It's longer than the maximum line width (unless disabled)
 	// 2. It contains binary operations with multiple clauses
 	// 3. It has complex aggregations
 
-	if !disableLineLength && len(expr) > 80 {
+	if !disableLineLength && len(expr) > maxLineWidth {
 		return true
 	}
 
@@ -221,67 +316,46 @@ func shouldBeMultiline(expr string, disableLineLength bool) bool {
 	return operatorCount >= 2
 }
 
-// formatPromQLMultiline formats a PromQL expression with proper multiline formatting
-func formatPromQLMultiline(expr string) string {
-	// Formatting rules:
-	// 1. Split by binary operators (/, *, +, -, etc.)
-	// 2. Each operand on its own line(s)
-	// 3. Binary operators indented by 2 spaces on their own line
-	// 4. Nested expressions properly indented
-	// 5. Remove redundant aggregation clauses from left operand when both operands have the same clause
-	// 6. Add on() clause when operands have common label selectors for explicit vector matching
-
-	// First, try to split by binary operators
-	binaryOps := []string{" / ", " * ", " + ", " - ", " % ", " ^ "}
-
-	for _, op := range binaryOps {
-		if strings.Contains(expr, op) {
-			parts := splitByBinaryOperator(expr, op)
-			if len(parts) == 2 {
-				leftStr := strings.TrimSpace(parts[0])
-				rightStr := strings.TrimSpace(parts[1])
-
-				// Check if both operands have the same aggregation clause
-				leftAgg := extractTrailingAggregation(leftStr)
-				rightAgg := extractTrailingAggregation(rightStr)
-
-				// If both have the same aggregation (and it's not 'without'), omit from left
-				// Exception: 'without' needs to be explicit on both sides
-				omitLeftAggregation := leftAgg != "" && leftAgg == rightAgg && !strings.Contains(leftAgg, "without")
-
-				// Extract matching labels from aggregation clause if present
-				var matchingLabels []string
-				if rightAgg != "" && strings.Contains(rightAgg, "by") {
-					// Extract labels from by clause: ) by (label1, label2)
-					byRegex := regexp.MustCompile(`by\s*\(([^)]+)\)`)
-					if match := byRegex.FindStringSubmatch(rightAgg); len(match) >= 2 {
-						labelStr := strings.TrimSpace(match[1])
-						labels := strings.Split(labelStr, ",")
-						for _, label := range labels {
-							matchingLabels = append(matchingLabels, strings.TrimSpace(label))
-						}
-					}
-				}
-
-				// Format each operand
-				left := formatOperand(leftStr, 0, omitLeftAggregation)
-				right := formatOperand(rightStr, 0, false)
-
-				// Build operator line with optional on() clause
-				opLine := strings.TrimSpace(op)
-				if len(matchingLabels) > 0 {
-					// Add on() clause for explicit vector matching
-					opLine = opLine + " on (" + strings.Join(matchingLabels, ", ") + ")"
-				}
+// FormatExpr formats a single raw PromQL expression with the AST pretty printer, splitting
+// it across lines only where it exceeds the style's maximum line width. The result is
+// verified to be semantically equivalent to the input.
+func FormatExpr(expr string, style FormatStyle) (string, error) {
+	return formatExpression(expr, style, false)
+}
 
-				// Combine with indented operator
-				return left + "\n  " + opLine + "\n" + right
-			}
-		}
+// formatExpression rewrites an expression with the AST pretty printer, always splitting the
+// outermost expression when multiline is set. Grafana template variables are kept as they
+// are. The rewrite is verified to be semantically equivalent to the original before it is
+// returned.
+func formatExpression(expr string, style FormatStyle, multiline bool) (string, error) {
+	parsed, restore, err := promql.ParseTemplatedExpr(expr)
+	if err != nil {
+		return "", fmt.Errorf("expression does not parse, so a rewrite cannot be verified: %w", err)
+	}
+	var formatted string
+	if multiline {
+		formatted = prettyPrintMultiline(parsed, style)
+	} else {
+		formatted = PrettyPrint(parsed, style)
 	}
+	if err := verifyParsedRewrite(parsed, formatted); err != nil {
+		return "", err
+	}
+	return restore(formatted), nil
+}
 
-	// If no binary operators, format as a single operand
-	return formatOperand(expr, 0, false)
+// verifyParsedRewrite checks that a rewritten expression has the same meaning as an
+// already parsed original by comparing their normalized syntax trees
+func verifyParsedRewrite(before promql.Expr, rewritten string) error {
+	after, err := promql.ParseExpr(rewritten)
+	if err != nil {
+		return fmt.Errorf("rewritten expression does not parse: %w", err)
+	}
+	if !promql.Equivalent(before, after) {
+		return fmt.Errorf("rewrite changes the meaning of the expression: %s became %s",
+			promql.Canonical(before), promql.Canonical(after))
+	}
+	return nil
 }
 
 // splitByBinaryOperator splits expression by a binary operator, respecting parentheses
@@ -327,101 +401,6 @@ func splitByBinaryOperator(expr, op string) []string {
 	return []string{expr}
 }
 
-// formatOperand formats a single operand (which may be an aggregation with nested expressions)
-// If omitAggregation is true, any trailing aggregation clause (by/without) will be omitted
-func formatOperand(expr string, baseIndent int, omitAggregation bool) string {
-	expr = strings.TrimSpace(expr)
-
-	// Check if this is an aggregation with prefix style: sum by (labels) (expr)
-	// Pattern: aggregation_func [by/without (labels)] (expr)
-	aggOps := []string{"sum", "avg", "min", "max", "count", "stddev", "stdvar", "topk", "bottomk", "quantile", "count_values"}
-
-	for _, aggOp := range aggOps {
-		// First, check for postfix style: sum(...) by (labels)
-		// This is the most common style we need to reformat to prefix
-		postfixPattern := regexp.MustCompile(`^(` + aggOp + `)\s*(\([^)]+(?:\([^)]*\))*[^)]*\))\s+(by|without)\s*(\([^)]+\))$`)
-		if matches := postfixPattern.FindStringSubmatch(expr); matches != nil {
-			aggFunc := matches[1]
-			innerExpr := matches[2]
-			byOrWithout := matches[3]
-			labels := matches[4]
-
-			// Remove outer parentheses from inner expression
-			innerExpr = strings.TrimSpace(innerExpr)
-			if strings.HasPrefix(innerExpr, "(") && strings.HasSuffix(innerExpr, ")") {
-				innerExpr = innerExpr[1 : len(innerExpr)-1]
-				innerExpr = strings.TrimSpace(innerExpr)
-			}
-
-			// Format the inner expression with indentation
-			indent := strings.Repeat(" ", baseIndent+2)
-			formattedInner := indent + innerExpr
-
-			// If omitAggregation is true, format without the by/without clause
-			if omitAggregation {
-				return fmt.Sprintf("%s (\n%s\n%s)",
-					aggFunc, formattedInner, strings.Repeat(" ", baseIndent))
-			}
-
-			return fmt.Sprintf("%s %s %s (\n%s\n%s)",
-				aggFunc, byOrWithout, labels, formattedInner, strings.Repeat(" ", baseIndent))
-		}
-
-		// Check for prefix style: sum by (labels) (expr)
-		prefixPattern := regexp.MustCompile(`^(` + aggOp + `)\s+(by|without)\s*(\([^)]+\))\s*(\(.+\))$`)
-		if matches := prefixPattern.FindStringSubmatch(expr); matches != nil {
-			// Already in prefix style, just format with proper indentation
-			aggFunc := matches[1]
-			byOrWithout := matches[2]
-			labels := matches[3]
-			innerExpr := matches[4]
-
-			// Remove outer parentheses from inner expression
-			innerExpr = strings.TrimSpace(innerExpr)
-			if strings.HasPrefix(innerExpr, "(") && strings.HasSuffix(innerExpr, ")") {
-				innerExpr = innerExpr[1 : len(innerExpr)-1]
-				innerExpr = strings.TrimSpace(innerExpr)
-			}
-
-			// Format the inner expression with indentation
-			indent := strings.Repeat(" ", baseIndent+2)
-			formattedInner := indent + innerExpr
-
-			// If omitAggregation is true, format without the by/without clause
-			if omitAggregation {
-				return fmt.Sprintf("%s (\n%s\n%s)",
-					aggFunc, formattedInner, strings.Repeat(" ", baseIndent))
-			}
-
-			return fmt.Sprintf("%s %s %s (\n%s\n%s)",
-				aggFunc, byOrWithout, labels, formattedInner, strings.Repeat(" ", baseIndent))
-		}
-
-		// Also check for simple aggregation without by/without: sum(expr)
-		simplePattern := regexp.MustCompile(`^(` + aggOp + `)\s*(\(.+\))$`)
-		if matches := simplePattern.FindStringSubmatch(expr); matches != nil {
-			aggFunc := matches[1]
-			innerExpr := matches[2]
-
-			// Remove outer parentheses
-			innerExpr = strings.TrimSpace(innerExpr)
-			if strings.HasPrefix(innerExpr, "(") && strings.HasSuffix(innerExpr, ")") {
-				innerExpr = innerExpr[1 : len(innerExpr)-1]
-				innerExpr = strings.TrimSpace(innerExpr)
-			}
-
-			// Always format with multiline for consistency in binary operations
-			indent := strings.Repeat(" ", baseIndent+2)
-			formattedInner := indent + innerExpr
-			return fmt.Sprintf("%s (\n%s\n%s)",
-				aggFunc, formattedInner, strings.Repeat(" ", baseIndent))
-		}
-	}
-
-	// No special formatting needed
-	return expr
-}
-
 // isOperator checks if a string is an operator
 func isOperator(s string) bool {
 	s = strings.ToLower(strings.TrimSpace(s))
@@ -436,36 +415,9 @@ func isOperator(s string) bool {
 	return false
 }
 
-// getIndentation extracts the indentation from a line
-func getIndentation(line string) string {
-	for i, ch := range line {
-		if ch != ' ' && ch != '\t' {
-			return line[:i]
-		}
-	}
-	return ""
-}
-
-// formatYAMLBlock formats a YAML block with multiline string
-func formatYAMLBlock(prefix, expr, indentation string) string {
-	if !strings.Contains(expr, "\n") {
-		return fmt.Sprintf("%s %s", prefix, expr)
-	}
-
-	lines := strings.Split(expr, "\n")
-	result := prefix + " |\n"
-
-	for _, line := range lines {
-		if strings.TrimSpace(line) != "" {
-			result += indentation + "  " + strings.TrimSpace(line) + "\n"
-		}
-	}
-
-	return strings.TrimRight(result, "\n")
-}
-
-// checkPrometheusBestPractices validates PromQL expressions against Prometheus best practices
-func checkPrometheusBestPractices(expr string) []string {
+// checkPrometheusBestPractices validates PromQL expressions against Prometheus best practices.
+// Metrics whose types md knows are checked by type rather than by name.
+func checkPrometheusBestPractices(expr string, md Metadata) []string {
 	var issues []string
 
 	// Extract metric names from the expression
@@ -476,7 +428,7 @@ func checkPrometheusBestPractices(expr string) []string {
 		issues = append(issues, checkMetricNamingConventions(metricName)...)
 
 		// Check for proper suffixes
-		issues = append(issues, checkMetricSuffixes(metricName)...)
+		issues = append(issues, checkMetricSuffixes(metricName, md)...)
 
 		// Check recording rule naming (if applicable)
 		issues = append(issues, checkRecordingRuleNaming(metricName)...)
@@ -489,7 +441,12 @@ func checkPrometheusBestPractices(expr string) []string {
 	issues = append(issues, checkLabelNaming(expr)...)
 
 	// Check for instrumentation best practices
-	issues = append(issues, checkInstrumentationPatterns(expr)...)
+	issues = append(issues, checkInstrumentationPatterns(expr, md)...)
+
+	// Check metric usage against the types and units in metadata
+	if md != nil {
+		issues = append(issues, checkMetadataTypes(expr, md)...)
+	}
 
 	// Check for utilization metrics without proper total divisor
 	issues = append(issues, checkUtilizationDivisor(expr)...)
@@ -497,11 +454,26 @@ func checkPrometheusBestPractices(expr string) []string {
 	// Check for synthetic metrics without proper label selectors
 	issues = append(issues, checkSyntheticMetrics(expr)...)
 
+	// Check histogram and summary usage
+	issues = append(issues, checkHistograms(expr)...)
+
+	// Check for nested and needless subqueries
+	issues = append(issues, checkSubqueries(expr)...)
+
+	// Check comparisons and set operators against the label sets of their operands
+	issues = append(issues, checkBinaryOperators(expr)...)
+
 	return issues
 }
 
 // extractMetricNames extracts metric names from a PromQL expression
 func extractMetricNames(expr string) []string {
+	// Use the selectors of the parsed expression, so keywords such as offset and bool are
+	// never mistaken for metrics
+	if _, _, err := promql.ParseTemplatedExpr(expr); err == nil {
+		return promql.MetricNames(expr)
+	}
+
 	// Match metric names: alphanumeric with underscores, before { or [ or space or ) or end of string
 	metricRegex := regexp.MustCompile(`\b([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(?:[{\[\s)]|$)`)
 	matches := metricRegex.FindAllStringSubmatch(expr, -1)
@@ -532,8 +504,8 @@ func isPromQLKeyword(s string) bool {
 		"bottomk", "topk", "quantile",
 		// Binary operators
 		"and", "or", "unless",
-		// Clauses
-		"by", "without", "on", "ignoring", "group_left", "group_right",
+		// Clauses and modifiers
+		"by", "without", "on", "ignoring", "group_left", "group_right", "bool", "offset",
 		// Functions
 		"rate", "irate", "increase", "delta", "idelta", "deriv", "predict_linear",
 		"histogram_quantile", "label_replace", "label_join", "ln", "log2", "log10",
@@ -587,12 +559,13 @@ func checkMetricNamingConventions(metricName string) []string {
 	return issues
 }
 
-// checkMetricSuffixes validates that metrics use proper unit suffixes
-func checkMetricSuffixes(metricName string) []string {
+// checkMetricSuffixes validates that metrics use proper unit suffixes. Metrics whose types md
+// knows are left to checkMetadataTypes.
+func checkMetricSuffixes(metricName string, md Metadata) []string {
 	var issues []string
 
 	// Known counter patterns that should have _total suffix
-	if isCounterPattern(metricName) && !strings.HasSuffix(metricName, "_total") {
+	if md.seriesType(metricName) == "" && isCounterPattern(metricName) && !strings.HasSuffix(metricName, "_total") {
 		issues = append(issues, fmt.Sprintf("Counter metric '%s' should have '_total' suffix", metricName))
 	}
 
@@ -655,8 +628,9 @@ func isCounterPattern(metricName string) bool {
 	return false
 }
 
-// checkInstrumentationPatterns checks for common instrumentation anti-patterns
-func checkInstrumentationPatterns(expr string) []string {
+// checkInstrumentationPatterns checks for common instrumentation anti-patterns. Metrics whose
+// types md knows are left to checkMetadataTypes.
+func checkInstrumentationPatterns(expr string, md Metadata) []string {
 	var issues []string
 
 	// Check for rate() applied to gauges (common mistake)
@@ -667,7 +641,8 @@ func checkInstrumentationPatterns(expr string) []string {
 			if len(match) > 2 {
 				metricName := match[2]
 				// Only warn if it doesn't look like a counter
-				if !strings.HasSuffix(metricName, "_total") &&
+				if md.seriesType(metricName) == "" &&
+					!strings.HasSuffix(metricName, "_total") &&
 					!strings.HasSuffix(metricName, "_seconds_total") &&
 					!strings.HasSuffix(metricName, "_count") &&
 					!strings.Contains(metricName, "_seconds") {
@@ -1105,12 +1080,18 @@ func checkAggregationPlacement(expr string) []string {
 	return issues
 }
 
-// checkAlertHysteresisWithDuration checks for alert rules with both a duration in the expression and a 'for' clause
-func checkAlertHysteresisWithDuration(content string) []string {
-	var issues []string
+// alertHysteresisIssues checks for alert rules with both a duration in the expression and a 'for'
+// clause, locating each issue at its alert. If only is set, alerts starting at lines it rejects
+// are skipped.
+func alertHysteresisIssues(content string, only func(line int) bool) []Issue {
+	var issues []Issue
 
-	// Try to parse as Prometheus rules YAML
-	var rules PrometheusRules
+	// Try to parse as Prometheus rules YAML, keeping each rule's node for its line
+	var rules struct {
+		Groups []struct {
+			Rules []yaml.Node `yaml:"rules"`
+		} `yaml:"groups"`
+	}
 	if err := yaml.Unmarshal([]byte(content), &rules); err != nil {
 		// Not valid Prometheus rules format, skip this check
 		return issues
@@ -1120,9 +1101,14 @@ func checkAlertHysteresisWithDuration(content string) []string {
 	durationRegex := regexp.MustCompile(`\[(\d+[smhdwy])\]`)
 
 	for _, group := range rules.Groups {
-		for _, rule := range group.Rules {
+		for _, node := range group.Rules {
+			var rule PromQLRule
+			if err := node.Decode(&rule); err != nil {
+				continue
+			}
+
 			// Only check alert rules (not recording rules)
-			if rule.Alert == "" {
+			if rule.Alert == "" || (only != nil && !only(node.Line)) {
 				continue
 			}
 
@@ -1136,10 +1122,10 @@ func checkAlertHysteresisWithDuration(content string) []string {
 							durations = append(durations, match[1])
 						}
 					}
-					issues = append(issues, fmt.Sprintf(
+					issues = append(issues, Issue{Line: node.Line, Message: fmt.Sprintf(
 						"Alert '%s' has both a 'for: %s' clause (hysteresis) and duration(s) %v in the expression - "+
 							"consider removing the duration as the sliding window may interact poorly with hysteresis",
-						rule.Alert, rule.For, durations))
+						rule.Alert, rule.For, durations)})
 				}
 			}
 		}
@@ -1149,7 +1135,7 @@ func checkAlertHysteresisWithDuration(content string) []string {
 }
 
 // checkTimeseriesContinuity checks PromQL rules against a running Prometheus for timeseries continuity
-func checkTimeseriesContinuity(content string, prometheusURL string, verbose bool) []string {
+func checkTimeseriesContinuity(content string, prometheusURL string, verbose bool, cache *LookupCache) []string {
 	var issues []string
 
 	// Try to parse as Prometheus rules YAML
@@ -1174,14 +1160,20 @@ func checkTimeseriesContinuity(content string, prometheusURL string, verbose boo
 		return issues
 	}
 
-	// Check continuity for each metric
+	// Check continuity for each metric, in a stable order
+	sorted := make([]string, 0, len(metricNames))
 	for metricName := range metricNames {
+		sorted = append(sorted, metricName)
+	}
+	sort.Strings(sorted)
+
+	for _, metricName := range sorted {
 		if verbose {
 			fmt.Printf("Checking timeseries continuity for metric: %s\n", metricName)
 		}
 
 		// Query Prometheus for the last hour of data with 1-minute step
-		isSparse, err := checkMetricContinuity(prometheusURL, metricName)
+		isSparse, err := cache.metricContinuity(prometheusURL, metricName)
 		if err != nil {
 			if verbose {
 				fmt.Printf("Warning: Could not check metric '%s': %v\n", metricName, err)
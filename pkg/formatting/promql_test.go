@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
 )
 
 func TestShouldBeMultiline(t *testing.T) {
@@ -38,88 +41,9 @@ func TestShouldBeMultiline(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := shouldBeMultiline(tt.expr, false)
+			result := shouldBeMultilineWidth(tt.expr, false, defaultMaxLineWidth)
 			if result != tt.expected {
-				t.Errorf("shouldBeMultiline(%q) = %v, want %v", tt.expr, result, tt.expected)
-			}
-		})
-	}
-}
-
-func TestFormatPromQLMultiline(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{
-			name:  "README example - division with aggregations (optimized)",
-			input: `sum(rate(http_requests_total{job="api",status=~"5.."}[5m])) by (instance) / sum(rate(http_requests_total{job="api"}[5m])) by (instance)`,
-			expected: `sum (
-  rate(http_requests_total{job="api",status=~"5.."}[5m])
-)
-  / on (instance)
-sum by (instance) (
-  rate(http_requests_total{job="api"}[5m])
-)`,
-		},
-		{
-			name:  "simple division",
-			input: `sum(a) / sum(b)`,
-			expected: `sum (
-  a
-)
-  /
-sum (
-  b
-)`,
-		},
-		{
-			name:     "single operand - no formatting",
-			input:    `up{job="test"}`,
-			expected: `up{job="test"}`,
-		},
-		{
-			name:  "multiplication with aggregations (optimized)",
-			input: `avg(metric1) by (pod) * count(metric2) by (pod)`,
-			expected: `avg (
-  metric1
-)
-  * on (pod)
-count by (pod) (
-  metric2
-)`,
-		},
-		{
-			name:  "without clause - not optimized (both sides need labels)",
-			input: `sum(metric1) without (instance) * sum(metric2) without (instance)`,
-			expected: `sum without (instance) (
-  metric1
-)
-  *
-sum without (instance) (
-  metric2
-)`,
-		},
-		{
-			name:  "different aggregation clauses - not optimized but with on() clause",
-			input: `sum(metric1) by (pod) / sum(metric2) by (instance)`,
-			expected: `sum by (pod) (
-  metric1
-)
-  / on (instance)
-sum by (instance) (
-  metric2
-)`,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := formatPromQLMultiline(tt.input)
-			if result != tt.expected {
-				t.Errorf("formatPromQLMultiline() output mismatch.\nInput:\n%s\n\nExpected:\n%s\n\nGot:\n%s",
-					tt.input, tt.expected, result)
+				t.Errorf("shouldBeMultilineWidth(%q) = %v, want %v", tt.expr, result, tt.expected)
 			}
 		})
 	}
@@ -130,18 +54,18 @@ func TestShouldBeMultilineDisabled(t *testing.T) {
 	longExpr := `sum(rate(http_requests_total{job="api",status=~"5.."}[5m])) by (instance) / sum(rate(http_requests_total{job="api"}[5m])) by (instance)`
 
 	// With line length enabled, should be true
-	if !shouldBeMultiline(longExpr, false) {
+	if !shouldBeMultilineWidth(longExpr, false, defaultMaxLineWidth) {
 		t.Error("Expected true when line length check is enabled")
 	}
 
 	// With line length disabled, should still be true (has 2 'by' operators)
-	if !shouldBeMultiline(longExpr, true) {
+	if !shouldBeMultilineWidth(longExpr, true, defaultMaxLineWidth) {
 		t.Error("Expected true even with line length disabled (expression has multiple operators)")
 	}
 
 	// Simple short expression should be false with line length disabled
 	shortExpr := "up{job=\"test\"}"
-	if shouldBeMultiline(shortExpr, true) {
+	if shouldBeMultilineWidth(shortExpr, true, defaultMaxLineWidth) {
 		t.Error("Expected false for simple expression when line length check is disabled")
 	}
 }
@@ -157,7 +81,9 @@ func TestCheckAndFormatPromQL(t *testing.T) {
 			name: "well formatted expression",
 			input: `expr: |
   sum(rate(metric[5m]))`,
-			expectIssues:  false,
+			// Well formatted, but the block's metric has no application prefix and is not
+			// known to be a counter
+			expectIssues:  true,
 			expectChanged: false,
 		},
 		{
@@ -198,44 +124,6 @@ func TestCheckAndFormatPromQL(t *testing.T) {
 	}
 }
 
-func TestGetIndentation(t *testing.T) {
-	tests := []struct {
-		name     string
-		line     string
-		expected string
-	}{
-		{
-			name:     "no indentation",
-			line:     "expr: test",
-			expected: "",
-		},
-		{
-			name:     "two spaces",
-			line:     "  expr: test",
-			expected: "  ",
-		},
-		{
-			name:     "four spaces",
-			line:     "    expr: test",
-			expected: "    ",
-		},
-		{
-			name:     "tab",
-			line:     "\texpr: test",
-			expected: "\t",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := getIndentation(tt.line)
-			if result != tt.expected {
-				t.Errorf("getIndentation(%q) = %q, want %q", tt.line, result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestIsOperator(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -261,48 +149,6 @@ func TestIsOperator(t *testing.T) {
 	}
 }
 
-func TestFormatYAMLBlock(t *testing.T) {
-	tests := []struct {
-		name        string
-		prefix      string
-		expr        string
-		indentation string
-		wantMulti   bool
-	}{
-		{
-			name:        "single line expression",
-			prefix:      "expr:",
-			expr:        "up",
-			indentation: "  ",
-			wantMulti:   false,
-		},
-		{
-			name:        "multiline expression",
-			prefix:      "expr:",
-			expr:        "line1\nline2",
-			indentation: "  ",
-			wantMulti:   true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := formatYAMLBlock(tt.prefix, tt.expr, tt.indentation)
-
-			if tt.wantMulti {
-				if !strings.Contains(result, "|") {
-					t.Errorf("Expected multiline indicator '|' in result")
-				}
-				if !strings.Contains(result, "\n") {
-					t.Errorf("Expected newlines in multiline result")
-				}
-			} else if strings.Contains(result, "|") {
-				t.Errorf("Did not expect multiline indicator '|' for single line")
-			}
-		})
-	}
-}
-
 func TestCheckMetricNamingConventions(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -394,7 +240,7 @@ func TestCheckMetricSuffixes(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			issues := checkMetricSuffixes(tt.metricName)
+			issues := checkMetricSuffixes(tt.metricName, nil)
 			if tt.expectIssue && len(issues) == 0 {
 				t.Errorf("Expected %s issue for '%s' but got none", tt.issueType, tt.metricName)
 			}
@@ -437,7 +283,7 @@ func TestCheckInstrumentationPatterns(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			issues := checkInstrumentationPatterns(tt.expr)
+			issues := checkInstrumentationPatterns(tt.expr, nil)
 			if tt.expectIssue && len(issues) == 0 {
 				t.Errorf("Expected %s issue but got none", tt.issueType)
 			}
@@ -882,7 +728,7 @@ func TestCheckAggregationPlacement(t *testing.T) {
 	}
 }
 
-func TestCheckAlertHysteresisWithDuration(t *testing.T) {
+func TestAlertHysteresisIssues(t *testing.T) {
 	tests := []struct {
 		name        string
 		content     string
@@ -948,7 +794,7 @@ func TestCheckAlertHysteresisWithDuration(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			issues := checkAlertHysteresisWithDuration(tt.content)
+			issues := alertHysteresisIssues(tt.content, nil)
 
 			if tt.expectIssue && len(issues) == 0 {
 				t.Errorf("Expected issue but got none")
@@ -960,10 +806,10 @@ func TestCheckAlertHysteresisWithDuration(t *testing.T) {
 	}
 }
 
-func TestCheckAlertHysteresisWithDurationInvalidYAML(t *testing.T) {
+func TestAlertHysteresisIssuesInvalidYAML(t *testing.T) {
 	// Test that invalid YAML doesn't cause a panic
 	content := `this is not valid YAML { [ ] }`
-	issues := checkAlertHysteresisWithDuration(content)
+	issues := alertHysteresisIssues(content, nil)
 
 	if len(issues) != 0 {
 		t.Errorf("Expected no issues for invalid YAML, but got: %v", issues)
@@ -1002,7 +848,7 @@ func TestCheckTimeseriesContinuity(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Use empty Prometheus URL to skip actual HTTP calls
-			issues := checkTimeseriesContinuity(tt.content, "", false)
+			issues := checkTimeseriesContinuity(tt.content, "", false, nil)
 
 			if tt.expectIssue && len(issues) == 0 {
 				t.Errorf("Expected issue but got none")
@@ -1582,3 +1428,183 @@ func TestCheckRecordingRuleNaming(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyParsedRewrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		original  string
+		rewritten string
+		expectErr bool
+	}{
+		{
+			name:      "pretty printed expression",
+			original:  `sum(rate(x{job="api"}[5m])) by (instance) / sum(rate(y{job="api"}[5m])) by (instance)`,
+			rewritten: "sum by (instance) (rate(x{job=\"api\"}[5m]))\n  /\nsum by (instance) (rate(y{job=\"api\"}[5m]))",
+			expectErr: false,
+		},
+		{
+			name:      "legacy formatter dropping a different grouping",
+			original:  `sum(metric1) by (pod) / sum(metric2) by (instance)`,
+			rewritten: "sum by (pod) (\n  metric1\n)\n  / on (instance)\nsum by (instance) (\n  metric2\n)",
+			expectErr: true,
+		},
+		{
+			name:      "legacy formatter dropping a shared grouping",
+			original:  `avg(metric1) by (pod) * count(metric2) by (pod)`,
+			rewritten: "avg (\n  metric1\n)\n  * on (pod)\ncount by (pod) (\n  metric2\n)",
+			expectErr: true,
+		},
+		{
+			name:      "rewritten expression does not parse",
+			original:  `sum(x)`,
+			rewritten: `sum(x`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original, err := promql.ParseExpr(tt.original)
+			if err != nil {
+				t.Fatalf("ParseExpr(%q) returned error: %v", tt.original, err)
+			}
+			err = verifyParsedRewrite(original, tt.rewritten)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("verifyParsedRewrite() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+func TestCheckAndFormatPromQLRefusesUnverifiableRewrite(t *testing.T) {
+	// Long enough to need multiline formatting, but not valid PromQL
+	input := `groups:
+  - name: test
+    rules:
+      - record: instance:http_errors:ratio5m
+        expr: sum(rate(http_requests_total{job="api",status=~"5.."}[5m])) by (instance) / sum(rate(http_requests_total{job="api"}[5m]))) by (instance)`
+
+	issues, formatted := CheckAndFormatPromQL(input, CheckOptions{})
+	if formatted != input {
+		t.Errorf("Expected content to be left unchanged, got:\n%s", formatted)
+	}
+
+	found := false
+	for _, issue := range issues {
+		if strings.Contains(issue, "refusing to reformat") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected an issue refusing the rewrite, got: %v", issues)
+	}
+}
+
+func TestCheckBlockScalarExpressions(t *testing.T) {
+	// Block scalars and quoted values are decoded as YAML, so their expressions are checked
+	// rather than the "|" indicator
+	content := `groups:
+  - name: test
+    rules:
+      - record: job:series:count
+        expr: |
+          count by (job) (
+            {__name__=~".+"}
+          )
+      - record: job:series:count2
+        expr: "count by (job) ({__name__=~\".+\"})"
+`
+	issues, formatted := Check([]byte(content), CheckOptions{})
+	if formatted != content {
+		t.Errorf("Expected content to be left unchanged, got:\n%s", formatted)
+	}
+
+	var lines []int
+	for _, issue := range issues {
+		if strings.Contains(issue.Message, "has no matcher that limits") {
+			lines = append(lines, issue.Line)
+		}
+	}
+	if !slices.Equal(lines, []int{5, 10}) {
+		t.Errorf("Expected cost issues at lines 5 and 10, got %v in %v", lines, issues)
+	}
+}
+
+func TestFormatExpr(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "short expression stays on one line",
+			input:    `sum(rate(x{job="api"}[5m])) by (job)`,
+			expected: `sum by (job) (rate(x{job="api"}[5m]))`,
+		},
+		{
+			name:  "long expression is split",
+			input: `sum(rate(http_requests_total{job="api",status=~"5.."}[5m])) by (instance) / sum(rate(http_requests_total{job="api"}[5m])) by (instance)`,
+			expected: `sum by (instance) (rate(http_requests_total{job="api",status=~"5.."}[5m]))
+  /
+sum by (instance) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			name:      "invalid expression",
+			input:     `sum(rate(x[5m])`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatExpr(tt.input, FormatStyle{AggregationStyle: AggregationStylePrefix})
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("FormatExpr() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if got != tt.expected {
+				t.Errorf("FormatExpr() output mismatch.\nExpected:\n%s\n\nGot:\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckAndFormatPromQLAbsenceAlerts(t *testing.T) {
+	content := `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: sum by (job) (rate(errors_total{job="api",code=~"5.."}[5m])) / sum by (job) (rate(requests_total{job="api"}[5m])) > 0.1
+      - alert: ApiDown
+        expr: absent(requests_total{job="api"})
+`
+
+	issues, _ := CheckAndFormatPromQL(content, CheckOptions{})
+	for _, issue := range issues {
+		if strings.Contains(issue, "absent()") {
+			t.Errorf("absence issue reported without AbsenceAlerts: %s", issue)
+		}
+	}
+
+	// Without FixAbsenceAlerts the gap is reported but no alert is added
+	issues, formatted := CheckAndFormatPromQL(content, CheckOptions{AbsenceAlerts: true})
+	if strings.Contains(formatted, "ErrorsTotalAbsent") {
+		t.Errorf("absence alert added without FixAbsenceAlerts:\n%s", formatted)
+	}
+
+	issues, formatted = CheckAndFormatPromQL(content, CheckOptions{AbsenceAlerts: true, FixAbsenceAlerts: true})
+	expectedIssue := `Alert 'HighErrorRate' cannot fire once errors_total{job="api",code=~"5.."} disappears and no absent() alert covers it - add an alert on 'absent(errors_total{job="api"})'`
+	if !slices.Contains(issues, expectedIssue) {
+		t.Errorf("issues = %v, want %q", issues, expectedIssue)
+	}
+
+	// The expression is reformatted and the absence alert appended after the last rule
+	if !strings.Contains(formatted, "expr: |\n") {
+		t.Errorf("expression was not reformatted:\n%s", formatted)
+	}
+	if !strings.HasSuffix(formatted, "      - alert: ErrorsTotalAbsent\n        expr: absent(errors_total{job=\"api\"})\n        for: 5m\n"+
+		"        annotations:\n          summary: No data for errors_total{job=\"api\"}\n"+
+		"          description: HighErrorRate cannot fire while errors_total{job=\"api\"} is absent\n") {
+		t.Errorf("absence alert was not appended:\n%s", formatted)
+	}
+}
@@ -0,0 +1,216 @@
+package formatting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/conallob/o11y-analysis-tools/internal/promql"
+)
+
+// RuleFile is a file of a rule set checked by CheckRuleSet
+type RuleFile struct {
+	Path    string
+	Content []byte
+}
+
+// ruleRef locates a rule within a rule set
+type ruleRef struct {
+	group *promql.RuleGroup
+	index int
+}
+
+func (r ruleRef) rule() promql.Rule { return r.group.Rules[r.index] }
+
+// groupInterval returns the evaluation interval of a group, assuming Prometheus' default for
+// groups without one
+func groupInterval(g *promql.RuleGroup) time.Duration {
+	if g.Interval > 0 {
+		return g.Interval
+	}
+	return defaultEvaluationInterval
+}
+
+// CheckRuleSet checks the rules of several files as one rule set, reporting what checking
+// each file alone cannot: groups defined twice, recording rules writing the same series,
+// alerts of one name with conflicting labels, rules reading series recorded later in their
+// group, and rules reading series recorded by a group evaluated less often. Issues are keyed
+// by the path of the file they apply to and sorted by line.
+func CheckRuleSet(files []RuleFile) map[string][]Issue {
+	var groups []*promql.RuleGroup
+	for _, f := range files {
+		for _, g := range promql.LoadRuleGroups(f.Path, f.Content) {
+			groups = append(groups, &g)
+		}
+	}
+
+	issues := make(map[string][]Issue)
+	report := func(file string, line int, format string, args ...interface{}) {
+		issues[file] = append(issues[file], Issue{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	checkDuplicateGroups(groups, report)
+	checkDuplicateRules(groups, report)
+	checkRuleDependencies(groups, report)
+
+	for _, fileIssues := range issues {
+		sort.SliceStable(fileIssues, func(i, j int) bool { return fileIssues[i].Line < fileIssues[j].Line })
+	}
+	return issues
+}
+
+// locate describes where a rule or group at file:line is, relative to the file of the
+// issue mentioning it
+func locate(from, file string, line int) string {
+	if file == from {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// checkDuplicateGroups reports groups sharing the name of an earlier group
+func checkDuplicateGroups(groups []*promql.RuleGroup, report func(string, int, string, ...interface{})) {
+	first := make(map[string]*promql.RuleGroup)
+	for _, g := range groups {
+		prev, ok := first[g.Name]
+		if !ok {
+			first[g.Name] = g
+			continue
+		}
+		if prev.File == g.File {
+			report(g.File, g.Line, "Group '%s' is already defined at line %d - Prometheus rejects rule files with duplicate group names",
+				g.Name, prev.Line)
+		} else {
+			report(g.File, g.Line, "Group '%s' is also defined in %s - groups of one name cannot be told apart in rule listings and "+
+				"alert metadata; rename one", g.Name, locate(g.File, prev.File, prev.Line))
+		}
+	}
+}
+
+// checkDuplicateRules reports recording rules writing the same series as an earlier rule, and
+// alerts whose labels conflict with an earlier alert of the same name. Alerts of one name
+// differing only in severity are the usual warning and critical tiers and are accepted.
+func checkDuplicateRules(groups []*promql.RuleGroup, report func(string, int, string, ...interface{})) {
+	records := make(map[string]ruleRef)
+	alerts := make(map[string]ruleRef)
+	for _, g := range groups {
+		for i, rule := range g.Rules {
+			ref := ruleRef{group: g, index: i}
+			switch {
+			case rule.Record != "":
+				key := rule.Record + "{" + labelString(rule.Labels) + "}"
+				prev, ok := records[key]
+				if !ok {
+					records[key] = ref
+					continue
+				}
+				report(g.File, rule.Line, "Recording rule '%s' is already defined at %s with the same labels - "+
+					"both write the same series, so their samples collide; remove one",
+					rule.Record, locate(g.File, prev.group.File, prev.rule().Line))
+			case rule.Alert != "":
+				prev, ok := alerts[rule.Alert]
+				if !ok {
+					alerts[rule.Alert] = ref
+					continue
+				}
+				var conflicts []string
+				for _, name := range sortedKeys(rule.Labels) {
+					other, ok := prev.rule().Labels[name]
+					if ok && other != rule.Labels[name] && name != "severity" {
+						conflicts = append(conflicts, fmt.Sprintf("%s=%q (%q there)", name, rule.Labels[name], other))
+					}
+				}
+				if len(conflicts) > 0 {
+					report(g.File, rule.Line, "Alert '%s' is also defined at %s with conflicting labels %s - "+
+						"alerts of one name are grouped, routed and inhibited together; align the labels or rename one",
+						rule.Alert, locate(g.File, prev.group.File, prev.rule().Line), strings.Join(conflicts, ", "))
+				}
+			}
+		}
+	}
+}
+
+// checkRuleDependencies reports rules reading a series that their own group records later,
+// so they see the previous evaluation's value, and rules reading a series only recorded by
+// groups evaluated less often than theirs, so consecutive evaluations see the same value
+func checkRuleDependencies(groups []*promql.RuleGroup, report func(string, int, string, ...interface{})) {
+	producers := make(map[string][]ruleRef)
+	for _, g := range groups {
+		for i, rule := range g.Rules {
+			if rule.Record != "" {
+				producers[rule.Record] = append(producers[rule.Record], ruleRef{group: g, index: i})
+			}
+		}
+	}
+
+	for _, g := range groups {
+		for i, rule := range g.Rules {
+			for _, metric := range rule.Metrics() {
+				refs := producers[metric]
+				if len(refs) == 0 {
+					continue
+				}
+
+				var later, slower []ruleRef
+				for _, ref := range refs {
+					switch {
+					case ref.group == g && ref.index == i:
+						// A rule reading its own output is a cycle, not an ordering hazard
+					case ref.group == g && ref.index > i:
+						later = append(later, ref)
+					case ref.group == g:
+						// Recorded earlier in the same evaluation
+					case groupInterval(ref.group) > groupInterval(g):
+						slower = append(slower, ref)
+					default:
+						// Recorded elsewhere at least as often
+					}
+				}
+
+				switch {
+				case len(later) > 0 && len(later) == countIn(refs, g):
+					report(g.File, rule.Line, "Rule '%s' reads '%s', which its group records later at line %d - "+
+						"rules of a group are evaluated in order, so it sees the previous evaluation's value; move the recording rule before it",
+						rule.Name(), metric, later[0].rule().Line)
+				case len(slower) > 0 && len(slower) == len(refs):
+					prev := slower[0]
+					report(g.File, rule.Line, "Rule '%s' reads '%s', recorded at %s by group '%s' every %s - "+
+						"less often than this group's %s interval, so consecutive evaluations see the same value; "+
+						"evaluate both groups at the same interval or record the series in this group",
+						rule.Name(), metric, locate(g.File, prev.group.File, prev.rule().Line), prev.group.Name,
+						promql.FormatDuration(groupInterval(prev.group)), promql.FormatDuration(groupInterval(g)))
+				}
+			}
+		}
+	}
+}
+
+// countIn counts the rules of a group among refs
+func countIn(refs []ruleRef, g *promql.RuleGroup) int {
+	n := 0
+	for _, ref := range refs {
+		if ref.group == g {
+			n++
+		}
+	}
+	return n
+}
+
+// labelString renders labels as sorted name="value" pairs
+func labelString(labels map[string]string) string {
+	var pairs []string
+	for _, name := range sortedKeys(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package formatting
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRuleSet(t *testing.T) {
+	files := []RuleFile{
+		{Path: "api.yml", Content: []byte(`groups:
+  - name: api
+    interval: 30s
+    rules:
+      - alert: HighErrorRate
+        expr: job:http_errors:ratio5m > 0.05
+        labels:
+          severity: page
+          team: api
+      - record: job:http_errors:ratio5m
+        expr: job:http_errors:rate5m / job:http_requests:rate5m
+      - alert: SlowRequests
+        expr: job:latency:p99 > 1
+  - name: api
+    rules: []
+`)},
+		{Path: "shared.yml", Content: []byte(`groups:
+  - name: slow
+    interval: 5m
+    rules:
+      - record: job:latency:p99
+        expr: histogram_quantile(0.99, sum by (job, le) (rate(latency_seconds_bucket[5m])))
+      - record: job:http_errors:rate5m
+        expr: sum by (job) (rate(http_errors_total[5m]))
+  - name: fast
+    interval: 15s
+    rules:
+      - record: job:http_errors:rate5m
+        expr: sum by (job) (rate(http_errors_total[5m]))
+      - alert: HighErrorRate
+        expr: job:http_errors:ratio5m > 0.1
+        labels:
+          severity: critical
+          team: platform
+`)},
+		{Path: "other.yml", Content: []byte(`groups:
+  - name: slow
+    rules:
+      - alert: Fine
+        expr: job:latency:p99 > 2
+`)},
+	}
+
+	issues := CheckRuleSet(files)
+	expected := map[string][]struct {
+		line    int
+		message string
+	}{
+		"api.yml": {
+			{5, "Rule 'HighErrorRate' reads 'job:http_errors:ratio5m', which its group records later at line 10"},
+			{12, "Rule 'SlowRequests' reads 'job:latency:p99', recorded at shared.yml:5 by group 'slow' every 5m - less often than this group's 30s interval"},
+			{14, "Group 'api' is already defined at line 2 - Prometheus rejects rule files with duplicate group names"},
+		},
+		"shared.yml": {
+			{12, "Recording rule 'job:http_errors:rate5m' is already defined at line 7 with the same labels"},
+			{14, `Alert 'HighErrorRate' is also defined at api.yml:5 with conflicting labels team="platform" ("api" there)`},
+			{14, "Rule 'HighErrorRate' reads 'job:http_errors:ratio5m', recorded at api.yml:10 by group 'api' every 30s - less often than this group's 15s interval"},
+		},
+		"other.yml": {
+			{2, "Group 'slow' is also defined in shared.yml:2"},
+			{4, "Rule 'Fine' reads 'job:latency:p99', recorded at shared.yml:5 by group 'slow' every 5m - less often than this group's 1m interval"},
+		},
+	}
+
+	if len(issues) != len(expected) {
+		t.Errorf("CheckRuleSet() reported issues in %d files, want %d: %+v", len(issues), len(expected), issues)
+	}
+	for path, want := range expected {
+		got := issues[path]
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d issues, want %d: %+v", path, len(got), len(want), got)
+			continue
+		}
+		for i, w := range want {
+			if got[i].Line != w.line || !strings.Contains(got[i].Message, w.message) {
+				t.Errorf("%s: issue %d = %d: %q, want %d: %q", path, i, got[i].Line, got[i].Message, w.line, w.message)
+			}
+		}
+	}
+}
@@ -7,6 +7,9 @@ echo "Available commands:"
 echo "  - promql-fmt: Format and check PromQL expressions"
 echo "  - label-check: Enforce label standards"
 echo "  - alert-hysteresis: Analyze alert firing patterns"
+echo "  - promql-lsp: Language server for editing rule files"
+echo "  - rule-graph: Analyze dependencies between recording and alerting rules"
+echo "  - unused-rules: Find recording rules nothing reads"
 echo ""
 echo "Run any command with --help for usage information."
 echo "Documentation: https://github.com/conallob/o11y-analysis-tools"